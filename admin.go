@@ -0,0 +1,472 @@
+package cache
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+// Headers that are hidden when showing entries unless redact=false is used
+var redactedHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization", "Set-Cookie"}
+
+const redactedValue = "REDACTED"
+
+const (
+	maxBulkPurgeItems    = 1000
+	maxBulkPurgeBodySize = 1 << 20
+)
+
+type entryMetadata struct {
+	Code               int               `json:"code"`
+	Public             bool              `json:"public"`
+	Headers            http.Header       `json:"headers"`
+	StoredAt           time.Time         `json:"storedAt"`
+	Expiration         time.Time         `json:"expiration"`
+	FreshnessRemaining float64           `json:"freshnessRemaining"`
+	Size               int64             `json:"size"`
+	Vary               map[string]string `json:"vary"`
+}
+
+type entriesMetadata struct {
+	Key      string          `json:"key"`
+	Variants []entryMetadata `json:"variants"`
+}
+
+type purgeResult struct {
+	Purged int `json:"purged"`
+}
+
+type refreshResult struct {
+	Status string `json:"status,omitempty"`
+	Code   int    `json:"code"`
+	Size   int64  `json:"size"`
+	Error  string `json:"error,omitempty"`
+}
+
+type bulkPurgeRequest struct {
+	URLs     []string `json:"urls"`
+	Patterns []string `json:"patterns"`
+}
+
+type bulkPurgeItemResult struct {
+	URL     string `json:"url,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	Purged  int    `json:"purged"`
+	Error   string `json:"error,omitempty"`
+}
+
+type bulkPurgeResult struct {
+	Results []bulkPurgeItemResult `json:"results"`
+}
+
+// adminEnabled returns if admin requests can be authorized.
+// Without a token or allowed ips every admin endpoint is disabled
+func (handler *Handler) adminEnabled() bool {
+	return handler.Config.AdminToken != "" || len(handler.Config.AdminAllow) > 0
+}
+
+// isAuthorized checks the admin token and the remote ip, all the configured checks must pass
+func (handler *Handler) isAuthorized(r *http.Request) bool {
+	if !handler.adminEnabled() {
+		return false
+	}
+
+	if handler.Config.AdminToken != "" {
+		token := r.Header.Get(handler.Config.AdminTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(handler.Config.AdminToken)) != 1 {
+			return false
+		}
+	}
+
+	if len(handler.Config.AdminAllow) > 0 && !isAllowedIP(r.RemoteAddr, handler.Config.AdminAllow) {
+		return false
+	}
+
+	return true
+}
+
+func isAllowedIP(remoteAddr string, allowed []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (handler *Handler) isAdminRequest(r *http.Request) bool {
+	if handler.Config.AdminPath == "" || !handler.adminEnabled() {
+		return false
+	}
+	return r.URL.Path == handler.Config.AdminPath || strings.HasPrefix(r.URL.Path, handler.Config.AdminPath+"/")
+}
+
+func (handler *Handler) isPurgeRequest(r *http.Request) bool {
+	return r.Method == "PURGE" && handler.adminEnabled()
+}
+
+func (handler *Handler) serveAdmin(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !handler.isAuthorized(r) {
+		return http.StatusForbidden, nil
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, handler.Config.AdminPath) {
+	case "/entry":
+		if r.Method != http.MethodGet {
+			return http.StatusMethodNotAllowed, nil
+		}
+		return handler.serveEntryMetadata(w, r)
+	case "/flush":
+		if r.Method != http.MethodPost {
+			return http.StatusMethodNotAllowed, nil
+		}
+		purged := handler.Cache.Flush()
+		handler.Purger.Flushed()
+		return writeJSON(w, purgeResult{Purged: purged})
+	case "/hosts":
+		if r.Method != http.MethodGet {
+			return http.StatusMethodNotAllowed, nil
+		}
+		return writeJSON(w, handler.Cache.HostsUsage())
+	case "/inflight":
+		if r.Method != http.MethodGet {
+			return http.StatusMethodNotAllowed, nil
+		}
+		return handler.serveInFlight(w)
+	case "/maintenance":
+		return handler.serveMaintenanceMode(w, r)
+	case "/key_version":
+		return handler.serveKeyVersion(w, r)
+	case "/ready":
+		if r.Method != http.MethodGet {
+			return http.StatusMethodNotAllowed, nil
+		}
+		return handler.serveReady(w)
+	case "/stats":
+		if r.Method != http.MethodGet {
+			return http.StatusMethodNotAllowed, nil
+		}
+		return handler.serveStats(w)
+	case "/metrics":
+		if r.Method != http.MethodGet {
+			return http.StatusMethodNotAllowed, nil
+		}
+		return handler.serveMetrics(w)
+	case "/refresh":
+		if r.Method != http.MethodPost {
+			return http.StatusMethodNotAllowed, nil
+		}
+		return handler.serveRefresh(w, r)
+	case "/purge":
+		if r.Method != http.MethodPost {
+			return http.StatusMethodNotAllowed, nil
+		}
+		return handler.serveBulkPurge(w, r)
+	default:
+		return http.StatusNotFound, nil
+	}
+}
+
+// servePurge removes every GET and HEAD variant cached for the requested url
+func (handler *Handler) servePurge(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !handler.isAuthorized(r) {
+		return http.StatusForbidden, nil
+	}
+
+	purged := handler.purgeURL(r)
+	if purged == 0 {
+		return http.StatusNotFound, nil
+	}
+	return writeJSON(w, purgeResult{Purged: purged})
+}
+
+// serveBulkPurge purges every url and key pattern listed in the JSON body
+// and reports how many entries each one removed
+func (handler *Handler) serveBulkPurge(w http.ResponseWriter, r *http.Request) (int, error) {
+	request := bulkPurgeRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBulkPurgeBodySize)).Decode(&request); err != nil {
+		return http.StatusBadRequest, nil
+	}
+
+	if len(request.URLs)+len(request.Patterns) > maxBulkPurgeItems {
+		return http.StatusRequestEntityTooLarge, nil
+	}
+
+	result := bulkPurgeResult{Results: []bulkPurgeItemResult{}}
+
+	for _, rawURL := range request.URLs {
+		item := bulkPurgeItemResult{URL: rawURL}
+		if req, err := newRequestForURL(http.MethodGet, rawURL); err != nil {
+			item.Error = "invalid url"
+		} else {
+			item.Purged = handler.purgeURL(req)
+		}
+		result.Results = append(result.Results, item)
+	}
+
+	for _, pattern := range request.Patterns {
+		item := bulkPurgeItemResult{Pattern: pattern}
+		item.Purged = handler.Cache.PurgeMatching(func(key string) bool {
+			return matchGlob(pattern, key)
+		})
+		handler.Purger.PurgedPattern(pattern)
+		result.Results = append(result.Results, item)
+	}
+
+	for i := range result.Results {
+		if result.Results[i].Purged == 0 && result.Results[i].Error == "" {
+			result.Results[i].Error = "not found"
+		}
+	}
+
+	return writeJSON(w, result)
+}
+
+// matchGlob returns if s matches the pattern, where * matches any text and ? a single character
+func matchGlob(pattern string, s string) bool {
+	px, sx := 0, 0
+	// Where to restart if the text matched by the last * has to be longer
+	nextPx, nextSx := 0, 0
+
+	for px < len(pattern) || sx < len(s) {
+		if px < len(pattern) {
+			switch c := pattern[px]; c {
+			case '*':
+				nextPx, nextSx = px, sx+1
+				px++
+				continue
+			case '?':
+				if sx < len(s) {
+					px++
+					sx++
+					continue
+				}
+			default:
+				if sx < len(s) && s[sx] == c {
+					px++
+					sx++
+					continue
+				}
+			}
+		}
+
+		if 0 < nextSx && nextSx <= len(s) {
+			px, sx = nextPx, nextSx
+			continue
+		}
+		return false
+	}
+
+	return true
+}
+
+// purgeURL removes every GET and HEAD variant cached for the url of the request.
+// Other instances are told to purge the keys even if they were not cached here
+func (handler *Handler) purgeURL(r *http.Request) int {
+	purged := 0
+	purgedKeys := map[string]bool{}
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		req := r.WithContext(r.Context())
+		req.Method = method
+
+		// The values of the key headers are unknown so every key that starts like the url is purged
+		if len(handler.Config.KeyHeaders) > 0 || handler.Config.KeyAccept {
+			key := getTemplateKey(handler.Config.CacheKeyTemplate, req)
+			if !purgedKeys[key] {
+				purgedKeys[key] = true
+				purged += handler.Cache.PurgeKeyPrefix(key)
+				handler.Purger.PurgedKeyPrefix(key)
+			}
+			continue
+		}
+
+		// Without {method} in the template or with key_merge_head both keys are the same
+		for _, key := range handler.deviceKeys(req) {
+			if !purgedKeys[key] {
+				purgedKeys[key] = true
+				purged += handler.Cache.Purge(key)
+				handler.Purger.PurgedKey(key)
+			}
+		}
+	}
+	return purged
+}
+
+// deviceKeys returns the key of the request for every device class when vary_device is enabled
+func (handler *Handler) deviceKeys(req *http.Request) []string {
+	if handler.Config.VaryDevice == nil {
+		return []string{getKey(handler.Config, req)}
+	}
+
+	key := getTemplateKey(handler.Config.CacheKeyTemplate, req)
+	keys := []string{}
+	for _, class := range deviceClasses {
+		keys = append(keys, keyWithVersion(keyWithDevice(key, class), handler.Config.KeyVersion.Get()))
+	}
+	return keys
+}
+
+// newRequestForURL creates a request like the one caddy would pass to the handler, so it has the same key
+func newRequestForURL(method string, rawURL string) (*http.Request, error) {
+	req, err := http.NewRequest(method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Host == "" {
+		return nil, errors.New("url without host")
+	}
+	if req.URL.Scheme == "https" {
+		req.TLS = &tls.ConnectionState{}
+	}
+
+	// Caddy placeholders read the path and query from the original url
+	return req.WithContext(context.WithValue(req.Context(), httpserver.OriginalURLCtxKey, *req.URL)), nil
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) (int, error) {
+	return writeJSONWithCode(w, http.StatusOK, value)
+}
+
+func writeJSONWithCode(w http.ResponseWriter, code int, value interface{}) (int, error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	return code, json.NewEncoder(w).Encode(value)
+}
+
+// serveRefresh fetches the url given in the url parameter from upstream and replaces the cached entry.
+// If upstream fails the cached entry is kept
+func (handler *Handler) serveRefresh(w http.ResponseWriter, r *http.Request) (int, error) {
+	req, err := newRequestForURL(http.MethodGet, r.URL.Query().Get("url"))
+	if err != nil {
+		return http.StatusBadRequest, nil
+	}
+	req = req.WithContext(context.WithValue(req.Context(), refreshCtxKey, true))
+
+	event := &cacheEvent{request: req}
+	discard := &discardResponseWriter{header: http.Header{}}
+	code, err := handler.serve(discard, req, event)
+	if discard.code != 0 {
+		code = discard.code
+	}
+
+	result := refreshResult{Status: event.Status, Code: code}
+	if event.entry != nil {
+		result.Size = event.entry.Response.Size()
+	}
+
+	if err != nil || code >= 500 {
+		result.Error = fmt.Sprintf("upstream responded with code %d", code)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		return writeJSONWithCode(w, http.StatusBadGateway, result)
+	}
+	return writeJSON(w, result)
+}
+
+// serveEntryMetadata shows every variant saved for the key given in the key parameter
+// or for the key that the request to the url parameter with the method parameter would use
+func (handler *Handler) serveEntryMetadata(w http.ResponseWriter, r *http.Request) (int, error) {
+	query := r.URL.Query()
+
+	key := query.Get("key")
+	if key == "" {
+		if query.Get("url") == "" {
+			return http.StatusBadRequest, nil
+		}
+
+		method := query.Get("method")
+		if method == "" {
+			method = http.MethodGet
+		}
+
+		req, err := newRequestForURL(method, query.Get("url"))
+		if err != nil {
+			return http.StatusBadRequest, nil
+		}
+		// The key headers are taken from the admin request
+		for _, name := range handler.Config.KeyHeaders {
+			req.Header[name] = r.Header[name]
+		}
+		if handler.Config.KeyAccept {
+			req.Header["Accept"] = r.Header["Accept"]
+		}
+		key = getKey(handler.Config, req)
+
+		// The request has no User-Agent, the class is given in the device parameter
+		if handler.Config.VaryDevice != nil {
+			device := query.Get("device")
+			if device == "" {
+				device = deviceDesktop
+			}
+			if !isDeviceClass(device) {
+				return http.StatusBadRequest, nil
+			}
+			key = keyWithVersion(keyWithDevice(getKeyWithoutDevice(handler.Config, req), device), handler.Config.KeyVersion.Get())
+		}
+	}
+
+	entries := handler.Cache.GetVariants(key)
+	if len(entries) == 0 {
+		return http.StatusNotFound, nil
+	}
+
+	redact := query.Get("redact") != "false"
+	result := entriesMetadata{Key: key, Variants: []entryMetadata{}}
+	for _, entry := range entries {
+		result.Variants = append(result.Variants, getEntryMetadata(entry, redact))
+	}
+
+	return writeJSON(w, result)
+}
+
+func getEntryMetadata(entry *HTTPCacheEntry, redact bool) entryMetadata {
+	headers := http.Header{}
+	copyHeaders(entry.Response.snapHeader, headers)
+
+	vary := map[string]string{}
+	for _, header := range varyHeaders(entry.Response.snapHeader) {
+		vary[header] = entry.Request.Header.Get(header)
+	}
+
+	if redact {
+		for _, header := range redactedHeaders {
+			if _, ok := headers[header]; ok {
+				headers.Set(header, redactedValue)
+			}
+			if _, ok := vary[header]; ok {
+				vary[header] = redactedValue
+			}
+		}
+	}
+
+	return entryMetadata{
+		Code:               entry.Response.Code,
+		Public:             entry.isPublic,
+		Headers:            headers,
+		StoredAt:           entry.storedAt,
+		Expiration:         entry.expiration,
+		FreshnessRemaining: entry.expiration.Sub(now()).Seconds(),
+		Size:               entry.Response.Size(),
+		Vary:               vary,
+	}
+}
@@ -0,0 +1,429 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+// newRequestWithOriginalURL creates a request with the context caddy sets to compute placeholders
+func newRequestWithOriginalURL(t *testing.T, method string, target string) *http.Request {
+	r, err := http.NewRequest(method, target, nil)
+	require.NoError(t, err)
+	return r.WithContext(context.WithValue(r.Context(), httpserver.OriginalURLCtxKey, *r.URL))
+}
+
+const testAdminToken = "secret"
+
+func newAdminConfig() *Config {
+	config := emptyConfig()
+	config.AdminPath = "/_cache"
+	config.AdminToken = testAdminToken
+	config.AdminTokenHeader = defaultAdminTokenHeader
+	return config
+}
+
+func doAdminRequest(t *testing.T, h *Handler, method string, target string) *http.Response {
+	return doAdminRequestWithHeaders(t, h, method, target, makeHeader(defaultAdminTokenHeader, testAdminToken))
+}
+
+func doAdminRequestWithHeaders(t *testing.T, h *Handler, method string, target string, headers http.Header) *http.Response {
+	w := httptest.NewRecorder()
+	r := newRequestWithOriginalURL(t, method, target)
+	r.Header = headers
+
+	code, err := h.ServeHTTP(w, r)
+	require.NoError(t, err)
+
+	// Emulate caddy writing the error page when the handler didn't write anything
+	if code >= 400 {
+		w.WriteHeader(code)
+	}
+	return w.Result()
+}
+
+func TestEntryMetadata(t *testing.T) {
+	content := []byte("abc")
+	config := newAdminConfig()
+	config.VaryCookie = VaryCookieHonor
+
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Add("Cache-control", "max-age=10")
+		w.Header().Add("Vary", "Accept-Encoding, Cookie")
+		w.Header().Add("Set-Cookie", "session=secret")
+		w.Write(content)
+		return 200, nil
+	}), config)
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		w := httptest.NewRecorder()
+		r := newRequestWithOriginalURL(t, "GET", "http://example.com/path?q=1")
+		r.Header.Set("Accept-Encoding", encoding)
+		r.Header.Set("Cookie", "session=secret")
+		_, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+	}
+
+	entryURL := "/_cache/entry?url=" + url.QueryEscape("http://example.com/path?q=1")
+
+	t.Run("it should list every variant of the url", func(t *testing.T) {
+		res := doAdminRequest(t, h, "GET", entryURL)
+		requireCode(t, res, 200)
+		require.Equal(t, "application/json", res.Header.Get("Content-Type"))
+
+		metadata := entriesMetadata{}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&metadata))
+		require.Equal(t, "GET example.com/path?q=1", metadata.Key)
+		require.Len(t, metadata.Variants, 2)
+
+		require.Equal(t, "gzip", metadata.Variants[0].Vary["Accept-Encoding"])
+		require.Equal(t, "deflate", metadata.Variants[1].Vary["Accept-Encoding"])
+		for _, variant := range metadata.Variants {
+			require.Equal(t, 200, variant.Code)
+			require.True(t, variant.Public)
+			require.Equal(t, int64(len(content)), variant.Size)
+			require.True(t, variant.FreshnessRemaining > 0)
+			require.True(t, variant.Expiration.After(variant.StoredAt))
+			require.Equal(t, redactedValue, variant.Headers.Get("Set-Cookie"))
+			require.Equal(t, redactedValue, variant.Vary["Cookie"])
+		}
+	})
+
+	t.Run("it should show sensitive headers if redact is disabled", func(t *testing.T) {
+		res := doAdminRequest(t, h, "GET", entryURL+"&redact=false")
+		requireCode(t, res, 200)
+
+		metadata := entriesMetadata{}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&metadata))
+		require.Equal(t, "session=secret", metadata.Variants[0].Headers.Get("Set-Cookie"))
+		require.Equal(t, "session=secret", metadata.Variants[0].Vary["Cookie"])
+	})
+
+	t.Run("it should find entries by key", func(t *testing.T) {
+		res := doAdminRequest(t, h, "GET", "/_cache/entry?key="+url.QueryEscape("GET example.com/path?q=1"))
+		requireCode(t, res, 200)
+	})
+
+	t.Run("it should return 404 if the url is not cached", func(t *testing.T) {
+		res := doAdminRequest(t, h, "GET", "/_cache/entry?url="+url.QueryEscape("http://example.com/other"))
+		requireCode(t, res, 404)
+
+		res = doAdminRequest(t, h, "GET", "/_cache/entry?method=HEAD&url="+url.QueryEscape("http://example.com/path?q=1"))
+		requireCode(t, res, 404)
+	})
+
+	t.Run("it should return 400 without key or url", func(t *testing.T) {
+		res := doAdminRequest(t, h, "GET", "/_cache/entry")
+		requireCode(t, res, 400)
+	})
+
+	t.Run("it should not serve the admin endpoints if admin_path is not set", func(t *testing.T) {
+		hits := 0
+		config := newAdminConfig()
+		config.AdminPath = ""
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			hits++
+			return 200, nil
+		}), config)
+
+		doAdminRequest(t, h, "GET", entryURL)
+		require.Equal(t, 1, hits)
+	})
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	hits := 0
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits++
+		w.Header().Add("Cache-control", "max-age=10")
+		return 200, nil
+	})
+
+	doRequestFrom := func(h *Handler, method string, target string, remoteAddr string, token string) int {
+		w := httptest.NewRecorder()
+		r := newRequestWithOriginalURL(t, method, target)
+		r.RemoteAddr = remoteAddr
+		if token != "" {
+			r.Header.Set(defaultAdminTokenHeader, token)
+		}
+		code, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		return code
+	}
+
+	t.Run("it should disable admin endpoints and PURGE without token or allowed ips", func(t *testing.T) {
+		hits = 0
+		config := emptyConfig()
+		config.AdminPath = "/_cache"
+		h := NewHandler(upstream, config)
+
+		doRequestFrom(h, "POST", "/_cache/flush", "127.0.0.1:1234", "")
+		doRequestFrom(h, "PURGE", "/", "127.0.0.1:1234", "")
+		require.Equal(t, 2, hits)
+	})
+
+	t.Run("it should require the token", func(t *testing.T) {
+		h := NewHandler(upstream, newAdminConfig())
+
+		require.Equal(t, http.StatusForbidden, doRequestFrom(h, "POST", "/_cache/flush", "127.0.0.1:1234", ""))
+		require.Equal(t, http.StatusForbidden, doRequestFrom(h, "POST", "/_cache/flush", "127.0.0.1:1234", "wrong"))
+		require.Equal(t, http.StatusForbidden, doRequestFrom(h, "PURGE", "/", "127.0.0.1:1234", "secre"))
+		require.Equal(t, http.StatusForbidden, doRequestFrom(h, "GET", "/_cache/entry?key=a", "127.0.0.1:1234", ""))
+		require.Equal(t, http.StatusOK, doRequestFrom(h, "POST", "/_cache/flush", "127.0.0.1:1234", testAdminToken))
+	})
+
+	t.Run("it should require an allowed ip", func(t *testing.T) {
+		config := emptyConfig()
+		config.AdminPath = "/_cache"
+		_, network, _ := net.ParseCIDR("10.0.0.0/8")
+		config.AdminAllow = []*net.IPNet{network}
+		h := NewHandler(upstream, config)
+
+		require.Equal(t, http.StatusForbidden, doRequestFrom(h, "POST", "/_cache/flush", "192.168.0.1:1234", ""))
+		require.Equal(t, http.StatusOK, doRequestFrom(h, "POST", "/_cache/flush", "10.1.2.3:1234", ""))
+	})
+
+	t.Run("it should require both the token and the ip if both are configured", func(t *testing.T) {
+		config := newAdminConfig()
+		_, network, _ := net.ParseCIDR("10.0.0.0/8")
+		config.AdminAllow = []*net.IPNet{network}
+		h := NewHandler(upstream, config)
+
+		require.Equal(t, http.StatusForbidden, doRequestFrom(h, "POST", "/_cache/flush", "192.168.0.1:1234", testAdminToken))
+		require.Equal(t, http.StatusForbidden, doRequestFrom(h, "POST", "/_cache/flush", "10.1.2.3:1234", ""))
+		require.Equal(t, http.StatusOK, doRequestFrom(h, "POST", "/_cache/flush", "10.1.2.3:1234", testAdminToken))
+	})
+}
+
+func TestPurge(t *testing.T) {
+	hits := 0
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits++
+		w.Header().Add("Cache-control", "max-age=10")
+		w.Write([]byte("abc"))
+		return 200, nil
+	}), newAdminConfig())
+
+	doCachedRequest := func(method string, target string) {
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, method, target))
+		require.NoError(t, err)
+	}
+
+	t.Run("it should purge the GET and HEAD entries of the url", func(t *testing.T) {
+		hits = 0
+		// The HEAD goes first, otherwise it is answered from the GET entry
+		doCachedRequest("HEAD", "http://example.com/a")
+		doCachedRequest("GET", "http://example.com/a")
+		doCachedRequest("GET", "http://example.com/b")
+		require.Equal(t, 3, hits)
+
+		res := doAdminRequest(t, h, "PURGE", "http://example.com/a")
+		requireCode(t, res, 200)
+		result := purgeResult{}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+		require.Equal(t, 2, result.Purged)
+
+		doCachedRequest("GET", "http://example.com/a")
+		doCachedRequest("GET", "http://example.com/b")
+		require.Equal(t, 4, hits)
+	})
+
+	t.Run("it should purge every Vary variant of the url", func(t *testing.T) {
+		fetches := 0
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			fetches++
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Header().Add("Vary", "Accept-Encoding")
+			w.Write([]byte(r.Header.Get("Accept-Encoding")))
+			return 200, nil
+		}), newAdminConfig())
+
+		doVariantRequest := func(encoding string) {
+			r := newRequestWithOriginalURL(t, "GET", "http://example.com/a")
+			r.Header.Set("Accept-Encoding", encoding)
+			_, err := h.ServeHTTP(httptest.NewRecorder(), r)
+			require.NoError(t, err)
+		}
+		doVariantRequest("gzip")
+		doVariantRequest("br")
+		require.Len(t, h.Cache.GetVariants("GET example.com/a?"), 2)
+
+		res := doAdminRequest(t, h, "PURGE", "http://example.com/a")
+		requireCode(t, res, 200)
+		result := purgeResult{}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+		require.Equal(t, 2, result.Purged)
+		require.Empty(t, h.Cache.GetVariants("GET example.com/a?"))
+
+		doVariantRequest("gzip")
+		doVariantRequest("br")
+		require.Equal(t, 4, fetches)
+	})
+
+	t.Run("it should respond 404 if nothing was purged", func(t *testing.T) {
+		res := doAdminRequest(t, h, "PURGE", "http://example.com/not-cached")
+		requireCode(t, res, 404)
+	})
+
+	t.Run("it should flush everything", func(t *testing.T) {
+		hits = 0
+		doCachedRequest("GET", "http://example.com/a")
+		doCachedRequest("GET", "http://example.com/b")
+
+		res := doAdminRequest(t, h, "POST", "/_cache/flush")
+		requireCode(t, res, 200)
+		result := purgeResult{}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+		require.Equal(t, 2, result.Purged)
+
+		doCachedRequest("GET", "http://example.com/a")
+		require.Equal(t, 1, hits)
+	})
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		matches bool
+	}{
+		{"GET example.com/assets/*", "GET example.com/assets/a/b.png?", true},
+		{"GET example.com/assets/*", "GET example.com/api?", false},
+		{"* example.com/*.png?", "HEAD example.com/a/b.png?", true},
+		{"* example.com/*.png?", "HEAD example.com/a/b.jpg?", false},
+		{"GET example.com/?", "GET example.com/a", true},
+		{"GET example.com/?", "GET example.com/ab", false},
+		{"*", "", true},
+		{"", "", true},
+		{"", "a", false},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.matches, matchGlob(test.pattern, test.s), "Invalid match of "+test.pattern+" with "+test.s)
+	}
+}
+
+func TestBulkPurge(t *testing.T) {
+	hits := 0
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits++
+		w.Header().Add("Cache-control", "max-age=10")
+		return 200, nil
+	}), newAdminConfig())
+
+	for _, target := range []string{"http://example.com/a", "http://example.com/assets/1.png", "http://example.com/assets/2.png", "http://example.com/b"} {
+		_, err := h.ServeHTTP(httptest.NewRecorder(), newRequestWithOriginalURL(t, "GET", target))
+		require.NoError(t, err)
+	}
+
+	doBulkPurge := func(body string) (*httptest.ResponseRecorder, int) {
+		w := httptest.NewRecorder()
+		r := newRequestWithOriginalURL(t, "POST", "/_cache/purge")
+		r.Body = ioutil.NopCloser(strings.NewReader(body))
+		r.Header.Set(defaultAdminTokenHeader, testAdminToken)
+		code, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		return w, code
+	}
+
+	t.Run("it should report the result of each item", func(t *testing.T) {
+		w, code := doBulkPurge(`{"urls": ["http://example.com/a", "http://example.com/missing", "/no-host"], "patterns": ["GET example.com/assets/*", "GET other.com/*"]}`)
+		require.Equal(t, http.StatusOK, code)
+
+		result := bulkPurgeResult{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+		require.Equal(t, []bulkPurgeItemResult{
+			{URL: "http://example.com/a", Purged: 1},
+			{URL: "http://example.com/missing", Error: "not found"},
+			{URL: "/no-host", Error: "invalid url"},
+			{Pattern: "GET example.com/assets/*", Purged: 2},
+			{Pattern: "GET other.com/*", Error: "not found"},
+		}, result.Results)
+
+		hits = 0
+		_, err := h.ServeHTTP(httptest.NewRecorder(), newRequestWithOriginalURL(t, "GET", "http://example.com/b"))
+		require.NoError(t, err)
+		require.Equal(t, 0, hits)
+	})
+
+	t.Run("it should reject invalid bodies", func(t *testing.T) {
+		_, code := doBulkPurge(`{"urls": `)
+		require.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("it should reject too many items", func(t *testing.T) {
+		urls := make([]string, maxBulkPurgeItems+1)
+		for i := range urls {
+			urls[i] = "http://example.com/a"
+		}
+		body, _ := json.Marshal(bulkPurgeRequest{URLs: urls})
+		_, code := doBulkPurge(string(body))
+		require.Equal(t, http.StatusRequestEntityTooLarge, code)
+	})
+}
+
+func TestRefreshURL(t *testing.T) {
+	hits := 0
+	failing := false
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits++
+		if failing {
+			return http.StatusBadGateway, nil
+		}
+		w.Header().Add("Cache-control", "max-age=10")
+		w.Write([]byte("version " + strconv.Itoa(hits)))
+		return 200, nil
+	}), newAdminConfig())
+
+	doCachedRequest := func() string {
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", "http://example.com/a"))
+		require.NoError(t, err)
+		return w.Body.String()
+	}
+
+	refreshURL := "/_cache/refresh?url=" + url.QueryEscape("http://example.com/a")
+
+	t.Run("it should replace the cached entry", func(t *testing.T) {
+		require.Equal(t, "version 1", doCachedRequest())
+
+		res := doAdminRequest(t, h, "POST", refreshURL)
+		requireCode(t, res, 200)
+		result := refreshResult{}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+		require.Equal(t, refreshResult{Status: cacheMiss, Code: 200, Size: 9}, result)
+
+		require.Equal(t, "version 2", doCachedRequest())
+		require.Equal(t, 2, hits)
+	})
+
+	t.Run("it should keep the cached entry if upstream fails", func(t *testing.T) {
+		failing = true
+		res := doAdminRequest(t, h, "POST", refreshURL)
+		requireCode(t, res, http.StatusBadGateway)
+		result := refreshResult{}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+		require.Equal(t, "upstream responded with code 502", result.Error)
+
+		require.Equal(t, "version 2", doCachedRequest())
+		require.Equal(t, 3, hits)
+	})
+
+	t.Run("it should reject invalid urls", func(t *testing.T) {
+		requireCode(t, doAdminRequest(t, h, "POST", "/_cache/refresh?url=/no-host"), http.StatusBadRequest)
+		requireCode(t, doAdminRequest(t, h, "GET", refreshURL), http.StatusMethodNotAllowed)
+	})
+}
@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sync"
+
+	"github.com/caddyserver/caddy"
+)
+
+const (
+	// Counters of each row of the sketch, about 256KB in total
+	sketchWidth = 1 << 16
+	sketchDepth = 4
+
+	// The counters are halved after this many requests, so the keys that stop being requested are forgotten
+	sketchSamples = 10 * sketchWidth
+)
+
+// admitCtxKey marks the requests the cache makes itself, like the warming ones, their responses are always saved
+const admitCtxKey caddy.CtxKey = "cache_admit"
+
+// frequencySketch estimates how many times each key was requested recently in a fixed size, like TinyLFU.
+// Each key increments a counter in every row and its estimate is the smallest of them,
+// collisions can only make a key look more requested than it was
+type frequencySketch struct {
+	lock     *sync.Mutex
+	counters [sketchDepth][]uint8
+	samples  int
+}
+
+func newFrequencySketch() *frequencySketch {
+	sketch := &frequencySketch{lock: new(sync.Mutex)}
+	for i := range sketch.counters {
+		sketch.counters[i] = make([]uint8, sketchWidth)
+	}
+	return sketch
+}
+
+// indexes returns the counter of the key in each row
+func (s *frequencySketch) indexes(key string) [sketchDepth]uint32 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	sum := hash.Sum64()
+	low, high := uint32(sum), uint32(sum>>32)|1
+
+	indexes := [sketchDepth]uint32{}
+	for i := range indexes {
+		indexes[i] = (low + uint32(i)*high) % sketchWidth
+	}
+	return indexes
+}
+
+// record counts a request of the key and returns how many times it was requested recently, this one included
+func (s *frequencySketch) record(key string) int {
+	indexes := s.indexes(key)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	estimate := 255
+	for row, index := range indexes {
+		if s.counters[row][index] < 255 {
+			s.counters[row][index]++
+		}
+		if count := int(s.counters[row][index]); count < estimate {
+			estimate = count
+		}
+	}
+
+	s.samples++
+	if s.samples >= sketchSamples {
+		s.resetLocked()
+	}
+	return estimate
+}
+
+// resetLocked halves every counter, the lock must be held
+func (s *frequencySketch) resetLocked() {
+	for _, row := range s.counters {
+		for i := range row {
+			row[i] /= 2
+		}
+	}
+	s.samples = 0
+}
+
+// admits counts the request and returns if its response can be saved, with admission only the keys requested
+// that many times recently are. The refreshes and the requests the cache makes itself always are
+func (handler *Handler) admits(r *http.Request) bool {
+	if handler.admission == nil || isRefreshRequest(r) {
+		return true
+	}
+	if internal, _ := r.Context().Value(admitCtxKey).(bool); internal {
+		return true
+	}
+	return handler.admission.record(getKey(handler.Config, r)) >= handler.Config.Admission
+}
+
+// notAdmitted makes the entry private, it is sent to the client without saving it
+func (e *HTTPCacheEntry) notAdmitted(config *Config) {
+	e.isPublic = false
+	e.expiration = now().Add(config.LockTimeout)
+	e.reason = "not admitted"
+}
@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrequencySketch(t *testing.T) {
+	t.Run("it should estimate how many times each key was requested", func(t *testing.T) {
+		sketch := newFrequencySketch()
+		require.Equal(t, 1, sketch.record("GET example.com/a?"))
+		require.Equal(t, 2, sketch.record("GET example.com/a?"))
+		require.Equal(t, 1, sketch.record("GET example.com/b?"))
+	})
+
+	t.Run("it should halve the counters after many requests", func(t *testing.T) {
+		sketch := newFrequencySketch()
+		for i := 0; i < 4; i++ {
+			sketch.record("GET example.com/a?")
+		}
+		sketch.samples = sketchSamples - 1
+		sketch.record("GET example.com/b?")
+		require.Equal(t, 0, sketch.samples)
+		require.Equal(t, 3, sketch.record("GET example.com/a?"))
+	})
+}
+
+func TestAdmission(t *testing.T) {
+	newAdmissionHandler := func() (*Handler, *int) {
+		fetches := 0
+		config := emptyConfig()
+		config.Admission = 2
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			fetches++
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte("abc"))
+			return 200, nil
+		}), config), &fetches
+	}
+
+	serve := func(h *Handler, url string) *http.Response {
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", url))
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	t.Run("it should not save a key requested once", func(t *testing.T) {
+		h, _ := newAdmissionHandler()
+
+		res := serve(h, "http://example.com/once")
+		requireStatus(t, res, cacheMiss)
+		requireBody(t, res, []byte("abc"))
+		for _, entry := range h.Cache.GetVariants("GET example.com/once?") {
+			require.False(t, entry.isPublic)
+			require.Equal(t, "not admitted", entry.reason)
+		}
+	})
+
+	t.Run("it should save a key once it is requested often", func(t *testing.T) {
+		h, fetches := newAdmissionHandler()
+
+		requireStatus(t, serve(h, "http://example.com/popular"), cacheMiss)
+		requireBody(t, serve(h, "http://example.com/popular"), []byte("abc"))
+		res := serve(h, "http://example.com/popular")
+		requireStatus(t, res, cacheHit)
+		requireBody(t, res, []byte("abc"))
+		require.Equal(t, 2, *fetches)
+	})
+
+	t.Run("it should always save the warming requests", func(t *testing.T) {
+		h, _ := newAdmissionHandler()
+		h.Config.WarmURLs = []string{"http://example.com/warm"}
+		h.warmOnStartup()
+
+		requireStatus(t, serve(h, "http://example.com/warm"), cacheHit)
+	})
+}
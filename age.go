@@ -0,0 +1,45 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ageCap is the greatest Age sent, 2^31 seconds if age_cap is not set like RFC 7234 section 1.2.1 says
+func ageCap(config *Config) time.Duration {
+	if config.AgeCap == 0 {
+		return maxDeltaSeconds * time.Second
+	}
+	return config.AgeCap
+}
+
+// currentAge is how old the response of the entry is now, as RFC 7234 section 4.2.3 computes it:
+// its corrected initial age plus the time it has been in the cache
+func currentAge(entry *HTTPCacheEntry) time.Duration {
+	// Entries that were not fetched, like the warmed ones, only have the time they were saved
+	requestTime, responseTime := entry.fetchStart, entry.firstByteAt
+	if requestTime.IsZero() || responseTime.IsZero() {
+		requestTime, responseTime = entry.storedAt, entry.storedAt
+	}
+
+	age := correctedInitialAge(entry.Response.snapHeader, requestTime, responseTime) + now().Sub(responseTime)
+	if age < 0 {
+		return 0
+	}
+	return age
+}
+
+// addAgeHeader replaces the Age upstream sent with the current age of the responses served from cache
+func (handler *Handler) addAgeHeader(header http.Header, entry *HTTPCacheEntry, cacheStatus string) {
+	if cacheStatus != cacheHit && cacheStatus != cacheStale && cacheStatus != cacheMaintenance {
+		return
+	}
+
+	age := currentAge(entry)
+	if max := ageCap(handler.Config); age > max {
+		age = max
+	}
+	delHeaderFold(header, "Age")
+	header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+}
@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCurrentAge(t *testing.T) {
+	originalNow := now
+	defer func() { now = originalNow }()
+
+	responseTime := time.Now()
+	now = func() time.Time { return responseTime.Add(20 * time.Second) }
+
+	newEntry := func(header http.Header) *HTTPCacheEntry {
+		return &HTTPCacheEntry{
+			fetchStart:  responseTime.Add(-3 * time.Second),
+			firstByteAt: responseTime,
+			Response:    makeResponse(200, header),
+		}
+	}
+
+	t.Run("it should correct the Age with the response delay", func(t *testing.T) {
+		header := makeHeader("Age", "10")
+		header.Set("Date", responseTime.Add(-5*time.Second).UTC().Format(http.TimeFormat))
+		require.InDelta(t, float64(33*time.Second), float64(currentAge(newEntry(header))), float64(time.Second))
+	})
+
+	t.Run("it should use the apparent age if it is greater", func(t *testing.T) {
+		header := makeHeader("Age", "10")
+		header.Set("Date", responseTime.Add(-60*time.Second).UTC().Format(http.TimeFormat))
+		require.InDelta(t, float64(80*time.Second), float64(currentAge(newEntry(header))), float64(time.Second))
+	})
+
+	t.Run("it should count the response delay without Age", func(t *testing.T) {
+		require.Equal(t, 23*time.Second, currentAge(newEntry(http.Header{})))
+	})
+
+	t.Run("it should count the time since it was saved for the entries that were not fetched", func(t *testing.T) {
+		entry := &HTTPCacheEntry{storedAt: responseTime, Response: makeResponse(200, makeHeader("Age", "10"))}
+		require.Equal(t, 30*time.Second, currentAge(entry))
+	})
+}
+
+func TestAgeHeader(t *testing.T) {
+	newAgeHandler := func(config *Config, age string) *Handler {
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Set("Cache-Control", "max-age=86400")
+			w.Header().Set("Age", age)
+			w.Write([]byte("abc"))
+			return 200, nil
+		}), config)
+	}
+
+	serve := func(h *Handler) *http.Response {
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", "http://example.com/"))
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	t.Run("it should send the current age of the hits", func(t *testing.T) {
+		h := newAgeHandler(emptyConfig(), "100")
+
+		res := serve(h)
+		requireStatus(t, res, cacheMiss)
+		require.Equal(t, "100", res.Header.Get("Age"))
+
+		res = serve(h)
+		requireStatus(t, res, cacheHit)
+		require.Equal(t, []string{"100"}, res.Header["Age"])
+	})
+
+	t.Run("it should cap the age", func(t *testing.T) {
+		config := emptyConfig()
+		config.AgeCap = time.Minute
+		h := newAgeHandler(config, "3600")
+
+		serve(h)
+		res := serve(h)
+		requireStatus(t, res, cacheHit)
+		require.Equal(t, "60", res.Header.Get("Age"))
+	})
+
+	t.Run("it should cap the age at 2^31 seconds by default", func(t *testing.T) {
+		h := NewHandler(nil, emptyConfig())
+		entry := &HTTPCacheEntry{storedAt: now().Add(-time.Hour), Response: makeResponse(200, makeHeader("Age", "9999999999"))}
+		header := http.Header{}
+		h.addAgeHeader(header, entry, cacheHit)
+		require.Equal(t, "2147483648", header.Get("Age"))
+	})
+}
@@ -0,0 +1,68 @@
+package cache
+
+/* Go API to drive the cache from other plugins without the admin endpoints.
+These methods can be called from any goroutine while requests are served.
+Keys are made with the cache_key template, like "GET example.com/path?query" by default */
+
+// Purge removes every variant saved with the key and returns if anything was removed.
+// With purge_redis the other instances are told to remove it too
+func (handler *Handler) Purge(key string) bool {
+	purged := handler.Cache.Purge(key)
+	handler.Purger.PurgedKey(key)
+	return purged > 0
+}
+
+// PurgePattern removes the entries of every key that matches the pattern, where * matches any text
+// and ? a single character, and returns how many were removed.
+// With purge_redis the other instances are told to remove them too
+func (handler *Handler) PurgePattern(pattern string) int {
+	purged := handler.Cache.PurgeMatching(func(key string) bool {
+		return matchGlob(pattern, key)
+	})
+	handler.Purger.PurgedPattern(pattern)
+	return purged
+}
+
+// Get returns a fresh public entry saved with the key, the first one if there are many variants.
+// The entry is only meant to be inspected, its body may be removed at any time
+func (handler *Handler) Get(key string) (*HTTPCacheEntry, bool) {
+	for _, entry := range handler.Cache.GetVariants(key) {
+		if entry.isPublic && entry.Fresh() {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+// Stats returns the counters of what the cache did since it started and how much it has saved
+func (handler *Handler) Stats() CacheStats {
+	return handler.stats()
+}
+
+// Ready returns if the urls warmed on startup are already cached, it is always true without warm urls.
+// Health checks can wait for it so the first clients don't all go to upstream
+func (handler *Handler) Ready() bool {
+	return handler.isReady()
+}
+
+// SetMaintenance enables or disables the maintenance mode, where upstream is never requested and
+// the cache sends whatever it has, like POST /_cache/maintenance
+func (handler *Handler) SetMaintenance(enabled bool) {
+	handler.setMaintenance(enabled)
+}
+
+// InMaintenance returns if the maintenance mode is enabled
+func (handler *Handler) InMaintenance() bool {
+	return handler.inMaintenance()
+}
+
+// SetKeyVersion changes the version folded into every key, like POST /_cache/key_version.
+// Every url misses until it is cached again with the new version
+func (handler *Handler) SetKeyVersion(version string) {
+	handler.setKeyVersion(version)
+}
+
+// KeyVersion returns the version folded into every key, empty if there is none
+func (handler *Handler) KeyVersion() string {
+	return handler.Config.KeyVersion.Get()
+}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func newAPIHandler() *Handler {
+	return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		if r.URL.Path == "/private" {
+			w.Header().Set("Cache-Control", "private")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=10")
+		}
+		w.Write([]byte(r.URL.Path))
+		return 200, nil
+	}), emptyConfig())
+}
+
+// serveAPIRequest is like newRequestWithOriginalURL but it can be used in the examples
+func serveAPIRequest(h *Handler, target string) {
+	r := httptest.NewRequest("GET", target, nil)
+	r = r.WithContext(context.WithValue(r.Context(), httpserver.OriginalURLCtxKey, *r.URL))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestGoAPI(t *testing.T) {
+	t.Run("it should get the entries by key", func(t *testing.T) {
+		h := newAPIHandler()
+		serveAPIRequest(h, "http://example.com/a")
+		serveAPIRequest(h, "http://example.com/private")
+
+		entry, ok := h.Get("GET example.com/a?")
+		require.True(t, ok)
+		require.Equal(t, 200, entry.Response.Code)
+		require.True(t, entry.Fresh())
+
+		_, ok = h.Get("GET example.com/private?")
+		require.False(t, ok)
+		_, ok = h.Get("GET example.com/missing?")
+		require.False(t, ok)
+	})
+
+	t.Run("it should purge a key", func(t *testing.T) {
+		h := newAPIHandler()
+		serveAPIRequest(h, "http://example.com/a")
+
+		require.True(t, h.Purge("GET example.com/a?"))
+		require.False(t, h.Purge("GET example.com/a?"))
+		_, ok := h.Get("GET example.com/a?")
+		require.False(t, ok)
+	})
+
+	t.Run("it should purge the keys matching a pattern", func(t *testing.T) {
+		h := newAPIHandler()
+		serveAPIRequest(h, "http://example.com/blog/1")
+		serveAPIRequest(h, "http://example.com/blog/2")
+		serveAPIRequest(h, "http://example.com/about")
+
+		require.Equal(t, 2, h.PurgePattern("GET example.com/blog/*"))
+		require.Equal(t, 1, h.Stats().Entries)
+		require.Equal(t, int64(2), h.Stats().Purged)
+	})
+
+	t.Run("it should be usable while requests are served", func(t *testing.T) {
+		h := newAPIHandler()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				serveAPIRequest(h, fmt.Sprintf("http://example.com/%d", i%10))
+			}
+		}()
+		for i := 0; i < 100; i++ {
+			h.Get(fmt.Sprintf("GET example.com/%d?", i%10))
+			h.PurgePattern("GET example.com/1*")
+			h.Stats()
+		}
+		<-done
+	})
+}
+
+// Purging the cache from a companion plugin, like when a message says the posts of a blog changed
+func ExampleHandler_PurgePattern() {
+	h := newAPIHandler()
+	serveAPIRequest(h, "http://example.com/blog/1")
+	serveAPIRequest(h, "http://example.com/blog/2")
+	serveAPIRequest(h, "http://example.com/about")
+
+	fmt.Println(h.PurgePattern("GET example.com/blog/*"))
+	_, cached := h.Get("GET example.com/about?")
+	fmt.Println(cached)
+	fmt.Println(h.Stats().Misses)
+	// Output:
+	// 2
+	// true
+	// 3
+}
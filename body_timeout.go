@@ -0,0 +1,36 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+var errBodyTimeout = errors.New("upstream stopped sending the body")
+
+// watchBody aborts the fetch if upstream sends the headers and then no part of the body for the timeout.
+// The entry is discarded and the clients that were getting it get an incomplete body
+func watchBody(r *Response, timeout time.Duration, cancel context.CancelFunc, done <-chan struct{}) {
+	r.WaitHeaders()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+
+		if idle := r.idleFor(); idle < timeout {
+			timer.Reset(timeout - idle)
+			continue
+		}
+
+		log.Printf("[WARNING] cache: Upstream sent no body for %v, the fetch is aborted", timeout)
+		r.Abort(errBodyTimeout)
+		cancel()
+		return
+	}
+}
@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBodyTimeout(t *testing.T) {
+	newHandler := func(cancelled chan bool) *Handler {
+		config := emptyConfig()
+		config.BodyTimeout = 50 * time.Millisecond
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Add("Cache-control", "max-age=10")
+			w.WriteHeader(200)
+			w.Write([]byte("abc"))
+
+			if r.URL.Path == "/slow" {
+				// Slower than the timeout in total, but each part arrives before it
+				for i := 0; i < 5; i++ {
+					time.Sleep(20 * time.Millisecond)
+					w.Write([]byte("abc"))
+				}
+				return 200, nil
+			}
+
+			select {
+			case <-r.Context().Done():
+				cancelled <- true
+			case <-time.After(time.Second):
+				cancelled <- false
+			}
+			return 200, nil
+		}), config)
+	}
+
+	serve := func(h *Handler, target string) (*httptest.ResponseRecorder, error) {
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", target))
+		return w, err
+	}
+
+	t.Run("it should abort and discard a body that stalls", func(t *testing.T) {
+		cancelled := make(chan bool, 2)
+		h := newHandler(cancelled)
+
+		w, err := serve(h, "http://example.com/stalled")
+		require.Equal(t, errBodyTimeout, err)
+		require.Equal(t, []byte("abc"), w.Body.Bytes())
+		require.True(t, <-cancelled)
+
+		require.Eventually(t, func() bool {
+			return len(h.Cache.GetVariants("GET example.com/stalled?")) == 0
+		}, time.Second, 10*time.Millisecond)
+
+		w, _ = serve(h, "http://example.com/stalled")
+		requireStatus(t, w.Result(), cacheMiss)
+	})
+
+	t.Run("it should not abort a body that keeps arriving", func(t *testing.T) {
+		h := newHandler(make(chan bool, 1))
+
+		_, err := serve(h, "http://example.com/slow")
+		require.NoError(t, err)
+
+		w, err := serve(h, "http://example.com/slow")
+		require.NoError(t, err)
+		requireStatus(t, w.Result(), cacheHit)
+		require.Equal(t, bytes.Repeat([]byte("abc"), 6), w.Body.Bytes())
+	})
+}
@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+// bypassQueryCtxKey marks the requests that skipped the cache with the bypass_query parameter
+const bypassQueryCtxKey caddy.CtxKey = "cache_bypass_query"
+
+func isBypassQueryRequest(r *http.Request) bool {
+	bypassed, _ := r.Context().Value(bypassQueryCtxKey).(bool)
+	return bypassed
+}
+
+// bypassQuery returns if the request has the bypass_query parameter and it is allowed to use it.
+// It needs the configured value and to come from an admin_allow ip if they are set
+func (handler *Handler) bypassQuery(r *http.Request) bool {
+	if handler.Config.BypassQuery == "" {
+		return false
+	}
+
+	values, ok := r.URL.Query()[handler.Config.BypassQuery]
+	if !ok {
+		return false
+	}
+
+	if handler.Config.BypassQueryValue != "" {
+		if len(values) == 0 || subtle.ConstantTimeCompare([]byte(values[0]), []byte(handler.Config.BypassQueryValue)) != 1 {
+			return false
+		}
+	}
+
+	if len(handler.Config.AdminAllow) > 0 && !isAllowedIP(r.RemoteAddr, handler.Config.AdminAllow) {
+		return false
+	}
+
+	return true
+}
+
+// withoutBypassQuery returns the request without the bypass_query parameter, so it has
+// the key of the normal requests, marked to fetch a new response that replaces the cached one
+func (handler *Handler) withoutBypassQuery(r *http.Request) *http.Request {
+	ctx := context.WithValue(r.Context(), bypassQueryCtxKey, true)
+	ctx = context.WithValue(ctx, refreshCtxKey, true)
+
+	req := r.WithContext(ctx)
+	req.URL = removeQueryParam(r.URL, handler.Config.BypassQuery)
+	req.RequestURI = req.URL.RequestURI()
+
+	// Caddy placeholders read the path and query from the original url
+	if originalURL, ok := r.Context().Value(httpserver.OriginalURLCtxKey).(url.URL); ok {
+		req = req.WithContext(context.WithValue(req.Context(), httpserver.OriginalURLCtxKey, *removeQueryParam(&originalURL, handler.Config.BypassQuery)))
+	}
+	return req
+}
+
+// removeQueryParam removes the parameter keeping the order of the others
+func removeQueryParam(u *url.URL, name string) *url.URL {
+	result := *u
+	params := []string{}
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		key := param
+		if equal := strings.Index(param, "="); equal >= 0 {
+			key = param[:equal]
+		}
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		if param != "" && key != name {
+			params = append(params, param)
+		}
+	}
+	result.RawQuery = strings.Join(params, "&")
+	return &result
+}
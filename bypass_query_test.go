@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBypassQuery(t *testing.T) {
+	newHandler := func(config *Config) (*Handler, *[]string) {
+		queries := []string{}
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			queries = append(queries, r.URL.RawQuery)
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Write([]byte("version " + strconv.Itoa(len(queries))))
+			return 200, nil
+		}), config), &queries
+	}
+
+	doRequestFromIP := func(h *Handler, target string, remoteAddr string) *http.Response {
+		w := httptest.NewRecorder()
+		r := newRequestWithOriginalURL(t, "GET", target)
+		r.RemoteAddr = remoteAddr
+		_, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	t.Run("it should replace the entry of the url without the parameter", func(t *testing.T) {
+		config := emptyConfig()
+		config.BypassQuery = "nocache"
+		config.BypassQueryValue = "secret"
+		h, queries := newHandler(config)
+
+		res := doRequestFromIP(h, "http://example.com/a?q=1", "1.2.3.4:80")
+		requireStatus(t, res, cacheMiss)
+		requireBody(t, res, []byte("version 1"))
+
+		res = doRequestFromIP(h, "http://example.com/a?q=1&nocache=secret", "1.2.3.4:80")
+		requireStatus(t, res, cacheBypass)
+		requireBody(t, res, []byte("version 2"))
+
+		res = doRequestFromIP(h, "http://example.com/a?q=1", "1.2.3.4:80")
+		requireStatus(t, res, cacheHit)
+		requireBody(t, res, []byte("version 2"))
+
+		require.Equal(t, []string{"q=1", "q=1"}, *queries)
+	})
+
+	t.Run("it should ignore the parameter without the secret value", func(t *testing.T) {
+		config := emptyConfig()
+		config.BypassQuery = "nocache"
+		config.BypassQueryValue = "secret"
+		h, _ := newHandler(config)
+
+		doRequestFromIP(h, "http://example.com/a", "1.2.3.4:80")
+		for _, query := range []string{"nocache", "nocache=", "nocache=wrong"} {
+			res := doRequestFromIP(h, "http://example.com/a?"+query, "1.2.3.4:80")
+			requireStatus(t, res, cacheMiss)
+		}
+		res := doRequestFromIP(h, "http://example.com/a", "1.2.3.4:80")
+		requireBody(t, res, []byte("version 1"))
+	})
+
+	t.Run("it should require a trusted ip if admin_allow is set", func(t *testing.T) {
+		config := emptyConfig()
+		config.BypassQuery = "nocache"
+		config.AdminAllow = []*net.IPNet{{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)}}
+		h, _ := newHandler(config)
+
+		doRequestFromIP(h, "http://example.com/a", "1.2.3.4:80")
+		requireStatus(t, doRequestFromIP(h, "http://example.com/a?nocache", "1.2.3.4:80"), cacheMiss)
+		requireStatus(t, doRequestFromIP(h, "http://example.com/a?nocache", "10.0.0.1:80"), cacheBypass)
+		requireBody(t, doRequestFromIP(h, "http://example.com/a", "1.2.3.4:80"), []byte("version 3"))
+	})
+}
+
+func TestRemoveQueryParam(t *testing.T) {
+	for query, expected := range map[string]string{
+		"nocache":             "",
+		"a=1&nocache=1&b=2":   "a=1&b=2",
+		"nocache&nocache=2&a": "a",
+		"b=%20&no%63ache=1":   "b=%20",
+		"nocacheother=1&&c=2": "nocacheother=1&c=2",
+		"":                    "",
+	} {
+		u, err := url.Parse("http://example.com/?" + query)
+		require.NoError(t, err)
+		require.Equal(t, expected, removeQueryParam(u, "nocache").RawQuery, query)
+	}
+}
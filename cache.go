@@ -2,21 +2,44 @@ package cache
 
 import (
 	"hash/crc32"
+	"log"
 	"math"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/nicolasazrak/caddy-cache/storage"
 )
 
 const cacheBucketsSize = 256
 
 type HTTPCache struct {
-	cacheKeyTemplate string
-	entries          [cacheBucketsSize]map[string][]*HTTPCacheEntry
-	entriesLock      [cacheBucketsSize]*sync.RWMutex
+	config      *Config
+	entries     [cacheBucketsSize]map[string][]*HTTPCacheEntry
+	entriesLock [cacheBucketsSize]*sync.RWMutex
+	hosts       *hostQuotas
+
+	// memoryTier is nil if the bodies are only saved to disk
+	memoryTier *storage.MemoryTier
+
+	// openFiles bounds the files read at the same time, it is nil if the limit of the process is unknown
+	openFiles *storage.OpenFileLimit
+
+	// segments are the bodies assembled from range requests
+	segments *segmentedBodies
+
+	// tombstones keep the responses fetched before a purge from being saved
+	tombstones *tombstones
+
+	counters *cacheCounters
+
+	// events sends what the cache does to the EventSink, it is nil without one
+	events *eventEmitter
 }
 
-func NewHTTPCache(cacheKeyTemplate string) *HTTPCache {
+func NewHTTPCache(config *Config) *HTTPCache {
 	entriesLocks := [cacheBucketsSize]*sync.RWMutex{}
 	entries := [cacheBucketsSize]map[string][]*HTTPCacheEntry{}
 
@@ -25,15 +48,65 @@ func NewHTTPCache(cacheKeyTemplate string) *HTTPCache {
 		entries[i] = make(map[string][]*HTTPCacheEntry)
 	}
 
+	var memoryTier *storage.MemoryTier
+	if config.MemoryTierSize > 0 {
+		memoryTier = storage.NewMemoryTier(config.MemoryTierSize)
+	}
+
 	return &HTTPCache{
-		cacheKeyTemplate: cacheKeyTemplate,
-		entries:          entries,
-		entriesLock:      entriesLocks,
+		config:      config,
+		entries:     entries,
+		entriesLock: entriesLocks,
+		hosts:       newHostQuotas(evictionName(config)),
+		memoryTier:  memoryTier,
+		openFiles:   newOpenFileLimit(config),
+		segments:    newSegmentedBodies(),
+		tombstones:  newTombstones(tombstoneWindow(config)),
+		counters:    newCacheCounters(evictionName(config)),
+		events:      newEventEmitter(config.EventSink),
 	}
 }
 
+// Get returns a fresh entry for the request. The entry is acquired,
+// it must be released once it is not used anymore so its body can be removed
 func (cache *HTTPCache) Get(request *http.Request) (*HTTPCacheEntry, bool) {
-	key := getKey(cache.cacheKeyTemplate, request)
+	if cache.config.NullStorage {
+		return nil, false
+	}
+
+	entry, exists := cache.getFresh(request)
+	if !exists {
+		return nil, false
+	}
+	if cache.discardIncomplete(entry) {
+		entry.release()
+		return nil, false
+	}
+
+	cache.hosts.touch(entry)
+	atomic.StoreInt64(&entry.lastUsed, time.Now().UnixNano())
+	atomic.AddInt64(&entry.uses, 1)
+
+	// Entries that are used again are moved to memory if there is a memory tier
+	body := entry.Response.body
+	if compressed, ok := body.(*storage.GzipStorage); ok {
+		body = compressed.Storage()
+	}
+	if buffered, ok := body.(*storage.ThresholdStorage); ok {
+		body = buffered.Storage()
+	}
+	if spilled, ok := body.(*storage.SpillStorage); ok {
+		body = spilled.Storage()
+	}
+	if body, ok := body.(*storage.TieredStorage); ok && cache.memoryTier != nil {
+		cache.memoryTier.Accessed(body)
+	}
+
+	return entry, true
+}
+
+func (cache *HTTPCache) getFresh(request *http.Request) (*HTTPCacheEntry, bool) {
+	key := getKey(cache.config, request)
 	b := cache.getBucketIndexForKey(key)
 	cache.entriesLock[b].RLock()
 	defer cache.entriesLock[b].RUnlock()
@@ -45,7 +118,8 @@ func (cache *HTTPCache) Get(request *http.Request) (*HTTPCacheEntry, bool) {
 	}
 
 	for _, entry := range previousEntries {
-		if entry.Fresh() && matchesVary(request, entry) {
+		if entry.Fresh() && servesMethod(request.Method, entry) && matchesVary(request, entry, cache.config) && matchesEncoding(request, entry, cache.config) {
+			entry.acquire()
 			return entry, true
 		}
 	}
@@ -53,34 +127,380 @@ func (cache *HTTPCache) Get(request *http.Request) (*HTTPCacheEntry, bool) {
 	return nil, false
 }
 
+// newStorage creates where the body of a public entry is saved, in the backend its path is routed to if any
+func (cache *HTTPCache) newStorage(request *http.Request) (storage.ResponseStorage, error) {
+	path, memory := cache.storagePath(request)
+	if memory {
+		return storage.NewMemoryStorage(), nil
+	}
+
+	newDiskStorage := func() (storage.ResponseStorage, error) {
+		return cache.newDiskStorage(path)
+	}
+	if cache.config.MemorySpillSize > 0 {
+		return storage.NewSpillStorage(cache.config.MemorySpillSize, newDiskStorage), nil
+	}
+	return newDiskStorage()
+}
+
+// newSegmentedStorage creates the file where the segments of a body are assembled, in the backend its path is routed to if any.
+// Segments are always saved in a file, the ones of memory backends go to the cache path
+func (cache *HTTPCache) newSegmentedStorage(request *http.Request, size int64) (*storage.SegmentedStorage, error) {
+	path, memory := cache.storagePath(request)
+	if memory {
+		path = cache.config.Path
+	}
+	return storage.NewSegmentedStorage(path, size)
+}
+
+// storagePath returns the path where the bodies of the request are saved, or true if its backend is in memory
+func (cache *HTTPCache) storagePath(request *http.Request) (string, bool) {
+	backend, ok := storageBackendFor(cache.config, request.URL.Path)
+	if !ok {
+		return cache.config.Path, false
+	}
+	return backend.Path, backend.Memory
+}
+
+// newFileStorage creates the files of the bodies that are not in the memory tier, tests replace it to emulate slow disks
+var newFileStorage = storage.NewLimitedFileStorage
+
+// newDiskStorage creates the file where the body is saved, it can be moved to the memory tier later
+func (cache *HTTPCache) newDiskStorage(path string) (storage.ResponseStorage, error) {
+	if cache.memoryTier != nil {
+		return storage.NewLimitedTieredStorage(path, cache.memoryTier, cache.openFiles)
+	}
+	return newFileStorage(path, cache.config.MmapMinSize, cache.openFiles)
+}
+
+// newOpenFileLimit uses max_open_files or, if it is not set, the default derived from the limit of the process
+func newOpenFileLimit(config *Config) *storage.OpenFileLimit {
+	max := config.MaxOpenFiles
+	if max == 0 {
+		max = storage.DefaultOpenFileLimit()
+	}
+	if max <= 0 {
+		return nil
+	}
+	return storage.NewOpenFileLimit(max)
+}
+
+// GetStale returns a public entry that is no longer fresh
+// but expired less than maxStale ago. Like in Get, the entry must be released
+func (cache *HTTPCache) GetStale(request *http.Request, maxStale time.Duration) (*HTTPCacheEntry, bool) {
+	return cache.getExpired(request, func(entry *HTTPCacheEntry) bool {
+		return entry.StaleWithin(maxStale)
+	})
+}
+
+// GetInGrace returns a public entry that expired but is still within its grace. Like in Get, the entry must be released
+func (cache *HTTPCache) GetInGrace(request *http.Request) (*HTTPCacheEntry, bool) {
+	return cache.getExpired(request, (*HTTPCacheEntry).InGrace)
+}
+
+// getExpired returns the first public entry of the request that is usable as the function says
+func (cache *HTTPCache) getExpired(request *http.Request, usable func(*HTTPCacheEntry) bool) (*HTTPCacheEntry, bool) {
+	if cache.config.NullStorage {
+		return nil, false
+	}
+
+	key := getKey(cache.config, request)
+	b := cache.getBucketIndexForKey(key)
+	cache.entriesLock[b].RLock()
+
+	var stale *HTTPCacheEntry
+	for _, entry := range cache.entries[b][key] {
+		if entry.isPublic && usable(entry) && cache.withinMaxStaleAge(entry) && servesMethod(request.Method, entry) && matchesVary(request, entry, cache.config) &&
+			matchesEncoding(request, entry, cache.config) {
+			stale = entry
+			stale.acquire()
+			break
+		}
+	}
+	cache.entriesLock[b].RUnlock()
+
+	if stale == nil {
+		return nil, false
+	}
+	if cache.discardIncomplete(stale) {
+		stale.release()
+		return nil, false
+	}
+	return stale, true
+}
+
+// withinMaxStaleAge returns if the entry expired less than max_stale_age ago, any stale entry is usable without it
+func (cache *HTTPCache) withinMaxStaleAge(entry *HTTPCacheEntry) bool {
+	return cache.config.MaxStaleAge <= 0 || entry.expiration.Add(cache.config.MaxStaleAge).After(now())
+}
+
+// GetVariants returns every entry saved with the given key, no matter its Vary
+func (cache *HTTPCache) GetVariants(key string) []*HTTPCacheEntry {
+	b := cache.getBucketIndexForKey(key)
+	cache.entriesLock[b].RLock()
+	defer cache.entriesLock[b].RUnlock()
+
+	return append([]*HTTPCacheEntry{}, cache.entries[b][key]...)
+}
+
 func (cache *HTTPCache) Put(request *http.Request, entry *HTTPCacheEntry) {
+	if cache.config.NullStorage {
+		return
+	}
+
+	// Private entries have no body so they don't count for the quotas
+	if cache.putEntry(entry) && entry.isPublic {
+		cache.events.emit(EventStore, entry.Key())
+		cache.trackEntry(entry)
+	}
+}
+
+// putAlias saves the entry under the key of another request too. The alias uses the body of the entry,
+// which is kept until both are removed. It doesn't count for the quotas, the entry already does
+func (cache *HTTPCache) putAlias(request *http.Request, entry *HTTPCacheEntry, key string) {
+	if cache.config.NullStorage {
+		return
+	}
+
+	entry.acquire()
+	cache.putEntry(&HTTPCacheEntry{
+		isPublic:         entry.isPublic,
+		expiration:       entry.expiration,
+		hardExpiration:   entry.hardExpiration,
+		storedAt:         entry.storedAt,
+		lastUsed:         time.Now().UnixNano(),
+		key:              key,
+		reason:           entry.reason,
+		fetchStart:       entry.fetchStart,
+		alwaysRevalidate: entry.alwaysRevalidate,
+		compressed:       entry.compressed,
+		firstByteAt:      entry.firstByteAt,
+		refsLock:         new(sync.Mutex),
+		aliasOf:          entry,
+		Request:          request,
+		Response:         entry.Response,
+	})
+}
+
+// putEntry saves the entry and returns false if it was fetched before a purge of its key, then it is removed
+func (cache *HTTPCache) putEntry(entry *HTTPCacheEntry) bool {
 	key := entry.Key()
 	bucket := cache.getBucketIndexForKey(key)
 
 	cache.entriesLock[bucket].Lock()
 	defer cache.entriesLock[bucket].Unlock()
 
+	// It could have what was purged, it is sent to the requests that are using it but not saved
+	if cache.tombstones.buried(key, entry.fetchStart) {
+		go entry.Clean()
+		return false
+	}
+
 	cache.scheduleCleanEntry(entry)
+	cache.removeOutdatedVariantsLocked(bucket, key, entry)
 
 	for i, previousEntry := range cache.entries[bucket][key] {
-		if matchesVary(entry.Request, previousEntry) {
+		if previousEntry.Request.Method == entry.Request.Method && matchesVary(entry.Request, previousEntry, cache.config) {
+			cache.hosts.remove(previousEntry)
 			go previousEntry.Clean()
 			cache.entries[bucket][key][i] = entry
-			return
+			return true
 		}
 	}
 
+	if cache.config.MaxVariants > 0 && len(cache.entries[bucket][key]) >= cache.config.MaxVariants {
+		cache.evictVariantLocked(bucket, key)
+	}
 	cache.entries[bucket][key] = append(cache.entries[bucket][key], entry)
+	return true
+}
+
+// removeOutdatedVariantsLocked removes the variants of the key saved with a different Vary than the new entry.
+// RFC 7234 section 4.1 says the Vary of the most recent response is the one that tells apart the variants,
+// the older ones would be matched comparing headers that upstream no longer uses. Variants of other methods that share
+// the key are kept. The bucket must be locked
+func (cache *HTTPCache) removeOutdatedVariantsLocked(bucket uint32, key string, entry *HTTPCacheEntry) {
+	variants := cache.entries[bucket][key]
+	kept := make([]*HTTPCacheEntry, 0, len(variants))
+	for _, variant := range variants {
+		if variant.Request.Method != entry.Request.Method || sameVary(variant.Response.HeaderMap, entry.Response.HeaderMap) {
+			kept = append(kept, variant)
+			continue
+		}
+		cache.hosts.remove(variant)
+		go variant.Clean()
+	}
+	cache.entries[bucket][key] = kept
+}
+
+// evictVariantLocked removes the variant of the key that the eviction policy picks, the bucket must be locked
+func (cache *HTTPCache) evictVariantLocked(bucket uint32, key string) {
+	variants := cache.entries[bucket][key]
+	eviction := evictionName(cache.config)
+	oldest := 0
+	for i, variant := range variants {
+		if evictsBefore(eviction, variant, variants[oldest]) {
+			oldest = i
+		}
+	}
+
+	evicted := variants[oldest]
+	cache.entries[bucket][key] = append(variants[:oldest], variants[oldest+1:]...)
+	cache.hosts.remove(evicted)
+	go evicted.Clean()
+	cache.counters.addEvicted(1)
+	cache.events.emit(EventEvict, key)
+}
+
+// trackEntry adds the entry to the usage of its host and evicts entries of that host,
+// as the eviction policy says, if it goes over the quota. The size is only known when the body is saved
+func (cache *HTTPCache) trackEntry(entry *HTTPCacheEntry) {
+	cache.hosts.add(entry)
+	cache.enforceQuota(entry)
+
+	go func() {
+		entry.Response.WaitClose()
+		if cache.discardIncomplete(entry) {
+			return
+		}
+		cache.hosts.setSize(entry, entry.Response.Size())
+		cache.enforceQuota(entry)
+	}()
+}
+
+// enforceQuota evicts entries of the host of the saved entry while it is over its quota
+func (cache *HTTPCache) enforceQuota(saved *HTTPCacheEntry) {
+	for _, entry := range cache.hosts.overQuota(hostOf(saved.Request), cache.config.PerHostMaxEntries, cache.config.PerHostMaxSize, saved) {
+		if cache.cleanEntry(entry) {
+			cache.counters.addEvicted(1)
+			cache.events.emit(EventEvict, entry.Key())
+		}
+	}
+}
+
+// discardIncomplete removes the entry if its fetch was aborted, if write_timeout abandoned its body or if the body
+// doesn't have the length upstream announced
+func (cache *HTTPCache) discardIncomplete(entry *HTTPCacheEntry) bool {
+	if entry.Response.Aborted() {
+		if cache.cleanEntry(entry) {
+			log.Printf("[WARNING] cache: Discarding %s, its fetch was aborted after %d bytes", entry.Key(), entry.Response.Size())
+		}
+		return true
+	}
+
+	if entry.isWriteAbandoned() {
+		if cache.cleanEntry(entry) {
+			log.Printf("[WARNING] cache: Discarding %s, writing its body took more than write_timeout", entry.Key())
+		}
+		return true
+	}
+
+	if !entry.hasWrongLength() {
+		return false
+	}
+
+	// Get and the check done once the body is saved can find it at the same time
+	if cache.cleanEntry(entry) {
+		log.Printf("[WARNING] cache: Discarding %s, its body has %d bytes but its Content-Length is %s",
+			entry.Key(), entry.Response.Size(), entry.Response.snapHeader.Get("Content-Length"))
+	}
+	return true
+}
+
+// HostsUsage returns how many entries and bytes each host has
+func (cache *HTTPCache) HostsUsage() map[string]HostUsage {
+	return cache.hosts.usage()
+}
+
+// Purge removes every variant saved with the key and returns how many were removed
+func (cache *HTTPCache) Purge(key string) int {
+	cache.tombstones.addKey(key)
+	bucket := cache.getBucketIndexForKey(key)
+
+	cache.entriesLock[bucket].Lock()
+	defer cache.entriesLock[bucket].Unlock()
+
+	entries := cache.entries[bucket][key]
+	delete(cache.entries[bucket], key)
+
+	for _, entry := range entries {
+		cache.hosts.remove(entry)
+		go entry.Clean()
+	}
+
+	if len(entries) > 0 {
+		cache.events.emit(EventPurge, key)
+	}
+
+	purged := len(entries) + cache.purgeSegmented(func(segmentedKey string) bool { return segmentedKey == key })
+	cache.counters.addPurged(purged)
+	return purged
+}
+
+// PurgeKeyPrefix removes the entries of the key and of the keys made adding the key headers
+// or the device class to it, and returns how many were removed
+func (cache *HTTPCache) PurgeKeyPrefix(key string) int {
+	return cache.PurgeMatching(func(candidate string) bool {
+		return candidate == key || strings.HasPrefix(candidate, key+" ")
+	})
+}
+
+// Flush removes every entry and returns how many were removed
+func (cache *HTTPCache) Flush() int {
+	return cache.PurgeMatching(func(key string) bool { return true })
+}
+
+// PurgeMatching removes the entries of every key that matches and returns how many were removed
+func (cache *HTTPCache) PurgeMatching(matches func(key string) bool) int {
+	cache.tombstones.addMatching(matches)
+	purged := 0
+
+	for bucket := range cache.entries {
+		cache.entriesLock[bucket].Lock()
+		for key, entries := range cache.entries[bucket] {
+			if !matches(key) {
+				continue
+			}
+			for _, entry := range entries {
+				cache.hosts.remove(entry)
+				go entry.Clean()
+			}
+			purged += len(entries)
+			delete(cache.entries[bucket], key)
+			cache.events.emit(EventPurge, key)
+		}
+		cache.entriesLock[bucket].Unlock()
+	}
+
+	purged += cache.purgeSegmented(matches)
+	cache.counters.addPurged(purged)
+	return purged
 }
 
 func (cache *HTTPCache) scheduleCleanEntry(entry *HTTPCacheEntry) {
+	cleanAt := entry.expiration
+
+	// Public entries are kept after they expire so they can still be served if upstream fails.
+	// The ones with validators are kept too, they are revalidated instead of fetched again
+	if entry.isPublic && (cache.config.ServeStaleOnError || hasValidators(entry.Response.snapHeader)) {
+		cleanAt = cleanAt.Add(cache.config.MaxStale)
+	}
+	if entry.hardExpiration.After(cleanAt) {
+		cleanAt = entry.hardExpiration
+	}
+	// Past max_stale_age the entry is never used again
+	if maxStaleAt := entry.expiration.Add(cache.config.MaxStaleAge); cache.config.MaxStaleAge > 0 && maxStaleAt.Before(cleanAt) {
+		cleanAt = maxStaleAt
+	}
+
 	go func(entry *HTTPCacheEntry) {
-		time.Sleep(entry.expiration.Sub(time.Now().UTC()))
+		time.Sleep(cleanAt.Sub(time.Now().UTC()))
 		cache.cleanEntry(entry)
 	}(entry)
 }
 
-func (cache *HTTPCache) cleanEntry(entry *HTTPCacheEntry) {
+// cleanEntry removes the entry and returns false if it was already removed
+func (cache *HTTPCache) cleanEntry(entry *HTTPCacheEntry) bool {
 	key := entry.Key()
 	bucket := cache.getBucketIndexForKey(key)
 
@@ -90,10 +510,12 @@ func (cache *HTTPCache) cleanEntry(entry *HTTPCacheEntry) {
 	for i, otherEntry := range cache.entries[bucket][key] {
 		if entry == otherEntry {
 			cache.entries[bucket][key] = append(cache.entries[bucket][key][:i], cache.entries[bucket][key][i+1:]...)
+			cache.hosts.remove(entry)
 			entry.Clean()
-			return
+			return true
 		}
 	}
+	return false
 }
 
 func (cache *HTTPCache) getBucketIndexForKey(key string) uint32 {
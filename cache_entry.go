@@ -3,6 +3,8 @@ package cache
 import (
 	"io"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/nicolasazrak/caddy-cache/storage"
@@ -10,10 +12,47 @@ import (
 
 // HTTPCacheEntry saves the request response of an http request
 type HTTPCacheEntry struct {
+	lastUsed int64 // unix nanoseconds of the last time it was found, first to be 64 bit aligned for atomic access
+	uses     int64 // times it was found, only accessed atomically
+
 	isPublic   bool
 	expiration time.Time
+	storedAt   time.Time
 	key        string
 
+	// hardExpiration is when the entry can't be served anymore. With grace it is later than the expiration
+	// and the entry is served stale between both while it is revalidated, otherwise they are the same
+	hardExpiration time.Time
+
+	// reason explains why the response is or isn't public
+	reason string
+
+	// alwaysRevalidate is set for no-cache responses, upstream must confirm they did not change before each use
+	alwaysRevalidate bool
+
+	// compressed is set when the body was compressed by the cache before saving it
+	compressed bool
+
+	// When the upstream request started and when its headers arrived.
+	// They are zero for entries that were not fetched
+	fetchStart  time.Time
+	firstByteAt time.Time
+
+	// refs counts the requests that are serving the entry.
+	// The body of a removed entry is only cleaned once none of them is using it
+	refsLock *sync.Mutex
+	refs     int
+	removed  bool
+
+	// writeAbandoned is 1 once write_timeout stopped saving the body, only accessed atomically
+	writeAbandoned int32
+
+	// offload is set when the body is also uploaded to the offloader of its storage backend
+	offload *storage.OffloadStorage
+
+	// aliasOf is the entry whose body is used when this one was saved under its Content-Location
+	aliasOf *HTTPCacheEntry
+
 	Request  *http.Request
 	Response *Response
 }
@@ -21,36 +60,134 @@ type HTTPCacheEntry struct {
 // NewHTTPCacheEntry creates a new HTTPCacheEntry for the given request and response
 // and it also calculates if the response is public
 func NewHTTPCacheEntry(key string, request *http.Request, response *Response, config *Config) *HTTPCacheEntry {
-	isPublic, expiration := getCacheableStatus(request, response, config)
+	isPublic, expiration, reason := getCacheability(request, response, config)
+
+	// The ttl header overrides Cache-Control, no-cache included
+	overridden := config.TTLHeader != "" && response.snapHeader.Get(config.TTLHeader) != ""
+	alwaysRevalidate := isPublic && !overridden && requiresRevalidation(response.snapHeader)
+
+	// The ttl header is meant only for the cache, it is not sent to the client
+	if config.TTLHeader != "" {
+		response.DelHeader(config.TTLHeader)
+	}
+
+	// The status sent is the one the cache sets, not one that upstream set or echoed
+	if config.StatusHeader != "" {
+		response.DelHeader(config.StatusHeader)
+	}
+
+	// Headers that the operator doesn't want to replay from the cache, private responses still get them
+	if isPublic {
+		for _, name := range config.StripHeaders {
+			response.DelHeader(name)
+		}
+	}
+
+	entry := &HTTPCacheEntry{
+		key:              key,
+		isPublic:         isPublic,
+		expiration:       expiration,
+		hardExpiration:   expiration,
+		reason:           reason,
+		alwaysRevalidate: alwaysRevalidate,
+		storedAt:         now(),
+		lastUsed:         time.Now().UnixNano(),
+		refsLock:         new(sync.Mutex),
+		Request:          request,
+		Response:         response,
+	}
 
-	return &HTTPCacheEntry{
-		key:        key,
-		isPublic:   isPublic,
-		expiration: expiration,
-		Request:    request,
-		Response:   response,
+	// Responses that must be revalidated once they expire get no grace
+	if isPublic && config.Grace > 0 && canServeStale(entry) {
+		entry.hardExpiration = expiration.Add(config.Grace)
 	}
+	return entry
 }
 
 func (e *HTTPCacheEntry) Key() string {
 	return e.key
 }
 
-// Clean removes the response if it has an associated file
+// Clean removes the response if it has an associated file.
+// If the entry is being served it is removed when the last request releases it
 func (e *HTTPCacheEntry) Clean() error {
+	e.refsLock.Lock()
+	alreadyRemoved := e.removed
+	e.removed = true
+	inUse := e.refs > 0
+	e.refsLock.Unlock()
+
+	if inUse || alreadyRemoved {
+		return nil
+	}
+	return e.cleanBody()
+}
+
+// cleanBody removes the body, an alias only releases the entry that owns it
+func (e *HTTPCacheEntry) cleanBody() error {
+	if e.aliasOf != nil {
+		e.aliasOf.release()
+		return nil
+	}
 	return e.Response.Clean()
 }
 
+// acquire keeps the body of the entry until release is called
+func (e *HTTPCacheEntry) acquire() {
+	e.refsLock.Lock()
+	e.refs++
+	e.refsLock.Unlock()
+}
+
+// release ends a use of the entry and cleans it if it was removed meanwhile.
+// It does nothing with a nil entry so lookups that found nothing can be released too
+func (e *HTTPCacheEntry) release() {
+	if e == nil {
+		return
+	}
+
+	e.refsLock.Lock()
+	e.refs--
+	clean := e.refs == 0 && e.removed
+	e.refsLock.Unlock()
+
+	if clean {
+		e.cleanBody()
+	}
+}
+
 func (e *HTTPCacheEntry) writePublicResponse(w http.ResponseWriter) error {
 	reader, err := e.Response.body.GetReader()
 	if err != nil {
 		return err
 	}
 	defer reader.Close()
-	_, err = io.Copy(w, reader)
+
+	// While upstream still sends the body each part is flushed as it arrives, so the client does not wait
+	// for the buffer of the connection to fill. The client reads on its own, a slow one doesn't delay the cache
+	var dst io.Writer = w
+	if flusher, ok := w.(http.Flusher); ok && !e.Response.IsClosed() {
+		dst = &flushWriter{w: w, flusher: flusher}
+	}
+	_, err = io.Copy(dst, reader)
 	return err
 }
 
+// flushWriter flushes every write to the client
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	f.flusher.Flush()
+	return n, nil
+}
+
 func (e *HTTPCacheEntry) writePrivateResponse(w http.ResponseWriter) error {
 	e.Response.SetBody(storage.WrapResponseWriter(w))
 	e.Response.WaitClose()
@@ -59,22 +196,115 @@ func (e *HTTPCacheEntry) writePrivateResponse(w http.ResponseWriter) error {
 
 // WriteBodyTo sends the body to the http.ResponseWritter
 func (e *HTTPCacheEntry) WriteBodyTo(w http.ResponseWriter) error {
+	// Private entries that were buffered already have their body
+	if _, buffered := e.Response.body.(*storage.ThresholdStorage); buffered {
+		return e.writePublicResponse(w)
+	}
+
 	if !e.isPublic {
 		return e.writePrivateResponse(w)
 	}
 	return e.writePublicResponse(w)
 }
 
-func (e *HTTPCacheEntry) setStorage(config *Config) error {
-	storage, err := storage.NewFileStorage(config.Path)
+func (e *HTTPCacheEntry) setStorage(cache *HTTPCache) error {
+	// Nothing is saved so the body is sent like the private ones
+	if cache.config.NullStorage {
+		e.isPublic = false
+		e.reason = "null storage"
+		return nil
+	}
+
+	// Without a known size the body is buffered until it is known if it reaches min_body_size
+	if cache.config.MinBodySize > 0 && e.Response.snapHeader.Get("Content-Length") == "" {
+		return e.setBufferedStorage(cache)
+	}
+
+	body, err := cache.newStorage(e.Request)
+
+	// A body compressed by the cache can't be downloaded from the store without its headers
+	compress := err == nil && shouldCompress(e, cache.config)
+	if err == nil && !compress {
+		body = cache.withOffload(e, body)
+	}
+	body = cache.withWriteTimeout(e, body)
+
+	// The headers are changed before the body is set, until then upstream waits and doesn't read them
+	if compress {
+		e.compressOnStore()
+		body = storage.NewGzipStorage(body)
+	}
 
 	// Set the storage even if it is nil to continue and stop the upstream request
-	e.Response.SetBody(storage)
+	e.Response.SetBody(body)
 
 	return err
 }
 
+// setBufferedStorage makes the entry private if the whole body is smaller than min_body_size.
+// Its body stays in memory so it can still be sent but it is never served from cache
+func (e *HTTPCacheEntry) setBufferedStorage(cache *HTTPCache) error {
+	buffer := storage.NewThresholdStorage(cache.config.MinBodySize)
+	e.Response.SetBody(buffer)
+
+	if !buffer.Reached() {
+		e.isPublic = false
+		e.expiration = now().Add(cache.config.LockTimeout)
+		e.reason = "body smaller than min_body_size"
+		return nil
+	}
+
+	storage, err := cache.newStorage(e.Request)
+	if err != nil {
+		return err
+	}
+	return buffer.Commit(cache.withWriteTimeout(e, storage))
+}
+
+// hasWrongLength returns if the body is complete and its size is not the Content-Length upstream sent,
+// like when upstream closed the connection before sending all of it. Serving it would break the client connection
+func (e *HTTPCacheEntry) hasWrongLength() bool {
+	if !e.hasCompleteBody() {
+		return false
+	}
+
+	length, err := strconv.ParseInt(e.Response.snapHeader.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return false
+	}
+	return length != e.Response.Size()
+}
+
+// knownLength returns the size of a complete body that upstream sent without Content-Length.
+// The size of a body compressed by the cache is not known, only the one upstream sent is counted.
+// HTTP/1.0 clients can't get chunked bodies, with the length the connection doesn't have to be closed after the body.
+// Bodies with trailers are still sent chunked, otherwise the trailers would be lost
+func (e *HTTPCacheEntry) knownLength() (int64, bool) {
+	header := e.Response.snapHeader
+	if !e.hasCompleteBody() || e.compressed || header.Get("Content-Length") != "" || header.Get("Trailer") != "" || len(e.Response.Trailer()) > 0 {
+		return 0, false
+	}
+	return e.Response.Size(), true
+}
+
+// hasCompleteBody returns if the entry is public, its body was completely saved and the response can have a body
+func (e *HTTPCacheEntry) hasCompleteBody() bool {
+	code := e.Response.Code
+	return e.isPublic && e.Response.IsClosed() && e.Request.Method != http.MethodHead &&
+		code != http.StatusNoContent && code != http.StatusNotModified
+}
+
 // Fresh returns if the entry is still fresh
 func (e *HTTPCacheEntry) Fresh() bool {
-	return e.expiration.After(time.Now())
+	return e.expiration.After(now())
+}
+
+// InGrace returns if the entry expired but it can still be served while it is revalidated
+func (e *HTTPCacheEntry) InGrace() bool {
+	return !e.Fresh() && e.hardExpiration.After(now())
+}
+
+// StaleWithin returns if the entry is expired but by less than maxStale
+func (e *HTTPCacheEntry) StaleWithin(maxStale time.Duration) bool {
+	return !e.Fresh() && e.expiration.Add(maxStale).After(now())
 }
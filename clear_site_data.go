@@ -0,0 +1,83 @@
+package cache
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	clearSiteDataURL       = "url"
+	clearSiteDataDirectory = "directory"
+	clearSiteDataHost      = "host"
+)
+
+// clearsCache returns if a Clear-Site-Data header asks to clear the cache, with the "cache" or the "*" type
+func clearsCache(header http.Header) bool {
+	for _, value := range header["Clear-Site-Data"] {
+		for _, dataType := range strings.Split(value, ",") {
+			dataType = strings.TrimSpace(dataType)
+			if dataType == `"cache"` || dataType == `"*"` {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// clearSiteDataScope returns if a cached request is in the scope cleared by the response to r.
+// It is always the same host, and the same path, the paths in its directory or any path depending on the scope
+func clearSiteDataScope(r *http.Request, scope string) func(*http.Request) bool {
+	path := originalURL(r).Path
+	if scope == clearSiteDataDirectory {
+		path = path[:strings.LastIndex(path, "/")+1]
+	}
+
+	return func(cached *http.Request) bool {
+		if !strings.EqualFold(cached.Host, r.Host) {
+			return false
+		}
+		cachedPath := originalURL(cached).Path
+		switch scope {
+		case clearSiteDataHost:
+			return true
+		case clearSiteDataDirectory:
+			return strings.HasPrefix(cachedPath, path)
+		}
+		return cachedPath == path
+	}
+}
+
+// keysOfRequests returns the keys that have an entry saved for a request that matches
+func (cache *HTTPCache) keysOfRequests(matches func(*http.Request) bool) []string {
+	keys := []string{}
+	for bucket := range cache.entries {
+		cache.entriesLock[bucket].RLock()
+		for key, entries := range cache.entries[bucket] {
+			for _, entry := range entries {
+				if entry.Request != nil && matches(entry.Request) {
+					keys = append(keys, key)
+					break
+				}
+			}
+		}
+		cache.entriesLock[bucket].RUnlock()
+	}
+	return keys
+}
+
+// clearSiteData purges the entries in the scope of honor_clear_site_data when the response
+// to r has a Clear-Site-Data header with the cache type. It returns how many were removed
+func (handler *Handler) clearSiteData(r *http.Request, header http.Header) int {
+	if handler.Config.ClearSiteData == "" || !clearsCache(header) {
+		return 0
+	}
+
+	purged := 0
+	for _, key := range handler.Cache.keysOfRequests(clearSiteDataScope(r, handler.Config.ClearSiteData)) {
+		purged += handler.Cache.Purge(key)
+		handler.Purger.PurgedKey(key)
+	}
+	log.Printf("[INFO] cache: Clear-Site-Data of %s purged %d entries", r.URL, purged)
+	return purged
+}
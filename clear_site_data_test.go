@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClearsCache(t *testing.T) {
+	t.Run("it should clear the cache with the cache or the wildcard type", func(t *testing.T) {
+		require.True(t, clearsCache(makeHeader("Clear-Site-Data", `"cache"`)))
+		require.True(t, clearsCache(makeHeader("Clear-Site-Data", `"cookies", "cache"`)))
+		require.True(t, clearsCache(makeHeader("Clear-Site-Data", `"*"`)))
+	})
+
+	t.Run("it should not clear the cache with other types", func(t *testing.T) {
+		require.False(t, clearsCache(makeHeader("Clear-Site-Data", `"cookies", "storage"`)))
+		require.False(t, clearsCache(makeHeader("Clear-Site-Data", `cache`)))
+		require.False(t, clearsCache(http.Header{}))
+	})
+}
+
+func TestHonorClearSiteData(t *testing.T) {
+	newClearingHandler := func(scope string) *Handler {
+		config := emptyConfig()
+		config.ClearSiteData = scope
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			if strings.HasSuffix(r.URL.Path, "/logout") {
+				w.Header().Set("Clear-Site-Data", `"cache", "cookies"`)
+				return 200, nil
+			}
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte("abc"))
+			return 200, nil
+		}), config)
+	}
+
+	serve := func(h *Handler, method string, url string) *http.Response {
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, method, url))
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	cached := []string{"http://example.com/app/a", "http://example.com/app/b/c", "http://example.com/other", "http://other.com/app/a"}
+	fill := func(h *Handler) {
+		for _, url := range cached {
+			serve(h, "GET", url)
+		}
+	}
+
+	t.Run("it should purge the directory of the request in the same host", func(t *testing.T) {
+		h := newClearingHandler(clearSiteDataDirectory)
+		fill(h)
+		serve(h, "GET", "http://example.com/app/logout")
+
+		requireStatus(t, serve(h, "GET", "http://example.com/app/a"), cacheMiss)
+		requireStatus(t, serve(h, "GET", "http://example.com/app/b/c"), cacheMiss)
+		requireStatus(t, serve(h, "GET", "http://example.com/other"), cacheHit)
+		requireStatus(t, serve(h, "GET", "http://other.com/app/a"), cacheHit)
+	})
+
+	t.Run("it should purge the whole host", func(t *testing.T) {
+		h := newClearingHandler(clearSiteDataHost)
+		fill(h)
+		serve(h, "POST", "http://example.com/app/logout")
+
+		requireStatus(t, serve(h, "GET", "http://example.com/other"), cacheMiss)
+		requireStatus(t, serve(h, "GET", "http://other.com/app/a"), cacheHit)
+	})
+
+	t.Run("it should only purge the url", func(t *testing.T) {
+		h := newClearingHandler(clearSiteDataURL)
+		fill(h)
+		serve(h, "GET", "http://example.com/app/logout")
+
+		requireStatus(t, serve(h, "GET", "http://example.com/app/a"), cacheHit)
+	})
+
+	t.Run("it should ignore the header without honor_clear_site_data", func(t *testing.T) {
+		h := newClearingHandler("")
+		fill(h)
+		serve(h, "GET", "http://example.com/app/logout")
+
+		requireStatus(t, serve(h, "GET", "http://example.com/app/a"), cacheHit)
+	})
+}
@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+// defaultIncompressibleTypes are already compressed, gzip would cost CPU without making them smaller.
+// Types that end with a slash match every subtype
+var defaultIncompressibleTypes = []string{
+	"image/", "video/", "audio/", "font/woff", "font/woff2",
+	"application/zip", "application/gzip", "application/x-gzip", "application/x-bzip2", "application/x-xz",
+	"application/zstd", "application/x-7z-compressed", "application/x-rar-compressed", "application/pdf",
+}
+
+// defaultCompressibleTypes are text even if their type says otherwise
+var defaultCompressibleTypes = []string{"image/svg+xml"}
+
+func matchesMediaType(mediaType string, types []string) bool {
+	for _, candidate := range types {
+		if mediaType == candidate || strings.HasSuffix(candidate, "/") && strings.HasPrefix(mediaType, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// isCompressibleType returns if a body of the Content-Type gets smaller with gzip.
+// The configured types win over the default ones, and the allowed over the denied
+func isCompressibleType(contentType string, config *Config) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	switch {
+	case mediaType == "":
+		return false
+	case matchesMediaType(mediaType, config.CompressAllow):
+		return true
+	case matchesMediaType(mediaType, config.CompressDeny):
+		return false
+	case matchesMediaType(mediaType, defaultCompressibleTypes):
+		return true
+	}
+	return !matchesMediaType(mediaType, defaultIncompressibleTypes)
+}
+
+// shouldCompress returns if the body of the entry is compressed before it is saved.
+// Bodies that upstream already encoded or that must not be transformed are saved as they are
+func shouldCompress(e *HTTPCacheEntry, config *Config) bool {
+	if !config.CompressStore || !e.isPublic || e.Request.Method != http.MethodGet {
+		return false
+	}
+
+	header := e.Response.snapHeader
+	if encoding := header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return false
+	}
+	if code := e.Response.Code; code == http.StatusNoContent || code == http.StatusNotModified {
+		return false
+	}
+
+	directives, err := cacheobject.ParseResponseCacheControl(header.Get("Cache-Control"))
+	if err != nil || directives.NoTransform {
+		return false
+	}
+	return isCompressibleType(header.Get("Content-Type"), config)
+}
+
+// compressOnStore changes the headers of the entry for the compressed body it is going to have.
+// The size of the body is unknown until it is compressed, and it is not the same representation
+// that upstream tagged so the ETag is weak
+func (e *HTTPCacheEntry) compressOnStore() {
+	e.compressed = true
+	e.Response.DelHeader("Content-Length")
+	e.Response.SetHeader("Content-Encoding", "gzip")
+	weakenETag(e.Response)
+}
+
+func weakenETag(response *Response) {
+	if etag := response.snapHeader.Get("Etag"); etag != "" && !isWeakETag(etag) {
+		response.SetHeader("Etag", "W/"+etag)
+	}
+}
+
+// addVaryAcceptEncoding tells other caches that the body of the response depends on the Accept-Encoding,
+// clients that don't accept gzip get it decompressed
+func addVaryAcceptEncoding(header http.Header) {
+	for _, name := range getHeaderValues(header, "Vary") {
+		if name == "*" || strings.EqualFold(name, "Accept-Encoding") {
+			return
+		}
+	}
+	header.Add("Vary", "Accept-Encoding")
+}
@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsCompressibleType(t *testing.T) {
+	config := emptyConfig()
+	config.CompressAllow = []string{"video/mp2t"}
+	config.CompressDeny = []string{"application/x-protobuf", "text/event-stream"}
+
+	for contentType, expected := range map[string]bool{
+		"":                         false,
+		"text/html":                true,
+		"text/html; charset=utf-8": true,
+		"Application/JSON":         true,
+		"image/jpeg":               false,
+		"image/svg+xml":            true,
+		"video/mp4":                false,
+		"video/mp2t":               true,
+		"application/zip":          false,
+		"font/woff2":               false,
+		"application/x-protobuf":   false,
+		"text/event-stream":        false,
+	} {
+		require.Equal(t, expected, isCompressibleType(contentType, config), contentType)
+	}
+}
+
+func TestCompressStore(t *testing.T) {
+	content := bytes.Repeat([]byte("compressible content "), 100)
+
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Header().Set("Etag", `"v1"`)
+		switch r.URL.Path {
+		case "/image.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+		case "/no-transform":
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Cache-Control", "max-age=10, no-transform")
+		default:
+			w.Header().Set("Content-Type", "text/html")
+		}
+		w.Write(content)
+		return 200, nil
+	})
+
+	serve := func(h *Handler, target string, encoding string) *http.Response {
+		r := newRequestWithOriginalURL(t, "GET", target)
+		if encoding != "" {
+			r.Header.Set("Accept-Encoding", encoding)
+		}
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	newCompressHandler := func() *Handler {
+		config := emptyConfig()
+		config.CompressStore = true
+		return NewHandler(upstream, config)
+	}
+
+	// storedSize is the size of the saved bytes, Size counts the ones upstream sent
+	storedSize := func(h *Handler, key string) int64 {
+		variants := h.Cache.GetVariants(key)
+		require.Len(t, variants, 1)
+		reader, err := variants[0].Response.body.GetReader()
+		require.NoError(t, err)
+		defer reader.Close()
+		body, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		return int64(len(body))
+	}
+
+	t.Run("it should save text bodies compressed", func(t *testing.T) {
+		h := newCompressHandler()
+
+		res := serve(h, "http://example.com/", "")
+		requireStatus(t, res, cacheMiss)
+		requireBody(t, res, content)
+		require.Less(t, storedSize(h, "GET example.com/?"), int64(len(content)))
+
+		res = serve(h, "http://example.com/", "gzip")
+		requireStatus(t, res, cacheHit)
+		require.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+		require.Equal(t, `W/"v1"`, res.Header.Get("Etag"))
+		require.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+		require.Empty(t, res.Header.Get("Content-Length"))
+
+		reader, err := gzip.NewReader(res.Body)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, content, body)
+
+		res = serve(h, "http://example.com/", "identity")
+		requireStatus(t, res, cacheHit)
+		require.Empty(t, res.Header.Get("Content-Encoding"))
+		requireBody(t, res, content)
+	})
+
+	t.Run("it should save images as they are", func(t *testing.T) {
+		h := newCompressHandler()
+
+		serve(h, "http://example.com/image.jpg", "gzip")
+		res := serve(h, "http://example.com/image.jpg", "gzip")
+		requireStatus(t, res, cacheHit)
+		require.Empty(t, res.Header.Get("Content-Encoding"))
+		require.Equal(t, `"v1"`, res.Header.Get("Etag"))
+		requireBody(t, res, content)
+		require.Equal(t, int64(len(content)), storedSize(h, "GET example.com/image.jpg?"))
+	})
+
+	t.Run("it should not compress no-transform responses", func(t *testing.T) {
+		h := newCompressHandler()
+
+		serve(h, "http://example.com/no-transform", "gzip")
+		res := serve(h, "http://example.com/no-transform", "gzip")
+		requireStatus(t, res, cacheHit)
+		require.Empty(t, res.Header.Get("Content-Encoding"))
+		requireBody(t, res, content)
+	})
+
+	t.Run("it should save bodies as they are by default", func(t *testing.T) {
+		h := NewHandler(upstream, emptyConfig())
+
+		serve(h, "http://example.com/", "gzip")
+		res := serve(h, "http://example.com/", "gzip")
+		requireStatus(t, res, cacheHit)
+		require.Empty(t, res.Header.Get("Content-Encoding"))
+		require.Equal(t, int64(len(content)), storedSize(h, "GET example.com/?"))
+	})
+}
@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+// contentLocationRequest returns the request of the url in the Content-Location of the response,
+// with the same headers as the original one. Only urls of the same host are accepted,
+// otherwise any upstream could replace what other sites have cached
+func contentLocationRequest(r *http.Request, header http.Header) (*http.Request, bool) {
+	req, ok := sameHostRequest(r, header.Get("Content-Location"))
+	if !ok {
+		return nil, false
+	}
+
+	// It is already saved under that url
+	if original := originalURL(r); req.URL.Path == original.Path && req.URL.RawQuery == original.RawQuery {
+		return nil, false
+	}
+	return req, true
+}
+
+// originalURL returns the url of the request before other middlewares rewrote it
+func originalURL(r *http.Request) url.URL {
+	if original, ok := r.Context().Value(httpserver.OriginalURLCtxKey).(url.URL); ok {
+		return original
+	}
+	return *r.URL
+}
+
+// sameHostRequest returns the request of an url, relative to the one of the request, with the same headers.
+// It fails if the url is of another host
+func sameHostRequest(r *http.Request, value string) (*http.Request, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, false
+	}
+
+	original := originalURL(r)
+	base := original
+	base.Host = r.Host
+	base.Scheme = "http"
+	if r.TLS != nil {
+		base.Scheme = "https"
+	}
+
+	location, err := base.Parse(value)
+	if err != nil || (location.Scheme != "http" && location.Scheme != "https") ||
+		location.User != nil || !strings.EqualFold(location.Host, r.Host) {
+		return nil, false
+	}
+
+	canonical := original
+	canonical.Path = location.Path
+	canonical.RawPath = location.RawPath
+	canonical.RawQuery = location.RawQuery
+
+	// Caddy placeholders read the path and query from the original url
+	req := r.WithContext(context.WithValue(r.Context(), httpserver.OriginalURLCtxKey, canonical))
+	req.URL = &url.URL{Path: location.Path, RawPath: location.RawPath, RawQuery: location.RawQuery}
+	req.RequestURI = req.URL.RequestURI()
+	return req, true
+}
+
+// saveContentLocation saves a new public entry under its Content-Location too.
+// A fresh entry that is already cached for that url is not replaced
+func (handler *Handler) saveContentLocation(r *http.Request, entry *HTTPCacheEntry) {
+	if !handler.Config.HonorContentLocation || !entry.isPublic || r.Method != http.MethodGet || entry.Response.Code != http.StatusOK {
+		return
+	}
+
+	canonical, ok := contentLocationRequest(r, entry.Response.snapHeader)
+	if !ok {
+		return
+	}
+
+	cached, exists := handler.Cache.Get(canonical)
+	cached.release()
+	if exists {
+		return
+	}
+
+	handler.Cache.putAlias(canonical, entry, getKey(handler.Config, canonical))
+}
@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentLocationRequest(t *testing.T) {
+	config := emptyConfig()
+	r := newRequestWithOriginalURL(t, "GET", "http://example.com/docs?lang=en")
+	r.Header.Set("Accept", "application/json")
+
+	t.Run("it should accept urls of the same host", func(t *testing.T) {
+		for _, location := range []string{"/docs.json", "docs.json", "http://example.com/docs.json", "https://EXAMPLE.com/docs.json"} {
+			canonical, ok := contentLocationRequest(r, http.Header{"Content-Location": {location}})
+			require.True(t, ok, location)
+			require.Equal(t, "GET example.com/docs.json?", getKey(config, canonical), location)
+			require.Equal(t, "application/json", canonical.Header.Get("Accept"))
+		}
+
+		canonical, ok := contentLocationRequest(r, http.Header{"Content-Location": {"/docs?lang=en&format=json"}})
+		require.True(t, ok)
+		require.Equal(t, "GET example.com/docs?lang=en&format=json", getKey(config, canonical))
+	})
+
+	t.Run("it should reject urls of other hosts", func(t *testing.T) {
+		for _, location := range []string{
+			"http://other.com/docs",
+			"//other.com/docs",
+			"http://example.com:8080/docs",
+			"http://user@example.com/docs",
+			"ftp://example.com/docs",
+			"http://[::1",
+		} {
+			_, ok := contentLocationRequest(r, http.Header{"Content-Location": {location}})
+			require.False(t, ok, location)
+		}
+	})
+
+	t.Run("it should ignore the url of the request", func(t *testing.T) {
+		for _, location := range []string{"", "/docs?lang=en", "http://example.com/docs?lang=en"} {
+			_, ok := contentLocationRequest(r, http.Header{"Content-Location": {location}})
+			require.False(t, ok, location)
+		}
+	})
+}
+
+func TestHonorContentLocation(t *testing.T) {
+	hits := 0
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits++
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Header().Set("Content-Location", r.URL.Query().Get("location"))
+		w.Write([]byte(r.URL.Path))
+		return 200, nil
+	})
+
+	serve := func(h *Handler, target string) *http.Response {
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", target))
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	t.Run("it should save the response under its Content-Location of the same host", func(t *testing.T) {
+		hits = 0
+		config := emptyConfig()
+		config.HonorContentLocation = true
+		h := NewHandler(upstream, config)
+
+		requireStatus(t, serve(h, "http://example.com/docs?location=/docs.json"), cacheMiss)
+		res := serve(h, "http://example.com/docs.json")
+		requireStatus(t, res, cacheHit)
+		requireBody(t, res, []byte("/docs"))
+		require.Equal(t, 1, hits)
+
+		// The body is kept while the alias is cached
+		require.Equal(t, 1, h.Cache.Purge("GET example.com/docs?location=/docs.json"))
+		requireBody(t, serve(h, "http://example.com/docs.json"), []byte("/docs"))
+	})
+
+	t.Run("it should not save the response under a Content-Location of other host", func(t *testing.T) {
+		hits = 0
+		config := emptyConfig()
+		config.HonorContentLocation = true
+		h := NewHandler(upstream, config)
+
+		requireStatus(t, serve(h, "http://example.com/docs?location=http://other.com/docs"), cacheMiss)
+		requireStatus(t, serve(h, "http://other.com/docs"), cacheMiss)
+		require.Equal(t, 2, hits)
+	})
+
+	t.Run("it should not replace what is cached for the Content-Location", func(t *testing.T) {
+		config := emptyConfig()
+		config.HonorContentLocation = true
+		h := NewHandler(upstream, config)
+
+		requireStatus(t, serve(h, "http://example.com/docs.json"), cacheMiss)
+		requireStatus(t, serve(h, "http://example.com/docs?location=/docs.json"), cacheMiss)
+		requireBody(t, serve(h, "http://example.com/docs.json"), []byte("/docs.json"))
+	})
+
+	t.Run("it should ignore Content-Location by default", func(t *testing.T) {
+		h := NewHandler(upstream, emptyConfig())
+
+		requireStatus(t, serve(h, "http://example.com/docs?location=/docs.json"), cacheMiss)
+		requireStatus(t, serve(h, "http://example.com/docs.json"), cacheMiss)
+	})
+}
@@ -0,0 +1,39 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const defaultDebugTTLHeader = "X-Cache-TTL"
+
+// addDebugTTLHeader sets the debug_ttl_header to how long the entry is fresh and how much of it is left.
+// Like bypass_query, if admin_allow is set only the requests from those ips get it
+func (handler *Handler) addDebugTTLHeader(w http.ResponseWriter, r *http.Request, entry *HTTPCacheEntry) {
+	if handler.Config.DebugTTLHeader == "" {
+		return
+	}
+	if len(handler.Config.AdminAllow) > 0 && !isAllowedIP(r.RemoteAddr, handler.Config.AdminAllow) {
+		return
+	}
+	w.Header().Set(handler.Config.DebugTTLHeader, debugTTL(entry))
+}
+
+// debugTTL formats the freshness lifetime and the remaining ttl in seconds, like max-age=3600; remaining=2840.
+// Entries that are not public have none
+func debugTTL(entry *HTTPCacheEntry) string {
+	var lifetime, remaining time.Duration
+	if entry.isPublic {
+		lifetime = entry.expiration.Sub(entry.storedAt)
+		remaining = entry.expiration.Sub(now())
+	}
+	return fmt.Sprintf("max-age=%d; remaining=%d", debugSeconds(lifetime), debugSeconds(remaining))
+}
+
+func debugSeconds(d time.Duration) int64 {
+	if d < 0 {
+		return 0
+	}
+	return int64(d.Round(time.Second) / time.Second)
+}
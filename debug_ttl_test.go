@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugTTLHeader(t *testing.T) {
+	originalNow := now
+	defer func() { now = originalNow }()
+
+	newHandler := func(config *Config) *Handler {
+		config.DebugTTLHeader = defaultDebugTTLHeader
+		config.DefaultMaxAge = time.Hour
+		config.CacheRules = []CacheRule{&PathCacheRule{Path: "/public"}}
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Write([]byte("abc"))
+			return 200, nil
+		}), config)
+	}
+
+	doRequestFromIP := func(h *Handler, target string, remoteAddr string) *http.Response {
+		w := httptest.NewRecorder()
+		r := newRequestWithOriginalURL(t, "GET", target)
+		r.RemoteAddr = remoteAddr
+		_, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	t.Run("it should send the default max age on a miss and what is left on a hit", func(t *testing.T) {
+		now = originalNow
+		h := newHandler(emptyConfig())
+
+		res := doRequestFromIP(h, "http://example.com/public", "1.2.3.4:80")
+		requireStatus(t, res, cacheMiss)
+		require.Equal(t, "max-age=3600; remaining=3600", res.Header.Get(defaultDebugTTLHeader))
+
+		now = func() time.Time { return originalNow().Add(10 * time.Minute) }
+		res = doRequestFromIP(h, "http://example.com/public", "1.2.3.4:80")
+		requireStatus(t, res, cacheHit)
+		require.Equal(t, "max-age=3600; remaining=3000", res.Header.Get(defaultDebugTTLHeader))
+	})
+
+	t.Run("it should send no ttl for the responses that are not cached", func(t *testing.T) {
+		now = originalNow
+		h := newHandler(emptyConfig())
+
+		res := doRequestFromIP(h, "http://example.com/private", "1.2.3.4:80")
+		require.Equal(t, "max-age=0; remaining=0", res.Header.Get(defaultDebugTTLHeader))
+	})
+
+	t.Run("it should only send it to the admin_allow ips if they are set", func(t *testing.T) {
+		now = originalNow
+		config := emptyConfig()
+		config.AdminAllow = []*net.IPNet{{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)}}
+		h := newHandler(config)
+
+		res := doRequestFromIP(h, "http://example.com/public", "1.2.3.4:80")
+		require.Empty(t, res.Header.Get(defaultDebugTTLHeader))
+
+		res = doRequestFromIP(h, "http://example.com/public", "10.1.2.3:80")
+		requireStatus(t, res, cacheHit)
+		require.Equal(t, "max-age=3600; remaining=3600", res.Header.Get(defaultDebugTTLHeader))
+	})
+}
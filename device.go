@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"errors"
+	"regexp"
+)
+
+const (
+	deviceMobile  = "mobile"
+	deviceTablet  = "tablet"
+	deviceDesktop = "desktop"
+)
+
+var deviceClasses = []string{deviceMobile, deviceTablet, deviceDesktop}
+
+type deviceRule struct {
+	class   string
+	pattern *regexp.Regexp
+}
+
+// DeviceClassifier puts requests in a small set of device classes from their User-Agent.
+// Rules are checked in order and requests that match none of them are desktop
+type DeviceClassifier struct {
+	rules []deviceRule
+}
+
+// NewDeviceClassifier creates the default classifier. iPads send "Mobile" so they
+// are checked before phones, and Android tablets are the Android devices without "Mobile"
+func NewDeviceClassifier() *DeviceClassifier {
+	return &DeviceClassifier{rules: []deviceRule{
+		{deviceTablet, regexp.MustCompile(`(?i)ipad|tablet|kindle|silk|playbook`)},
+		{deviceMobile, regexp.MustCompile(`(?i)mobi|iphone|ipod|blackberry|opera mini|windows phone`)},
+		{deviceTablet, regexp.MustCompile(`(?i)android`)},
+	}}
+}
+
+// Override replaces the rules of the class by the pattern, which is checked where the first rule of the class was
+func (classifier *DeviceClassifier) Override(class string, pattern string) error {
+	if class != deviceMobile && class != deviceTablet {
+		return errors.New("Invalid device class " + class)
+	}
+
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+
+	rules := []deviceRule{}
+	replaced := false
+	for _, rule := range classifier.rules {
+		if rule.class != class {
+			rules = append(rules, rule)
+		} else if !replaced {
+			rules = append(rules, deviceRule{class, compiled})
+			replaced = true
+		}
+	}
+	if !replaced {
+		rules = append(rules, deviceRule{class, compiled})
+	}
+	classifier.rules = rules
+	return nil
+}
+
+func (classifier *DeviceClassifier) classify(userAgent string) string {
+	for _, rule := range classifier.rules {
+		if rule.pattern.MatchString(userAgent) {
+			return rule.class
+		}
+	}
+	return deviceDesktop
+}
+
+func isDeviceClass(class string) bool {
+	for _, deviceClass := range deviceClasses {
+		if class == deviceClass {
+			return true
+		}
+	}
+	return false
+}
+
+// keyWithDevice adds the device class to the key
+func keyWithDevice(key string, class string) string {
+	return key + " device=" + class
+}
@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	iPhoneUserAgent        = "Mozilla/5.0 (iPhone; CPU iPhone OS 13_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.0 Mobile/15E148 Safari/604.1"
+	androidPhoneUserAgent  = "Mozilla/5.0 (Linux; Android 10; Pixel 3) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/78.0.3904.108 Mobile Safari/537.36"
+	iPadUserAgent          = "Mozilla/5.0 (iPad; CPU OS 12_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/12.1 Mobile/15E148 Safari/604.1"
+	androidTabletUserAgent = "Mozilla/5.0 (Linux; Android 9; SM-T510) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/78.0.3904.108 Safari/537.36"
+	desktopUserAgent       = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/78.0.3904.108 Safari/537.36"
+	windowsPhoneUserAgent  = "Mozilla/5.0 (Windows Phone 10.0; Android 6.0.1; Microsoft; Lumia 950) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/52.0.2743.116 Mobile Safari/537.36 Edge/15.14977"
+	kindleUserAgent        = "Mozilla/5.0 (Linux; U; Android 4.0.3; en-us; KFTT Build/IML74K) AppleWebKit/537.36 (KHTML, like Gecko) Silk/3.68 like Chrome/39.0.2171.93 Safari/537.36"
+	operaMiniUserAgent     = "Opera/9.80 (J2ME/MIDP; Opera Mini/9.80 (S60; SymbOS; Opera Mobi/23.348; U; en) Presto/2.5.25 Version/10.54"
+	curlUserAgent          = "curl/7.64.1"
+	lowerCaseUserAgent     = "mozilla/5.0 (iphone; cpu iphone os 13_2 like mac os x)"
+)
+
+func TestDeviceClassifier(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		class     string
+	}{
+		{iPhoneUserAgent, deviceMobile},
+		{androidPhoneUserAgent, deviceMobile},
+		{windowsPhoneUserAgent, deviceMobile},
+		{operaMiniUserAgent, deviceMobile},
+		{lowerCaseUserAgent, deviceMobile},
+		{iPadUserAgent, deviceTablet},
+		{androidTabletUserAgent, deviceTablet},
+		{kindleUserAgent, deviceTablet},
+		{desktopUserAgent, deviceDesktop},
+		{curlUserAgent, deviceDesktop},
+		{"", deviceDesktop},
+	}
+
+	classifier := NewDeviceClassifier()
+	for _, test := range tests {
+		require.Equal(t, test.class, classifier.classify(test.userAgent), test.userAgent)
+	}
+
+	t.Run("it should replace every rule of the class", func(t *testing.T) {
+		classifier := NewDeviceClassifier()
+		require.NoError(t, classifier.Override(deviceTablet, "(?i)ipad"))
+
+		require.Equal(t, deviceTablet, classifier.classify(iPadUserAgent))
+		require.Equal(t, deviceDesktop, classifier.classify(androidTabletUserAgent))
+		require.Equal(t, deviceMobile, classifier.classify(iPhoneUserAgent))
+	})
+
+	t.Run("it should not accept other classes", func(t *testing.T) {
+		require.Error(t, NewDeviceClassifier().Override(deviceDesktop, "(?i)windows"))
+		require.Error(t, NewDeviceClassifier().Override("watch", "(?i)watch"))
+	})
+}
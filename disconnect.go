@@ -0,0 +1,26 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"log"
+)
+
+var errClientLeft = errors.New("the client that started the fetch left")
+
+// watchClient aborts the fetch if the request that started it is cancelled before upstream sent the whole body,
+// like when its client disconnects. The entry is discarded and the other clients that were getting it get an incomplete body
+func watchClient(ctx context.Context, r *Response, cancel context.CancelFunc, done <-chan struct{}) {
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	if r.IsClosed() {
+		return
+	}
+	log.Printf("[INFO] cache: The client left before upstream sent the body, the fetch is aborted")
+	r.Abort(errClientLeft)
+	cancel()
+}
@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContinueOnDisconnect(t *testing.T) {
+	newHandler := func(abort bool) (*Handler, chan struct{}, chan struct{}, chan bool) {
+		started, release, cancelled := make(chan struct{}), make(chan struct{}), make(chan bool, 1)
+		config := emptyConfig()
+		config.AbortOnDisconnect = abort
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Write([]byte("abc"))
+			close(started)
+
+			select {
+			case <-release:
+				w.Write([]byte("def"))
+				cancelled <- false
+			case <-r.Context().Done():
+				cancelled <- true
+			}
+			return 200, nil
+		}), config), started, release, cancelled
+	}
+
+	// disconnect starts a request and cancels it once upstream sent the first part of the body
+	disconnect := func(h *Handler, started chan struct{}) chan error {
+		r := newRequestWithOriginalURL(t, "GET", "http://example.com/")
+		ctx, cancel := context.WithCancel(r.Context())
+		errs := make(chan error, 1)
+		go func() {
+			_, err := h.ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+			errs <- err
+		}()
+		<-started
+		cancel()
+		return errs
+	}
+
+	serve := func(h *Handler) *http.Response {
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", "http://example.com/"))
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	t.Run("it should finish saving the body after the client leaves by default", func(t *testing.T) {
+		h, started, release, cancelled := newHandler(false)
+		errs := disconnect(h, started)
+		close(release)
+		require.False(t, <-cancelled)
+		require.NoError(t, <-errs)
+
+		res := serve(h)
+		requireStatus(t, res, cacheHit)
+		requireBody(t, res, []byte("abcdef"))
+	})
+
+	t.Run("it should abort and discard the fetch when the client leaves with continue_on_disconnect off", func(t *testing.T) {
+		h, started, release, cancelled := newHandler(true)
+		defer close(release)
+		errs := disconnect(h, started)
+		require.True(t, <-cancelled)
+		require.Equal(t, errClientLeft, <-errs)
+
+		require.Eventually(t, func() bool {
+			return len(h.Cache.GetVariants("GET example.com/?")) == 0
+		}, time.Second, 10*time.Millisecond)
+	})
+}
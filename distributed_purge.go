@@ -0,0 +1,276 @@
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	redisTimeout        = time.Duration(5) * time.Second
+	redisReconnectDelay = time.Duration(1) * time.Second
+	purgeQueueSize      = 1000
+
+	purgeKey     = "key"
+	purgePattern = "pattern"
+	purgePrefix  = "prefix"
+	purgeFlush   = "flush"
+)
+
+var errPurgerStopped = errors.New("purger stopped")
+
+type purgeEvent struct {
+	Origin string `json:"origin"`
+	Type   string `json:"type"`
+	Value  string `json:"value,omitempty"`
+}
+
+// DistributedPurger sends the purges done in this instance to a redis channel and
+// applies the ones that other instances send, so every cache in a cluster is purged.
+// If redis is not available purges keep working locally and are not propagated
+type DistributedPurger struct {
+	address string
+	channel string
+	node    string
+
+	cachesLock *sync.RWMutex
+	caches     []*HTTPCache
+
+	events    chan purgeEvent
+	stop      chan struct{}
+	stopOnce  *sync.Once
+	loops     *sync.WaitGroup
+	connsLock *sync.Mutex
+	conns     map[*redisConn]bool
+}
+
+// NewDistributedPurger creates a purger that uses the redis at address.
+// It does nothing until Start is called
+func NewDistributedPurger(address string, channel string) *DistributedPurger {
+	node := make([]byte, 16)
+	rand.Read(node)
+
+	return &DistributedPurger{
+		address:    address,
+		channel:    channel,
+		node:       hex.EncodeToString(node),
+		cachesLock: new(sync.RWMutex),
+		events:     make(chan purgeEvent, purgeQueueSize),
+		stop:       make(chan struct{}),
+		stopOnce:   new(sync.Once),
+		loops:      new(sync.WaitGroup),
+		connsLock:  new(sync.Mutex),
+		conns:      map[*redisConn]bool{},
+	}
+}
+
+// AddCache adds a cache where the purges of other instances are applied
+func (p *DistributedPurger) AddCache(cache *HTTPCache) {
+	p.cachesLock.Lock()
+	defer p.cachesLock.Unlock()
+	p.caches = append(p.caches, cache)
+}
+
+// Start publishes and subscribes in background
+func (p *DistributedPurger) Start() {
+	p.loops.Add(2)
+	go p.publishLoop()
+	go p.subscribeLoop()
+}
+
+// Stop closes the redis connections and waits until the loops end
+func (p *DistributedPurger) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+
+		p.connsLock.Lock()
+		for conn := range p.conns {
+			conn.Close()
+		}
+		p.connsLock.Unlock()
+	})
+	p.loops.Wait()
+}
+
+// PurgedKey tells the other instances to purge the key
+func (p *DistributedPurger) PurgedKey(key string) {
+	p.publish(purgeEvent{Type: purgeKey, Value: key})
+}
+
+// PurgedPattern tells the other instances to purge the keys matching the pattern
+func (p *DistributedPurger) PurgedPattern(pattern string) {
+	p.publish(purgeEvent{Type: purgePattern, Value: pattern})
+}
+
+// PurgedKeyPrefix tells the other instances to purge the key and the keys that extend it
+func (p *DistributedPurger) PurgedKeyPrefix(key string) {
+	p.publish(purgeEvent{Type: purgePrefix, Value: key})
+}
+
+// Flushed tells the other instances to remove every entry
+func (p *DistributedPurger) Flushed() {
+	p.publish(purgeEvent{Type: purgeFlush})
+}
+
+// publish queues the event without blocking the request that made the purge.
+// A nil purger does nothing so purges work the same without redis
+func (p *DistributedPurger) publish(event purgeEvent) {
+	if p == nil {
+		return
+	}
+	event.Origin = p.node
+	select {
+	case p.events <- event:
+	default:
+		log.Printf("[WARNING] cache: Purge queue is full, %s %s is not sent to other instances", event.Type, event.Value)
+	}
+}
+
+func (p *DistributedPurger) apply(event purgeEvent) {
+	p.cachesLock.RLock()
+	defer p.cachesLock.RUnlock()
+
+	for _, cache := range p.caches {
+		switch event.Type {
+		case purgeKey:
+			cache.Purge(event.Value)
+		case purgePattern:
+			cache.PurgeMatching(func(key string) bool {
+				return matchGlob(event.Value, key)
+			})
+		case purgePrefix:
+			cache.PurgeKeyPrefix(event.Value)
+		case purgeFlush:
+			cache.Flush()
+		}
+	}
+}
+
+func (p *DistributedPurger) stopped() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// connect dials redis and keeps track of the connection so Stop can close it
+func (p *DistributedPurger) connect() (*redisConn, error) {
+	conn, err := dialRedis(p.address, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	p.connsLock.Lock()
+	defer p.connsLock.Unlock()
+	if p.stopped() {
+		conn.Close()
+		return nil, errPurgerStopped
+	}
+	p.conns[conn] = true
+	return conn, nil
+}
+
+func (p *DistributedPurger) disconnect(conn *redisConn) {
+	p.connsLock.Lock()
+	defer p.connsLock.Unlock()
+	delete(p.conns, conn)
+	conn.Close()
+}
+
+// wait sleeps before reconnecting and returns false if the purger was stopped
+func (p *DistributedPurger) wait() bool {
+	select {
+	case <-p.stop:
+		return false
+	case <-time.After(redisReconnectDelay):
+		return true
+	}
+}
+
+func (p *DistributedPurger) publishLoop() {
+	defer p.loops.Done()
+	var conn *redisConn
+
+	for {
+		var event purgeEvent
+		select {
+		case <-p.stop:
+			return
+		case event = <-p.events:
+		}
+
+		message, _ := json.Marshal(event)
+
+		if conn == nil {
+			var err error
+			if conn, err = p.connect(); err != nil {
+				log.Printf("[WARNING] cache: Purge %s %s is not sent to other instances: %v", event.Type, event.Value, err)
+				continue
+			}
+		}
+
+		conn.conn.SetDeadline(time.Now().Add(redisTimeout))
+		if _, err := conn.do("PUBLISH", p.channel, string(message)); err != nil {
+			log.Printf("[WARNING] cache: Purge %s %s is not sent to other instances: %v", event.Type, event.Value, err)
+			p.disconnect(conn)
+			conn = nil
+		}
+	}
+}
+
+func (p *DistributedPurger) subscribeLoop() {
+	defer p.loops.Done()
+	for {
+		if err := p.subscribe(); err != nil && !p.stopped() {
+			log.Printf("[WARNING] cache: Can not receive purges from other instances: %v", err)
+		}
+		if !p.wait() {
+			return
+		}
+	}
+}
+
+// subscribe applies the purges received until the connection fails
+func (p *DistributedPurger) subscribe() error {
+	conn, err := p.connect()
+	if err != nil {
+		return err
+	}
+	defer p.disconnect(conn)
+
+	if err := conn.send("SUBSCRIBE", p.channel); err != nil {
+		return err
+	}
+
+	for {
+		reply, err := conn.receive()
+		if err != nil {
+			return err
+		}
+
+		// Messages are ["message", channel, payload], the rest are subscription confirmations
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 3 || items[0] != "message" {
+			continue
+		}
+
+		payload, _ := items[2].(string)
+		event := purgeEvent{}
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			log.Printf("[WARNING] cache: Ignoring invalid purge message %q", payload)
+			continue
+		}
+
+		// The purges of this instance were already applied and must not be applied again
+		if event.Origin == p.node {
+			continue
+		}
+		p.apply(event)
+	}
+}
@@ -0,0 +1,222 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis implements the SUBSCRIBE and PUBLISH commands of redis
+type fakeRedis struct {
+	listener net.Listener
+
+	lock        *sync.Mutex
+	subscribers map[string][]net.Conn
+	published   int
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &fakeRedis{
+		listener:    listener,
+		lock:        new(sync.Mutex),
+		subscribers: map[string][]net.Conn{},
+	}
+	go server.serve()
+	return server
+}
+
+func (server *fakeRedis) Address() string {
+	return server.listener.Addr().String()
+}
+
+func (server *fakeRedis) Close() {
+	server.listener.Close()
+}
+
+func (server *fakeRedis) Subscribers(channel string) int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return len(server.subscribers[channel])
+}
+
+func (server *fakeRedis) Published() int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.published
+}
+
+func (server *fakeRedis) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		go server.handle(conn)
+	}
+}
+
+func (server *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+
+	// Commands are arrays of bulk strings so they can be read as replies
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	for {
+		command, err := rc.receive()
+		if err != nil {
+			return
+		}
+		args, _ := command.([]interface{})
+		if len(args) == 0 {
+			return
+		}
+
+		server.lock.Lock()
+		switch args[0] {
+		case "SUBSCRIBE":
+			channel := args[1].(string)
+			server.subscribers[channel] = append(server.subscribers[channel], conn)
+			fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(channel), channel)
+		case "PUBLISH":
+			channel, message := args[1].(string), args[2].(string)
+			server.published++
+			for _, subscriber := range server.subscribers[channel] {
+				fmt.Fprintf(subscriber, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(channel), channel, len(message), message)
+			}
+			fmt.Fprintf(conn, ":%d\r\n", len(server.subscribers[channel]))
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command\r\n")
+		}
+		server.lock.Unlock()
+	}
+}
+
+func newPurgerHandler(t *testing.T, address string, hits *int) *Handler {
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		*hits++
+		w.Header().Add("Cache-control", "max-age=10")
+		w.Write([]byte("abc"))
+		return 200, nil
+	}), newAdminConfig())
+
+	h.Purger = NewDistributedPurger(address, defaultPurgeChannel)
+	h.Purger.AddCache(h.Cache)
+	h.Purger.Start()
+	return h
+}
+
+func TestDistributedPurge(t *testing.T) {
+	doCachedRequest := func(h *Handler, target string) {
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", target))
+		require.NoError(t, err)
+	}
+
+	t.Run("it should purge the other instances", func(t *testing.T) {
+		server := newFakeRedis(t)
+		defer server.Close()
+
+		hitsA, hitsB := 0, 0
+		a := newPurgerHandler(t, server.Address(), &hitsA)
+		defer a.Purger.Stop()
+		b := newPurgerHandler(t, server.Address(), &hitsB)
+		defer b.Purger.Stop()
+
+		require.Eventually(t, func() bool {
+			return server.Subscribers(defaultPurgeChannel) == 2
+		}, time.Second, 10*time.Millisecond)
+
+		doCachedRequest(a, "http://example.com/a")
+		doCachedRequest(b, "http://example.com/a")
+		doCachedRequest(b, "http://example.com/b")
+
+		res := doAdminRequest(t, a, "PURGE", "http://example.com/a")
+		requireCode(t, res, 200)
+
+		require.Eventually(t, func() bool {
+			return len(b.Cache.GetVariants("GET example.com/a?")) == 0
+		}, time.Second, 10*time.Millisecond)
+		require.Len(t, b.Cache.GetVariants("GET example.com/b?"), 1)
+	})
+
+	t.Run("it should purge the keys with key headers in the other instances", func(t *testing.T) {
+		server := newFakeRedis(t)
+		defer server.Close()
+
+		hitsA, hitsB := 0, 0
+		a := newPurgerHandler(t, server.Address(), &hitsA)
+		defer a.Purger.Stop()
+		b := newPurgerHandler(t, server.Address(), &hitsB)
+		defer b.Purger.Stop()
+		a.Config.KeyHeaders = []string{"X-Tenant"}
+		b.Config.KeyHeaders = []string{"X-Tenant"}
+
+		require.Eventually(t, func() bool {
+			return server.Subscribers(defaultPurgeChannel) == 2
+		}, time.Second, 10*time.Millisecond)
+
+		doCachedRequest(a, "http://example.com/a")
+		doCachedRequest(b, "http://example.com/a")
+		doCachedRequest(b, "http://example.com/ab")
+
+		res := doAdminRequest(t, a, "PURGE", "http://example.com/a")
+		requireCode(t, res, 200)
+
+		require.Eventually(t, func() bool {
+			return len(b.Cache.GetVariants("GET example.com/a? X-Tenant:")) == 0
+		}, time.Second, 10*time.Millisecond)
+		require.Len(t, b.Cache.GetVariants("GET example.com/ab? X-Tenant:"), 1)
+	})
+
+	t.Run("it should not send again the purges received", func(t *testing.T) {
+		server := newFakeRedis(t)
+		defer server.Close()
+
+		hitsA, hitsB := 0, 0
+		a := newPurgerHandler(t, server.Address(), &hitsA)
+		defer a.Purger.Stop()
+		b := newPurgerHandler(t, server.Address(), &hitsB)
+		defer b.Purger.Stop()
+
+		require.Eventually(t, func() bool {
+			return server.Subscribers(defaultPurgeChannel) == 2
+		}, time.Second, 10*time.Millisecond)
+
+		doCachedRequest(b, "http://example.com/a")
+		res := doAdminRequest(t, a, "POST", "http://example.com/_cache/flush")
+		requireCode(t, res, 200)
+
+		require.Eventually(t, func() bool {
+			return len(b.Cache.GetVariants("GET example.com/a?")) == 0
+		}, time.Second, 10*time.Millisecond)
+
+		time.Sleep(50 * time.Millisecond)
+		require.Equal(t, 1, server.Published())
+	})
+
+	t.Run("it should purge locally if redis is down", func(t *testing.T) {
+		server := newFakeRedis(t)
+		server.Close()
+
+		hits := 0
+		h := newPurgerHandler(t, server.Address(), &hits)
+		defer h.Purger.Stop()
+
+		doCachedRequest(h, "http://example.com/a")
+		res := doAdminRequest(t, h, "PURGE", "http://example.com/a")
+		requireCode(t, res, 200)
+
+		doCachedRequest(h, "http://example.com/a")
+		require.Equal(t, 2, hits)
+	})
+}
@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"net/http"
+	"strings"
+)
+
+// scanETag returns the first entity-tag of s and what remains after it.
+// It returns an empty tag if s does not start with a valid entity-tag
+func scanETag(s string) (etag string, remain string) {
+	s = strings.TrimLeft(s, " \t")
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+
+	if len(s[start:]) < 2 || s[start] != '"' {
+		return "", ""
+	}
+
+	// Entity tags can have commas inside so they must be scanned until the closing quote
+	for i := start + 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			return s[:i+1], s[i+1:]
+		// Characters allowed by RFC 7232 are 0x21, 0x23-0x7E and obs-text
+		case c == 0x21 || c >= 0x23 && c != 0x7F:
+		default:
+			return "", ""
+		}
+	}
+
+	return "", ""
+}
+
+func isWeakETag(etag string) bool {
+	return strings.HasPrefix(etag, "W/")
+}
+
+// etagStrongMatch compares as RFC 7232 section 2.3.2 says, both tags must be strong and equal
+func etagStrongMatch(a string, b string) bool {
+	return a != "" && a == b && !isWeakETag(a)
+}
+
+// etagWeakMatch compares as RFC 7232 section 2.3.2 says, the tags are equal ignoring W/
+func etagWeakMatch(a string, b string) bool {
+	return a != "" && strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// matchesIfNoneMatch returns if the If-None-Match header matches the etag
+// using the weak comparison as required by RFC 7232 section 3.2
+func matchesIfNoneMatch(ifNoneMatch string, etag string) bool {
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+
+	for ifNoneMatch != "" {
+		ifNoneMatch = strings.TrimLeft(ifNoneMatch, " \t,")
+		if ifNoneMatch == "" {
+			break
+		}
+
+		candidate, remain := scanETag(ifNoneMatch)
+		if candidate == "" {
+			break
+		}
+		if etagWeakMatch(candidate, etag) {
+			return true
+		}
+		ifNoneMatch = remain
+	}
+
+	return false
+}
+
+// isNotModified returns if the conditional request can be answered with a 304 using the entry
+func isNotModified(r *http.Request, entry *HTTPCacheEntry) bool {
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifNoneMatch == "" {
+		return false
+	}
+
+	etag, _ := scanETag(entry.Response.snapHeader.Get("Etag"))
+	return matchesIfNoneMatch(ifNoneMatch, etag)
+}
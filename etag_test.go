@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanETag(t *testing.T) {
+	tests := []struct {
+		input  string
+		etag   string
+		remain string
+	}{
+		{`"abc"`, `"abc"`, ""},
+		{`W/"abc"`, `W/"abc"`, ""},
+		{` "abc", "def"`, `"abc"`, `, "def"`},
+		{`"a,b"`, `"a,b"`, ""},
+		{`""`, `""`, ""},
+		{`abc`, "", ""},
+		{`"abc`, "", ""},
+		{`W/abc`, "", ""},
+		{`"a"b"`, `"a"`, `b"`},
+		{"\"a b\"", "", ""},
+	}
+
+	for _, test := range tests {
+		etag, remain := scanETag(test.input)
+		require.Equal(t, test.etag, etag, "Invalid etag scanned from "+test.input)
+		require.Equal(t, test.remain, remain, "Invalid remain scanned from "+test.input)
+	}
+}
+
+func TestETagComparison(t *testing.T) {
+	// Examples from RFC 7232 section 2.3.2
+	tests := []struct {
+		a      string
+		b      string
+		strong bool
+		weak   bool
+	}{
+		{`W/"1"`, `W/"1"`, false, true},
+		{`W/"1"`, `W/"2"`, false, false},
+		{`W/"1"`, `"1"`, false, true},
+		{`"1"`, `"1"`, true, true},
+		{`"1"`, `"2"`, false, false},
+		{``, ``, false, false},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.strong, etagStrongMatch(test.a, test.b), "Invalid strong comparison of "+test.a+" and "+test.b)
+		require.Equal(t, test.strong, etagStrongMatch(test.b, test.a), "Invalid strong comparison of "+test.b+" and "+test.a)
+		require.Equal(t, test.weak, etagWeakMatch(test.a, test.b), "Invalid weak comparison of "+test.a+" and "+test.b)
+		require.Equal(t, test.weak, etagWeakMatch(test.b, test.a), "Invalid weak comparison of "+test.b+" and "+test.a)
+	}
+}
+
+func TestMatchesIfNoneMatch(t *testing.T) {
+	tests := []struct {
+		ifNoneMatch string
+		etag        string
+		matches     bool
+	}{
+		{`"1"`, `"1"`, true},
+		{`W/"1"`, `"1"`, true},
+		{`"1"`, `W/"1"`, true},
+		{`"2", W/"1"`, `"1"`, true},
+		{`"2","3"`, `"1"`, false},
+		{`"a,b", "c"`, `"c"`, true},
+		{`*`, `"1"`, true},
+		{`*`, ``, true},
+		{`"1"`, ``, false},
+		{`garbage, "1"`, `"1"`, false},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.matches, matchesIfNoneMatch(test.ifNoneMatch, test.etag), "Invalid match of "+test.ifNoneMatch+" with "+test.etag)
+	}
+}
+
+func TestIfNoneMatchOnCachedResponse(t *testing.T) {
+	content := []byte("abc")
+	hits := 0
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits++
+		w.Header().Add("Cache-control", "max-age=10")
+		w.Header().Add("Etag", `"v1"`)
+		w.Header().Add("Content-Type", "text/plain")
+		w.Write(content)
+		return 200, nil
+	}), emptyConfig())
+
+	requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+
+	t.Run("it should respond 304 if the etag matches", func(t *testing.T) {
+		res, err := doRequestWithHeaders(t, h, makeHeader("If-None-Match", `"v1"`))
+		require.NoError(t, err)
+		requireCode(t, res, http.StatusNotModified)
+		requireStatus(t, res, cacheHit)
+		requireBody(t, res, []byte{})
+		require.Equal(t, `"v1"`, res.Header.Get("Etag"))
+		require.Equal(t, "", res.Header.Get("Content-Type"))
+	})
+
+	t.Run("it should use weak comparison", func(t *testing.T) {
+		res, err := doRequestWithHeaders(t, h, makeHeader("If-None-Match", `W/"v0", W/"v1"`))
+		require.NoError(t, err)
+		requireCode(t, res, http.StatusNotModified)
+	})
+
+	t.Run("it should respond the whole body if the etag doesn't match", func(t *testing.T) {
+		requestAndAssert(t, h, makeHeader("If-None-Match", `"v0"`), 200, cacheHit, content)
+	})
+
+	require.Equal(t, 1, hits)
+}
@@ -0,0 +1,156 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EventLogLevel is how much is logged about the cache decision of each request
+type EventLogLevel int
+
+const (
+	// EventLogOff does not log anything
+	EventLogOff EventLogLevel = iota
+	// EventLogSummary logs the key, status, code, ranges and upstream latency
+	EventLogSummary
+	// EventLogVerbose also logs why the response was cacheable or not, the ttl and the headers
+	EventLogVerbose
+)
+
+var eventLogLevels = map[string]EventLogLevel{
+	"off":     EventLogOff,
+	"summary": EventLogSummary,
+	"verbose": EventLogVerbose,
+}
+
+type cacheEvent struct {
+	Key             string      `json:"key"`
+	Method          string      `json:"method"`
+	Status          string      `json:"status"`
+	Code            int         `json:"code"`
+	Range           string      `json:"range,omitempty"`
+	ContentRange    string      `json:"contentRange,omitempty"`
+	UpstreamLatency float64     `json:"upstreamLatency,omitempty"`
+	Error           string      `json:"error,omitempty"`
+	Reason          string      `json:"reason,omitempty"`
+	TTL             float64     `json:"ttl,omitempty"`
+	RequestHeaders  http.Header `json:"requestHeaders,omitempty"`
+	ResponseHeaders http.Header `json:"responseHeaders,omitempty"`
+
+	request *http.Request
+	entry   *HTTPCacheEntry
+}
+
+// record saves the status and the entry used to respond. Events are nil when logging is off
+func (event *cacheEvent) record(status string, entry *HTTPCacheEntry) {
+	if event == nil {
+		return
+	}
+	event.Status = status
+	event.entry = entry
+}
+
+func (event *cacheEvent) bypass(reason string) {
+	if event == nil {
+		return
+	}
+	event.Status = cacheBypass
+	event.Reason = reason
+}
+
+func (event *cacheEvent) fetched(start time.Time) {
+	if event == nil {
+		return
+	}
+	event.UpstreamLatency = float64(time.Since(start)) / float64(time.Millisecond)
+}
+
+// redactHeaders copies the headers hiding the ones that can have credentials
+func (handler *Handler) redactHeaders(from http.Header) http.Header {
+	headers := http.Header{}
+	copyHeaders(from, headers)
+
+	hidden := redactedHeaders
+	if handler.Config.AdminTokenHeader != "" {
+		hidden = append([]string{handler.Config.AdminTokenHeader}, hidden...)
+	}
+	for _, header := range hidden {
+		for key := range headers {
+			if strings.EqualFold(key, header) {
+				headers[key] = []string{redactedValue}
+			}
+		}
+	}
+	return headers
+}
+
+func (handler *Handler) logEvent(event *cacheEvent) {
+	if handler.Config.EventLog == EventLogVerbose {
+		if event.entry != nil {
+			if event.Reason == "" {
+				event.Reason = event.entry.reason
+			}
+			if event.entry.isPublic {
+				event.TTL = event.entry.expiration.Sub(event.entry.storedAt).Seconds()
+			}
+			event.ResponseHeaders = handler.redactHeaders(event.entry.Response.snapHeader)
+		}
+		event.RequestHeaders = handler.redactHeaders(event.request.Header)
+	} else {
+		event.Reason = ""
+	}
+
+	if handler.Config.EventLogJSON {
+		data, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("[WARNING] cache: Can not log event of %s: %v", event.Key, err)
+			return
+		}
+		log.Printf("%s", data)
+		return
+	}
+
+	line := fmt.Sprintf("[INFO] cache: key=%q method=%s status=%s code=%d", event.Key, event.Method, event.Status, event.Code)
+	if event.Range != "" {
+		line += fmt.Sprintf(" range=%q contentRange=%q", event.Range, event.ContentRange)
+	}
+	if event.UpstreamLatency > 0 {
+		line += fmt.Sprintf(" upstreamLatency=%.3fms", event.UpstreamLatency)
+	}
+	if event.Error != "" {
+		line += fmt.Sprintf(" error=%q", event.Error)
+	}
+	if event.Reason != "" {
+		line += fmt.Sprintf(" reason=%q", event.Reason)
+	}
+	if event.TTL > 0 {
+		line += fmt.Sprintf(" ttl=%gs", event.TTL)
+	}
+	if event.RequestHeaders != nil {
+		line += fmt.Sprintf(" requestHeaders=%q", formatHeaders(event.RequestHeaders))
+	}
+	if event.ResponseHeaders != nil {
+		line += fmt.Sprintf(" responseHeaders=%q", formatHeaders(event.ResponseHeaders))
+	}
+	log.Print(line)
+}
+
+// formatHeaders writes the headers sorted by name in a single line
+func formatHeaders(headers http.Header) string {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, key+": "+strings.Join(headers[key], ", "))
+	}
+	return strings.Join(parts, "; ")
+}
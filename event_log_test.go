@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventLog(t *testing.T) {
+	newHandler := func(config *Config) *Handler {
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			if r.URL.Path == "/private" {
+				w.Header().Add("Cache-control", "no-store")
+			} else {
+				w.Header().Add("Cache-control", "max-age=10")
+			}
+			w.Header().Add("Set-Cookie", "session=abc")
+			w.Write([]byte("abc"))
+			return 200, nil
+		}), config)
+	}
+
+	// getEvents makes the requests and returns the logged events
+	getEvents := func(t *testing.T, h *Handler, requests ...*http.Request) []string {
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		defer log.SetOutput(os.Stderr)
+
+		for _, r := range requests {
+			_, err := h.ServeHTTP(httptest.NewRecorder(), r)
+			require.NoError(t, err)
+		}
+
+		lines := []string{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			// Other tests can still be logging in background
+			if strings.Contains(line, "key=") || strings.Contains(line, `"key":`) {
+				lines = append(lines, line)
+			}
+		}
+		return lines
+	}
+
+	parseEvent := func(t *testing.T, line string) cacheEvent {
+		event := cacheEvent{}
+		require.NoError(t, json.Unmarshal([]byte(line[strings.Index(line, "{"):]), &event))
+		return event
+	}
+
+	t.Run("it should not log anything by default", func(t *testing.T) {
+		h := newHandler(emptyConfig())
+		require.Empty(t, getEvents(t, h, newRequestWithOriginalURL(t, "GET", "http://example.com/a")))
+	})
+
+	t.Run("it should log the summary of misses and hits", func(t *testing.T) {
+		config := emptyConfig()
+		config.EventLog = EventLogSummary
+		config.EventLogJSON = true
+		h := newHandler(config)
+
+		lines := getEvents(t, h,
+			newRequestWithOriginalURL(t, "GET", "http://example.com/a"),
+			newRequestWithOriginalURL(t, "GET", "http://example.com/a"),
+			newRequestWithOriginalURL(t, "POST", "http://example.com/a"),
+		)
+		require.Len(t, lines, 3)
+
+		miss := parseEvent(t, lines[0])
+		require.Equal(t, "GET example.com/a?", miss.Key)
+		require.Equal(t, cacheMiss, miss.Status)
+		require.Equal(t, 200, miss.Code)
+		require.True(t, miss.UpstreamLatency > 0)
+		require.Empty(t, miss.Reason)
+		require.Empty(t, miss.RequestHeaders)
+
+		hit := parseEvent(t, lines[1])
+		require.Equal(t, cacheHit, hit.Status)
+		require.Zero(t, hit.UpstreamLatency)
+
+		bypass := parseEvent(t, lines[2])
+		require.Equal(t, cacheBypass, bypass.Status)
+	})
+
+	t.Run("it should log the requested and the sent range", func(t *testing.T) {
+		config := emptyConfig()
+		config.EventLog = EventLogSummary
+		h := newHandler(config)
+
+		ranged := newRequestWithOriginalURL(t, "GET", "http://example.com/a")
+		ranged.Header.Set("Range", "bytes=1-")
+		lines := getEvents(t, h, newRequestWithOriginalURL(t, "GET", "http://example.com/a"), ranged)
+		require.Len(t, lines, 2)
+		require.NotContains(t, lines[0], "range=")
+		require.Contains(t, lines[1], `status=hit code=206 range="bytes=1-" contentRange="bytes 1-2/3"`)
+	})
+
+	t.Run("it should log why a response is not cacheable in verbose mode", func(t *testing.T) {
+		config := emptyConfig()
+		config.EventLog = EventLogVerbose
+		config.EventLogJSON = true
+		h := newHandler(config)
+
+		lines := getEvents(t, h,
+			newRequestWithOriginalURL(t, "GET", "http://example.com/private"),
+			newRequestWithOriginalURL(t, "GET", "http://example.com/public"),
+		)
+		require.Len(t, lines, 2)
+
+		private := parseEvent(t, lines[0])
+		require.Equal(t, cacheMiss, private.Status)
+		require.Equal(t, "ReasonResponseNoStore", private.Reason)
+		require.Zero(t, private.TTL)
+
+		public := parseEvent(t, lines[1])
+		require.Equal(t, "explicit expiration", public.Reason)
+		require.InDelta(t, 10, public.TTL, 0.1)
+	})
+
+	t.Run("it should not log sensitive headers", func(t *testing.T) {
+		config := emptyConfig()
+		config.EventLog = EventLogVerbose
+		h := newHandler(config)
+
+		r := newRequestWithOriginalURL(t, "GET", "http://example.com/a")
+		r.Header.Set("Authorization", "Bearer token")
+		r.Header.Set("Accept", "text/html")
+
+		lines := getEvents(t, h, r)
+		require.Len(t, lines, 1)
+		require.Contains(t, lines[0], `status=miss`)
+		require.Contains(t, lines[0], `Accept: text/html`)
+		require.Contains(t, lines[0], `Authorization: REDACTED`)
+		require.Contains(t, lines[0], `Set-Cookie: REDACTED`)
+		require.NotContains(t, lines[0], "Bearer token")
+		require.NotContains(t, lines[0], "session=abc")
+	})
+}
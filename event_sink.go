@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Events waiting to be sent to the sink, the new ones are dropped while it is full
+const eventQueueSize = 1024
+
+const webhookTimeout = 5 * time.Second
+
+// CacheEventType is what the cache did with a key
+type CacheEventType string
+
+const (
+	// EventStore is sent when a response is saved
+	EventStore CacheEventType = "store"
+	// EventHit is sent when a saved response is served
+	EventHit CacheEventType = "hit"
+	// EventStale is sent when an expired response is served
+	EventStale CacheEventType = "stale"
+	// EventEvict is sent when a response is removed by the host quotas or max_variants
+	EventEvict CacheEventType = "evict"
+	// EventPurge is sent when the responses of a key are removed by a purge
+	EventPurge CacheEventType = "purge"
+)
+
+// CacheEvent is sent to the EventSink
+type CacheEvent struct {
+	Type CacheEventType `json:"type"`
+	Key  string         `json:"key"`
+	Time time.Time      `json:"time"`
+}
+
+// EventSink receives the events of the cache, like a webhook or a message queue.
+// Emit is called from a single goroutine, a slow sink never delays the requests
+type EventSink interface {
+	Emit(event CacheEvent)
+}
+
+// eventEmitter sends the events to the sink in background. It is nil if there is no sink
+type eventEmitter struct {
+	sink     EventSink
+	events   chan CacheEvent
+	stop     chan struct{}
+	stopOnce *sync.Once
+}
+
+func newEventEmitter(sink EventSink) *eventEmitter {
+	if sink == nil {
+		return nil
+	}
+
+	emitter := &eventEmitter{
+		sink:     sink,
+		events:   make(chan CacheEvent, eventQueueSize),
+		stop:     make(chan struct{}),
+		stopOnce: new(sync.Once),
+	}
+	go emitter.loop()
+	return emitter
+}
+
+func (e *eventEmitter) loop() {
+	for {
+		select {
+		case event := <-e.events:
+			e.sink.Emit(event)
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// emit queues the event without blocking
+func (e *eventEmitter) emit(eventType CacheEventType, key string) {
+	if e == nil {
+		return
+	}
+	select {
+	case e.events <- CacheEvent{Type: eventType, Key: key, Time: time.Now()}:
+	default:
+		log.Printf("[WARNING] cache: Event queue is full, %s %s is not sent", eventType, key)
+	}
+}
+
+// emitStatus sends the hits and the stale responses of the requests
+func (e *eventEmitter) emitStatus(event *cacheEvent) {
+	switch event.Status {
+	case cacheHit:
+		e.emit(EventHit, event.Key)
+	case cacheStale, cacheMaintenance:
+		e.emit(EventStale, event.Key)
+	}
+}
+
+// Stop stops sending the events, the queued ones are dropped
+func (e *eventEmitter) Stop() {
+	if e == nil {
+		return
+	}
+	e.stopOnce.Do(func() { close(e.stop) })
+}
+
+// WebhookSink posts each event as JSON to an url
+type WebhookSink struct {
+	URL    string
+	client *http.Client
+}
+
+// NewWebhookSink creates a sink that posts the events to the url
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{URL: url, client: &http.Client{Timeout: webhookTimeout}}
+}
+
+// Emit posts the event, failures are only logged
+func (s *WebhookSink) Emit(event CacheEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[WARNING] cache: Can not encode the %s event of %s: %v", event.Type, event.Key, err)
+		return
+	}
+
+	res, err := s.client.Post(s.URL, "application/json", bytes.NewReader(body))
+	if err == nil {
+		res.Body.Close()
+		if res.StatusCode >= 300 {
+			err = fmt.Errorf("status %d", res.StatusCode)
+		}
+	}
+	if err != nil {
+		log.Printf("[WARNING] cache: Can not send the %s event of %s to %s: %v", event.Type, event.Key, s.URL, err)
+	}
+}
@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingSink keeps the events it gets, it waits for release before each one if it is set
+type recordingSink struct {
+	lock    *sync.Mutex
+	events  []CacheEvent
+	release chan struct{}
+}
+
+func newRecordingSink() *recordingSink {
+	return &recordingSink{lock: new(sync.Mutex)}
+}
+
+func (s *recordingSink) Emit(event CacheEvent) {
+	if s.release != nil {
+		<-s.release
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.events = append(s.events, event)
+}
+
+func (s *recordingSink) types() []CacheEventType {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	types := []CacheEventType{}
+	for _, event := range s.events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestEventSink(t *testing.T) {
+	newSinkHandler := func(sink EventSink) *Handler {
+		config := emptyConfig()
+		config.EventSink = sink
+		config.MaxVariants = 1
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			w.Write([]byte("abc"))
+			return 200, nil
+		}), config)
+	}
+
+	serve := func(h *Handler, language string) {
+		w := httptest.NewRecorder()
+		r := newRequestWithOriginalURL(t, "GET", "http://example.com/")
+		r.Header.Set("Accept-Language", language)
+		_, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+	}
+
+	t.Run("it should emit the stores, hits, evictions and purges", func(t *testing.T) {
+		sink := newRecordingSink()
+		h := newSinkHandler(sink)
+		defer h.Cache.events.Stop()
+
+		serve(h, "en")
+		serve(h, "en")
+		serve(h, "es")
+		h.Purge("GET example.com/?")
+
+		require.Eventually(t, func() bool {
+			return len(sink.types()) == 5
+		}, time.Second, 10*time.Millisecond)
+		require.Equal(t, []CacheEventType{EventStore, EventHit, EventEvict, EventStore, EventPurge}, sink.types())
+		require.Equal(t, "GET example.com/?", sink.events[0].Key)
+	})
+
+	t.Run("it should not stall the requests with a slow sink", func(t *testing.T) {
+		sink := newRecordingSink()
+		sink.release = make(chan struct{})
+		h := newSinkHandler(sink)
+		defer h.Cache.events.Stop()
+		defer close(sink.release)
+
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < eventQueueSize+10; i++ {
+				serve(h, "en")
+			}
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the requests waited for the sink")
+		}
+	})
+}
+
+func TestWebhookSink(t *testing.T) {
+	t.Run("it should post the event as JSON", func(t *testing.T) {
+		received := make(chan CacheEvent, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			event := CacheEvent{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+			require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+			received <- event
+		}))
+		defer server.Close()
+
+		NewWebhookSink(server.URL).Emit(CacheEvent{Type: EventPurge, Key: "GET example.com/?"})
+		event := <-received
+		require.Equal(t, EventPurge, event.Type)
+		require.Equal(t, "GET example.com/?", event.Key)
+	})
+}
@@ -0,0 +1,196 @@
+package cache
+
+import (
+	"container/list"
+	"sync/atomic"
+)
+
+const (
+	evictionLRU  = "lru"
+	evictionLFU  = "lfu"
+	evictionFIFO = "fifo"
+)
+
+// evictionPolicy orders the entries of a host by which one is evicted first.
+// It is not safe for concurrent use, the host quotas lock it
+type evictionPolicy interface {
+	add(entry *HTTPCacheEntry)
+	touch(entry *HTTPCacheEntry)
+	remove(entry *HTTPCacheEntry)
+
+	// next returns the entry other than skip that is evicted first or nil if there are none
+	next(skip *HTTPCacheEntry) *HTTPCacheEntry
+}
+
+// evictionName returns the policy of the config, lru if it is not set
+func evictionName(config *Config) string {
+	if config.Eviction == "" {
+		return evictionLRU
+	}
+	return config.Eviction
+}
+
+func newEvictionPolicy(name string) evictionPolicy {
+	switch name {
+	case evictionLFU:
+		return newLFUPolicy()
+	case evictionFIFO:
+		return newListPolicy(false)
+	default:
+		return newListPolicy(true)
+	}
+}
+
+// evictsBefore returns if the policy evicts a before b. It compares the variants of a key,
+// which are too few to be tracked like the entries of a host
+func evictsBefore(name string, a *HTTPCacheEntry, b *HTTPCacheEntry) bool {
+	switch name {
+	case evictionLFU:
+		aUses, bUses := atomic.LoadInt64(&a.uses), atomic.LoadInt64(&b.uses)
+		if aUses != bUses {
+			return aUses < bUses
+		}
+	case evictionFIFO:
+		return a.storedAt.Before(b.storedAt)
+	}
+	return atomic.LoadInt64(&a.lastUsed) < atomic.LoadInt64(&b.lastUsed)
+}
+
+// listPolicy evicts the entry at the back of the list. New entries are added to the front and,
+// for lru, so are the entries that are used. Without moving them it is fifo
+type listPolicy struct {
+	order       *list.List
+	elements    map[*HTTPCacheEntry]*list.Element
+	moveOnTouch bool
+}
+
+func newListPolicy(moveOnTouch bool) *listPolicy {
+	return &listPolicy{order: list.New(), elements: map[*HTTPCacheEntry]*list.Element{}, moveOnTouch: moveOnTouch}
+}
+
+func (p *listPolicy) add(entry *HTTPCacheEntry) {
+	p.elements[entry] = p.order.PushFront(entry)
+}
+
+func (p *listPolicy) touch(entry *HTTPCacheEntry) {
+	if element, ok := p.elements[entry]; ok && p.moveOnTouch {
+		p.order.MoveToFront(element)
+	}
+}
+
+func (p *listPolicy) remove(entry *HTTPCacheEntry) {
+	if element, ok := p.elements[entry]; ok {
+		p.order.Remove(element)
+		delete(p.elements, entry)
+	}
+}
+
+func (p *listPolicy) next(skip *HTTPCacheEntry) *HTTPCacheEntry {
+	for element := p.order.Back(); element != nil; element = element.Prev() {
+		if entry := element.Value.(*HTTPCacheEntry); entry != skip {
+			return entry
+		}
+	}
+	return nil
+}
+
+// lfuPolicy evicts the entry used the fewest times, the least recently used of them if there are many.
+// The entries are kept in a list for each count, so every operation is constant time
+type lfuPolicy struct {
+	counts   map[*HTTPCacheEntry]int
+	elements map[*HTTPCacheEntry]*list.Element
+	byCount  map[int]*list.List
+
+	// minCount is the lowest count with entries, 0 if it must be looked for again
+	minCount int
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{counts: map[*HTTPCacheEntry]int{}, elements: map[*HTTPCacheEntry]*list.Element{}, byCount: map[int]*list.List{}}
+}
+
+func (p *lfuPolicy) push(entry *HTTPCacheEntry, count int) {
+	entries, ok := p.byCount[count]
+	if !ok {
+		entries = list.New()
+		p.byCount[count] = entries
+	}
+	p.counts[entry] = count
+	p.elements[entry] = entries.PushFront(entry)
+}
+
+// pop removes the entry from the list of its count and returns the count
+func (p *lfuPolicy) pop(entry *HTTPCacheEntry) (int, bool) {
+	count, ok := p.counts[entry]
+	if !ok {
+		return 0, false
+	}
+	entries := p.byCount[count]
+	entries.Remove(p.elements[entry])
+	if entries.Len() == 0 {
+		delete(p.byCount, count)
+		if count == p.minCount {
+			p.minCount = 0
+		}
+	}
+	delete(p.counts, entry)
+	delete(p.elements, entry)
+	return count, true
+}
+
+func (p *lfuPolicy) add(entry *HTTPCacheEntry) {
+	p.push(entry, 1)
+	p.minCount = 1
+}
+
+func (p *lfuPolicy) touch(entry *HTTPCacheEntry) {
+	minCount := p.minCount
+	count, ok := p.pop(entry)
+	if !ok {
+		return
+	}
+	p.push(entry, count+1)
+
+	// Only the entry that was alone with the lowest count knows the next one,
+	// otherwise a lower count may have entries and next looks for it
+	if minCount != 0 && count == minCount && p.minCount == 0 {
+		p.minCount = count + 1
+	}
+}
+
+func (p *lfuPolicy) remove(entry *HTTPCacheEntry) {
+	p.pop(entry)
+}
+
+func (p *lfuPolicy) next(skip *HTTPCacheEntry) *HTTPCacheEntry {
+	if len(p.counts) == 0 {
+		return nil
+	}
+	if p.minCount == 0 {
+		for count := range p.byCount {
+			if p.minCount == 0 || count < p.minCount {
+				p.minCount = count
+			}
+		}
+	}
+
+	entries := p.byCount[p.minCount]
+	if entry := entries.Back().Value.(*HTTPCacheEntry); entry != skip {
+		return entry
+	}
+	if entries.Len() > 1 {
+		return entries.Back().Prev().Value.(*HTTPCacheEntry)
+	}
+
+	// skip is alone with the lowest count
+	next := 0
+	for count := range p.byCount {
+		if count != p.minCount && (next == 0 || count < next) {
+			next = count
+		}
+	}
+	if next == 0 {
+		return nil
+	}
+	return p.byCount[next].Back().Value.(*HTTPCacheEntry)
+}
@@ -0,0 +1,183 @@
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvictionPolicies(t *testing.T) {
+	a, b, c := &HTTPCacheEntry{key: "a"}, &HTTPCacheEntry{key: "b"}, &HTTPCacheEntry{key: "c"}
+
+	t.Run("it should evict the least recently used entry with lru", func(t *testing.T) {
+		policy := newEvictionPolicy(evictionLRU)
+		policy.add(a)
+		policy.add(b)
+		policy.add(c)
+		policy.touch(a)
+		require.Equal(t, b, policy.next(nil))
+
+		policy.remove(b)
+		require.Equal(t, c, policy.next(nil))
+	})
+
+	t.Run("it should evict the oldest entry with fifo no matter its uses", func(t *testing.T) {
+		policy := newEvictionPolicy(evictionFIFO)
+		policy.add(a)
+		policy.add(b)
+		policy.touch(a)
+		policy.touch(a)
+		require.Equal(t, a, policy.next(nil))
+	})
+
+	t.Run("it should evict the least frequently used entry with lfu", func(t *testing.T) {
+		policy := newEvictionPolicy(evictionLFU)
+		require.Nil(t, policy.next(nil))
+
+		policy.add(a)
+		policy.add(b)
+		policy.add(c)
+		policy.touch(a)
+		policy.touch(a)
+		policy.touch(c)
+		require.Equal(t, b, policy.next(nil))
+
+		policy.remove(b)
+		require.Equal(t, c, policy.next(nil))
+
+		// With the same uses the least recently used goes first
+		policy.touch(c)
+		require.Equal(t, a, policy.next(nil))
+		policy.touch(c)
+		require.Equal(t, a, policy.next(nil))
+
+		policy.remove(a)
+		policy.remove(c)
+		require.Nil(t, policy.next(nil))
+	})
+
+	t.Run("it should not evict the most used entry with lfu after a removal", func(t *testing.T) {
+		policy := newEvictionPolicy(evictionLFU)
+		policy.add(a)
+		policy.add(b)
+		policy.add(c)
+		for i := 0; i < 2; i++ {
+			policy.touch(b)
+		}
+		for i := 0; i < 4; i++ {
+			policy.touch(c)
+		}
+
+		policy.remove(a)
+		policy.touch(c)
+		require.Equal(t, b, policy.next(nil))
+	})
+
+	for _, name := range []string{evictionLRU, evictionFIFO, evictionLFU} {
+		t.Run("it should skip the saved entry without moving it with "+name, func(t *testing.T) {
+			policy := newEvictionPolicy(name)
+			policy.add(a)
+			policy.add(b)
+			require.Equal(t, b, policy.next(a))
+			require.Equal(t, a, policy.next(b))
+			require.Equal(t, a, policy.next(nil))
+
+			policy.remove(b)
+			require.Nil(t, policy.next(a))
+		})
+	}
+
+	t.Run("it should skip the saved entry when it is alone with the fewest uses with lfu", func(t *testing.T) {
+		policy := newEvictionPolicy(evictionLFU)
+		policy.add(a)
+		policy.add(b)
+		policy.touch(b)
+		policy.add(c)
+		require.Equal(t, a, policy.next(c))
+
+		policy.remove(a)
+		require.Equal(t, b, policy.next(c))
+	})
+}
+
+func TestEviction(t *testing.T) {
+	newHandler := func(eviction string) *Handler {
+		config := newAdminConfig()
+		config.PerHostMaxEntries = 2
+		config.Eviction = eviction
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Write([]byte("abc"))
+			return 200, nil
+		}), config)
+	}
+
+	// evicted returns which of /a and /b is not cached after requesting the paths
+	evicted := func(h *Handler, paths ...string) string {
+		for _, path := range paths {
+			_, err := h.ServeHTTP(httptest.NewRecorder(), newRequestWithOriginalURL(t, "GET", "http://example.com"+path))
+			require.NoError(t, err)
+		}
+		for _, path := range []string{"/a", "/b"} {
+			if len(h.Cache.GetVariants("GET example.com"+path+"?")) == 0 {
+				return path
+			}
+		}
+		return ""
+	}
+
+	for _, test := range []struct {
+		eviction string
+		paths    []string
+		evicted  string
+	}{
+		{"", []string{"/a", "/b", "/a", "/c"}, "/b"},
+		{evictionLRU, []string{"/a", "/a", "/a", "/b", "/b", "/c"}, "/a"},
+		{evictionFIFO, []string{"/a", "/b", "/a", "/c"}, "/a"},
+		{evictionFIFO, []string{"/a", "/a", "/a", "/b", "/b", "/c"}, "/a"},
+		{evictionLFU, []string{"/a", "/b", "/a", "/c"}, "/b"},
+		{evictionLFU, []string{"/a", "/a", "/a", "/b", "/b", "/c"}, "/b"},
+	} {
+		t.Run("it should evict "+test.evicted+" with "+evictionName(&Config{Eviction: test.eviction}), func(t *testing.T) {
+			require.Equal(t, test.evicted, evicted(newHandler(test.eviction), test.paths...))
+		})
+	}
+
+	t.Run("it should label the evictions with the policy", func(t *testing.T) {
+		h := newHandler(evictionLFU)
+		evicted(h, "/a", "/b", "/c")
+
+		res := doAdminRequest(t, h, "GET", "http://example.com/_cache/metrics")
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(body), "caddy_cache_evicted_entries_total{policy=\"lfu\"} 1\n")
+	})
+
+	t.Run("it should evict the variants with the policy", func(t *testing.T) {
+		config := emptyConfig()
+		config.MaxVariants = 2
+		config.Eviction = evictionFIFO
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Header().Add("Vary", "X-Version")
+			w.Write([]byte(r.Header.Get("X-Version")))
+			return 200, nil
+		}), config)
+
+		version := func(value string) http.Header {
+			return http.Header{"X-Version": []string{value}}
+		}
+		requestAndAssert(t, h, version("1"), 200, cacheMiss, []byte("1"))
+		requestAndAssert(t, h, version("2"), 200, cacheMiss, []byte("2"))
+		requestAndAssert(t, h, version("1"), 200, cacheHit, []byte("1"))
+		requestAndAssert(t, h, version("3"), 200, cacheMiss, []byte("3"))
+
+		// With lru the second one would be removed
+		requestAndAssert(t, h, version("2"), 200, cacheHit, []byte("2"))
+		requestAndAssert(t, h, version("1"), 200, cacheMiss, []byte("1"))
+	})
+}
@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+)
+
+// FallbackResponse is a static response, like a maintenance page,
+// sent when upstream fails and there is nothing cached for the request
+type FallbackResponse struct {
+	Code        int
+	ContentType string
+	Body        []byte
+}
+
+// NewFallbackResponse reads the body from the file, so a missing file is noticed on startup
+func NewFallbackResponse(path string, code int) (*FallbackResponse, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+
+	return &FallbackResponse{
+		Code:        code,
+		ContentType: contentType,
+		Body:        body,
+	}, nil
+}
+
+// shouldFallback returns if the fallback has to be sent instead of what upstream responded
+func (handler *Handler) shouldFallback(entry *HTTPCacheEntry, err error) bool {
+	return handler.Config.Fallback != nil && (err != nil || entry.Response.Code >= 500)
+}
+
+// respondFallback sends the fallback response. It must not be cached by
+// anyone because it stops being true once upstream is back
+func (handler *Handler) respondFallback(w http.ResponseWriter, cacheStatus string) (int, error) {
+	fallback := handler.Config.Fallback
+	handler.addStatusHeaderIfConfigured(w, cacheStatus)
+
+	w.Header().Set("Content-Type", fallback.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(fallback.Body)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(fallback.Code)
+
+	_, err := w.Write(fallback.Body)
+	return fallback.Code, err
+}
@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFallback(t *testing.T, code int) *FallbackResponse {
+	dir, err := ioutil.TempDir("", "caddy-cache-fallback")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "maintenance.html")
+	require.NoError(t, ioutil.WriteFile(path, []byte("<h1>Back soon</h1>"), 0644))
+
+	fallback, err := NewFallbackResponse(path, code)
+	require.NoError(t, err)
+	return fallback
+}
+
+func TestFallbackResponse(t *testing.T) {
+	originalNow := now
+	defer func() { now = originalNow }()
+
+	newHandler := func(config *Config, cacheControl string, failure error) (*Handler, *bool) {
+		failing := false
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			if failing {
+				if failure != nil {
+					return http.StatusBadGateway, failure
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				return http.StatusInternalServerError, nil
+			}
+			w.Header().Add("Cache-Control", cacheControl)
+			w.Write([]byte("abc"))
+			return 200, nil
+		}), config), &failing
+	}
+
+	requireFallback := func(t *testing.T, res *http.Response, code int) {
+		requireCode(t, res, code)
+		requireBody(t, res, []byte("<h1>Back soon</h1>"))
+		require.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+		require.Equal(t, "no-store", res.Header.Get("Cache-Control"))
+	}
+
+	for _, failure := range []error{nil, errors.New("dial tcp: connection refused")} {
+		t.Run("it should be sent when nothing is cached", func(t *testing.T) {
+			now = originalNow
+			config := emptyConfig()
+			config.Fallback = newTestFallback(t, http.StatusServiceUnavailable)
+			h, failing := newHandler(config, "max-age=10", failure)
+			*failing = true
+
+			res, err := doRequest(t, h)
+			require.NoError(t, err)
+			requireStatus(t, res, cacheMiss)
+			requireFallback(t, res, http.StatusServiceUnavailable)
+		})
+	}
+
+	t.Run("it should not be cached", func(t *testing.T) {
+		now = originalNow
+		config := emptyConfig()
+		config.Fallback = newTestFallback(t, http.StatusOK)
+		h, failing := newHandler(config, "max-age=10", nil)
+		*failing = true
+
+		res, err := doRequest(t, h)
+		require.NoError(t, err)
+		requireFallback(t, res, http.StatusOK)
+
+		*failing = false
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, []byte("abc"))
+	})
+
+	t.Run("it should be sent when the previous response was private", func(t *testing.T) {
+		now = originalNow
+		config := emptyConfig()
+		config.Fallback = newTestFallback(t, http.StatusServiceUnavailable)
+		h, failing := newHandler(config, "private", nil)
+
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, []byte("abc"))
+		*failing = true
+
+		res, err := doRequest(t, h)
+		require.NoError(t, err)
+		requireStatus(t, res, cacheSkip)
+		requireFallback(t, res, http.StatusServiceUnavailable)
+	})
+
+	t.Run("it should prefer the stale response", func(t *testing.T) {
+		now = originalNow
+		config := emptyConfig()
+		config.ServeStaleOnError = true
+		config.MaxStale = time.Hour
+		config.Fallback = newTestFallback(t, http.StatusServiceUnavailable)
+		h, failing := newHandler(config, "max-age=10", nil)
+
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, []byte("abc"))
+		*failing = true
+		now = func() time.Time { return originalNow().Add(time.Minute) }
+
+		requestAndAssert(t, h, http.Header{}, 200, cacheStale, []byte("abc"))
+	})
+
+	t.Run("it should fail if the file does not exist", func(t *testing.T) {
+		_, err := NewFallbackResponse("/does/not/exist.html", http.StatusServiceUnavailable)
+		require.Error(t, err)
+	})
+}
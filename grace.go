@@ -0,0 +1,34 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+)
+
+// getEntryInGrace returns the expired entry of the request if it is within its grace and there isn't a fresh one
+func (handler *Handler) getEntryInGrace(r *http.Request) (*HTTPCacheEntry, bool) {
+	fresh, exists := handler.Cache.Get(r)
+	fresh.release()
+	if exists {
+		return nil, false
+	}
+	return handler.Cache.GetInGrace(r)
+}
+
+// refreshInBackground fetches the request again to replace its entry.
+// Only one refresh of each key runs at the same time, the other requests keep getting the stale entry
+func (handler *Handler) refreshInBackground(r *http.Request) {
+	key := getKey(handler.Config, r)
+	if _, refreshing := handler.graceRefreshes.LoadOrStore(key, true); refreshing {
+		return
+	}
+
+	req := r.WithContext(context.WithValue(r.Context(), refreshCtxKey, true))
+	req.Header = http.Header{}
+	copyHeaders(r.Header, req.Header)
+
+	go func() {
+		defer handler.graceRefreshes.Delete(key)
+		handler.ServeHTTP(&discardResponseWriter{header: http.Header{}}, req)
+	}()
+}
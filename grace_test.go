@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGrace(t *testing.T) {
+	originalNow := now
+	defer func() { now = originalNow }()
+
+	var fetches int32
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		fetch := atomic.AddInt32(&fetches, 1)
+		cacheControl := "max-age=60"
+		if r.URL.Path == "/must-revalidate" {
+			cacheControl += ", must-revalidate"
+		}
+		w.Header().Set("Cache-Control", cacheControl)
+		w.Write([]byte(strconv.Itoa(int(fetch))))
+		return 200, nil
+	})
+
+	newGraceHandler := func() *Handler {
+		now = originalNow
+		atomic.StoreInt32(&fetches, 0)
+		config := emptyConfig()
+		config.Grace = 5 * time.Minute
+		return NewHandler(upstream, config)
+	}
+
+	serve := func(h *Handler, target string) *http.Response {
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", target))
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	// The background refresh reads the time, it must end before the test moves it again
+	waitRefreshes := func(h *Handler) {
+		for i := 0; i < 1000; i++ {
+			refreshing := false
+			h.graceRefreshes.Range(func(key, value interface{}) bool {
+				refreshing = true
+				return false
+			})
+			if !refreshing {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatal("the refresh did not end")
+	}
+
+	t.Run("it should serve a fresh entry as a hit", func(t *testing.T) {
+		h := newGraceHandler()
+		requireStatus(t, serve(h, "http://example.com/"), cacheMiss)
+
+		res := serve(h, "http://example.com/")
+		requireStatus(t, res, cacheHit)
+		requireBody(t, res, []byte("1"))
+		require.Empty(t, res.Header.Get("Warning"))
+	})
+
+	t.Run("it should serve the entry within grace and revalidate it in background", func(t *testing.T) {
+		h := newGraceHandler()
+		requireStatus(t, serve(h, "http://example.com/"), cacheMiss)
+		now = func() time.Time { return originalNow().Add(2 * time.Minute) }
+
+		res := serve(h, "http://example.com/")
+		requireStatus(t, res, cacheStale)
+		requireBody(t, res, []byte("1"))
+		require.Equal(t, warningStale, res.Header.Get("Warning"))
+		waitRefreshes(h)
+
+		res = serve(h, "http://example.com/")
+		requireStatus(t, res, cacheHit)
+		requireBody(t, res, []byte("2"))
+		require.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+	})
+
+	t.Run("it should fetch the entry beyond grace", func(t *testing.T) {
+		h := newGraceHandler()
+		requireStatus(t, serve(h, "http://example.com/"), cacheMiss)
+		now = func() time.Time { return originalNow().Add(10 * time.Minute) }
+
+		res := serve(h, "http://example.com/")
+		requireStatus(t, res, cacheMiss)
+		requireBody(t, res, []byte("2"))
+	})
+
+	t.Run("it should give no grace to must-revalidate responses", func(t *testing.T) {
+		h := newGraceHandler()
+		requireStatus(t, serve(h, "http://example.com/must-revalidate"), cacheMiss)
+		now = func() time.Time { return originalNow().Add(2 * time.Minute) }
+
+		requireStatus(t, serve(h, "http://example.com/must-revalidate"), cacheMiss)
+	})
+}
@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptsGzip returns if the Accept-Encoding of the request allows a gzip body
+func acceptsGzip(header http.Header) bool {
+	return acceptsEncoding(header, "gzip")
+}
+
+// acceptsEncoding returns if the Accept-Encoding of the request allows a body with the content coding.
+// An explicit coding wins over *, a coding with q=0 is refused. Without Accept-Encoding only identity is accepted
+func acceptsEncoding(header http.Header, encoding string) bool {
+	encoding = normalizeEncoding(encoding)
+	if encoding == "identity" {
+		return true
+	}
+
+	encodingQuality, anyQuality := -1.0, -1.0
+	for _, value := range getHeaderValues(header, "Accept-Encoding") {
+		params := strings.Split(value, ";")
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+
+		switch coding := normalizeEncoding(params[0]); coding {
+		case encoding:
+			encodingQuality = quality
+		case "*":
+			anyQuality = quality
+		}
+	}
+
+	if encodingQuality >= 0 {
+		return encodingQuality > 0
+	}
+	return anyQuality > 0
+}
+
+// normalizeEncoding lowercases the content coding, x-gzip is the same as gzip as RFC 7230 section 4.2.3 says
+func normalizeEncoding(encoding string) string {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	if encoding == "x-gzip" {
+		return "gzip"
+	}
+	if encoding == "" {
+		return "identity"
+	}
+	return encoding
+}
+
+func isGzipEncoded(header http.Header) bool {
+	return normalizeEncoding(header.Get("Content-Encoding")) == "gzip"
+}
+
+// matchesEncoding returns if the body of the entry can be sent to the client of the request.
+// A gzip body is decompressed for the clients that don't accept it with gzip_dedup and compress_store,
+// other encodings are only sent to the clients that accept them, even if upstream didn't send Vary
+func matchesEncoding(r *http.Request, entry *HTTPCacheEntry, config *Config) bool {
+	if decompressesGzip(entry, config) {
+		return true
+	}
+	return acceptsEncoding(r.Header, entry.Response.snapHeader.Get("Content-Encoding"))
+}
+
+func decompressesGzip(entry *HTTPCacheEntry, config *Config) bool {
+	return (config.GzipDedup || config.CompressStore) && isGzipEncoded(entry.Response.snapHeader)
+}
+
+// negotiatesEncoding returns if the cache decides the encoding each client gets from the entry,
+// so the responses vary on Accept-Encoding even if upstream didn't say it
+func (handler *Handler) negotiatesEncoding(entry *HTTPCacheEntry) bool {
+	return entry.compressed || decompressesGzip(entry, handler.Config)
+}
+
+// withGzipAccepted returns a copy of the request that asks upstream for a gzip body.
+// With gzip_dedup every client shares the gzip representation, other encodings are not requested
+func withGzipAccepted(req *http.Request) *http.Request {
+	copied := req.WithContext(req.Context())
+	copied.Header = http.Header{}
+	copyHeaders(req.Header, copied.Header)
+	copied.Header.Set("Accept-Encoding", "gzip")
+	return copied
+}
+
+// gunzipWriter decompresses gzip bodies for the clients that don't accept gzip,
+// other bodies are sent as they are. finish must be called once the body was written
+type gunzipWriter struct {
+	http.ResponseWriter
+
+	wroteHeader bool
+	pipe        *io.PipeWriter
+	done        chan struct{}
+}
+
+func newGunzipWriter(w http.ResponseWriter) *gunzipWriter {
+	return &gunzipWriter{ResponseWriter: w}
+}
+
+func (g *gunzipWriter) WriteHeader(code int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+
+	header := g.Header()
+	if isGzipEncoded(header) {
+		// The size of the decompressed body is unknown, it is sent chunked
+		delHeaderFold(header, "Content-Encoding")
+		delHeaderFold(header, "Content-Length")
+
+		reader, writer := io.Pipe()
+		g.pipe = writer
+		g.done = make(chan struct{})
+		go g.decompress(reader)
+	}
+
+	g.ResponseWriter.WriteHeader(code)
+}
+
+// decompress sends the decompressed body, if it is not valid gzip the writes fail
+func (g *gunzipWriter) decompress(reader *io.PipeReader) {
+	defer close(g.done)
+
+	body, err := gzip.NewReader(reader)
+	if err == nil {
+		_, err = io.Copy(g.ResponseWriter, body)
+	}
+	// A body without content, like the one of a HEAD, is not an error
+	if err == io.EOF {
+		err = nil
+	}
+	reader.CloseWithError(err)
+}
+
+func (g *gunzipWriter) Write(p []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.pipe != nil {
+		return g.pipe.Write(p)
+	}
+	return g.ResponseWriter.Write(p)
+}
+
+// finish waits until the whole body is decompressed and sent
+func (g *gunzipWriter) finish() {
+	if g.pipe == nil {
+		return
+	}
+	g.pipe.Close()
+	<-g.done
+}
@@ -0,0 +1,227 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for value, expected := range map[string]bool{
+		"":                     false,
+		"gzip":                 true,
+		"deflate, GZIP":        true,
+		"x-gzip":               true,
+		"br;q=1.0, gzip;q=0.5": true,
+		"gzip;q=0":             false,
+		"*":                    true,
+		"*;q=0":                false,
+		"gzip;q=0, *":          false,
+		"identity":             false,
+		"br":                   false,
+	} {
+		require.Equal(t, expected, acceptsGzip(http.Header{"Accept-Encoding": {value}}), value)
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	require.True(t, acceptsEncoding(http.Header{}, "identity"))
+	require.True(t, acceptsEncoding(http.Header{}, ""))
+	require.False(t, acceptsEncoding(http.Header{}, "br"))
+	require.True(t, acceptsEncoding(http.Header{"Accept-Encoding": {"gzip, BR"}}, "br"))
+	require.False(t, acceptsEncoding(http.Header{"Accept-Encoding": {"br;q=0, *"}}, "br"))
+	require.True(t, acceptsEncoding(http.Header{"Accept-Encoding": {"gzip"}}, "x-gzip"))
+}
+
+func TestEncodingWithoutVary(t *testing.T) {
+	content := bytes.Repeat([]byte("compressible content "), 100)
+	compressed := &bytes.Buffer{}
+	writer := gzip.NewWriter(compressed)
+	writer.Write(content)
+	writer.Close()
+
+	// Upstream negotiates the encoding but forgets to send Vary
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Set("Cache-Control", "max-age=10")
+		if acceptsGzip(r.Header) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(compressed.Bytes())
+		} else {
+			w.Write(content)
+		}
+		return 200, nil
+	})
+
+	serve := func(h *Handler, encoding string) *http.Response {
+		r := newRequestWithOriginalURL(t, "GET", "http://example.com/")
+		if encoding != "" {
+			r.Header.Set("Accept-Encoding", encoding)
+		}
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	t.Run("it should not send a gzip body to a client that doesn't accept it", func(t *testing.T) {
+		h := NewHandler(upstream, emptyConfig())
+
+		requireStatus(t, serve(h, "gzip"), cacheMiss)
+		res := serve(h, "gzip")
+		requireStatus(t, res, cacheHit)
+		require.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+
+		for _, encoding := range []string{"", "identity", "br"} {
+			res = serve(h, encoding)
+			require.Empty(t, res.Header.Get("Content-Encoding"))
+			requireBody(t, res, content)
+		}
+	})
+
+	for name, config := range map[string]func(config *Config){
+		"gzip_dedup":     func(config *Config) { config.GzipDedup = true },
+		"compress_store": func(config *Config) { config.CompressStore = true },
+	} {
+		t.Run("it should add Vary when the cache decides the encoding with "+name, func(t *testing.T) {
+			c := emptyConfig()
+			config(c)
+			h := NewHandler(upstream, c)
+
+			for _, encoding := range []string{"gzip", "gzip", ""} {
+				res := serve(h, encoding)
+				require.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+				if encoding == "" {
+					requireStatus(t, res, cacheHit)
+					require.Empty(t, res.Header.Get("Content-Encoding"))
+					requireBody(t, res, content)
+				}
+			}
+		})
+	}
+}
+
+func TestGzipDedup(t *testing.T) {
+	content := bytes.Repeat([]byte("compressible content "), 100)
+	compressed := &bytes.Buffer{}
+	writer := gzip.NewWriter(compressed)
+	writer.Write(content)
+	writer.Close()
+
+	var encodings []string
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		encodings = append(encodings, r.Header.Get("Accept-Encoding"))
+		if r.URL.Path != "/private" {
+			w.Header().Set("Cache-Control", "max-age=10")
+		}
+		w.Header().Set("Vary", "Accept-Encoding")
+		if acceptsGzip(r.Header) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(compressed.Bytes())
+		} else {
+			w.Write(content)
+		}
+		return 200, nil
+	})
+
+	serve := func(h *Handler, target string, encoding string) *http.Response {
+		r := newRequestWithOriginalURL(t, "GET", target)
+		if encoding != "" {
+			r.Header.Set("Accept-Encoding", encoding)
+		}
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	requireIdentity := func(t *testing.T, res *http.Response) {
+		require.Empty(t, res.Header.Get("Content-Encoding"))
+		require.Empty(t, res.Header.Get("Content-Length"))
+		requireBody(t, res, content)
+	}
+
+	requireCompressed := func(t *testing.T, res *http.Response) {
+		require.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+		requireBody(t, res, compressed.Bytes())
+	}
+
+	newDedupHandler := func() *Handler {
+		encodings = nil
+		config := emptyConfig()
+		config.GzipDedup = true
+		return NewHandler(upstream, config)
+	}
+
+	t.Run("it should serve both clients from the compressed body", func(t *testing.T) {
+		h := newDedupHandler()
+
+		res := serve(h, "http://example.com/", "gzip, deflate")
+		requireStatus(t, res, cacheMiss)
+		requireCompressed(t, res)
+
+		res = serve(h, "http://example.com/", "")
+		requireStatus(t, res, cacheHit)
+		requireIdentity(t, res)
+
+		res = serve(h, "http://example.com/", "identity")
+		requireStatus(t, res, cacheHit)
+		requireIdentity(t, res)
+
+		require.Equal(t, []string{"gzip"}, encodings)
+		require.Len(t, h.Cache.GetVariants("GET example.com/?"), 1)
+		require.Equal(t, int64(compressed.Len()), h.Cache.GetVariants("GET example.com/?")[0].Response.Size())
+	})
+
+	t.Run("it should save the compressed body if an identity client comes first", func(t *testing.T) {
+		h := newDedupHandler()
+
+		res := serve(h, "http://example.com/", "")
+		requireStatus(t, res, cacheMiss)
+		requireIdentity(t, res)
+
+		res = serve(h, "http://example.com/", "gzip")
+		requireStatus(t, res, cacheHit)
+		requireCompressed(t, res)
+		require.Equal(t, []string{"gzip"}, encodings)
+	})
+
+	t.Run("it should decompress the responses that are not cached", func(t *testing.T) {
+		h := newDedupHandler()
+
+		for _, status := range []string{cacheMiss, cacheSkip} {
+			res := serve(h, "http://example.com/private", "")
+			requireStatus(t, res, status)
+			requireIdentity(t, res)
+		}
+	})
+
+	t.Run("it should not serve compressed ranges to identity clients", func(t *testing.T) {
+		h := newDedupHandler()
+		serve(h, "http://example.com/", "gzip")
+
+		r := newRequestWithOriginalURL(t, "GET", "http://example.com/")
+		r.Header.Set("Range", "bytes=0-9")
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		requireStatus(t, w.Result(), cacheBypass)
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		require.Equal(t, content, body)
+	})
+
+	t.Run("it should save a variant for each encoding by default", func(t *testing.T) {
+		encodings = nil
+		h := NewHandler(upstream, emptyConfig())
+
+		requireCompressed(t, serve(h, "http://example.com/", "gzip"))
+		requireIdentity(t, serve(h, "http://example.com/", ""))
+		require.Equal(t, []string{"gzip", ""}, encodings)
+		require.Len(t, h.Cache.GetVariants("GET example.com/?"), 2)
+	})
+}
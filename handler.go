@@ -3,7 +3,10 @@ package cache
 import (
 	"context"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/caddyserver/caddy"
 	"github.com/caddyserver/caddy/caddyhttp/httpserver"
@@ -22,6 +25,24 @@ type Handler struct {
 
 	// Handles locking for different URLs
 	URLLocks *URLLock
+
+	// Purger sends the purges to other instances, it is nil if purge_redis is not used
+	Purger *DistributedPurger
+
+	// Metrics measures the upstream latency
+	Metrics *originMetrics
+
+	// graceRefreshes are the keys being revalidated in background because they are in their grace
+	graceRefreshes *sync.Map
+
+	// ready is 1 once the urls warmed on startup are cached, see Ready
+	ready int32
+
+	// maintenance is 1 while the origin is down for maintenance, then upstream is never requested
+	maintenance int32
+
+	// admission counts the requests of each key, it is nil without admission
+	admission *frequencySketch
 }
 
 const (
@@ -29,6 +50,13 @@ const (
 	cacheMiss   = "miss"
 	cacheSkip   = "skip"
 	cacheBypass = "bypass"
+	cacheStale  = "stale"
+
+	// cacheOverloaded is sent when there are too many fetches to upstream and nothing can be served instead
+	cacheOverloaded = "overloaded"
+
+	// cacheMaintenance is sent in maintenance mode with the entries that were not fresh and when nothing is cached
+	cacheMaintenance = "maintenance"
 )
 
 var (
@@ -43,18 +71,60 @@ var (
 	}
 )
 
-func getKey(cacheKeyTemplate string, r *http.Request) string {
+func getKey(config *Config, r *http.Request) string {
+	key := getKeyWithoutDevice(config, r)
+	if config.VaryDevice != nil {
+		key = keyWithDevice(key, config.VaryDevice.classify(r.UserAgent()))
+	}
+	return keyWithVersion(key, config.KeyVersion.Get())
+}
+
+// getKeyWithoutDevice returns the key of the request before the device class is added
+func getKeyWithoutDevice(config *Config, r *http.Request) string {
+	// With key_merge_head a HEAD gets the key of the GET of the url, the entries still know their method
+	if config.KeyMergeHead && r.Method == http.MethodHead {
+		r = asGet(r)
+	}
+	key := getTemplateKey(config.CacheKeyTemplate, r)
+	for _, name := range config.KeyHeaders {
+		key += " " + name + ":" + strings.Join(r.Header[name], ",")
+	}
+	if config.KeyAccept {
+		key = keyWithAccept(key, r)
+	}
+	return key
+}
+
+func getTemplateKey(cacheKeyTemplate string, r *http.Request) string {
 	return httpserver.NewReplacer(r, nil, "").Replace(cacheKeyTemplate)
 }
 
 // NewHandler creates a new Handler using Next middleware
 func NewHandler(Next httpserver.Handler, config *Config) *Handler {
-	return &Handler{
+	// The version can be changed with the admin endpoint even if key_version was not set
+	if config.KeyVersion == nil {
+		config.KeyVersion = NewKeyVersion("")
+	}
+
+	handler := &Handler{
 		Config:   config,
-		Cache:    NewHTTPCache(config.CacheKeyTemplate),
+		Cache:    NewHTTPCache(config),
 		URLLocks: NewURLLock(),
 		Next:     Next,
+		Metrics:  newOriginMetrics(config.MetricsByHost),
+
+		graceRefreshes: new(sync.Map),
+	}
+	if !handler.warmsOnStartup() {
+		handler.markReady()
+	}
+	if config.Maintenance {
+		handler.maintenance = 1
+	}
+	if config.Admission > 0 {
+		handler.admission = newFrequencySketch()
 	}
+	return handler
 }
 
 /* Responses */
@@ -67,8 +137,43 @@ func copyHeaders(from http.Header, to http.Header) {
 	}
 }
 
+// delHeaderFold deletes the header even if the key is not canonicalized
+func delHeaderFold(h http.Header, name string) {
+	for k := range h {
+		if strings.EqualFold(k, name) {
+			delete(h, k)
+		}
+	}
+}
+
+// hasHeaderFold returns if the header is set, the name and the keys don't need to be canonicalized
+func hasHeaderFold(h http.Header, name string) bool {
+	for k := range h {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutHeader returns a copy of the request without the header
+func withoutHeader(r *http.Request, name string) *http.Request {
+	req := r.WithContext(r.Context())
+	req.Header = http.Header{}
+	copyHeaders(r.Header, req.Header)
+	delHeaderFold(req.Header, name)
+	return req
+}
+
 func (handler *Handler) addStatusHeaderIfConfigured(w http.ResponseWriter, status string) {
-	if rec, ok := w.(*httpserver.ResponseRecorder); ok {
+	// Every response gets its status here, so it is counted here too
+	handler.Cache.counters.responded(status)
+
+	recorder := w
+	if gunzip, ok := w.(*gunzipWriter); ok {
+		recorder = gunzip.ResponseWriter
+	}
+	if rec, ok := recorder.(*httpserver.ResponseRecorder); ok {
 		rec.Replacer.Set("cache_status", status)
 	}
 
@@ -77,39 +182,92 @@ func (handler *Handler) addStatusHeaderIfConfigured(w http.ResponseWriter, statu
 	}
 }
 
-func (handler *Handler) respond(w http.ResponseWriter, entry *HTTPCacheEntry, cacheStatus string) (int, error) {
+// addHitHeaders sets the add_headers_on_hit headers to the responses sent from the cache.
+// They replace the ones with the same name that the cached response has
+func (handler *Handler) addHitHeaders(header http.Header, cacheStatus string) {
+	if cacheStatus != cacheHit && cacheStatus != cacheStale && cacheStatus != cacheMaintenance {
+		return
+	}
+	for name, values := range handler.Config.HitHeaders {
+		delHeaderFold(header, name)
+		header[name] = append([]string{}, values...)
+	}
+}
+
+func (handler *Handler) respond(w http.ResponseWriter, r *http.Request, entry *HTTPCacheEntry, cacheStatus string) (int, error) {
+	if url, ok := offloadedURL(w, r, entry); ok {
+		return handler.respondOffloaded(w, r, entry, cacheStatus, url)
+	}
 	handler.addStatusHeaderIfConfigured(w, cacheStatus)
 
-	copyHeaders(entry.Response.snapHeader, w.Header())
+	entry.Response.CopyHeadersTo(w.Header())
+	removeMismatchedWarnings(w.Header())
+	handler.addHitHeaders(w.Header(), cacheStatus)
+	handler.addAgeHeader(w.Header(), entry, cacheStatus)
+	handler.addDebugTTLHeader(w, r, entry)
+	if handler.negotiatesEncoding(entry) {
+		addVaryAcceptEncoding(w.Header())
+	}
+	if length, ok := entry.knownLength(); ok {
+		w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	}
 	w.WriteHeader(entry.Response.Code)
 
 	err := entry.WriteBodyTo(w)
+	if err == nil {
+		err = entry.Response.AbortError()
+	}
+
+	// Trailers are only known once the whole body was written
+	for name, values := range entry.Response.Trailer() {
+		w.Header()[http.TrailerPrefix+name] = values
+	}
 
 	return entry.Response.Code, err
 }
 
-/* Handler */
+// respondNotModified sends the entry headers that are not related to the body with a 304
+func (handler *Handler) respondNotModified(w http.ResponseWriter, r *http.Request, entry *HTTPCacheEntry, cacheStatus string) (int, error) {
+	handler.addStatusHeaderIfConfigured(w, cacheStatus)
 
-func shouldUseCache(req *http.Request) bool {
-	// TODO Add more logic like get params, ?nocache=true
+	entry.Response.CopyHeadersTo(w.Header())
+	removeMismatchedWarnings(w.Header())
+	handler.addHitHeaders(w.Header(), cacheStatus)
+	handler.addAgeHeader(w.Header(), entry, cacheStatus)
+	handler.addDebugTTLHeader(w, r, entry)
+	delHeaderFold(w.Header(), "Content-Type")
+	delHeaderFold(w.Header(), "Content-Length")
+	delHeaderFold(w.Header(), "Content-Encoding")
+	w.WriteHeader(http.StatusNotModified)
+
+	return http.StatusNotModified, nil
+}
 
-	if req.Method != "GET" && req.Method != "HEAD" {
-		// Only cache Get and head request
-		return false
-	}
+// respondNotCached answers a request with only-if-cached that has nothing usable in cache.
+// RFC 7234 section 5.2.1.7 requires a 504
+func (handler *Handler) respondNotCached(w http.ResponseWriter, event *cacheEvent) (int, error) {
+	event.record(cacheMiss, nil)
+	handler.addStatusHeaderIfConfigured(w, cacheMiss)
+	return http.StatusGatewayTimeout, nil
+}
 
-	// Range requests still not supported
-	// It may happen that the previous request for this url has a successful response
-	// but for another Range. So a special handling is needed
-	if req.Header.Get("range") != "" {
-		return false
+/* Handler */
+
+func shouldUseCache(req *http.Request, config *Config) bool {
+	return bypassReason(req, config) == ""
+}
+
+// bypassReason returns why the request can not use the cache or an empty string if it can
+func bypassReason(req *http.Request, config *Config) string {
+	if !isCacheMethod(req.Method, config) {
+		return "method " + req.Method
 	}
 
 	if isWebSocket(req.Header) {
-		return false
+		return "websocket"
 	}
 
-	return true
+	return ""
 }
 
 func popOrNil(errChan chan error) (err error) {
@@ -121,13 +279,24 @@ func popOrNil(errChan chan error) (err error) {
 }
 
 func (handler *Handler) fetchUpstream(req *http.Request) (*HTTPCacheEntry, error) {
+	handler.Metrics.fetchStarted()
+	return handler.fetchCounted(req)
+}
+
+// fetchCounted fetches from upstream a request that was already counted as in flight
+func (handler *Handler) fetchCounted(req *http.Request) (*HTTPCacheEntry, error) {
+	start := time.Now()
+
 	// Create a new empty response
 	response := NewResponse()
+	response.preserveHeaderCase = handler.Config.PreserveHeaderCase
 
 	errChan := make(chan error, 1)
 
 	// Do the upstream fetching in background
 	go func(req *http.Request, response *Response) {
+		defer handler.Metrics.fetchEnded()
+
 		// Create a new context to avoid terminating the Next.ServeHTTP when the original
 		// request is closed. Otherwise if the original request is cancelled the other requests
 		// will see a bad response that has the same contents the first request has
@@ -145,9 +314,31 @@ func (handler *Handler) fetchUpstream(req *http.Request) (*HTTPCacheEntry, error
 			}
 		}
 
+		updatedContext, cancel := context.WithCancel(updatedContext)
+		defer cancel()
+
+		done := make(chan struct{})
+		defer close(done)
+
+		// With body_timeout a stalled upstream is cancelled instead of holding the fetch forever
+		if handler.Config.BodyTimeout > 0 {
+			go watchBody(response, handler.Config.BodyTimeout, cancel, done)
+		}
+
+		// Background refreshes outlive the request that started them, they are never cancelled with it
+		if handler.Config.AbortOnDisconnect && !isRefreshRequest(req) {
+			go watchClient(req.Context(), response, cancel, done)
+		}
+
 		updatedReq := req.WithContext(updatedContext)
+		if handler.Config.GzipDedup {
+			updatedReq = withGzipAccepted(updatedReq)
+		}
+		if handler.Config.VaryLanguage != nil {
+			updatedReq = withLanguage(updatedReq, handler.Config.VaryLanguage.normalize(req.Header))
+		}
 
-		statusCode, upstreamError := handler.Next.ServeHTTP(response, updatedReq)
+		statusCode, upstreamError := handler.serveUpstream(response, updatedReq, req)
 		errChan <- upstreamError
 
 		// If status code was not set, this will not replace it
@@ -165,28 +356,175 @@ func (handler *Handler) fetchUpstream(req *http.Request) (*HTTPCacheEntry, error
 
 	// Wait headers to be sent
 	response.WaitHeaders()
+	handler.clearSiteData(req, response.snapHeader)
 
 	// Create a new CacheEntry
-	return NewHTTPCacheEntry(getKey(handler.Config.CacheKeyTemplate, req), req, response, handler.Config), popOrNil(errChan)
+	entry := NewHTTPCacheEntry(getKey(handler.Config, req), req, response, handler.Config)
+	entry.fetchStart = start
+	entry.firstByteAt = time.Now()
+	return entry, popOrNil(errChan)
 }
 
 func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
-	if !shouldUseCache(r) {
+	if handler.isAdminRequest(r) {
+		return handler.serveAdmin(w, r)
+	}
+
+	if handler.isPurgeRequest(r) {
+		return handler.servePurge(w, r)
+	}
+
+	if handler.bypassQuery(r) {
+		r = handler.withoutBypassQuery(r)
+	}
+
+	// Otherwise a client could send a status to upstream or the logs, like a hit that never happened
+	if handler.Config.StatusHeader != "" && hasHeaderFold(r.Header, handler.Config.StatusHeader) {
+		r = withoutHeader(r, handler.Config.StatusHeader)
+	}
+
+	if handler.Config.EventLog == EventLogOff && handler.Config.EventSink == nil {
+		return handler.serve(w, r, nil)
+	}
+
+	event := &cacheEvent{Key: getKey(handler.Config, r), Method: r.Method, request: r}
+	code, err := handler.serve(w, r, event)
+	event.Code = code
+	if requestedRange := r.Header.Get("Range"); requestedRange != "" {
+		event.Range = requestedRange
+		event.ContentRange = w.Header().Get("Content-Range")
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	handler.Cache.events.emitStatus(event)
+	if handler.Config.EventLog != EventLogOff {
+		handler.logEvent(event)
+	}
+	return code, err
+}
+
+// serve responds the request and records what was done in the event if it is not nil
+func (handler *Handler) serve(w http.ResponseWriter, r *http.Request, event *cacheEvent) (int, error) {
+	if reason := bypassReason(r, handler.Config); reason != "" {
+		event.bypass(reason)
+		handler.addStatusHeaderIfConfigured(w, cacheBypass)
+		if !isSafeMethod(r.Method) {
+			return handler.serveUnsafe(w, r)
+		}
+		return handler.Next.ServeHTTP(w, r)
+	}
+
+	directives := getRequestDirectives(r)
+
+	// With gzip_dedup or compress_store the bodies are saved compressed, they are decompressed for the clients that don't accept gzip
+	gunzip := (handler.Config.GzipDedup || handler.Config.CompressStore) && !acceptsGzip(r.Header)
+	if gunzip {
+		decompressed := newGunzipWriter(w)
+		defer decompressed.finish()
+		w = decompressed
+	}
+
+	if handler.inMaintenance() {
+		return handler.serveMaintenance(w, r, event, gunzip)
+	}
+
+	// Ranges are only served from entries that are already cached.
+	// Responses to range requests are partial so they are never saved as entries,
+	// with range_assembly they are saved as segments of the whole body.
+	// Ranges of a compressed body can't be decompressed, so they are not served to clients that need it
+	if r.Header.Get("Range") != "" {
+		entry, exists := handler.Cache.Get(r)
+		defer entry.release()
+		if exists && entry.isPublic && !entry.alwaysRevalidate && r.Method == http.MethodGet && !gunzip {
+			event.record(cacheHit, entry)
+			return handler.respondRange(w, r, entry, cacheHit)
+		}
+		if handler.Config.RangeAssembly && r.Method == http.MethodGet && !gunzip {
+			return handler.serveAssembledRange(w, r, event, directives)
+		}
+		if directives.onlyIfCached {
+			return handler.respondNotCached(w, event)
+		}
+		event.bypass("range request")
 		handler.addStatusHeaderIfConfigured(w, cacheBypass)
 		return handler.Next.ServeHTTP(w, r)
 	}
 
-	lock := handler.URLLocks.Adquire(getKey(handler.Config.CacheKeyTemplate, r))
+	// A HEAD gets the headers of the GET entry of the url when it is cached
+	if r.Method == http.MethodHead && !isRefreshRequest(r) {
+		if entry, ok := handler.getEntryForHead(r, directives); ok {
+			defer entry.release()
+			event.record(cacheHit, entry)
+			return handler.respondHead(w, r, entry)
+		}
+	}
+
+	// Within its grace an expired entry is served at once, without waiting the request that revalidates it
+	if handler.Config.Grace > 0 && !isRefreshRequest(r) && !directives.onlyIfCached {
+		if entry, ok := handler.getEntryInGrace(r); ok {
+			defer entry.release()
+			handler.refreshInBackground(r)
+			event.record(cacheStale, entry)
+			return handler.respondStale(w, r, entry, warningStale)
+		}
+	}
+
+	// Every request counts, so the keys that are requested often stay admitted
+	admitted := handler.admits(r)
+
+	waitStart := time.Now()
+	lock, locked := handler.URLLocks.AdquireWithTimeout(getKey(handler.Config, r), handler.Config.CollapseTimeout)
+	if !locked {
+		return handler.serveWithoutLock(w, r, event, directives)
+	}
 
 	// Lookup correct entry
+	// It is released once the request ends, so it is not removed while it is sent
 	previousEntry, exists := handler.Cache.Get(r)
+	defer previousEntry.release()
+
+	// With min-fresh entries that are about to expire must be fetched again.
+	// Scheduled refreshes always replace the entry
+	if exists && previousEntry.isPublic && (!directives.freshEnough(previousEntry) || isRefreshRequest(r)) {
+		exists = false
+	}
+
+	// no-cache entries are only served after upstream confirms they did not change,
+	// one that upstream confirmed while this request waited the lock is not asked again
+	var revalidated *HTTPCacheEntry
+	if exists && previousEntry.isPublic && previousEntry.alwaysRevalidate && !validatedSince(previousEntry, waitStart) {
+		revalidated = previousEntry
+		exists = false
+	}
+
+	// With max-stale the client accepts an expired entry instead of fetching a new one
+	if !exists && directives.maxStaleSet {
+		staleEntry, ok := handler.Cache.GetStale(r, directives.maxStale)
+		defer staleEntry.release()
+		if ok && canServeStale(staleEntry) {
+			lock.Unlock()
+			event.record(cacheStale, staleEntry)
+			return handler.respondStale(w, r, staleEntry, warningStale)
+		}
+	}
 
 	// First case: CACHE HIT
 	// The response exists in cache and is public
 	// It should be served as saved
 	if exists && previousEntry.isPublic {
 		lock.Unlock()
-		return handler.respond(w, previousEntry, cacheHit)
+		event.record(cacheHit, previousEntry)
+		if isNotModified(r, previousEntry) {
+			return handler.respondNotModified(w, r, previousEntry, cacheHit)
+		}
+		return handler.respond(w, r, previousEntry, cacheHit)
+	}
+
+	// The client does not want to contact upstream
+	if directives.onlyIfCached {
+		lock.Unlock()
+		return handler.respondNotCached(w, event)
 	}
 
 	// Second case: CACHE SKIP
@@ -196,47 +534,210 @@ func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int,
 	// To check if the new response changes to public
 	if exists && !previousEntry.isPublic {
 		lock.Unlock()
-		entry, err := handler.fetchUpstream(r)
+		start := time.Now()
+		entry, err := handler.fetchWithinLimit(r)
+		if err == errOverloaded {
+			return handler.respondOverloaded(w, r, event, nil)
+		}
+		event.fetched(start)
+		if handler.shouldFallback(entry, err) {
+			entry.Response.SetBody(nil)
+			handler.Metrics.observe(entry, cacheSkip)
+			event.record(cacheSkip, entry)
+			return handler.respondFallback(w, cacheSkip)
+		}
 		if err != nil {
+			// Release the upstream response, its body is not going to be used
+			entry.Response.SetBody(nil)
+			handler.Metrics.observe(entry, cacheSkip)
 			return entry.Response.Code, err
 		}
 
+		if entry.isPublic && !admitted {
+			entry.notAdmitted(handler.Config)
+		}
+
 		// Case when response was private but now is public
 		if entry.isPublic {
-			err := entry.setStorage(handler.Config)
+			err := entry.setStorage(handler.Cache)
 			if err != nil {
 				return 500, err
 			}
 
-			handler.Cache.Put(r, entry)
-			return handler.respond(w, entry, cacheMiss)
+			// It is still private if the body is smaller than min_body_size
+			if entry.isPublic {
+				entry.acquire()
+				defer entry.release()
+				handler.Cache.Put(r, entry)
+				handler.saveContentLocation(r, entry)
+				handler.Metrics.observe(entry, cacheMiss)
+				event.record(cacheMiss, entry)
+				return handler.respond(w, r, entry, cacheMiss)
+			}
 		}
 
-		return handler.respond(w, entry, cacheSkip)
+		handler.Metrics.observe(entry, cacheSkip)
+		event.record(cacheSkip, entry)
+		return handler.respond(w, r, entry, cacheSkip)
 	}
 
 	// Third case: CACHE MISS
 	// The response is not in cache
 	// It should be fetched from upstream and save it in cache
-	entry, err := handler.fetchUpstream(r)
+	missStatus := cacheMiss
+	if isBypassQueryRequest(r) {
+		missStatus = cacheBypass
+	}
+
+	// An expired entry with validators is revalidated, its body is reused if it did not change
+	if revalidated == nil && missStatus == cacheMiss && !isRefreshRequest(r) {
+		staleEntry, ok := handler.Cache.GetStale(r, handler.Config.MaxStale)
+		defer staleEntry.release()
+		if ok && validatedSince(staleEntry, waitStart) {
+			lock.Unlock()
+			event.record(cacheHit, staleEntry)
+			if isNotModified(r, staleEntry) {
+				return handler.respondNotModified(w, r, staleEntry, cacheHit)
+			}
+			return handler.respond(w, r, staleEntry, cacheHit)
+		}
+		if ok && hasValidators(staleEntry.Response.snapHeader) {
+			revalidated = staleEntry
+		}
+	}
+
+	upstreamRequest := r
+	if revalidated != nil {
+		upstreamRequest = revalidationRequest(r, revalidated)
+	}
+
+	start := time.Now()
+	entry, err := handler.fetchWithinLimit(upstreamRequest)
+	if err == errOverloaded {
+		lock.Unlock()
+		staleEntry, _ := handler.Cache.GetStale(r, handler.Config.MaxStale)
+		defer staleEntry.release()
+		return handler.respondOverloaded(w, r, event, staleEntry)
+	}
+	event.fetched(start)
+
+	if revalidated != nil {
+		// The entry did not change, it is served as a hit
+		if err == nil && entry.Response.Code == http.StatusNotModified {
+			return handler.serveRevalidated(w, r, event, lock, revalidated, entry)
+		}
+
+		// Otherwise the new response replaces it, saved with the headers of the client
+		entry.Request = r
+	}
+
+	// Upstream can answer with a 304 a request the cache did not make conditional, if the conditions of the
+	// client were forwarded or it misbehaves. The empty body is never cached, it refreshes the entry it refers to
+	if revalidated == nil && err == nil && entry.Response.Code == http.StatusNotModified {
+		if stored, ok := handler.getNotModifiedEntry(r, previousEntry, entry); ok {
+			defer stored.release()
+			return handler.serveRevalidated(w, r, event, lock, stored, entry)
+		}
+
+		// It is sent as it is, saving it would replace the cached entry with one that has no body
+		handler.Metrics.observe(entry, cacheMiss)
+		lock.Unlock()
+		event.record(missStatus, entry)
+		return handler.respond(w, r, entry, missStatus)
+	}
+
+	// If upstream failed an expired entry is better than an error
+	if handler.Config.ServeStaleOnError && (err != nil || entry.Response.Code >= 500) {
+		staleEntry, ok := handler.Cache.GetStale(r, handler.Config.MaxStale)
+		defer staleEntry.release()
+		if ok && canServeStale(staleEntry) {
+			// Release the upstream response, its body is not going to be used
+			entry.Response.SetBody(nil)
+			lock.Unlock()
+			handler.Metrics.observe(entry, cacheStale)
+			event.record(cacheStale, staleEntry)
+			return handler.respondStale(w, r, staleEntry, warningRevalidationFailed)
+		}
+	}
+
+	handler.Metrics.observe(entry, cacheMiss)
+	// A failed refresh keeps the entry that was cached
+	if isRefreshRequest(r) && previousEntry != nil && (err != nil || entry.Response.Code >= 500) {
+		lock.Unlock()
+		event.record(missStatus, entry)
+		if err != nil {
+			entry.Response.SetBody(nil)
+			return entry.Response.Code, err
+		}
+		return handler.respond(w, r, entry, missStatus)
+	}
+
+	// The stale entry was already looked for, there is nothing else to send
+	if handler.shouldFallback(entry, err) {
+		// Release the upstream response, its body is not going to be used
+		entry.Response.SetBody(nil)
+		lock.Unlock()
+		event.record(missStatus, entry)
+		return handler.respondFallback(w, missStatus)
+	}
+
 	if err != nil {
+		entry.Response.SetBody(nil)
 		lock.Unlock()
 		return entry.Response.Code, err
 	}
 
+	if entry.isPublic && !admitted {
+		entry.notAdmitted(handler.Config)
+	}
+
 	// Entry is always saved, even if it is not public
 	// This is to release the URL lock.
 	if entry.isPublic {
-		err := entry.setStorage(handler.Config)
+		err := entry.setStorage(handler.Cache)
 		if err != nil {
 			lock.Unlock()
 			return 500, err
 		}
 	}
 
+	// Like the entries found in the cache, it is not removed until it is sent
+	entry.acquire()
+	defer entry.release()
 	handler.Cache.Put(r, entry)
+	handler.saveContentLocation(r, entry)
 	lock.Unlock()
-	return handler.respond(w, entry, cacheMiss)
+	event.record(missStatus, entry)
+	return handler.respond(w, r, entry, missStatus)
+}
+
+// serveWithoutLock answers when another request of the same key is fetching upstream for longer than collapse_timeout.
+// It uses what is cached if it can, otherwise it goes upstream without saving the response
+func (handler *Handler) serveWithoutLock(w http.ResponseWriter, r *http.Request, event *cacheEvent, directives requestDirectives) (int, error) {
+	entry, exists := handler.Cache.Get(r)
+	defer entry.release()
+	if exists && entry.isPublic && !entry.alwaysRevalidate && directives.freshEnough(entry) && !isRefreshRequest(r) {
+		event.record(cacheHit, entry)
+		if isNotModified(r, entry) {
+			return handler.respondNotModified(w, r, entry, cacheHit)
+		}
+		return handler.respond(w, r, entry, cacheHit)
+	}
+
+	if directives.onlyIfCached {
+		return handler.respondNotCached(w, event)
+	}
+
+	staleEntry, ok := handler.Cache.GetStale(r, handler.Config.MaxStale)
+	defer staleEntry.release()
+	if ok && canServeStale(staleEntry) {
+		event.record(cacheStale, staleEntry)
+		return handler.respondStale(w, r, staleEntry, warningStale)
+	}
+
+	event.bypass("collapse timeout")
+	handler.addStatusHeaderIfConfigured(w, cacheBypass)
+	return handler.Next.ServeHTTP(w, r)
 }
 
 func isWebSocket(h http.Header) bool {
@@ -46,7 +46,7 @@ func TestCacheKeyTemplating(t *testing.T) {
 			// match the templating behavior of the httpserver.Replacer.
 			r.TLS = &tls.ConnectionState{}
 
-			actual := getKey(test.input, r)
+			actual := getTemplateKey(test.input, r)
 			require.Equal(t, test.expect, actual, "Invalid cache key computed in test "+strconv.Itoa(i+1))
 		})
 	}
@@ -0,0 +1,55 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// getEntryForHead returns the cached GET entry of the url of a HEAD request.
+// RFC 7231 section 4.3.2 says a HEAD gets the same headers as a GET, so both don't need to be fetched
+func (handler *Handler) getEntryForHead(r *http.Request, directives requestDirectives) (*HTTPCacheEntry, bool) {
+	entry, exists := handler.Cache.Get(asGet(r))
+	if !exists || !entry.isPublic || entry.alwaysRevalidate || !directives.freshEnough(entry) {
+		entry.release()
+		return nil, false
+	}
+	return entry, true
+}
+
+// asGet returns a copy of the request with the GET method
+func asGet(r *http.Request) *http.Request {
+	get := r.WithContext(r.Context())
+	get.Method = http.MethodGet
+	return get
+}
+
+// servesMethod returns if the entry can answer a request with that method. A GET entry answers a HEAD
+// too, but a HEAD entry has no body for a GET. Their keys are the same without {method} in the template
+// or with key_merge_head
+func servesMethod(method string, entry *HTTPCacheEntry) bool {
+	return entry.Request.Method == method || method == http.MethodHead && entry.Request.Method == http.MethodGet
+}
+
+// respondHead sends the headers of a GET entry without its body.
+// Content-Length is the size of the body a GET would get, even if upstream did not send it
+func (handler *Handler) respondHead(w http.ResponseWriter, r *http.Request, entry *HTTPCacheEntry) (int, error) {
+	if isNotModified(r, entry) {
+		return handler.respondNotModified(w, r, entry, cacheHit)
+	}
+
+	handler.addStatusHeaderIfConfigured(w, cacheHit)
+
+	entry.Response.CopyHeadersTo(w.Header())
+	removeMismatchedWarnings(w.Header())
+	handler.addHitHeaders(w.Header(), cacheHit)
+	handler.addAgeHeader(w.Header(), entry, cacheHit)
+	if handler.negotiatesEncoding(entry) {
+		addVaryAcceptEncoding(w.Header())
+	}
+	if length, ok := entry.knownLength(); ok {
+		w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	}
+	w.WriteHeader(entry.Response.Code)
+
+	return entry.Response.Code, nil
+}
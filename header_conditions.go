@@ -0,0 +1,44 @@
+package cache
+
+import "net/http"
+
+// HeaderCondition matches the responses that have the Header, with a value that matches any of the Values globs
+// if there are any
+type HeaderCondition struct {
+	Header string
+	Values []string
+}
+
+func (condition HeaderCondition) matches(header http.Header) bool {
+	values, ok := header[http.CanonicalHeaderKey(condition.Header)]
+	if !ok {
+		return false
+	}
+	if len(condition.Values) == 0 {
+		return true
+	}
+
+	for _, value := range values {
+		for _, pattern := range condition.Values {
+			if matchGlob(pattern, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchConditions returns if any of the conditions matches, or all of them with header_conditions all.
+// No conditions never match
+func matchConditions(conditions []HeaderCondition, header http.Header, all bool) bool {
+	if len(conditions) == 0 {
+		return false
+	}
+
+	for _, condition := range conditions {
+		if condition.matches(header) != all {
+			return !all
+		}
+	}
+	return all
+}
@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderConditions(t *testing.T) {
+	header := http.Header{
+		"Set-Cookie":   []string{"session=1"},
+		"X-Cacheable":  []string{"1"},
+		"Content-Type": []string{"image/png"},
+	}
+
+	t.Run("it should match the presence of a header", func(t *testing.T) {
+		require.True(t, HeaderCondition{Header: "set-cookie"}.matches(header))
+		require.False(t, HeaderCondition{Header: "X-Missing"}.matches(header))
+	})
+
+	t.Run("it should match the values with globs", func(t *testing.T) {
+		require.True(t, HeaderCondition{Header: "Content-Type", Values: []string{"text/*", "image/*"}}.matches(header))
+		require.False(t, HeaderCondition{Header: "Content-Type", Values: []string{"text/*"}}.matches(header))
+		require.True(t, HeaderCondition{Header: "X-Cacheable", Values: []string{"1"}}.matches(header))
+	})
+
+	t.Run("it should combine the conditions with any or all", func(t *testing.T) {
+		conditions := []HeaderCondition{{Header: "X-Cacheable"}, {Header: "X-Missing"}}
+		require.True(t, matchConditions(conditions, header, false))
+		require.False(t, matchConditions(conditions, header, true))
+		require.True(t, matchConditions(conditions[:1], header, true))
+		require.False(t, matchConditions(nil, header, false))
+		require.False(t, matchConditions(nil, header, true))
+	})
+}
+
+func TestHeaderConditionsCacheability(t *testing.T) {
+	config := emptyConfig()
+	config.SkipIfHeader = []HeaderCondition{{Header: "Set-Cookie"}}
+	config.CacheIfHeader = []HeaderCondition{{Header: "X-Cacheable", Values: []string{"1"}}}
+
+	t.Run("it should not cache a response with a skipped header", func(t *testing.T) {
+		header := makeHeader("Cache-Control", "max-age=60")
+		header.Set("Set-Cookie", "session=1")
+		isPublic, _, reason := getCacheability(makeRequest("/", http.Header{}), makeResponse(200, header), config)
+		require.False(t, isPublic)
+		require.Equal(t, "skip_if_header", reason)
+	})
+
+	t.Run("it should cache a response without explicit expiration with a matching value", func(t *testing.T) {
+		isPublic, expiration, reason := getCacheability(makeRequest("/", http.Header{}), makeResponse(200, makeHeader("X-Cacheable", "1")), config)
+		require.True(t, isPublic)
+		require.Equal(t, "cache_if_header with default max age", reason)
+		require.True(t, expiration.After(now()))
+	})
+
+	t.Run("it should not cache a response with another value", func(t *testing.T) {
+		isPublic, _ := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(200, makeHeader("X-Cacheable", "0")), config)
+		require.False(t, isPublic)
+	})
+
+	t.Run("it should not override no-store", func(t *testing.T) {
+		header := makeHeader("X-Cacheable", "1")
+		header.Set("Cache-Control", "no-store")
+		isPublic, _ := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(200, header), config)
+		require.False(t, isPublic)
+	})
+
+	t.Run("it should skip a response with a ttl header", func(t *testing.T) {
+		ttlConfig := *config
+		ttlConfig.TTLHeader = "X-Cache-TTL"
+		header := makeHeader("X-Cache-TTL", "60")
+		header.Set("Set-Cookie", "session=1")
+		isPublic, _ := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(200, header), &ttlConfig)
+		require.False(t, isPublic)
+	})
+}
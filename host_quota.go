@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// HostUsage is how many public entries and bytes a host has in the cache
+type HostUsage struct {
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`
+
+	// policy decides which entry of the host is evicted first
+	policy evictionPolicy
+}
+
+// hostQuotas keeps the usage of each host so the eviction of a host
+// that goes over its quota never removes the entries of another one
+type hostQuotas struct {
+	lock     *sync.Mutex
+	eviction string
+	hosts    map[string]*HostUsage
+	sizes    map[*HTTPCacheEntry]int64
+}
+
+func newHostQuotas(eviction string) *hostQuotas {
+	return &hostQuotas{
+		lock:     new(sync.Mutex),
+		eviction: eviction,
+		hosts:    map[string]*HostUsage{},
+		sizes:    map[*HTTPCacheEntry]int64{},
+	}
+}
+
+// hostOf returns the host of the request without the port
+func hostOf(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	return strings.ToLower(host)
+}
+
+func (quotas *hostQuotas) add(entry *HTTPCacheEntry) {
+	quotas.lock.Lock()
+	defer quotas.lock.Unlock()
+
+	if _, ok := quotas.sizes[entry]; ok {
+		return
+	}
+
+	host := hostOf(entry.Request)
+	usage, ok := quotas.hosts[host]
+	if !ok {
+		usage = &HostUsage{policy: newEvictionPolicy(quotas.eviction)}
+		quotas.hosts[host] = usage
+	}
+
+	usage.Entries++
+	usage.policy.add(entry)
+	quotas.sizes[entry] = 0
+}
+
+// setSize adds the size of the body once it is known. Removed entries are ignored
+func (quotas *hostQuotas) setSize(entry *HTTPCacheEntry, size int64) {
+	quotas.lock.Lock()
+	defer quotas.lock.Unlock()
+
+	if _, ok := quotas.sizes[entry]; !ok {
+		return
+	}
+
+	usage := quotas.hosts[hostOf(entry.Request)]
+	usage.Size += size - quotas.sizes[entry]
+	quotas.sizes[entry] = size
+}
+
+func (quotas *hostQuotas) touch(entry *HTTPCacheEntry) {
+	quotas.lock.Lock()
+	defer quotas.lock.Unlock()
+
+	if _, ok := quotas.sizes[entry]; ok {
+		quotas.hosts[hostOf(entry.Request)].policy.touch(entry)
+	}
+}
+
+func (quotas *hostQuotas) remove(entry *HTTPCacheEntry) {
+	quotas.lock.Lock()
+	defer quotas.lock.Unlock()
+	quotas.removeLocked(entry)
+}
+
+func (quotas *hostQuotas) removeLocked(entry *HTTPCacheEntry) {
+	size, ok := quotas.sizes[entry]
+	if !ok {
+		return
+	}
+
+	host := hostOf(entry.Request)
+	usage := quotas.hosts[host]
+	usage.policy.remove(entry)
+	usage.Entries--
+	usage.Size -= size
+
+	delete(quotas.sizes, entry)
+	if usage.Entries == 0 {
+		delete(quotas.hosts, host)
+	}
+}
+
+// overQuota stops tracking the entries of the host that the eviction policy picks until
+// it is within the limits and returns them so they are removed from the cache.
+// The entry that was just saved is only evicted if it is over the limits on its own,
+// with lfu it would always be the least used one. A limit of 0 means there is no limit
+func (quotas *hostQuotas) overQuota(host string, maxEntries int, maxSize int64, saved *HTTPCacheEntry) []*HTTPCacheEntry {
+	quotas.lock.Lock()
+	defer quotas.lock.Unlock()
+
+	usage, ok := quotas.hosts[host]
+	if !ok {
+		return nil
+	}
+
+	evicted := []*HTTPCacheEntry{}
+	for usage.Entries > 0 && (maxEntries > 0 && usage.Entries > maxEntries || maxSize > 0 && usage.Size > maxSize) {
+		entry := usage.policy.next(saved)
+		if entry == nil {
+			entry = saved
+		}
+		quotas.removeLocked(entry)
+		evicted = append(evicted, entry)
+	}
+
+	return evicted
+}
+
+// usage returns a copy of the usage of every host
+func (quotas *hostQuotas) usage() map[string]HostUsage {
+	quotas.lock.Lock()
+	defer quotas.lock.Unlock()
+
+	result := map[string]HostUsage{}
+	for host, usage := range quotas.hosts {
+		result[host] = HostUsage{Entries: usage.Entries, Size: usage.Size}
+	}
+	return result
+}
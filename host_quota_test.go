@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostQuotas(t *testing.T) {
+	newHandler := func(config *Config) *Handler {
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Write([]byte("abc"))
+			return 200, nil
+		}), config)
+	}
+
+	doCachedRequest := func(h *Handler, target string) {
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", target))
+		require.NoError(t, err)
+	}
+
+	isCached := func(h *Handler, key string) bool {
+		return len(h.Cache.GetVariants(key)) > 0
+	}
+
+	t.Run("it should evict only the entries of the host over the quota", func(t *testing.T) {
+		config := newAdminConfig()
+		config.PerHostMaxEntries = 2
+		h := newHandler(config)
+
+		doCachedRequest(h, "http://b.com/1")
+		doCachedRequest(h, "http://a.com/1")
+		doCachedRequest(h, "http://a.com/2")
+		doCachedRequest(h, "http://a.com/3")
+
+		require.False(t, isCached(h, "GET a.com/1?"))
+		require.True(t, isCached(h, "GET a.com/2?"))
+		require.True(t, isCached(h, "GET a.com/3?"))
+		require.True(t, isCached(h, "GET b.com/1?"))
+	})
+
+	t.Run("it should evict the least recently used entry", func(t *testing.T) {
+		config := newAdminConfig()
+		config.PerHostMaxEntries = 2
+		h := newHandler(config)
+
+		doCachedRequest(h, "http://a.com/1")
+		doCachedRequest(h, "http://a.com/2")
+		doCachedRequest(h, "http://a.com/1")
+		doCachedRequest(h, "http://a.com/3")
+
+		require.True(t, isCached(h, "GET a.com/1?"))
+		require.False(t, isCached(h, "GET a.com/2?"))
+		require.True(t, isCached(h, "GET a.com/3?"))
+	})
+
+	t.Run("it should evict when the host goes over the size", func(t *testing.T) {
+		config := newAdminConfig()
+		config.PerHostMaxSize = 5
+		h := newHandler(config)
+
+		doCachedRequest(h, "http://b.com/1")
+		doCachedRequest(h, "http://a.com/1")
+		doCachedRequest(h, "http://a.com/2")
+
+		require.Eventually(t, func() bool {
+			return !isCached(h, "GET a.com/1?")
+		}, time.Second, 10*time.Millisecond)
+		require.True(t, isCached(h, "GET a.com/2?"))
+		require.True(t, isCached(h, "GET b.com/1?"))
+		require.Equal(t, HostUsage{Entries: 1, Size: 3}, h.Cache.HostsUsage()["a.com"])
+	})
+
+	t.Run("it should not count purged entries", func(t *testing.T) {
+		h := newHandler(newAdminConfig())
+
+		doCachedRequest(h, "http://a.com/1")
+		doCachedRequest(h, "http://a.com/2")
+		h.Cache.Purge("GET a.com/1?")
+
+		require.Equal(t, 1, h.Cache.HostsUsage()["a.com"].Entries)
+	})
+
+	t.Run("it should show the usage of each host", func(t *testing.T) {
+		h := newHandler(newAdminConfig())
+
+		doCachedRequest(h, "http://a.com/1")
+		doCachedRequest(h, "http://a.com/2")
+		doCachedRequest(h, "http://b.com:8080/1")
+
+		require.Eventually(t, func() bool {
+			return h.Cache.HostsUsage()["a.com"].Size == 6
+		}, time.Second, 10*time.Millisecond)
+
+		res := doAdminRequest(t, h, "GET", "http://a.com/_cache/hosts")
+		requireCode(t, res, 200)
+		usage := map[string]HostUsage{}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&usage))
+		require.Equal(t, map[string]HostUsage{
+			"a.com": {Entries: 2, Size: 6},
+			"b.com": {Entries: 1, Size: 3},
+		}, usage)
+	})
+}
@@ -1,16 +1,25 @@
 package cache
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"io/ioutil"
 
 	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/nicolasazrak/caddy-cache/storage"
 	"github.com/stretchr/testify/require"
 )
 
@@ -74,6 +83,289 @@ func TestPublicResponseWithBody(t *testing.T) {
 	require.Equal(t, 1, hits)
 }
 
+func TestInformationalResponse(t *testing.T) {
+	content := []byte("abc")
+	hits := 0
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits++
+		w.WriteHeader(http.StatusContinue)
+		w.Header().Add("Cache-control", "max-age=10")
+		w.WriteHeader(http.StatusOK)
+		w.Write(content)
+		return 200, nil
+	}), emptyConfig())
+
+	requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+	requestAndAssert(t, h, http.Header{}, 200, cacheHit, content)
+	require.Equal(t, 1, hits)
+}
+
+func TestWrongContentLength(t *testing.T) {
+	content := []byte("abc")
+
+	t.Run("it should not cache truncated bodies", func(t *testing.T) {
+		hits := 0
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			hits++
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Header().Add("Content-Length", "10")
+			w.Write(content)
+			return 200, nil
+		}), emptyConfig())
+
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+		require.Equal(t, 2, hits)
+	})
+
+	t.Run("it should discard a corrupted entry and fetch it again", func(t *testing.T) {
+		hits := 0
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			hits++
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Header().Add("Content-Length", "3")
+			w.Write(content)
+			return 200, nil
+		}), emptyConfig())
+
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+		requestAndAssert(t, h, http.Header{}, 200, cacheHit, content)
+
+		r, err := http.NewRequest("GET", "/", nil)
+		require.NoError(t, err)
+		entry, ok := h.Cache.Get(r)
+		require.True(t, ok)
+		entry.Response.WaitClose()
+		atomic.AddInt64(&entry.Response.size, -1)
+		entry.release()
+
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+		requestAndAssert(t, h, http.Header{}, 200, cacheHit, content)
+		require.Equal(t, 2, hits)
+	})
+
+	t.Run("it should cache HEAD responses without body", func(t *testing.T) {
+		hits := 0
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			hits++
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Header().Add("Content-Length", "3")
+			return 200, nil
+		}), emptyConfig())
+
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			r, err := http.NewRequest("HEAD", "/", nil)
+			require.NoError(t, err)
+			_, err = h.ServeHTTP(w, r)
+			require.NoError(t, err)
+		}
+		require.Equal(t, 1, hits)
+	})
+}
+
+func TestHeadFromGet(t *testing.T) {
+	content := bytes.Repeat([]byte("a"), 64*1024)
+	var methods []string
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		methods = append(methods, r.Method)
+		w.Header().Add("Cache-control", "max-age=10")
+		w.Header().Add("Etag", `"v1"`)
+		if r.URL.Path == "/known" {
+			w.Header().Add("Content-Length", strconv.Itoa(len(content)))
+		}
+		// Without Content-Length the body is sent chunked
+		w.Write(content)
+		return 200, nil
+	}), emptyConfig())
+
+	serve := func(method string, target string, header http.Header) *http.Response {
+		r := newRequestWithOriginalURL(t, method, target)
+		copyHeaders(header, r.Header)
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	for _, path := range []string{"/known", "/chunked"} {
+		t.Run("it should send the Content-Length of the cached GET body of "+path, func(t *testing.T) {
+			methods = nil
+			target := "http://example.com" + path
+			requireStatus(t, serve("GET", target, nil), cacheMiss)
+
+			head := serve("HEAD", target, nil)
+			requireStatus(t, head, cacheHit)
+			requireCode(t, head, 200)
+			require.Equal(t, `"v1"`, head.Header.Get("Etag"))
+			requireBody(t, head, []byte{})
+
+			get := serve("GET", target, nil)
+			body, err := ioutil.ReadAll(get.Body)
+			require.NoError(t, err)
+			require.Equal(t, strconv.Itoa(len(body)), head.Header.Get("Content-Length"))
+			require.Equal(t, get.Header.Get("Content-Length"), head.Header.Get("Content-Length"))
+			require.Equal(t, []string{"GET"}, methods)
+		})
+	}
+
+	t.Run("it should answer a conditional HEAD with a 304", func(t *testing.T) {
+		serve("GET", "http://example.com/known", nil)
+		requireCode(t, serve("HEAD", "http://example.com/known", http.Header{"If-None-Match": {`"v1"`}}), http.StatusNotModified)
+	})
+
+	t.Run("it should fetch the HEAD if the GET is not cached", func(t *testing.T) {
+		methods = nil
+		requireStatus(t, serve("HEAD", "http://example.com/other", nil), cacheMiss)
+		require.Equal(t, []string{"HEAD"}, methods)
+	})
+}
+
+func TestKeyMergeHead(t *testing.T) {
+	var methods []string
+	config := emptyConfig()
+	config.KeyMergeHead = true
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		methods = append(methods, r.Method)
+		w.Header().Add("Cache-control", "max-age=10")
+		if r.Method != http.MethodHead {
+			w.Write([]byte("abc"))
+		}
+		return 200, nil
+	}), config)
+
+	serve := func(method string, target string) *http.Response {
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, method, target))
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	t.Run("it should save HEAD and GET under the same key", func(t *testing.T) {
+		methods = nil
+		requireStatus(t, serve("GET", "http://example.com/a"), cacheMiss)
+		requireStatus(t, serve("HEAD", "http://example.com/a"), cacheHit)
+		require.Equal(t, []string{"GET"}, methods)
+		require.Equal(t, "GET example.com/a?", getKey(config, newRequestWithOriginalURL(t, "HEAD", "http://example.com/a")))
+	})
+
+	t.Run("it should not answer a GET with a saved HEAD", func(t *testing.T) {
+		methods = nil
+		requireStatus(t, serve("HEAD", "http://example.com/b"), cacheMiss)
+		requireStatus(t, serve("HEAD", "http://example.com/b"), cacheHit)
+
+		get := serve("GET", "http://example.com/b")
+		requireStatus(t, get, cacheMiss)
+		requireBody(t, get, []byte("abc"))
+		require.Equal(t, []string{"HEAD", "GET"}, methods)
+
+		// Saving the GET does not replace the HEAD of the same key
+		require.Len(t, h.Cache.GetVariants("GET example.com/b?"), 2)
+		requireStatus(t, serve("GET", "http://example.com/b"), cacheHit)
+	})
+}
+
+func TestTrailers(t *testing.T) {
+	content := []byte("abc")
+
+	t.Run("it should save the trailers declared in the Trailer header", func(t *testing.T) {
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Header().Add("Trailer", "X-Checksum, Grpc-Status")
+			w.WriteHeader(200)
+			w.Write(content)
+			w.Header().Set("X-Checksum", "900150983cd24fb0")
+			w.Header().Set("Grpc-Status", "0")
+			return 200, nil
+		}), emptyConfig())
+
+		for _, status := range []string{cacheMiss, cacheHit} {
+			res, err := doRequest(t, h)
+			require.NoError(t, err)
+			requireStatus(t, res, status)
+			requireBody(t, res, content)
+			require.Equal(t, http.Header{"X-Checksum": {"900150983cd24fb0"}, "Grpc-Status": {"0"}}, res.Trailer)
+		}
+	})
+
+	t.Run("it should save the trailers set with the trailer prefix", func(t *testing.T) {
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Write(content)
+			w.Header().Set(http.TrailerPrefix+"X-Checksum", "900150983cd24fb0")
+			return 200, nil
+		}), emptyConfig())
+
+		for _, status := range []string{cacheMiss, cacheHit} {
+			res, err := doRequest(t, h)
+			require.NoError(t, err)
+			requireStatus(t, res, status)
+			require.Equal(t, http.Header{"X-Checksum": {"900150983cd24fb0"}}, res.Trailer)
+		}
+	})
+
+	t.Run("it should send the trailers of private responses", func(t *testing.T) {
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Add("Cache-control", "private")
+			w.Header().Add("Trailer", "X-Checksum")
+			w.Write(content)
+			w.Header().Set("X-Checksum", "900150983cd24fb0")
+			return 200, nil
+		}), emptyConfig())
+
+		res, err := doRequest(t, h)
+		require.NoError(t, err)
+		requireStatus(t, res, cacheMiss)
+		require.Equal(t, http.Header{"X-Checksum": {"900150983cd24fb0"}}, res.Trailer)
+	})
+}
+
+// doHTTP10Request sends a HTTP/1.0 request to the server, net/http clients always use HTTP/1.1
+func doHTTP10Request(t *testing.T, server *httptest.Server) *http.Response {
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET / HTTP/1.0\r\nHost: example.com\r\n\r\n"))
+	require.NoError(t, err)
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return res
+}
+
+func TestHTTP10Clients(t *testing.T) {
+	// Bigger than the buffer net/http uses to find the length of small responses
+	content := bytes.Repeat([]byte("abcdefgh"), 8*1024)
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Add("Cache-control", "max-age=10")
+		// Like a chunked response, there is no Content-Length
+		w.Write(content[:8])
+		w.(http.Flusher).Flush()
+		w.Write(content[8:])
+		return 200, nil
+	}), emptyConfig())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	t.Run("it should send the length of a cached body that upstream sent chunked", func(t *testing.T) {
+		res := doHTTP10Request(t, server)
+		requireStatus(t, res, cacheMiss)
+		requireBody(t, res, content)
+
+		res = doHTTP10Request(t, server)
+		requireStatus(t, res, cacheHit)
+		requireBody(t, res, content)
+		require.Equal(t, int64(len(content)), res.ContentLength)
+		require.Empty(t, res.TransferEncoding)
+	})
+}
+
 func TestPublicResponseWithoutBody(t *testing.T) {
 	hits := 0
 	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
@@ -158,6 +450,243 @@ func TestPublicResponseWithVaryHeader(t *testing.T) {
 	require.Equal(t, 3, hits)
 }
 
+func TestVaryChanged(t *testing.T) {
+	vary := "Accept-Encoding"
+	config := emptyConfig()
+	config.VaryCookie = VaryCookieHonor
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Add("Cache-control", "max-age=10")
+		w.Header().Add("Vary", vary)
+		w.Write([]byte(r.Header.Get("Accept-Encoding") + " " + r.Header.Get("Cookie")))
+		return 200, nil
+	}), config)
+
+	withCookie := func(encoding string, cookie string) http.Header {
+		return http.Header{"Accept-Encoding": {encoding}, "Cookie": {cookie}}
+	}
+
+	requestAndAssert(t, h, withCookie("gzip", "a"), 200, cacheMiss, []byte("gzip a"))
+	requestAndAssert(t, h, withCookie("deflate", "a"), 200, cacheMiss, []byte("deflate a"))
+	requestAndAssert(t, h, withCookie("gzip", "b"), 200, cacheHit, []byte("gzip a"))
+
+	vary = "Accept-Encoding, Cookie"
+	requestAndAssert(t, h, withCookie("br", "a"), 200, cacheMiss, []byte("br a"))
+	require.Len(t, h.Cache.GetVariants(getKey(config, makeRequest("/", http.Header{}))), 1)
+
+	// The variants saved with the old Vary are not matched ignoring the cookie anymore
+	requestAndAssert(t, h, withCookie("gzip", "b"), 200, cacheMiss, []byte("gzip b"))
+	requestAndAssert(t, h, withCookie("gzip", "a"), 200, cacheMiss, []byte("gzip a"))
+	requestAndAssert(t, h, withCookie("gzip", "b"), 200, cacheHit, []byte("gzip b"))
+	require.Len(t, h.Cache.GetVariants(getKey(config, makeRequest("/", http.Header{}))), 3)
+}
+
+func TestMaxVariants(t *testing.T) {
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Add("Cache-control", "max-age=10")
+		w.Header().Add("Vary", "Accept-Language")
+		w.Write([]byte(r.Header.Get("Accept-Language")))
+		return 200, nil
+	})
+
+	t.Run("it should remove the least recently used variant over the limit", func(t *testing.T) {
+		config := emptyConfig()
+		config.MaxVariants = 2
+		h := NewHandler(upstream, config)
+
+		requestAndAssert(t, h, makeHeader("Accept-Language", "en"), 200, cacheMiss, []byte("en"))
+		requestAndAssert(t, h, makeHeader("Accept-Language", "es"), 200, cacheMiss, []byte("es"))
+		requestAndAssert(t, h, makeHeader("Accept-Language", "en"), 200, cacheHit, []byte("en"))
+
+		requestAndAssert(t, h, makeHeader("Accept-Language", "fr"), 200, cacheMiss, []byte("fr"))
+		require.Len(t, h.Cache.GetVariants(getKey(config, makeRequest("/", http.Header{}))), 2)
+
+		requestAndAssert(t, h, makeHeader("Accept-Language", "en"), 200, cacheHit, []byte("en"))
+		requestAndAssert(t, h, makeHeader("Accept-Language", "fr"), 200, cacheHit, []byte("fr"))
+		requestAndAssert(t, h, makeHeader("Accept-Language", "es"), 200, cacheMiss, []byte("es"))
+	})
+
+	t.Run("it should not limit the variants by default", func(t *testing.T) {
+		h := NewHandler(upstream, emptyConfig())
+
+		for _, status := range []string{cacheMiss, cacheHit} {
+			for _, language := range []string{"en", "es", "fr"} {
+				requestAndAssert(t, h, makeHeader("Accept-Language", language), 200, status, []byte(language))
+			}
+		}
+	})
+}
+
+func TestVaryCookie(t *testing.T) {
+	content := []byte("abc")
+	newHandler := func(config *Config) (*Handler, *int) {
+		hits := 0
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			hits++
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Header().Add("Vary", "Accept-Encoding, Cookie")
+			w.Write(content)
+			return 200, nil
+		}), config), &hits
+	}
+
+	cookies := func(value string) http.Header {
+		return http.Header{"Cookie": []string{value}}
+	}
+
+	t.Run("it should not cache by default", func(t *testing.T) {
+		h, hits := newHandler(emptyConfig())
+		requestAndAssert(t, h, cookies("session=a"), 200, cacheMiss, content)
+		requestAndAssert(t, h, cookies("session=a"), 200, cacheSkip, content)
+		require.Equal(t, 2, *hits)
+	})
+
+	t.Run("it should save a variant for each cookie header when it is honored", func(t *testing.T) {
+		config := emptyConfig()
+		config.VaryCookie = VaryCookieHonor
+		h, hits := newHandler(config)
+
+		requestAndAssert(t, h, cookies("session=a"), 200, cacheMiss, content)
+		requestAndAssert(t, h, cookies("session=a"), 200, cacheHit, content)
+		requestAndAssert(t, h, cookies("session=a; tracking=1"), 200, cacheMiss, content)
+		requestAndAssert(t, h, cookies("session=b"), 200, cacheMiss, content)
+		require.Equal(t, 3, *hits)
+	})
+
+	t.Run("it should compare only the named cookies", func(t *testing.T) {
+		config := emptyConfig()
+		config.VaryCookie = VaryCookieSubset
+		config.VaryCookieNames = []string{"session", "lang"}
+		h, hits := newHandler(config)
+
+		requestAndAssert(t, h, cookies("session=a; tracking=1"), 200, cacheMiss, content)
+		requestAndAssert(t, h, cookies("tracking=2; session=a"), 200, cacheHit, content)
+		requestAndAssert(t, h, cookies("session=a; lang=es"), 200, cacheMiss, content)
+		requestAndAssert(t, h, cookies("lang=es; session=a"), 200, cacheHit, content)
+		requestAndAssert(t, h, cookies("session=b"), 200, cacheMiss, content)
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+		requestAndAssert(t, h, cookies("tracking=3"), 200, cacheHit, content)
+		require.Equal(t, 4, *hits)
+	})
+}
+
+func TestVaryDevice(t *testing.T) {
+	hits := 0
+	config := emptyConfig()
+	config.VaryDevice = NewDeviceClassifier()
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits++
+		w.Header().Add("Cache-control", "max-age=10")
+		w.Write([]byte(config.VaryDevice.classify(r.UserAgent())))
+		return 200, nil
+	}), config)
+
+	userAgent := func(value string) http.Header {
+		return http.Header{"User-Agent": []string{value}}
+	}
+
+	requestAndAssert(t, h, userAgent(iPhoneUserAgent), 200, cacheMiss, []byte(deviceMobile))
+	requestAndAssert(t, h, userAgent(androidPhoneUserAgent), 200, cacheHit, []byte(deviceMobile))
+	requestAndAssert(t, h, userAgent(iPadUserAgent), 200, cacheMiss, []byte(deviceTablet))
+	requestAndAssert(t, h, userAgent(androidTabletUserAgent), 200, cacheHit, []byte(deviceTablet))
+	requestAndAssert(t, h, userAgent(desktopUserAgent), 200, cacheMiss, []byte(deviceDesktop))
+	requestAndAssert(t, h, http.Header{}, 200, cacheHit, []byte(deviceDesktop))
+	require.Equal(t, 3, hits)
+
+	t.Run("it should purge every device class", func(t *testing.T) {
+		r, err := http.NewRequest("GET", "/", nil)
+		require.NoError(t, err)
+		require.Equal(t, 3, h.purgeURL(r))
+		requestAndAssert(t, h, userAgent(iPhoneUserAgent), 200, cacheMiss, []byte(deviceMobile))
+	})
+}
+
+func TestKeyHeaders(t *testing.T) {
+	hits := 0
+	config := emptyConfig()
+	config.KeyHeaders = []string{"Accept-Language", "X-Tenant"}
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits++
+		w.Header().Add("Cache-control", "max-age=10")
+		w.Write([]byte(r.Header.Get("X-Tenant")))
+		return 200, nil
+	}), config)
+
+	tenant := func(value string) http.Header {
+		return http.Header{"X-Tenant": []string{value}}
+	}
+
+	requestAndAssert(t, h, tenant("a"), 200, cacheMiss, []byte("a"))
+	requestAndAssert(t, h, tenant("a"), 200, cacheHit, []byte("a"))
+	requestAndAssert(t, h, tenant("b"), 200, cacheMiss, []byte("b"))
+	requestAndAssert(t, h, http.Header{}, 200, cacheMiss, []byte{})
+	requestAndAssert(t, h, http.Header{}, 200, cacheHit, []byte{})
+	require.Equal(t, 3, hits)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	require.NoError(t, err)
+	r.Header = tenant("a")
+	require.True(t, strings.HasSuffix(getKey(config, r), "? Accept-Language: X-Tenant:a"))
+
+	t.Run("it should purge every value of the headers", func(t *testing.T) {
+		r, err := http.NewRequest("GET", "/", nil)
+		require.NoError(t, err)
+		require.Equal(t, 3, h.purgeURL(r))
+		requestAndAssert(t, h, tenant("a"), 200, cacheMiss, []byte("a"))
+	})
+}
+
+func TestVaryByHeaderNotInKey(t *testing.T) {
+	hits := 0
+	config := emptyConfig()
+	config.VaryByHeader = "X-Cache-Vary-By"
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits++
+		w.Header().Add("Cache-control", "max-age=10")
+		w.Header().Add("X-Cache-Vary-By", "X-Tenant")
+		w.Write([]byte(r.Header.Get("X-Tenant")))
+		return 200, nil
+	}), config)
+
+	// Caching it would serve the response of a tenant to the others
+	requestAndAssert(t, h, http.Header{"X-Tenant": []string{"a"}}, 200, cacheMiss, []byte("a"))
+	requestAndAssert(t, h, http.Header{"X-Tenant": []string{"b"}}, 200, cacheSkip, []byte("b"))
+	require.Equal(t, 2, hits)
+}
+
+func TestKeyAccept(t *testing.T) {
+	hits := 0
+	config := emptyConfig()
+	config.KeyAccept = true
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits++
+		w.Header().Add("Cache-control", "max-age=10")
+		if preferredMediaType(r.Header) == "application/xml" {
+			w.Write([]byte("<a/>"))
+		} else {
+			w.Write([]byte("{}"))
+		}
+		return 200, nil
+	}), config)
+
+	accept := func(value string) http.Header {
+		return http.Header{"Accept": []string{value}}
+	}
+
+	requestAndAssert(t, h, accept("application/json"), 200, cacheMiss, []byte("{}"))
+	requestAndAssert(t, h, accept("application/json, text/html;q=0.9"), 200, cacheHit, []byte("{}"))
+	requestAndAssert(t, h, accept("application/xml"), 200, cacheMiss, []byte("<a/>"))
+	requestAndAssert(t, h, accept("application/json;q=0.5, application/xml"), 200, cacheHit, []byte("<a/>"))
+	requestAndAssert(t, h, http.Header{}, 200, cacheMiss, []byte("{}"))
+	require.Equal(t, 3, hits)
+
+	t.Run("it should purge every media type", func(t *testing.T) {
+		r, err := http.NewRequest("GET", "/", nil)
+		require.NoError(t, err)
+		require.Equal(t, 3, h.purgeURL(r))
+		requestAndAssert(t, h, accept("application/json"), 200, cacheMiss, []byte("{}"))
+	})
+}
+
 func TestConfigRules(t *testing.T) {
 	content := []byte("abc")
 	config := emptyConfig()
@@ -215,11 +744,58 @@ func TestConfigRules(t *testing.T) {
 	})
 }
 
-func TestPlaceholder(t *testing.T) {
+func TestCollapseTimeout(t *testing.T) {
+	content := []byte("abc")
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var calls int32
+
+	config := emptyConfig()
+	config.CollapseTimeout = 50 * time.Millisecond
 	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
-		w.Header().Set("cache-control", "max-age=10")
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+			<-release
+		}
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Write(content)
 		return 200, nil
-	}), emptyConfig())
+	}), config)
+
+	leader := make(chan struct{})
+	go func() {
+		defer close(leader)
+		doRequest(t, h)
+	}()
+	<-started
+
+	t.Run("should go upstream without waiting the slow request", func(t *testing.T) {
+		wg := sync.WaitGroup{}
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				requestAndAssert(t, h, http.Header{}, 200, cacheBypass, content)
+			}()
+		}
+		wg.Wait()
+		require.Equal(t, int32(4), atomic.LoadInt32(&calls))
+	})
+
+	close(release)
+	<-leader
+
+	t.Run("should keep the response of the slow request", func(t *testing.T) {
+		requestAndAssert(t, h, http.Header{}, 200, cacheHit, content)
+		require.Equal(t, int32(4), atomic.LoadInt32(&calls))
+	})
+}
+
+func TestPlaceholder(t *testing.T) {
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Set("cache-control", "max-age=10")
+		return 200, nil
+	}), emptyConfig())
 
 	reqAndTest := func(expectedPlaceholder string) {
 		w := httptest.NewRecorder()
@@ -239,7 +815,22 @@ func TestPlaceholder(t *testing.T) {
 
 func TestRangeRequests(t *testing.T) {
 	content := []byte("0123456789")
-	t.Run("it should by pass cache if there is a range request", func(t *testing.T) {
+	t.Run("it should by pass cache if there is a range request and it is not cached", func(t *testing.T) {
+		hits := 0
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Add("Cache-control", "max-age=10")
+			http.ServeContent(w, r, "content.txt", time.Now(), bytes.NewReader(content))
+			hits++
+			return 200, nil
+		}), emptyConfig())
+
+		requestAndAssert(t, h, http.Header{"Range": []string{"bytes=0-4"}}, 206, cacheBypass, []byte("01234"))
+		require.Equal(t, 1, hits)
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+		require.Equal(t, 2, hits)
+	})
+
+	t.Run("it should serve the range from cache if it is cached", func(t *testing.T) {
 		hits := 0
 		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
 			w.Header().Add("Cache-control", "max-age=10")
@@ -251,8 +842,38 @@ func TestRangeRequests(t *testing.T) {
 		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
 		requestAndAssert(t, h, http.Header{}, 200, cacheHit, content)
 		require.Equal(t, 1, hits)
-		requestAndAssert(t, h, http.Header{"Range": []string{"bytes=0-4"}}, 206, cacheBypass, []byte("01234"))
-		require.Equal(t, 2, hits)
+
+		res, err := doRequestWithHeaders(t, h, http.Header{"Range": []string{"bytes=0-4"}})
+		require.NoError(t, err)
+		requireCode(t, res, 206)
+		requireStatus(t, res, cacheHit)
+		requireBody(t, res, []byte("01234"))
+		require.Equal(t, "bytes 0-4/10", res.Header.Get("Content-Range"))
+		require.Equal(t, "5", res.Header.Get("Content-Length"))
+
+		requestAndAssert(t, h, http.Header{"Range": []string{"bytes=-3"}}, 206, cacheHit, []byte("789"))
+		requestAndAssert(t, h, http.Header{"Range": []string{"bytes=8-"}}, 206, cacheHit, []byte("89"))
+		requestAndAssert(t, h, http.Header{"Range": []string{"bytes=0-1,4-5"}}, 200, cacheHit, content)
+		require.Equal(t, 1, hits)
+	})
+
+	t.Run("it should not serve unsatisfiable ranges", func(t *testing.T) {
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Write(content)
+			return 200, nil
+		}), emptyConfig())
+
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", "/", nil)
+		require.NoError(t, err)
+		r.Header.Set("Range", "bytes=20-30")
+		code, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusRequestedRangeNotSatisfiable, code)
+		require.Equal(t, "bytes */10", w.Header().Get("Content-Range"))
 	})
 
 	t.Run("it should not cache 206 status", func(t *testing.T) {
@@ -273,6 +894,26 @@ func TestRangeRequests(t *testing.T) {
 		require.Equal(t, 3, hits)
 	})
 
+	t.Run("it should cache the full response after a partial one", func(t *testing.T) {
+		partial := true
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Add("Cache-control", "max-age=10")
+			if partial {
+				w.Header().Add("Content-Range", "bytes 0-4/10")
+				w.WriteHeader(206)
+				w.Write(content[:5])
+				return 206, nil
+			}
+			w.Write(content)
+			return 200, nil
+		}), emptyConfig())
+
+		requestAndAssert(t, h, http.Header{}, 206, cacheMiss, content[:5])
+		partial = false
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+		requestAndAssert(t, h, http.Header{}, 200, cacheHit, content)
+	})
+
 	t.Run("it should not cache Content-Range header", func(t *testing.T) {
 		hits := 0
 		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
@@ -288,6 +929,229 @@ func TestRangeRequests(t *testing.T) {
 		requestAndAssert(t, h, http.Header{}, 200, cacheSkip, content)
 		require.Equal(t, 2, hits)
 	})
+
+	for _, cached := range []struct {
+		code int
+		body []byte
+	}{
+		{http.StatusNotFound, []byte("not found")},
+		{http.StatusNoContent, []byte{}},
+	} {
+		cached := cached
+		t.Run("it should send a cached "+strconv.Itoa(cached.code)+" whole to a range request", func(t *testing.T) {
+			hits := 0
+			h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				w.Header().Add("Cache-control", "max-age=10")
+				w.WriteHeader(cached.code)
+				w.Write(cached.body)
+				hits++
+				return cached.code, nil
+			}), emptyConfig())
+
+			requestAndAssert(t, h, http.Header{}, cached.code, cacheMiss, cached.body)
+			response, err := doRequestWithHeaders(t, h, http.Header{"Range": []string{"bytes=0-1"}})
+			require.NoError(t, err)
+			requireCode(t, response, cached.code)
+			requireStatus(t, response, cacheHit)
+			require.Empty(t, response.Header.Get("Content-Range"))
+			requireBody(t, response, cached.body)
+			require.Equal(t, 1, hits)
+		})
+	}
+}
+
+func TestRangeAssembly(t *testing.T) {
+	content := []byte("0123456789")
+	newHandler := func(cacheControl string) (*Handler, *[]string) {
+		config := emptyConfig()
+		config.RangeAssembly = true
+		fetched := []string{}
+		lock := new(sync.Mutex)
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			lock.Lock()
+			fetched = append(fetched, r.Header.Get("Range"))
+			lock.Unlock()
+			w.Header().Add("Cache-control", cacheControl)
+			w.Header().Set("Etag", `"v1"`)
+			http.ServeContent(w, r, "content.txt", time.Time{}, bytes.NewReader(content))
+			return 200, nil
+		}), config), &fetched
+	}
+
+	requestRange := func(t *testing.T, h *Handler, value string, expectedStatus string, expectedContentRange string, expectedBody []byte) {
+		response, err := doRequestWithHeaders(t, h, http.Header{"Range": []string{value}})
+		require.NoError(t, err)
+		requireCode(t, response, 206)
+		requireStatus(t, response, expectedStatus)
+		require.Equal(t, expectedContentRange, response.Header.Get("Content-Range"))
+		requireBody(t, response, expectedBody)
+	}
+
+	t.Run("it should fetch only the missing gaps", func(t *testing.T) {
+		h, fetched := newHandler("max-age=10")
+
+		requestRange(t, h, "bytes=0-3", cacheMiss, "bytes 0-3/10", []byte("0123"))
+		requestRange(t, h, "bytes=1-2", cacheHit, "bytes 1-2/10", []byte("12"))
+		requestRange(t, h, "bytes=6-7", cacheMiss, "bytes 6-7/10", []byte("67"))
+		requestRange(t, h, "bytes=2-", cacheMiss, "bytes 2-9/10", []byte("23456789"))
+		requestRange(t, h, "bytes=-5", cacheHit, "bytes 5-9/10", []byte("56789"))
+		require.Equal(t, []string{"bytes=0-3", "bytes=6-7", "bytes=4-5", "bytes=8-9"}, *fetched)
+	})
+
+	t.Run("it should answer unsatisfiable ranges from the saved size", func(t *testing.T) {
+		h, fetched := newHandler("max-age=10")
+		requestRange(t, h, "bytes=0-3", cacheMiss, "bytes 0-3/10", []byte("0123"))
+
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", "/", nil)
+		require.NoError(t, err)
+		r.Header.Set("Range", "bytes=20-30")
+		code, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusRequestedRangeNotSatisfiable, code)
+		require.Equal(t, "bytes */10", w.Header().Get("Content-Range"))
+		require.Len(t, *fetched, 1)
+	})
+
+	t.Run("it should send the whole body if upstream ignores the range", func(t *testing.T) {
+		config := emptyConfig()
+		config.RangeAssembly = true
+		fetches := 0
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			fetches++
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Write(content)
+			return 200, nil
+		}), config)
+
+		for i := 0; i < 2; i++ {
+			done := make(chan *http.Response)
+			go func() {
+				response, err := doRequestWithHeaders(t, h, http.Header{"Range": []string{"bytes=0-9"}})
+				require.NoError(t, err)
+				done <- response
+			}()
+
+			select {
+			case response := <-done:
+				requireCode(t, response, 200)
+				requireStatus(t, response, cacheSkip)
+				requireBody(t, response, content)
+			case <-time.After(time.Second):
+				t.Fatal("the range request did not end")
+			}
+		}
+		require.Equal(t, 2, fetches)
+		require.Eventually(t, func() bool { return h.Metrics.fetchesInFlight() == 0 }, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("it should not save ranges of private responses", func(t *testing.T) {
+		h, fetched := newHandler("private")
+
+		requestRange(t, h, "bytes=0-3", cacheSkip, "bytes 0-3/10", []byte("0123"))
+		requestRange(t, h, "bytes=0-3", cacheSkip, "bytes 0-3/10", []byte("0123"))
+		require.Len(t, *fetched, 2)
+	})
+
+	t.Run("it should remove the segments when the url is purged", func(t *testing.T) {
+		h, fetched := newHandler("max-age=10")
+
+		requestRange(t, h, "bytes=0-3", cacheMiss, "bytes 0-3/10", []byte("0123"))
+		r, err := http.NewRequest("GET", "/", nil)
+		require.NoError(t, err)
+		require.Equal(t, 1, h.Cache.Purge(getKey(h.Config, r)))
+		requestRange(t, h, "bytes=0-3", cacheMiss, "bytes 0-3/10", []byte("0123"))
+		require.Len(t, *fetched, 2)
+	})
+
+	t.Run("it should fetch the first segment once for concurrent requests", func(t *testing.T) {
+		config := emptyConfig()
+		config.RangeAssembly = true
+		proceed := make(chan struct{})
+		var fetches int32
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			atomic.AddInt32(&fetches, 1)
+			<-proceed
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Header().Set("Etag", `"v1"`)
+			http.ServeContent(w, r, "content.txt", time.Time{}, bytes.NewReader(content))
+			return 200, nil
+		}), config)
+
+		clients := 5
+		responses := make(chan *http.Response, clients)
+		for i := 0; i < clients; i++ {
+			go func() {
+				response, err := doRequestWithHeaders(t, h, http.Header{"Range": []string{"bytes=0-3"}})
+				require.NoError(t, err)
+				responses <- response
+			}()
+		}
+		require.Eventually(t, func() bool { return h.URLLocks.Waiting() == int64(clients-1) }, time.Second, 10*time.Millisecond)
+		close(proceed)
+
+		statuses := map[string]int{}
+		for i := 0; i < clients; i++ {
+			response := <-responses
+			requireCode(t, response, 206)
+			requireBody(t, response, []byte("0123"))
+			statuses[response.Header.Get(defaultStatusHeader)]++
+		}
+		require.Equal(t, map[string]int{cacheMiss: 1, cacheHit: clients - 1}, statuses)
+		require.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+	})
+
+	t.Run("it should save the segments in the backend of the path", func(t *testing.T) {
+		videosDir, err := ioutil.TempDir("", "caddy-cache-videos")
+		require.NoError(t, err)
+		defer os.RemoveAll(videosDir)
+
+		h, _ := newHandler("max-age=10")
+		h.Config.StorageBackends = map[string]StorageBackend{"videos": {Path: videosDir}}
+		h.Config.StorageRules = []StorageRule{{Path: "/videos/", Backend: "videos"}}
+
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", "/videos/a.mp4", nil)
+		require.NoError(t, err)
+		r.Header.Set("Range", "bytes=0-3")
+		_, err = h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		requireStatus(t, w.Result(), cacheMiss)
+
+		files, err := ioutil.ReadDir(videosDir)
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+	})
+}
+
+func TestNullStorage(t *testing.T) {
+	content := []byte("abc")
+	hits := 0
+	config := newAdminConfig()
+	config.NullStorage = true
+	config.RangeAssembly = true
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits++
+		w.Header().Add("Cache-control", "max-age=10")
+		http.ServeContent(w, r, "content.txt", time.Time{}, bytes.NewReader(content))
+		return 200, nil
+	}), config)
+
+	t.Run("it should always fetch from upstream", func(t *testing.T) {
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+		requestAndAssert(t, h, http.Header{"Range": []string{"bytes=0-1"}}, 206, cacheSkip, content[:2])
+		requestAndAssert(t, h, http.Header{"Range": []string{"bytes=0-1"}}, 206, cacheSkip, content[:2])
+		require.Equal(t, 4, hits)
+	})
+
+	t.Run("it should still measure upstream", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			res := doAdminRequest(t, h, "GET", "/_cache/metrics")
+			body, _ := ioutil.ReadAll(res.Body)
+			return strings.Contains(string(body), `caddy_cache_origin_total_seconds_count{status="miss"} 2`)
+		}, time.Second, 10*time.Millisecond)
+	})
 }
 
 func TestHeaderAfterCodeSent(t *testing.T) {
@@ -337,3 +1201,917 @@ func TestNotModifiedContent(t *testing.T) {
 	require.Equal(t, http.StatusOK, res2.StatusCode)
 	require.Equal(t, content, res2Content)
 }
+
+func TestServeStaleOnError(t *testing.T) {
+	content := []byte("abc")
+	originalNow := now
+	defer func() { now = originalNow }()
+
+	tests := []struct {
+		name string
+		code int
+		err  error
+	}{
+		{"bad gateway", http.StatusBadGateway, nil},
+		{"service unavailable", http.StatusServiceUnavailable, nil},
+		{"gateway timeout", http.StatusGatewayTimeout, nil},
+		{"connection refused", http.StatusBadGateway, errors.New("dial tcp: connection refused")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now = originalNow
+			failing := false
+			config := emptyConfig()
+			config.ServeStaleOnError = true
+			config.MaxStale = time.Duration(1) * time.Hour
+
+			h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				if failing {
+					if test.err != nil {
+						return test.code, test.err
+					}
+					w.WriteHeader(test.code)
+					return test.code, nil
+				}
+				w.Header().Add("Cache-control", "max-age=10")
+				w.Write(content)
+				return 200, nil
+			}), config)
+
+			requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+			failing = true
+
+			// Within max_stale the expired entry is served
+			now = func() time.Time { return originalNow().Add(time.Duration(1) * time.Minute) }
+			res, err := doRequest(t, h)
+			require.NoError(t, err)
+			requireCode(t, res, 200)
+			requireStatus(t, res, cacheStale)
+			requireBody(t, res, content)
+			require.Equal(t, `111 - "Revalidation Failed"`, res.Header.Get("Warning"))
+
+			// After max_stale upstream failure is forwarded
+			now = func() time.Time { return originalNow().Add(time.Duration(2) * time.Hour) }
+			res, err = doRequest(t, h)
+			require.Equal(t, test.err, err)
+			if test.err == nil {
+				requireCode(t, res, test.code)
+			}
+			require.Equal(t, "", res.Header.Get("Warning"))
+		})
+	}
+
+	for _, cacheControl := range []string{"must-revalidate", "proxy-revalidate"} {
+		t.Run("it should forward the error of responses with "+cacheControl, func(t *testing.T) {
+			now = originalNow
+			failing := false
+			config := emptyConfig()
+			config.ServeStaleOnError = true
+			config.MaxStale = time.Duration(1) * time.Hour
+
+			h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				if failing {
+					w.WriteHeader(http.StatusBadGateway)
+					return http.StatusBadGateway, nil
+				}
+				w.Header().Add("Cache-control", "max-age=10, "+cacheControl)
+				w.Write(content)
+				return 200, nil
+			}), config)
+
+			requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+			failing = true
+			now = func() time.Time { return originalNow().Add(time.Duration(1) * time.Minute) }
+			requestAndAssert(t, h, http.Header{}, http.StatusBadGateway, cacheMiss, []byte{})
+		})
+	}
+
+	t.Run("it should forward the error if it is disabled", func(t *testing.T) {
+		now = originalNow
+		failing := false
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			if failing {
+				w.WriteHeader(http.StatusBadGateway)
+				return http.StatusBadGateway, nil
+			}
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Write(content)
+			return 200, nil
+		}), emptyConfig())
+
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+		failing = true
+		now = func() time.Time { return originalNow().Add(time.Duration(1) * time.Minute) }
+		requestAndAssert(t, h, http.Header{}, http.StatusBadGateway, cacheMiss, []byte{})
+	})
+}
+
+func TestStaleWarning(t *testing.T) {
+	originalNow := now
+	defer func() { now = originalNow }()
+	content := []byte("abc")
+
+	t.Run("it should remove stored warnings of other dates", func(t *testing.T) {
+		now = originalNow
+		date := originalNow().UTC()
+		config := emptyConfig()
+		config.ServeStaleOnError = true
+		config.MaxStale = time.Hour
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Header().Add("Date", date.Format(http.TimeFormat))
+			w.Header().Add("Warning", `110 - "Response is Stale" "`+date.Add(-time.Hour).Format(http.TimeFormat)+`"`)
+			w.Write(content)
+			return 200, nil
+		}), config)
+
+		res, err := doRequest(t, h)
+		require.NoError(t, err)
+		requireStatus(t, res, cacheMiss)
+		require.Equal(t, "", res.Header.Get("Warning"))
+
+		now = func() time.Time { return originalNow().Add(time.Minute) }
+		res, err = doRequestWithHeaders(t, h, makeHeader("Cache-Control", "max-stale=600"))
+		require.NoError(t, err)
+		requireStatus(t, res, cacheStale)
+		require.Equal(t, []string{`110 - "Response is Stale"`}, res.Header["Warning"])
+	})
+
+	t.Run("it should warn when the request waiting upstream gets a stale response", func(t *testing.T) {
+		now = originalNow
+		started := make(chan struct{})
+		release := make(chan struct{})
+		calls := 0
+
+		config := emptyConfig()
+		config.ServeStaleOnError = true
+		config.MaxStale = time.Hour
+		config.CollapseTimeout = 50 * time.Millisecond
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			calls++
+			if calls == 2 {
+				close(started)
+				<-release
+			}
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Write(content)
+			return 200, nil
+		}), config)
+
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+		now = func() time.Time { return originalNow().Add(time.Minute) }
+
+		leader := make(chan struct{})
+		go func() {
+			defer close(leader)
+			doRequest(t, h)
+		}()
+		<-started
+
+		res, err := doRequest(t, h)
+		require.NoError(t, err)
+		requireStatus(t, res, cacheStale)
+		requireBody(t, res, content)
+		require.Equal(t, warningStale, res.Header.Get("Warning"))
+
+		close(release)
+		<-leader
+	})
+}
+
+func TestTTLHeaderIsNotSent(t *testing.T) {
+	content := []byte("abc")
+	hits := 0
+	config := emptyConfig()
+	config.TTLHeader = "X-Cache-TTL"
+
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits++
+		w.Header().Add("X-Cache-TTL", "60")
+		w.Write(content)
+		return 200, nil
+	}), config)
+
+	res, err := doRequest(t, h)
+	require.NoError(t, err)
+	requireStatus(t, res, cacheMiss)
+	require.Equal(t, "", res.Header.Get("X-Cache-TTL"))
+
+	res, err = doRequest(t, h)
+	require.NoError(t, err)
+	requireStatus(t, res, cacheHit)
+	require.Equal(t, "", res.Header.Get("X-Cache-TTL"))
+	require.Equal(t, 1, hits)
+}
+
+func TestStatusHeaderIsNotSpoofed(t *testing.T) {
+	var received []string
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		received = append(received, r.Header.Get(defaultStatusHeader))
+		w.Header().Add("Cache-control", "max-age=10")
+		w.Header().Set(defaultStatusHeader, "upstream")
+		w.Write([]byte("abc"))
+		return 200, nil
+	}), emptyConfig())
+
+	for _, status := range []string{cacheMiss, cacheHit} {
+		r := newRequestWithOriginalURL(t, "GET", "http://example.com/")
+		r.Header.Set(defaultStatusHeader, cacheHit)
+		r.Header["x-cache-status"] = []string{cacheHit}
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		require.Equal(t, []string{status}, w.Result().Header[defaultStatusHeader])
+		require.Equal(t, []string{cacheHit}, r.Header[defaultStatusHeader])
+	}
+	require.Equal(t, []string{""}, received)
+}
+
+func TestStatusHeaderIsNotSpoofedWithLowercaseName(t *testing.T) {
+	var received []bool
+	config := emptyConfig()
+	config.StatusHeader = "x-cache-status"
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		received = append(received, hasHeaderFold(r.Header, "X-Cache-Status"))
+		w.Header().Add("Cache-control", "max-age=10")
+		w.Write([]byte("abc"))
+		return 200, nil
+	}), config)
+
+	for _, header := range []string{"X-Cache-Status", "x-cache-status"} {
+		r := newRequestWithOriginalURL(t, "GET", "http://example.com/"+header)
+		r.Header[header] = []string{cacheHit}
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		require.Equal(t, []string{cacheMiss}, w.Result().Header["X-Cache-Status"])
+	}
+	require.Equal(t, []bool{false, false}, received)
+}
+
+func TestIfRange(t *testing.T) {
+	content := []byte("0123456789")
+	lastModified := "Mon, 02 Jan 2006 15:04:05 GMT"
+	hits := 0
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits++
+		w.Header().Add("Cache-control", "max-age=10")
+		w.Header().Add("Etag", `"v1"`)
+		w.Header().Add("Last-Modified", lastModified)
+		w.Write(content)
+		return 200, nil
+	}), emptyConfig())
+
+	requestAndAssert(t, h, http.Header{}, 200, cacheMiss, content)
+
+	withIfRange := func(ifRange string) http.Header {
+		return http.Header{"Range": []string{"bytes=2-3"}, "If-Range": []string{ifRange}}
+	}
+
+	t.Run("it should serve the range if the etag matches", func(t *testing.T) {
+		requestAndAssert(t, h, withIfRange(`"v1"`), 206, cacheHit, []byte("23"))
+	})
+
+	t.Run("it should serve the whole body if the etag changed", func(t *testing.T) {
+		requestAndAssert(t, h, withIfRange(`"v0"`), 200, cacheHit, content)
+	})
+
+	t.Run("it should serve the whole body if the etag is weak", func(t *testing.T) {
+		requestAndAssert(t, h, withIfRange(`W/"v1"`), 200, cacheHit, content)
+	})
+
+	t.Run("it should serve the range if the date matches", func(t *testing.T) {
+		requestAndAssert(t, h, withIfRange(lastModified), 206, cacheHit, []byte("23"))
+	})
+
+	t.Run("it should serve the whole body if the date does not match", func(t *testing.T) {
+		requestAndAssert(t, h, withIfRange("Mon, 02 Jan 2006 15:04:04 GMT"), 200, cacheHit, content)
+	})
+
+	require.Equal(t, 1, hits)
+}
+
+func TestDownloadHeaders(t *testing.T) {
+	content := []byte("0123456789")
+	disposition := `attachment; filename="report.pdf"`
+	newHandler := func(config *Config) (*Handler, *int) {
+		fetches := 0
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			fetches++
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Content-Disposition", disposition)
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Header().Set("Etag", `"v1"`)
+			http.ServeContent(w, r, "report.pdf", time.Unix(1500000000, 0), bytes.NewReader(content))
+			return 200, nil
+		}), config), &fetches
+	}
+
+	serve := func(t *testing.T, h *Handler, method string, headers http.Header) *http.Response {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(method, "/report.pdf", nil)
+		require.NoError(t, err)
+		r.Header = headers
+		_, err = h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	requireDownloadHeaders := func(t *testing.T, res *http.Response) {
+		require.Equal(t, disposition, res.Header.Get("Content-Disposition"))
+		require.Equal(t, "application/pdf", res.Header.Get("Content-Type"))
+		require.Equal(t, `"v1"`, res.Header.Get("Etag"))
+		require.NotEmpty(t, res.Header.Get("Last-Modified"))
+	}
+
+	for _, preserveCase := range []bool{false, true} {
+		t.Run("it should keep the disposition on full and partial serves when preserve_header_case is "+strconv.FormatBool(preserveCase), func(t *testing.T) {
+			config := emptyConfig()
+			config.PreserveHeaderCase = preserveCase
+			h, fetches := newHandler(config)
+
+			res := serve(t, h, "GET", http.Header{})
+			requireStatus(t, res, cacheMiss)
+			requireDownloadHeaders(t, res)
+			requireBody(t, res, content)
+
+			res = serve(t, h, "GET", http.Header{})
+			requireStatus(t, res, cacheHit)
+			requireDownloadHeaders(t, res)
+			requireBody(t, res, content)
+
+			res = serve(t, h, "GET", http.Header{"Range": []string{"bytes=2-5"}})
+			requireCode(t, res, 206)
+			requireStatus(t, res, cacheHit)
+			requireDownloadHeaders(t, res)
+			require.Equal(t, "bytes 2-5/10", res.Header.Get("Content-Range"))
+			require.Equal(t, "4", res.Header.Get("Content-Length"))
+			requireBody(t, res, []byte("2345"))
+
+			res = serve(t, h, "GET", http.Header{"Range": []string{"bytes=2-5"}, "If-Range": []string{`"v1"`}})
+			requireCode(t, res, 206)
+			requireDownloadHeaders(t, res)
+
+			res = serve(t, h, "HEAD", http.Header{})
+			requireStatus(t, res, cacheHit)
+			requireDownloadHeaders(t, res)
+			require.Equal(t, 1, *fetches)
+		})
+	}
+
+	t.Run("it should keep the disposition on the assembled ranges", func(t *testing.T) {
+		config := emptyConfig()
+		config.RangeAssembly = true
+		h, fetches := newHandler(config)
+
+		res := serve(t, h, "GET", http.Header{"Range": []string{"bytes=0-3"}})
+		requireCode(t, res, 206)
+		requireStatus(t, res, cacheMiss)
+		requireDownloadHeaders(t, res)
+		requireBody(t, res, []byte("0123"))
+
+		res = serve(t, h, "GET", http.Header{"Range": []string{"bytes=1-2"}})
+		requireCode(t, res, 206)
+		requireStatus(t, res, cacheHit)
+		requireDownloadHeaders(t, res)
+		require.Equal(t, "bytes 1-2/10", res.Header.Get("Content-Range"))
+		requireBody(t, res, []byte("12"))
+		require.Equal(t, 1, *fetches)
+	})
+}
+
+func TestStripHeaders(t *testing.T) {
+	config := emptyConfig()
+	config.StripHeaders = []string{"Set-Cookie", "X-Backend-Server"}
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		if r.URL.Path == "/private" {
+			w.Header().Add("Cache-control", "no-store")
+		} else {
+			w.Header().Add("Cache-control", "max-age=10")
+		}
+		w.Header().Add("Set-Cookie", "session=abc")
+		w.Header().Add("x-backend-server", "backend-1")
+		w.Write([]byte("abc"))
+		return 200, nil
+	}), config)
+
+	serve := func(target string) *http.Response {
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", target))
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	t.Run("it should not save nor send the headers of cached responses", func(t *testing.T) {
+		for _, status := range []string{cacheMiss, cacheHit} {
+			res := serve("http://example.com/")
+			requireStatus(t, res, status)
+			require.Empty(t, res.Header.Get("Set-Cookie"))
+			require.Empty(t, res.Header.Get("X-Backend-Server"))
+			requireBody(t, res, []byte("abc"))
+		}
+
+		stored := h.Cache.GetVariants("GET example.com/?")[0].Response.snapHeader
+		require.NotContains(t, stored, "Set-Cookie")
+		require.NotContains(t, stored, "X-Backend-Server")
+	})
+
+	t.Run("it should keep the headers of responses that are not cached", func(t *testing.T) {
+		res := serve("http://example.com/private")
+		require.Equal(t, "session=abc", res.Header.Get("Set-Cookie"))
+		require.Equal(t, "backend-1", res.Header.Get("X-Backend-Server"))
+	})
+}
+
+func TestHitHeaders(t *testing.T) {
+	config := emptyConfig()
+	config.HitHeaders = http.Header{"X-Served-By": {"cache-1"}, "Cache-Control": {"max-age=60"}}
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Add("Cache-control", "max-age=10")
+		w.Header().Add("Etag", `"v1"`)
+		w.Write([]byte("abc"))
+		return 200, nil
+	}), config)
+
+	serve := func(method string, header http.Header) *http.Response {
+		r := newRequestWithOriginalURL(t, method, "http://example.com/")
+		copyHeaders(header, r.Header)
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	miss := serve("GET", nil)
+	requireStatus(t, miss, cacheMiss)
+	require.Empty(t, miss.Header.Get("X-Served-By"))
+	require.Equal(t, []string{"max-age=10"}, miss.Header["Cache-Control"])
+
+	for _, res := range []*http.Response{
+		serve("GET", nil),
+		serve("HEAD", nil),
+		serve("GET", http.Header{"Range": {"bytes=0-1"}}),
+		serve("GET", http.Header{"If-None-Match": {`"v1"`}}),
+	} {
+		requireStatus(t, res, cacheHit)
+		require.Equal(t, []string{"cache-1"}, res.Header["X-Served-By"])
+		require.Equal(t, []string{"max-age=60"}, res.Header["Cache-Control"])
+	}
+}
+
+func TestPreserveHeaderCase(t *testing.T) {
+	content := []byte("abc")
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header()["x-signed-Header"] = []string{"signature"}
+		w.Header()["cache-control"] = []string{"max-age=10"}
+		w.Header()["server"] = []string{"upstream"}
+		w.Write(content)
+		return 200, nil
+	})
+
+	t.Run("it should keep the keys as upstream set them", func(t *testing.T) {
+		config := emptyConfig()
+		config.PreserveHeaderCase = true
+		h := NewHandler(upstream, config)
+
+		for _, status := range []string{cacheMiss, cacheHit} {
+			res, err := doRequest(t, h)
+			require.NoError(t, err)
+			requireStatus(t, res, status)
+			require.Equal(t, []string{"signature"}, res.Header["x-signed-Header"])
+			require.Equal(t, []string{"max-age=10"}, res.Header["cache-control"])
+			require.Nil(t, res.Header["X-Signed-Header"])
+			require.Nil(t, res.Header["server"])
+		}
+	})
+
+	t.Run("it should canonicalize the keys by default", func(t *testing.T) {
+		h := NewHandler(upstream, emptyConfig())
+
+		res, err := doRequest(t, h)
+		require.NoError(t, err)
+		require.Equal(t, []string{"signature"}, res.Header["X-Signed-Header"])
+		require.Nil(t, res.Header["x-signed-Header"])
+	})
+}
+
+func TestMemoryTier(t *testing.T) {
+	content := []byte("abc")
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Add("Cache-control", "max-age=10")
+		w.Write(content)
+		return 200, nil
+	})
+
+	t.Run("it should serve the hits from memory", func(t *testing.T) {
+		config := emptyConfig()
+		config.MemoryTierSize = 1024
+		h := NewHandler(upstream, config)
+
+		for _, status := range []string{cacheMiss, cacheHit, cacheHit} {
+			res, err := doRequest(t, h)
+			require.NoError(t, err)
+			requireStatus(t, res, status)
+			requireBody(t, res, content)
+		}
+
+		r, _ := http.NewRequest("GET", "/", nil)
+		entry, exists := h.Cache.Get(r)
+		require.True(t, exists)
+		require.True(t, entry.Response.body.(*storage.TieredStorage).InMemory())
+		entry.release()
+	})
+
+	t.Run("it should only use disk by default", func(t *testing.T) {
+		h := NewHandler(upstream, emptyConfig())
+
+		for _, status := range []string{cacheMiss, cacheHit} {
+			res, err := doRequest(t, h)
+			require.NoError(t, err)
+			requireStatus(t, res, status)
+		}
+
+		r, _ := http.NewRequest("GET", "/", nil)
+		entry, exists := h.Cache.Get(r)
+		require.True(t, exists)
+		_, isFile := entry.Response.body.(*storage.FileStorage)
+		require.True(t, isFile)
+		entry.release()
+	})
+}
+
+// slowWriter makes the response take long enough to be removed while it is sent
+type slowWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w slowWriter) WriteHeader(code int) {
+	time.Sleep(time.Millisecond)
+	w.ResponseRecorder.WriteHeader(code)
+}
+
+func (w slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestRemoveWhileServing(t *testing.T) {
+	content := bytes.Repeat([]byte("abcdefgh"), 16*1024)
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Add("Cache-control", "max-age=10")
+		w.Write(content)
+		return 200, nil
+	})
+
+	for name, memoryTierSize := range map[string]int64{"disk": 0, "memory tier": 1024 * 1024} {
+		t.Run("it should send whole bodies that are purged while they are read from "+name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "caddy-cache-refs")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			config := emptyConfig()
+			config.Path = dir
+			config.MemoryTierSize = memoryTierSize
+			h := NewHandler(upstream, config)
+
+			done := make(chan struct{})
+			purged := make(chan struct{})
+			go func() {
+				defer close(purged)
+				for {
+					select {
+					case <-done:
+						return
+					default:
+						h.Cache.Flush()
+						time.Sleep(time.Millisecond)
+					}
+				}
+			}()
+
+			wg := sync.WaitGroup{}
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 20; j++ {
+						w := slowWriter{httptest.NewRecorder()}
+						_, err := h.ServeHTTP(w, makeRequest("/", http.Header{}))
+						require.NoError(t, err)
+						require.Equal(t, content, w.Body.Bytes())
+					}
+				}()
+			}
+			wg.Wait()
+			close(done)
+			<-purged
+
+			// Once nobody is reading them every body is removed
+			h.Cache.Flush()
+			require.Eventually(t, func() bool {
+				files, err := ioutil.ReadDir(dir)
+				return err == nil && len(files) == 0
+			}, time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestMmapBodies(t *testing.T) {
+	content := []byte("abcdef")
+	config := emptyConfig()
+	config.MmapMinSize = 1
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Add("Cache-control", "max-age=10")
+		w.Write(content)
+		return 200, nil
+	}), config)
+
+	res, err := doRequest(t, h)
+	require.NoError(t, err)
+	requireStatus(t, res, cacheMiss)
+	requireBody(t, res, content)
+
+	t.Run("it should serve the mapped body", func(t *testing.T) {
+		res, err := doRequest(t, h)
+		require.NoError(t, err)
+		requireStatus(t, res, cacheHit)
+		requireBody(t, res, content)
+	})
+
+	t.Run("it should serve ranges of the mapped body", func(t *testing.T) {
+		res, err := doRequestWithHeaders(t, h, makeHeader("Range", "bytes=2-3"))
+		require.NoError(t, err)
+		requireCode(t, res, http.StatusPartialContent)
+		requireBody(t, res, []byte("cd"))
+	})
+}
+
+func TestMinBodySize(t *testing.T) {
+	newHandler := func(content []byte, setLength bool) (*Handler, *int) {
+		hits := 0
+		config := emptyConfig()
+		config.MinBodySize = 5
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			hits++
+			w.Header().Add("Cache-control", "max-age=10")
+			if setLength {
+				w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			}
+			// Written in parts so the size is not known until the end
+			for _, b := range content {
+				w.Write([]byte{b})
+			}
+			return 200, nil
+		}), config), &hits
+	}
+
+	t.Run("it should not cache bodies smaller than the min size", func(t *testing.T) {
+		for _, setLength := range []bool{true, false} {
+			h, hits := newHandler([]byte("abc"), setLength)
+
+			for _, status := range []string{cacheMiss, cacheSkip} {
+				res, err := doRequest(t, h)
+				require.NoError(t, err)
+				requireStatus(t, res, status)
+				requireBody(t, res, []byte("abc"))
+			}
+			require.Equal(t, 2, *hits)
+		}
+	})
+
+	t.Run("it should cache bodies of at least the min size", func(t *testing.T) {
+		for _, setLength := range []bool{true, false} {
+			h, hits := newHandler([]byte("abcdefgh"), setLength)
+
+			for _, status := range []string{cacheMiss, cacheHit} {
+				res, err := doRequest(t, h)
+				require.NoError(t, err)
+				requireStatus(t, res, status)
+				requireBody(t, res, []byte("abcdefgh"))
+			}
+			require.Equal(t, 1, *hits)
+		}
+	})
+}
+
+func TestOnlyIfCached(t *testing.T) {
+	hits := 0
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		hits++
+		w.Header().Add("Cache-control", "max-age=10")
+		w.Write([]byte("abc"))
+		return 200, nil
+	}), emptyConfig())
+
+	t.Run("it should respond 504 without contacting upstream on a miss", func(t *testing.T) {
+		r, err := http.NewRequest("GET", "/", nil)
+		require.NoError(t, err)
+		r.Header.Set("Cache-Control", "only-if-cached")
+
+		code, err := h.ServeHTTP(httptest.NewRecorder(), r)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusGatewayTimeout, code)
+		require.Equal(t, 0, hits)
+	})
+
+	t.Run("it should serve a fresh hit", func(t *testing.T) {
+		res, err := doRequest(t, h)
+		require.NoError(t, err)
+		requireStatus(t, res, cacheMiss)
+
+		res, err = doRequestWithHeaders(t, h, makeHeader("Cache-Control", "no-transform, only-if-cached"))
+		require.NoError(t, err)
+		requireStatus(t, res, cacheHit)
+		requireBody(t, res, []byte("abc"))
+		require.Equal(t, 1, hits)
+	})
+}
+
+func TestRequestMaxStaleAndMinFresh(t *testing.T) {
+	originalNow := now
+	defer func() { now = originalNow }()
+
+	newHandler := func(cacheControl string) (*Handler, *int) {
+		hits := 0
+		config := emptyConfig()
+		config.ServeStaleOnError = true
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			hits++
+			w.Header().Add("Cache-control", cacheControl)
+			w.Write([]byte("abc"))
+			return 200, nil
+		}), config), &hits
+	}
+
+	after := func(d time.Duration) {
+		now = func() time.Time { return originalNow().Add(d) }
+	}
+
+	t.Run("max-stale should serve expired entries within the window", func(t *testing.T) {
+		now = originalNow
+		h, hits := newHandler("max-age=10")
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, []byte("abc"))
+
+		after(30 * time.Second)
+		res, err := doRequestWithHeaders(t, h, makeHeader("Cache-Control", "max-stale=60"))
+		require.NoError(t, err)
+		requireStatus(t, res, cacheStale)
+		require.Equal(t, `110 - "Response is Stale"`, res.Header.Get("Warning"))
+		require.Equal(t, 1, *hits)
+
+		res, err = doRequestWithHeaders(t, h, makeHeader("Cache-Control", "max-stale=10"))
+		require.NoError(t, err)
+		requireStatus(t, res, cacheMiss)
+		require.Equal(t, 2, *hits)
+	})
+
+	t.Run("max-stale without value should accept any age", func(t *testing.T) {
+		now = originalNow
+		h, hits := newHandler("max-age=10")
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, []byte("abc"))
+
+		after(30 * time.Minute)
+		res, err := doRequestWithHeaders(t, h, makeHeader("Cache-Control", "max-stale"))
+		require.NoError(t, err)
+		requireStatus(t, res, cacheStale)
+		require.Equal(t, 1, *hits)
+	})
+
+	t.Run("must-revalidate should override max-stale", func(t *testing.T) {
+		now = originalNow
+		h, hits := newHandler("max-age=10, must-revalidate")
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, []byte("abc"))
+
+		after(30 * time.Second)
+		res, err := doRequestWithHeaders(t, h, makeHeader("Cache-Control", "max-stale=60"))
+		require.NoError(t, err)
+		requireStatus(t, res, cacheMiss)
+		require.Equal(t, 2, *hits)
+	})
+
+	t.Run("proxy-revalidate should override max-stale", func(t *testing.T) {
+		now = originalNow
+		h, hits := newHandler("max-age=10, proxy-revalidate")
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, []byte("abc"))
+
+		after(30 * time.Second)
+		res, err := doRequestWithHeaders(t, h, makeHeader("Cache-Control", "max-stale=60"))
+		require.NoError(t, err)
+		requireStatus(t, res, cacheMiss)
+		require.Equal(t, "", res.Header.Get("Warning"))
+		require.Equal(t, 2, *hits)
+	})
+
+	t.Run("min-fresh should fetch entries that expire soon", func(t *testing.T) {
+		now = originalNow
+		h, hits := newHandler("max-age=100")
+		requestAndAssert(t, h, http.Header{}, 200, cacheMiss, []byte("abc"))
+
+		res, err := doRequestWithHeaders(t, h, makeHeader("Cache-Control", "min-fresh=50"))
+		require.NoError(t, err)
+		requireStatus(t, res, cacheHit)
+
+		after(60 * time.Second)
+		res, err = doRequestWithHeaders(t, h, makeHeader("Cache-Control", "min-fresh=50"))
+		require.NoError(t, err)
+		requireStatus(t, res, cacheMiss)
+		require.Equal(t, 2, *hits)
+	})
+}
+
+func TestMemorySpillSize(t *testing.T) {
+	big := bytes.Repeat([]byte("abcdefgh"), 16*1024)
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Add("Cache-control", "max-age=10")
+		if r.URL.Path == "/big" {
+			w.Write(big)
+		} else {
+			w.Write([]byte("small"))
+		}
+		return 200, nil
+	})
+
+	t.Run("it should only save to disk the bodies bigger than the spill size", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "caddy-cache-spill")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		config := emptyConfig()
+		config.Path = dir
+		config.MemorySpillSize = 1024
+		h := NewHandler(upstream, config)
+
+		for _, status := range []string{cacheMiss, cacheHit} {
+			w := httptest.NewRecorder()
+			_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", "http://example.com/small"))
+			require.NoError(t, err)
+			requireStatus(t, w.Result(), status)
+			require.Equal(t, []byte("small"), w.Body.Bytes())
+
+			w = httptest.NewRecorder()
+			_, err = h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", "http://example.com/big"))
+			require.NoError(t, err)
+			requireStatus(t, w.Result(), status)
+			require.Equal(t, big, w.Body.Bytes())
+		}
+
+		files, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+		require.Equal(t, int64(len(big)), files[0].Size())
+	})
+}
+
+func TestStorageRules(t *testing.T) {
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Add("Cache-control", "max-age=10")
+		w.Write([]byte(r.URL.Path))
+		return 200, nil
+	})
+
+	defaultDir, err := ioutil.TempDir("", "caddy-cache-default")
+	require.NoError(t, err)
+	defer os.RemoveAll(defaultDir)
+	imagesDir, err := ioutil.TempDir("", "caddy-cache-images")
+	require.NoError(t, err)
+	defer os.RemoveAll(imagesDir)
+
+	config := emptyConfig()
+	config.Path = defaultDir
+	config.StorageBackends = map[string]StorageBackend{
+		"ram":    {Memory: true},
+		"images": {Path: imagesDir},
+	}
+	config.StorageRules = []StorageRule{
+		{Path: "/api/", Backend: "ram"},
+		{Path: "/images/", Backend: "images"},
+	}
+	h := NewHandler(upstream, config)
+
+	for _, path := range []string{"/api/users", "/images/logo.png", "/index.html"} {
+		for _, status := range []string{cacheMiss, cacheHit} {
+			w := httptest.NewRecorder()
+			_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", "http://example.com"+path))
+			require.NoError(t, err)
+			requireStatus(t, w.Result(), status)
+			require.Equal(t, path, w.Body.String())
+		}
+	}
+
+	t.Run("it should save each path in its backend", func(t *testing.T) {
+		entry := h.Cache.GetVariants("GET example.com/api/users?")[0]
+		memory, ok := entry.Response.body.(*storage.SpillStorage)
+		require.True(t, ok)
+		require.Nil(t, memory.Storage())
+
+		for dir, expected := range map[string]string{imagesDir: "/images/logo.png", defaultDir: "/index.html"} {
+			files, err := ioutil.ReadDir(dir)
+			require.NoError(t, err)
+			require.Len(t, files, 1)
+			content, err := ioutil.ReadFile(filepath.Join(dir, files[0].Name()))
+			require.NoError(t, err)
+			require.Equal(t, expected, string(content))
+		}
+	})
+}
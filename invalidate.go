@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+var defaultCacheMethods = []string{http.MethodGet, http.MethodHead}
+
+// isSafeMethod returns if the method does not change the resource, RFC 7231 section 4.2.1
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// isCacheMethod returns if the requests with the method can use the cache, GET and HEAD if cache_methods is not set
+func isCacheMethod(method string, config *Config) bool {
+	methods := config.CacheMethods
+	if len(methods) == 0 {
+		methods = defaultCacheMethods
+	}
+	for _, cacheMethod := range methods {
+		if method == cacheMethod {
+			return true
+		}
+	}
+	return false
+}
+
+// serveUnsafe sends to upstream a request with an unsafe method and purges the cached responses of its url if it succeeds,
+// as RFC 7234 section 4.4 requires, the request probably changed the resource. The urls of the same host in
+// the Location and Content-Location of the response are purged too, other hosts could be purged by any upstream
+func (handler *Handler) serveUnsafe(w http.ResponseWriter, r *http.Request) (int, error) {
+	recorder := httpserver.NewResponseRecorder(w)
+	code, err := handler.Next.ServeHTTP(recorder, r)
+	if err != nil {
+		return code, err
+	}
+	handler.clearSiteData(r, recorder.Header())
+
+	status := code
+	if status == 0 {
+		status = recorder.Status()
+	}
+	if status < 200 || status >= 400 {
+		return code, err
+	}
+
+	handler.purgeURL(r)
+	for _, name := range []string{"Location", "Content-Location"} {
+		if location, ok := sameHostRequest(r, recorder.Header().Get(name)); ok {
+			handler.purgeURL(location)
+		}
+	}
+	return code, err
+}
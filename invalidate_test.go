@@ -0,0 +1,153 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnsafeMethodInvalidation(t *testing.T) {
+	version := 0
+	unsafeCode := http.StatusNoContent
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		if !isSafeMethod(r.Method) {
+			version++
+			w.WriteHeader(unsafeCode)
+			return unsafeCode, nil
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte{byte('0' + version)})
+		return 200, nil
+	})
+
+	serve := func(h *Handler, method string, target string) *http.Response {
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, method, target))
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	for _, method := range []string{http.MethodPut, http.MethodDelete, http.MethodPost, http.MethodPatch} {
+		t.Run("it should purge the cached GET after a successful "+method, func(t *testing.T) {
+			version = 0
+			unsafeCode = http.StatusNoContent
+			h := NewHandler(upstream, emptyConfig())
+
+			requireStatus(t, serve(h, "GET", "http://example.com/item"), cacheMiss)
+			requireStatus(t, serve(h, "GET", "http://example.com/other"), cacheMiss)
+			requireStatus(t, serve(h, "GET", "http://example.com/item"), cacheHit)
+
+			res := serve(h, method, "http://example.com/item")
+			requireStatus(t, res, cacheBypass)
+			requireCode(t, res, http.StatusNoContent)
+
+			res = serve(h, "GET", "http://example.com/item")
+			requireStatus(t, res, cacheMiss)
+			requireBody(t, res, []byte("1"))
+			requireStatus(t, serve(h, "GET", "http://example.com/other"), cacheHit)
+		})
+	}
+
+	t.Run("it should keep the cached GET when the unsafe request fails", func(t *testing.T) {
+		version = 0
+		unsafeCode = http.StatusConflict
+		h := NewHandler(upstream, emptyConfig())
+
+		requireStatus(t, serve(h, "GET", "http://example.com/item"), cacheMiss)
+		requireCode(t, serve(h, http.MethodPut, "http://example.com/item"), http.StatusConflict)
+
+		res := serve(h, "GET", "http://example.com/item")
+		requireStatus(t, res, cacheHit)
+		requireBody(t, res, []byte("0"))
+	})
+
+	t.Run("it should not purge with safe methods", func(t *testing.T) {
+		version = 0
+		h := NewHandler(upstream, emptyConfig())
+
+		requireStatus(t, serve(h, "GET", "http://example.com/item"), cacheMiss)
+		requireStatus(t, serve(h, http.MethodOptions, "http://example.com/item"), cacheBypass)
+		requireStatus(t, serve(h, "GET", "http://example.com/item"), cacheHit)
+	})
+}
+
+func TestLocationInvalidation(t *testing.T) {
+	version := 0
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		if r.Method == http.MethodPost {
+			version++
+			w.Header().Set(r.URL.Query().Get("header"), r.URL.Query().Get("location"))
+			w.WriteHeader(http.StatusCreated)
+			return http.StatusCreated, nil
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte{byte('0' + version)})
+		return 200, nil
+	})
+
+	serve := func(h *Handler, method string, target string) *http.Response {
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, method, target))
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	for _, header := range []string{"Location", "Content-Location"} {
+		t.Run("it should purge the url of the "+header+" of the same host", func(t *testing.T) {
+			version = 0
+			h := NewHandler(upstream, emptyConfig())
+
+			requireStatus(t, serve(h, "GET", "http://example.com/items/1"), cacheMiss)
+			requireStatus(t, serve(h, "POST", "http://example.com/items?header="+header+"&location=/items/1"), cacheBypass)
+
+			res := serve(h, "GET", "http://example.com/items/1")
+			requireStatus(t, res, cacheMiss)
+			requireBody(t, res, []byte("1"))
+		})
+	}
+
+	t.Run("it should not purge the urls of other hosts", func(t *testing.T) {
+		version = 0
+		h := NewHandler(upstream, emptyConfig())
+
+		requireStatus(t, serve(h, "GET", "http://other.com/items/1"), cacheMiss)
+		requireStatus(t, serve(h, "POST", "http://example.com/items?header=Location&location=http://other.com/items/1"), cacheBypass)
+		requireStatus(t, serve(h, "GET", "http://other.com/items/1"), cacheHit)
+	})
+}
+
+func TestCacheMethods(t *testing.T) {
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("abc"))
+		return 200, nil
+	})
+
+	serve := func(h *Handler, method string) *http.Response {
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, method, "http://example.com/"))
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	t.Run("it should cache GET and HEAD by default", func(t *testing.T) {
+		config := emptyConfig()
+		require.True(t, isCacheMethod(http.MethodGet, config))
+		require.True(t, isCacheMethod(http.MethodHead, config))
+		require.False(t, isCacheMethod(http.MethodPost, config))
+	})
+
+	t.Run("it should bypass the methods that are not configured", func(t *testing.T) {
+		config := emptyConfig()
+		config.CacheMethods = []string{http.MethodGet}
+		h := NewHandler(upstream, config)
+
+		requireStatus(t, serve(h, "HEAD"), cacheBypass)
+		requireStatus(t, serve(h, "HEAD"), cacheBypass)
+		requireStatus(t, serve(h, "GET"), cacheMiss)
+		requireStatus(t, serve(h, "GET"), cacheHit)
+	})
+}
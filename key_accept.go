@@ -0,0 +1,36 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// preferredMediaType returns the media type of the Accept header with the highest q value, without its parameters.
+// The first one listed wins a tie, types with q=0 are refused and an empty Accept gives an empty type
+func preferredMediaType(header http.Header) string {
+	preferred, preferredQuality := "", 0.0
+	for _, value := range getHeaderValues(header, "Accept") {
+		params := strings.Split(value, ";")
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		if mediaType != "" && quality > preferredQuality {
+			preferred, preferredQuality = mediaType, quality
+		}
+	}
+	return preferred
+}
+
+// keyWithAccept adds the preferred media type of the request to the key
+func keyWithAccept(key string, r *http.Request) string {
+	return key + " accept=" + preferredMediaType(r.Header)
+}
@@ -0,0 +1,24 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreferredMediaType(t *testing.T) {
+	for value, expected := range map[string]string{
+		"":                                    "",
+		"application/json":                    "application/json",
+		"application/json, text/html;q=0.9":   "application/json",
+		"text/html;q=0.9, Application/JSON":   "application/json",
+		"application/json; charset=utf-8":     "application/json",
+		"application/xml;q=0.5, */*;q=0.1":    "application/xml",
+		"text/html, application/json":         "text/html",
+		"application/json;q=0, text/xml;q=.2": "text/xml",
+		"application/json;q=0":                "",
+	} {
+		require.Equal(t, expected, preferredMediaType(http.Header{"Accept": {value}}), value)
+	}
+}
@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// keySignatureFile is where the signature of the keys is saved in each cache path.
+// It starts with a dot so it doesn't match the pattern of the body files
+const keySignatureFile = ".caddy-cache-keys"
+
+// keySignature summarizes every option that changes how keys are made.
+// If it changes, the files saved with the old keys can't be found with the new ones
+func keySignature(config *Config) string {
+	parts := []string{
+		"template=" + config.CacheKeyTemplate,
+		"headers=" + strings.Join(config.KeyHeaders, ","),
+		fmt.Sprintf("accept=%t", config.KeyAccept),
+		fmt.Sprintf("mergeHead=%t", config.KeyMergeHead),
+		fmt.Sprintf("device=%t", config.VaryDevice != nil),
+		"version=" + config.KeyVersion.Get(),
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// migrateKeys removes the body files left in the path by an instance that made its keys in another way,
+// so they don't use disk forever, and saves the signature of the current keys
+func migrateKeys(path string, signature string) error {
+	previous, err := ioutil.ReadFile(filepath.Join(path, keySignatureFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if strings.TrimSpace(string(previous)) != signature {
+		files, err := filepath.Glob(filepath.Join(path, "caddy-cache-*"))
+		if err != nil {
+			return err
+		}
+		if len(files) > 0 {
+			log.Printf("[INFO] cache: The keys changed since %s was used, removing %d files saved with the old keys", path, len(files))
+		}
+		for _, file := range files {
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+		}
+	}
+
+	return ioutil.WriteFile(filepath.Join(path, keySignatureFile), []byte(signature+"\n"), 0600)
+}
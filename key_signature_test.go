@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateKeys(t *testing.T) {
+	newPath := func(t *testing.T, signature string) (string, string) {
+		path, err := ioutil.TempDir("", "caddy-cache-migrate-")
+		require.NoError(t, err)
+		if signature != "" {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(path, keySignatureFile), []byte(signature+"\n"), 0600))
+		}
+		body, err := ioutil.TempFile(path, "caddy-cache-")
+		require.NoError(t, err)
+		body.Close()
+		return path, body.Name()
+	}
+
+	t.Run("it should remove the files saved with other keys", func(t *testing.T) {
+		config := emptyConfig()
+		config.KeyHeaders = []string{"X-Tenant"}
+		path, body := newPath(t, keySignature(emptyConfig()))
+		defer os.RemoveAll(path)
+
+		require.NoError(t, migrateKeys(path, keySignature(config)))
+
+		_, err := os.Stat(body)
+		require.True(t, os.IsNotExist(err))
+		saved, err := ioutil.ReadFile(filepath.Join(path, keySignatureFile))
+		require.NoError(t, err)
+		require.Equal(t, keySignature(config)+"\n", string(saved))
+	})
+
+	t.Run("it should keep the files if the keys did not change", func(t *testing.T) {
+		signature := keySignature(emptyConfig())
+		path, body := newPath(t, signature)
+		defer os.RemoveAll(path)
+
+		require.NoError(t, migrateKeys(path, signature))
+		_, err := os.Stat(body)
+		require.NoError(t, err)
+	})
+
+	t.Run("it should remove the files of a path without signature", func(t *testing.T) {
+		path, body := newPath(t, "")
+		defer os.RemoveAll(path)
+
+		require.NoError(t, migrateKeys(path, keySignature(emptyConfig())))
+		_, err := os.Stat(body)
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("it should change the signature with the key options", func(t *testing.T) {
+		config := emptyConfig()
+		require.Equal(t, keySignature(config), keySignature(emptyConfig()))
+
+		config.CacheKeyTemplate = "{scheme} " + defaultCacheKeyTemplate
+		require.NotEqual(t, keySignature(config), keySignature(emptyConfig()))
+
+		config = emptyConfig()
+		config.KeyMergeHead = true
+		require.NotEqual(t, keySignature(config), keySignature(emptyConfig()))
+	})
+}
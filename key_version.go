@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// KeyVersion is folded into every key. Changing it makes every url miss at once, like a flush that costs nothing:
+// the entries saved with the old version are never found again and they are removed when they expire or are evicted
+type KeyVersion struct {
+	value atomic.Value
+}
+
+func NewKeyVersion(version string) *KeyVersion {
+	v := &KeyVersion{}
+	v.value.Store(version)
+	return v
+}
+
+// Get returns the version, empty if there is none
+func (v *KeyVersion) Get() string {
+	if v == nil {
+		return ""
+	}
+	version, _ := v.value.Load().(string)
+	return version
+}
+
+func (v *KeyVersion) Set(version string) {
+	v.value.Store(version)
+}
+
+// keyWithVersion adds the version to the key, the keys without a version are the same as before it existed
+func keyWithVersion(key string, version string) string {
+	if version == "" {
+		return key
+	}
+	return key + " version=" + version
+}
+
+type keyVersionResult struct {
+	KeyVersion string `json:"keyVersion"`
+}
+
+func (handler *Handler) setKeyVersion(version string) {
+	if previous := handler.Config.KeyVersion.Get(); previous != version {
+		handler.Config.KeyVersion.Set(version)
+		log.Printf("[INFO] cache: Key version changed from %q to %q", previous, version)
+	}
+}
+
+// serveKeyVersion shows the key version with GET and changes it with POST and ?version=
+func (handler *Handler) serveKeyVersion(w http.ResponseWriter, r *http.Request) (int, error) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		values, ok := r.URL.Query()["version"]
+		if !ok {
+			return http.StatusBadRequest, nil
+		}
+		handler.setKeyVersion(values[0])
+	default:
+		return http.StatusMethodNotAllowed, nil
+	}
+	return writeJSON(w, keyVersionResult{KeyVersion: handler.Config.KeyVersion.Get()})
+}
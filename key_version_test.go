@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyVersion(t *testing.T) {
+	newHandler := func(config *Config) (*Handler, *int) {
+		fetches := 0
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			fetches++
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte("version " + strconv.Itoa(fetches)))
+			return 200, nil
+		}), config), &fetches
+	}
+
+	serve := func(h *Handler, target string) *http.Response {
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", target))
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	t.Run("it should miss the urls cached with the previous version", func(t *testing.T) {
+		config := newAdminConfig()
+		config.KeyVersion = NewKeyVersion("1")
+		h, fetches := newHandler(config)
+
+		requireStatus(t, serve(h, "http://example.com/a"), cacheMiss)
+		requireStatus(t, serve(h, "http://example.com/a"), cacheHit)
+		require.Equal(t, "GET example.com/a? version=1", getKey(h.Config, newRequestWithOriginalURL(t, "GET", "http://example.com/a")))
+
+		h.SetKeyVersion("2")
+		res := serve(h, "http://example.com/a")
+		requireStatus(t, res, cacheMiss)
+		requireBody(t, res, []byte("version 2"))
+		requireStatus(t, serve(h, "http://example.com/a"), cacheHit)
+		require.Equal(t, 2, *fetches)
+	})
+
+	t.Run("it should keep the keys without a version", func(t *testing.T) {
+		h, _ := newHandler(newAdminConfig())
+		require.Equal(t, "", h.KeyVersion())
+		require.Equal(t, "GET example.com/a?", getKey(h.Config, newRequestWithOriginalURL(t, "GET", "http://example.com/a")))
+	})
+
+	t.Run("it should be changed with the admin endpoint", func(t *testing.T) {
+		h, fetches := newHandler(newAdminConfig())
+		getVersion := func(res *http.Response) string {
+			requireCode(t, res, 200)
+			result := keyVersionResult{}
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+			return result.KeyVersion
+		}
+
+		requireStatus(t, serve(h, "http://example.com/a"), cacheMiss)
+		require.Equal(t, "", getVersion(doAdminRequest(t, h, "GET", "http://example.com/_cache/key_version")))
+		require.Equal(t, "43", getVersion(doAdminRequest(t, h, "POST", "http://example.com/_cache/key_version?version=43")))
+		require.Equal(t, "43", h.KeyVersion())
+
+		requireStatus(t, serve(h, "http://example.com/a"), cacheMiss)
+		require.Equal(t, 2, *fetches)
+
+		requireCode(t, doAdminRequest(t, h, "POST", "http://example.com/_cache/key_version"), http.StatusBadRequest)
+		requireCode(t, doAdminRequest(t, h, "DELETE", "http://example.com/_cache/key_version"), http.StatusMethodNotAllowed)
+	})
+}
@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LanguageNormalizer maps the Accept-Language of the requests to one of the supported languages, so the
+// responses that vary on it have a variant for each supported language instead of one for each header value
+type LanguageNormalizer struct {
+	// Supported are lowercase language tags like en or pt-br, the first one is the default
+	Supported []string
+}
+
+// NewLanguageNormalizer creates a normalizer whose default is the first language
+func NewLanguageNormalizer(languages []string) *LanguageNormalizer {
+	supported := []string{}
+	for _, language := range languages {
+		supported = append(supported, strings.ToLower(language))
+	}
+	return &LanguageNormalizer{Supported: supported}
+}
+
+// normalize returns the supported language the request prefers. A tag like en-US matches en if en-us is not supported.
+// Ties of q are won by the first listed, languages with q=0 are refused and the default is used if none matches
+func (normalizer *LanguageNormalizer) normalize(header http.Header) string {
+	type candidate struct {
+		tag     string
+		quality float64
+	}
+
+	candidates := []candidate{}
+	for _, value := range getHeaderValues(header, "Accept-Language") {
+		params := strings.Split(value, ";")
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+
+		if tag := strings.ToLower(strings.TrimSpace(params[0])); tag != "" && quality > 0 {
+			candidates = append(candidates, candidate{tag, quality})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].quality > candidates[j].quality })
+
+	for _, candidate := range candidates {
+		if language, ok := normalizer.match(candidate.tag); ok {
+			return language
+		}
+	}
+	return normalizer.Supported[0]
+}
+
+func (normalizer *LanguageNormalizer) match(tag string) (string, bool) {
+	primary := strings.SplitN(tag, "-", 2)[0]
+	for _, exact := range []bool{true, false} {
+		for _, language := range normalizer.Supported {
+			if exact && language == tag || !exact && language == primary {
+				return language, true
+			}
+		}
+	}
+	return "", false
+}
+
+// isLanguageTag returns if the tag is made of subtags of 1 to 8 letters or digits separated by hyphens, like en or pt-BR
+func isLanguageTag(tag string) bool {
+	for _, subtag := range strings.Split(tag, "-") {
+		if len(subtag) == 0 || len(subtag) > 8 {
+			return false
+		}
+		for _, char := range subtag {
+			if !(char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z' || char >= '0' && char <= '9') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// withLanguage asks upstream for the normalized language, so the variant it sends is the one of its requests
+func withLanguage(req *http.Request, language string) *http.Request {
+	copied := req.WithContext(req.Context())
+	copied.Header = http.Header{}
+	copyHeaders(req.Header, copied.Header)
+	copied.Header.Set("Accept-Language", language)
+	return copied
+}
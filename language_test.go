@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeLanguage(t *testing.T) {
+	normalizer := NewLanguageNormalizer([]string{"en", "fr", "de", "pt-BR"})
+
+	for value, expected := range map[string]string{
+		"en-US,en;q=0.9,fr;q=0.8": "en",
+		"fr-CA,fr;q=0.9":          "fr",
+		"de":                      "de",
+		"DE-at":                   "de",
+		"es;q=1, fr;q=0.5":        "fr",
+		"fr;q=0.5, de;q=0.8":      "de",
+		"fr, de":                  "fr",
+		"pt-BR":                   "pt-br",
+		"pt-PT, pt":               "en",
+		"de;q=0, fr;q=0.1":        "fr",
+		"es, ja":                  "en",
+		"*":                       "en",
+		"":                        "en",
+	} {
+		require.Equal(t, expected, normalizer.normalize(http.Header{"Accept-Language": {value}}), value)
+	}
+}
+
+func TestVaryLanguage(t *testing.T) {
+	fetched := []string{}
+	config := emptyConfig()
+	config.VaryLanguage = NewLanguageNormalizer([]string{"en", "fr"})
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		fetched = append(fetched, r.Header.Get("Accept-Language"))
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte(r.Header.Get("Accept-Language")))
+		return 200, nil
+	}), config)
+
+	serve := func(language string) *http.Response {
+		w := httptest.NewRecorder()
+		r := newRequestWithOriginalURL(t, "GET", "http://example.com/")
+		r.Header.Set("Accept-Language", language)
+		_, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	t.Run("it should save a variant for each supported language", func(t *testing.T) {
+		requireStatus(t, serve("en-US,en;q=0.9,fr;q=0.8"), cacheMiss)
+		requireStatus(t, serve("fr-FR"), cacheMiss)
+
+		for language, body := range map[string]string{"en": "en", "en-GB": "en", "es": "en", "fr, en;q=0.5": "fr"} {
+			res := serve(language)
+			requireStatus(t, res, cacheHit)
+			requireBody(t, res, []byte(body))
+		}
+
+		require.Equal(t, []string{"en", "fr"}, fetched)
+		require.Len(t, h.Cache.GetVariants("GET example.com/?"), 2)
+	})
+}
@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+type maintenanceResult struct {
+	Maintenance bool `json:"maintenance"`
+}
+
+func (handler *Handler) inMaintenance() bool {
+	return atomic.LoadInt32(&handler.maintenance) == 1
+}
+
+func (handler *Handler) setMaintenance(enabled bool) {
+	value := int32(0)
+	if enabled {
+		value = 1
+	}
+	if atomic.SwapInt32(&handler.maintenance, value) != value {
+		log.Printf("[INFO] cache: Maintenance mode %s", map[bool]string{true: "enabled", false: "disabled"}[enabled])
+	}
+}
+
+// serveMaintenanceMode shows the maintenance mode with GET and changes it with POST and ?enabled=true or false
+func (handler *Handler) serveMaintenanceMode(w http.ResponseWriter, r *http.Request) (int, error) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			return http.StatusBadRequest, nil
+		}
+		handler.setMaintenance(enabled)
+	default:
+		return http.StatusMethodNotAllowed, nil
+	}
+	return writeJSON(w, maintenanceResult{Maintenance: handler.inMaintenance()})
+}
+
+// serveMaintenance answers while the origin is down for maintenance, it never goes to upstream.
+// Fresh entries are hits, the entries that would have to be fetched or revalidated are sent with the maintenance status
+// and a Warning, and the requests that have nothing cached get a 504
+func (handler *Handler) serveMaintenance(w http.ResponseWriter, r *http.Request, event *cacheEvent, gunzip bool) (int, error) {
+	ranged := r.Header.Get("Range") != "" && r.Method == http.MethodGet && !gunzip
+
+	if r.Method == http.MethodHead {
+		if entry, ok := handler.getEntryForHead(r, requestDirectives{}); ok {
+			defer entry.release()
+			event.record(cacheHit, entry)
+			return handler.respondHead(w, r, entry)
+		}
+	}
+
+	entry, exists := handler.Cache.Get(r)
+	defer entry.release()
+	if exists && entry.isPublic && !entry.alwaysRevalidate {
+		event.record(cacheHit, entry)
+		if isNotModified(r, entry) {
+			return handler.respondNotModified(w, r, entry, cacheHit)
+		}
+		if ranged {
+			return handler.respondRange(w, r, entry, cacheHit)
+		}
+		return handler.respond(w, r, entry, cacheHit)
+	}
+
+	// Any public entry that is still saved is better than nothing
+	stale, ok := handler.Cache.getExpired(r, func(*HTTPCacheEntry) bool { return true })
+	defer stale.release()
+	if !ok {
+		event.record(cacheMaintenance, nil)
+		handler.addStatusHeaderIfConfigured(w, cacheMaintenance)
+		return http.StatusGatewayTimeout, nil
+	}
+
+	event.record(cacheMaintenance, stale)
+	warning := warningStale
+	if stale.Fresh() {
+		// A no-cache entry is fresh but upstream could not confirm it
+		warning = warningRevalidationFailed
+	}
+	w.Header().Add("Warning", warning)
+	if ranged {
+		return handler.respondRange(w, r, stale, cacheMaintenance)
+	}
+	return handler.respond(w, r, stale, cacheMaintenance)
+}
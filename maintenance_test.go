@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenance(t *testing.T) {
+	originalNow := now
+	defer func() { now = originalNow }()
+
+	fetches := 0
+	newHandler := func() *Handler {
+		fetches = 0
+		config := newAdminConfig()
+		config.ServeStaleOnError = true
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			fetches++
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte("abc"))
+			return 200, nil
+		}), config)
+	}
+
+	serve := func(h *Handler, target string) *http.Response {
+		w := httptest.NewRecorder()
+		code, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", target))
+		require.NoError(t, err)
+		if code >= 400 {
+			w.WriteHeader(code)
+		}
+		return w.Result()
+	}
+
+	t.Run("it should serve fresh hits normally", func(t *testing.T) {
+		now = originalNow
+		h := newHandler()
+		requireStatus(t, serve(h, "http://example.com/"), cacheMiss)
+		h.SetMaintenance(true)
+
+		res := serve(h, "http://example.com/")
+		requireStatus(t, res, cacheHit)
+		requireBody(t, res, []byte("abc"))
+		require.Empty(t, res.Header.Get("Warning"))
+		require.Equal(t, 1, fetches)
+	})
+
+	t.Run("it should serve expired entries with a warning", func(t *testing.T) {
+		now = originalNow
+		h := newHandler()
+		requireStatus(t, serve(h, "http://example.com/"), cacheMiss)
+		h.SetMaintenance(true)
+		now = func() time.Time { return originalNow().Add(10 * time.Minute) }
+
+		res := serve(h, "http://example.com/")
+		requireStatus(t, res, cacheMaintenance)
+		requireCode(t, res, 200)
+		requireBody(t, res, []byte("abc"))
+		require.Equal(t, warningStale, res.Header.Get("Warning"))
+		require.Equal(t, 1, fetches)
+	})
+
+	t.Run("it should answer misses with a 504 without going to upstream", func(t *testing.T) {
+		now = originalNow
+		h := newHandler()
+		h.SetMaintenance(true)
+
+		res := serve(h, "http://example.com/missing")
+		requireStatus(t, res, cacheMaintenance)
+		requireCode(t, res, http.StatusGatewayTimeout)
+		require.Equal(t, 0, fetches)
+		require.Equal(t, int64(1), h.Stats().Maintenance)
+
+		h.SetMaintenance(false)
+		requireStatus(t, serve(h, "http://example.com/missing"), cacheMiss)
+		require.Equal(t, 1, fetches)
+	})
+
+	t.Run("it should be toggled with the admin endpoint", func(t *testing.T) {
+		h := newHandler()
+		getMode := func(res *http.Response) bool {
+			requireCode(t, res, 200)
+			result := maintenanceResult{}
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+			return result.Maintenance
+		}
+
+		require.False(t, getMode(doAdminRequest(t, h, "GET", "http://example.com/_cache/maintenance")))
+		require.True(t, getMode(doAdminRequest(t, h, "POST", "http://example.com/_cache/maintenance?enabled=true")))
+		require.True(t, h.InMaintenance())
+		require.False(t, getMode(doAdminRequest(t, h, "POST", "http://example.com/_cache/maintenance?enabled=false")))
+		requireCode(t, doAdminRequest(t, h, "POST", "http://example.com/_cache/maintenance?enabled=maybe"), http.StatusBadRequest)
+		requireCode(t, doAdminRequest(t, h, "DELETE", "http://example.com/_cache/maintenance"), http.StatusMethodNotAllowed)
+	})
+
+	t.Run("it should start in maintenance with the directive", func(t *testing.T) {
+		config := emptyConfig()
+		config.Maintenance = true
+		require.True(t, NewHandler(nil, config).InMaintenance())
+	})
+}
@@ -0,0 +1,55 @@
+package cache
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/nicolasazrak/caddy-cache/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxOpenFiles(t *testing.T) {
+	t.Run("it should default to the limit of the process", func(t *testing.T) {
+		require.Equal(t, storage.DefaultOpenFileLimit() > 0, newOpenFileLimit(emptyConfig()) != nil)
+
+		config := emptyConfig()
+		config.MaxOpenFiles = 2
+		require.NotNil(t, newOpenFileLimit(config))
+	})
+
+	t.Run("it should queue the hits beyond the limit", func(t *testing.T) {
+		content := bytes.Repeat([]byte("abc"), 100*1024)
+		config := emptyConfig()
+		config.MaxOpenFiles = 2
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write(content)
+			return 200, nil
+		}), config)
+
+		serve := func() *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", "http://example.com/big"))
+			require.NoError(t, err)
+			return w
+		}
+		require.Equal(t, content, serve().Body.Bytes())
+
+		wg := &sync.WaitGroup{}
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := serve()
+				requireStatus(t, w.Result(), cacheHit)
+				require.Equal(t, content, w.Body.Bytes())
+			}()
+		}
+		wg.Wait()
+		require.Equal(t, 0, h.Cache.openFiles.InUse())
+	})
+}
@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxStaleAge(t *testing.T) {
+	originalNow := now
+	defer func() { now = originalNow }()
+
+	failing := false
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		if failing {
+			w.WriteHeader(http.StatusBadGateway)
+			return http.StatusBadGateway, nil
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("abc"))
+		return 200, nil
+	})
+
+	mechanisms := map[string]struct {
+		config func(config *Config)
+		header http.Header
+	}{
+		"serve_stale_on_error": {func(config *Config) { config.ServeStaleOnError = true }, http.Header{}},
+		"grace":                {func(config *Config) { config.Grace = time.Hour }, http.Header{}},
+		"max-stale":            {func(config *Config) {}, http.Header{"Cache-Control": {"max-stale"}}},
+	}
+
+	serve := func(h *Handler, header http.Header) *http.Response {
+		w := httptest.NewRecorder()
+		r := newRequestWithOriginalURL(t, "GET", "http://example.com/")
+		copyHeaders(header, r.Header)
+		_, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	waitRefreshes := func(h *Handler) {
+		for i := 0; i < 1000; i++ {
+			refreshing := false
+			h.graceRefreshes.Range(func(key, value interface{}) bool {
+				refreshing = true
+				return false
+			})
+			if !refreshing {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatal("the refresh did not end")
+	}
+
+	for name, mechanism := range mechanisms {
+		for _, test := range []struct {
+			stale  time.Duration
+			status string
+		}{
+			{time.Minute + 50*time.Second, cacheStale},
+			{2*time.Minute + 10*time.Second, cacheMiss},
+		} {
+			t.Run("it should cap "+name+" to max_stale_age after "+test.stale.String(), func(t *testing.T) {
+				now = originalNow
+				failing = false
+				config := emptyConfig()
+				config.MaxStaleAge = 2 * time.Minute
+				mechanism.config(config)
+				h := NewHandler(upstream, config)
+
+				requireStatus(t, serve(h, nil), cacheMiss)
+				failing = true
+				now = func() time.Time { return originalNow().Add(time.Minute + test.stale) }
+
+				res := serve(h, mechanism.header)
+				requireStatus(t, res, test.status)
+				if test.status == cacheStale {
+					requireBody(t, res, []byte("abc"))
+				} else {
+					requireCode(t, res, http.StatusBadGateway)
+				}
+
+				// The refresh of the grace reads the time, it must end before the test moves it again
+				waitRefreshes(h)
+			})
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds in seconds of the latency buckets, the same ones prometheus uses by default
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type latencyLabels struct {
+	status string
+	host   string
+}
+
+type latencySeries struct {
+	// counts[i] is how many observations are in the bucket i, the last one is +Inf
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// latencyHistogram is a prometheus histogram of durations by cache status and host
+type latencyHistogram struct {
+	name   string
+	help   string
+	lock   *sync.Mutex
+	series map[latencyLabels]*latencySeries
+}
+
+func newLatencyHistogram(name, help string) *latencyHistogram {
+	return &latencyHistogram{
+		name:   name,
+		help:   help,
+		lock:   new(sync.Mutex),
+		series: map[latencyLabels]*latencySeries{},
+	}
+}
+
+func (h *latencyHistogram) observe(labels latencyLabels, duration time.Duration) {
+	seconds := duration.Seconds()
+	bucket := sort.SearchFloat64s(latencyBuckets, seconds)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	series, ok := h.series[labels]
+	if !ok {
+		series = &latencySeries{counts: make([]uint64, len(latencyBuckets)+1)}
+		h.series[labels] = series
+	}
+	series.counts[bucket]++
+	series.count++
+	series.sum += seconds
+}
+
+// writeTo writes the histogram in the prometheus text format
+func (h *latencyHistogram) writeTo(w io.Writer, withHost bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	labels := make([]latencyLabels, 0, len(h.series))
+	for label := range h.series {
+		labels = append(labels, label)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].status != labels[j].status {
+			return labels[i].status < labels[j].status
+		}
+		return labels[i].host < labels[j].host
+	})
+
+	for _, label := range labels {
+		series := h.series[label]
+		names := fmt.Sprintf(`status="%s"`, escapeLabel(label.status))
+		if withHost {
+			names += fmt.Sprintf(`,host="%s"`, escapeLabel(label.host))
+		}
+
+		var cumulative uint64
+		for i, count := range series.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = strconv.FormatFloat(latencyBuckets[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", h.name, names, le, cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, names, strconv.FormatFloat(series.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, names, series.count)
+	}
+}
+
+// average returns the mean of every observation in seconds, or 0 if there are none
+func (h *latencyHistogram) average() float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var count uint64
+	var sum float64
+	for _, series := range h.series {
+		count += series.count
+		sum += series.sum
+	}
+	if count == 0 {
+		return 0
+	}
+	return sum / float64(count)
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// originMetrics measures how long upstream takes to send the headers and the whole body,
+// so a slow origin can be told apart from a big response
+type originMetrics struct {
+	inFlight int64 // fetches in progress, first to be 64 bit aligned for atomic access
+
+	byHost    bool
+	firstByte *latencyHistogram
+	total     *latencyHistogram
+}
+
+func newOriginMetrics(byHost bool) *originMetrics {
+	return &originMetrics{
+		byHost:    byHost,
+		firstByte: newLatencyHistogram("caddy_cache_origin_first_byte_seconds", "Time until upstream sends the response headers."),
+		total:     newLatencyHistogram("caddy_cache_origin_total_seconds", "Time until upstream sends the whole response body."),
+	}
+}
+
+// observe records the latencies of an entry fetched from upstream.
+// The total is recorded once the body is completely received
+func (metrics *originMetrics) observe(entry *HTTPCacheEntry, status string) {
+	if metrics == nil || entry.fetchStart.IsZero() {
+		return
+	}
+
+	labels := latencyLabels{status: status}
+	if metrics.byHost {
+		labels.host = hostOf(entry.Request)
+	}
+
+	metrics.firstByte.observe(labels, entry.firstByteAt.Sub(entry.fetchStart))
+	go func() {
+		entry.Response.WaitClose()
+		metrics.total.observe(labels, time.Since(entry.fetchStart))
+	}()
+}
+
+// fetchStarted counts a fetch to upstream until fetchEnded is called
+func (metrics *originMetrics) fetchStarted() {
+	metrics.tryFetchStarted(0)
+}
+
+// tryFetchStarted is like fetchStarted but it doesn't count the fetch and returns false
+// if there are already max fetches in progress. With 0 there is no limit
+func (metrics *originMetrics) tryFetchStarted(max int64) bool {
+	if metrics == nil {
+		return true
+	}
+
+	for {
+		inFlight := atomic.LoadInt64(&metrics.inFlight)
+		if max > 0 && inFlight >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&metrics.inFlight, inFlight, inFlight+1) {
+			return true
+		}
+	}
+}
+
+func (metrics *originMetrics) fetchEnded() {
+	if metrics != nil {
+		atomic.AddInt64(&metrics.inFlight, -1)
+	}
+}
+
+func (metrics *originMetrics) fetchesInFlight() int64 {
+	if metrics == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&metrics.inFlight)
+}
+
+// averageFetch returns how long upstream takes on average to send the whole body
+func (metrics *originMetrics) averageFetch() float64 {
+	if metrics == nil {
+		return 0
+	}
+	return metrics.total.average()
+}
+
+// write writes every metric in the prometheus text format
+func (metrics *originMetrics) write(w io.Writer) {
+	metrics.firstByte.writeTo(w, metrics.byHost)
+	metrics.total.writeTo(w, metrics.byHost)
+	writeGauge(w, "caddy_cache_origin_fetches_in_flight", "Fetches to upstream made by the cache that are in progress.", metrics.fetchesInFlight())
+}
+
+func writeGauge(w io.Writer, name string, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+}
+
+func (handler *Handler) serveMetrics(w http.ResponseWriter) (int, error) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	handler.Metrics.write(w)
+	handler.Cache.counters.write(w)
+	writeGauge(w, "caddy_cache_collapsed_requests_waiting", "Requests waiting another request of the same key that is fetching upstream.", handler.URLLocks.Waiting())
+	return http.StatusOK, nil
+}
+
+type inFlightResult struct {
+	Fetches      int64          `json:"fetches"`
+	Waiting      int64          `json:"waiting"`
+	WaitingByKey map[string]int `json:"waitingByKey"`
+}
+
+// serveInFlight shows the fetches to upstream in progress and the requests waiting them
+func (handler *Handler) serveInFlight(w http.ResponseWriter) (int, error) {
+	return writeJSON(w, inFlightResult{
+		Fetches:      handler.Metrics.fetchesInFlight(),
+		Waiting:      handler.URLLocks.Waiting(),
+		WaitingByKey: handler.URLLocks.WaitingByKey(),
+	})
+}
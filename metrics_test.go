@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	h := newLatencyHistogram("test_seconds", "Test.")
+	h.observe(latencyLabels{status: "miss"}, 20*time.Millisecond)
+	h.observe(latencyLabels{status: "miss"}, 3*time.Second)
+
+	output := new(strings.Builder)
+	h.writeTo(output, false)
+	require.Contains(t, output.String(), "# TYPE test_seconds histogram\n")
+	require.Contains(t, output.String(), `test_seconds_bucket{status="miss",le="0.01"} 0`+"\n")
+	require.Contains(t, output.String(), `test_seconds_bucket{status="miss",le="0.025"} 1`+"\n")
+	require.Contains(t, output.String(), `test_seconds_bucket{status="miss",le="5"} 2`+"\n")
+	require.Contains(t, output.String(), `test_seconds_bucket{status="miss",le="+Inf"} 2`+"\n")
+	require.Contains(t, output.String(), `test_seconds_sum{status="miss"} 3.02`+"\n")
+	require.Contains(t, output.String(), `test_seconds_count{status="miss"} 2`+"\n")
+}
+
+func TestOriginMetrics(t *testing.T) {
+	newHandler := func(config *Config) *Handler {
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Add("Cache-control", "max-age=10")
+			w.WriteHeader(200)
+			time.Sleep(30 * time.Millisecond)
+			w.Write([]byte("abc"))
+			return 200, nil
+		}), config)
+	}
+
+	getMetrics := func(h *Handler) string {
+		res := doAdminRequest(t, h, "GET", "http://example.com/_cache/metrics")
+		requireCode(t, res, 200)
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	t.Run("it should tell first byte from total time", func(t *testing.T) {
+		h := newHandler(newAdminConfig())
+		for i := 0; i < 2; i++ {
+			_, err := h.ServeHTTP(httptest.NewRecorder(), newRequestWithOriginalURL(t, "GET", "http://example.com/a"))
+			require.NoError(t, err)
+		}
+
+		require.Eventually(t, func() bool {
+			return strings.Contains(getMetrics(h), `caddy_cache_origin_total_seconds_count{status="miss"} 1`)
+		}, time.Second, 10*time.Millisecond)
+
+		metrics := getMetrics(h)
+		// Hits don't contact upstream
+		require.Contains(t, metrics, `caddy_cache_origin_first_byte_seconds_count{status="miss"} 1`)
+		require.Contains(t, metrics, `caddy_cache_origin_first_byte_seconds_bucket{status="miss",le="0.025"} 1`)
+		require.Contains(t, metrics, `caddy_cache_origin_total_seconds_bucket{status="miss",le="0.025"} 0`)
+	})
+
+	t.Run("it should label by host when it is configured", func(t *testing.T) {
+		config := newAdminConfig()
+		config.MetricsByHost = true
+		h := newHandler(config)
+
+		_, err := h.ServeHTTP(httptest.NewRecorder(), newRequestWithOriginalURL(t, "GET", "http://example.com:8080/a"))
+		require.NoError(t, err)
+
+		require.Contains(t, getMetrics(h), `caddy_cache_origin_first_byte_seconds_count{status="miss",host="example.com"} 1`)
+	})
+}
+
+func TestInFlight(t *testing.T) {
+	getInFlight := func(h *Handler) inFlightResult {
+		res := doAdminRequest(t, h, "GET", "http://example.com/_cache/inflight")
+		requireCode(t, res, 200)
+		result := inFlightResult{}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+		return result
+	}
+
+	newHandler := func(config *Config, release chan struct{}, failure error) *Handler {
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			<-release
+			if failure != nil {
+				return http.StatusBadGateway, failure
+			}
+			w.Header().Add("Cache-control", "max-age=10")
+			w.Write([]byte("abc"))
+			return 200, nil
+		}), config)
+	}
+
+	serveInBackground := func(h *Handler, wg *sync.WaitGroup) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.ServeHTTP(httptest.NewRecorder(), newRequestWithOriginalURL(t, "GET", "http://example.com/a"))
+		}()
+	}
+
+	t.Run("it should count the fetch and the requests waiting it", func(t *testing.T) {
+		release := make(chan struct{})
+		h := newHandler(newAdminConfig(), release, nil)
+		wg := &sync.WaitGroup{}
+		for i := 0; i < 3; i++ {
+			serveInBackground(h, wg)
+		}
+
+		require.Eventually(t, func() bool {
+			result := getInFlight(h)
+			return result.Fetches == 1 && result.Waiting == 2
+		}, time.Second, 10*time.Millisecond)
+		require.Equal(t, map[string]int{"GET example.com/a?": 2}, getInFlight(h).WaitingByKey)
+
+		res := doAdminRequest(t, h, "GET", "http://example.com/_cache/metrics")
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(body), "caddy_cache_origin_fetches_in_flight 1\n")
+		require.Contains(t, string(body), "caddy_cache_collapsed_requests_waiting 2\n")
+
+		close(release)
+		wg.Wait()
+		require.Eventually(t, func() bool {
+			result := getInFlight(h)
+			return result.Fetches == 0 && result.Waiting == 0 && len(result.WaitingByKey) == 0
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("it should stop counting fetches that fail and requests that stop waiting", func(t *testing.T) {
+		release := make(chan struct{})
+		config := newAdminConfig()
+		config.CollapseTimeout = 200 * time.Millisecond
+		h := newHandler(config, release, errors.New("dial tcp: connection refused"))
+
+		wg := &sync.WaitGroup{}
+		serveInBackground(h, wg)
+		require.Eventually(t, func() bool {
+			return getInFlight(h).Fetches == 1
+		}, time.Second, 10*time.Millisecond)
+
+		// It waits the timeout and then it goes upstream without the cache
+		serveInBackground(h, wg)
+		require.Eventually(t, func() bool {
+			return getInFlight(h).Waiting == 1
+		}, time.Second, 10*time.Millisecond)
+		require.Eventually(t, func() bool {
+			result := getInFlight(h)
+			return result.Fetches == 1 && result.Waiting == 0
+		}, time.Second, 10*time.Millisecond)
+
+		close(release)
+		wg.Wait()
+		require.Eventually(t, func() bool {
+			return getInFlight(h).Fetches == 0
+		}, time.Second, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/nicolasazrak/caddy-cache/storage"
+)
+
+// withOffload also uploads the body to the offloader of the storage backend of the request.
+// Bodies of unknown size are only uploaded if the backend has no min size
+func (cache *HTTPCache) withOffload(e *HTTPCacheEntry, body storage.ResponseStorage) storage.ResponseStorage {
+	backend, ok := storageBackendFor(cache.config, e.Request.URL.Path)
+	if !ok || backend.Offloader == nil || body == nil || e.Request.Method != http.MethodGet || e.Response.Code != http.StatusOK {
+		return body
+	}
+
+	if backend.OffloadMinSize > 0 {
+		length, err := strconv.ParseInt(e.Response.snapHeader.Get("Content-Length"), 10, 64)
+		if err != nil || length < backend.OffloadMinSize {
+			return body
+		}
+	}
+
+	remote, err := backend.Offloader.Create(e.key)
+	if err != nil {
+		log.Printf("[WARNING] cache: Can't offload the body of %s, it is only saved locally: %v", e.key, err)
+		return body
+	}
+	e.offload = storage.NewOffloadStorage(body, remote)
+	return e.offload
+}
+
+// offloadedURL returns where the client can download the body of the entry instead of getting it from the cache.
+// Only the whole bodies that are sent as they were saved are redirected
+func offloadedURL(w http.ResponseWriter, r *http.Request, entry *HTTPCacheEntry) (string, bool) {
+	if entry.offload == nil || r.Method != http.MethodGet {
+		return "", false
+	}
+	if _, decompressing := w.(*gunzipWriter); decompressing {
+		return "", false
+	}
+	return entry.offload.RedirectURL()
+}
+
+// respondOffloaded redirects the client to the uploaded body. The redirect is not cached by the client,
+// the freshness of the entry is checked by the cache every time
+func (handler *Handler) respondOffloaded(w http.ResponseWriter, r *http.Request, entry *HTTPCacheEntry, cacheStatus string, url string) (int, error) {
+	handler.addStatusHeaderIfConfigured(w, cacheStatus)
+	handler.addDebugTTLHeader(w, r, entry)
+	w.Header().Set("Location", url)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusFound)
+	return http.StatusFound, nil
+}
@@ -0,0 +1,173 @@
+package cache
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/nicolasazrak/caddy-cache/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryOffloader keeps the uploads in memory and gives them the url of the key
+type memoryOffloader struct {
+	lock    *sync.Mutex
+	uploads map[string]*memoryUpload
+}
+
+type memoryUpload struct {
+	offloader *memoryOffloader
+	key       string
+	content   bytes.Buffer
+}
+
+func newMemoryOffloader() *memoryOffloader {
+	return &memoryOffloader{lock: new(sync.Mutex), uploads: map[string]*memoryUpload{}}
+}
+
+func (o *memoryOffloader) Create(key string) (storage.OffloadedBody, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	upload := &memoryUpload{offloader: o, key: key}
+	o.uploads[key] = upload
+	return upload, nil
+}
+
+func (o *memoryOffloader) uploaded(key string) (string, bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	upload, ok := o.uploads[key]
+	if !ok {
+		return "", false
+	}
+	return upload.content.String(), true
+}
+
+func (u *memoryUpload) Write(p []byte) (int, error) {
+	u.offloader.lock.Lock()
+	defer u.offloader.lock.Unlock()
+	return u.content.Write(p)
+}
+
+func (u *memoryUpload) Close() error {
+	return nil
+}
+
+func (u *memoryUpload) URL() (string, error) {
+	return "https://bucket.example.com/" + u.key, nil
+}
+
+func (u *memoryUpload) Remove() error {
+	u.offloader.lock.Lock()
+	defer u.offloader.lock.Unlock()
+	delete(u.offloader.uploads, u.key)
+	return nil
+}
+
+func TestOffload(t *testing.T) {
+	originalNow := now
+	defer func() { now = originalNow }()
+
+	newOffloadHandler := func(minSize int64) (*Handler, *memoryOffloader) {
+		offloader := newMemoryOffloader()
+		config := emptyConfig()
+		config.StorageBackends = map[string]StorageBackend{
+			"media": {Memory: true, Offloader: offloader, OffloadMinSize: minSize},
+		}
+		config.StorageRules = []StorageRule{{Path: "/media/", Backend: "media"}}
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Content-Length", "5")
+			w.Write([]byte("video"))
+			return 200, nil
+		}), config), offloader
+	}
+
+	serve := func(h *Handler, method string, url string) *http.Response {
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, method, url))
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	t.Run("it should redirect the hits to the uploaded body", func(t *testing.T) {
+		now = originalNow
+		h, offloader := newOffloadHandler(0)
+
+		res := serve(h, "GET", "http://example.com/media/a.mp4")
+		requireStatus(t, res, cacheMiss)
+		requireCode(t, res, 200)
+		requireBody(t, res, []byte("video"))
+
+		content, ok := offloader.uploaded("GET example.com/media/a.mp4?")
+		require.True(t, ok)
+		require.Equal(t, "video", content)
+
+		require.Eventually(t, func() bool {
+			return serve(h, "GET", "http://example.com/media/a.mp4").StatusCode == http.StatusFound
+		}, time.Second, 10*time.Millisecond)
+		res = serve(h, "GET", "http://example.com/media/a.mp4")
+		requireStatus(t, res, cacheHit)
+		require.Equal(t, "https://bucket.example.com/GET example.com/media/a.mp4?", res.Header.Get("Location"))
+		require.Equal(t, "no-store", res.Header.Get("Cache-Control"))
+	})
+
+	t.Run("it should not redirect an expired entry", func(t *testing.T) {
+		now = originalNow
+		h, _ := newOffloadHandler(0)
+		serve(h, "GET", "http://example.com/media/a.mp4")
+		require.Eventually(t, func() bool {
+			return serve(h, "GET", "http://example.com/media/a.mp4").StatusCode == http.StatusFound
+		}, time.Second, 10*time.Millisecond)
+
+		now = func() time.Time { return originalNow().Add(2 * time.Minute) }
+		res := serve(h, "GET", "http://example.com/media/a.mp4")
+		requireStatus(t, res, cacheMiss)
+		requireCode(t, res, 200)
+		requireBody(t, res, []byte("video"))
+	})
+
+	t.Run("it should serve the ranges from the local body", func(t *testing.T) {
+		now = originalNow
+		h, _ := newOffloadHandler(0)
+		serve(h, "GET", "http://example.com/media/a.mp4")
+		require.Eventually(t, func() bool {
+			return serve(h, "GET", "http://example.com/media/a.mp4").StatusCode == http.StatusFound
+		}, time.Second, 10*time.Millisecond)
+
+		req := newRequestWithOriginalURL(t, "GET", "http://example.com/media/a.mp4")
+		req.Header.Set("Range", "bytes=0-1")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		requireCode(t, w.Result(), http.StatusPartialContent)
+		requireBody(t, w.Result(), []byte("vi"))
+	})
+
+	t.Run("it should not offload bodies smaller than the min size or of other paths", func(t *testing.T) {
+		now = originalNow
+		h, offloader := newOffloadHandler(1024)
+		serve(h, "GET", "http://example.com/media/a.mp4")
+		serve(h, "GET", "http://example.com/b.mp4")
+
+		_, ok := offloader.uploaded("GET example.com/media/a.mp4?")
+		require.False(t, ok)
+		require.Empty(t, offloader.uploads)
+		requireCode(t, serve(h, "GET", "http://example.com/media/a.mp4"), 200)
+	})
+
+	t.Run("it should remove the upload when the entry is purged", func(t *testing.T) {
+		now = originalNow
+		h, offloader := newOffloadHandler(0)
+		serve(h, "GET", "http://example.com/media/a.mp4")
+
+		h.Purge("GET example.com/media/a.mp4?")
+		require.Eventually(t, func() bool {
+			_, ok := offloader.uploaded("GET example.com/media/a.mp4?")
+			return !ok
+		}, time.Second, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,31 @@
+package cache
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+var errOverloaded = errors.New("too many fetches to upstream in progress")
+
+// fetchWithinLimit fetches from upstream unless there are already max_concurrent_fetches in progress,
+// then it returns errOverloaded without an entry
+func (handler *Handler) fetchWithinLimit(req *http.Request) (*HTTPCacheEntry, error) {
+	if !handler.Metrics.tryFetchStarted(int64(handler.Config.MaxConcurrentFetches)) {
+		return nil, errOverloaded
+	}
+	return handler.fetchCounted(req)
+}
+
+// respondOverloaded sends the stale entry if it can be used, otherwise it asks the client to retry later
+func (handler *Handler) respondOverloaded(w http.ResponseWriter, r *http.Request, event *cacheEvent, stale *HTTPCacheEntry) (int, error) {
+	if stale != nil && canServeStale(stale) {
+		event.record(cacheStale, stale)
+		return handler.respondStale(w, r, stale, warningStale)
+	}
+
+	event.record(cacheOverloaded, nil)
+	handler.addStatusHeaderIfConfigured(w, cacheOverloaded)
+	w.Header().Set("Retry-After", strconv.Itoa(int(handler.Config.RetryAfter.Seconds())))
+	return http.StatusServiceUnavailable, nil
+}
@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxConcurrentFetches(t *testing.T) {
+	originalNow := now
+	defer func() { now = originalNow }()
+
+	var fetches int32
+	release := make(chan struct{})
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		atomic.AddInt32(&fetches, 1)
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		w.Header().Add("Cache-control", "max-age=10")
+		w.Write([]byte(r.URL.Path))
+		return 200, nil
+	})
+
+	serve := func(h *Handler, target string) *http.Response {
+		w := httptest.NewRecorder()
+		code, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", target))
+		require.NoError(t, err)
+		if code >= 400 {
+			w.WriteHeader(code)
+		}
+		return w.Result()
+	}
+
+	t.Run("it should respond 503 to the requests over the limit", func(t *testing.T) {
+		atomic.StoreInt32(&fetches, 0)
+		release = make(chan struct{})
+		config := newAdminConfig()
+		config.MaxConcurrentFetches = 1
+		config.RetryAfter = 30 * time.Second
+		h := NewHandler(upstream, config)
+
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(h, "http://example.com/slow")
+		}()
+		require.Eventually(t, func() bool {
+			return h.Metrics.fetchesInFlight() == 1
+		}, time.Second, 10*time.Millisecond)
+
+		for i := 0; i < 3; i++ {
+			res := serve(h, "http://example.com/other")
+			requireCode(t, res, http.StatusServiceUnavailable)
+			requireStatus(t, res, cacheOverloaded)
+			require.Equal(t, "30", res.Header.Get("Retry-After"))
+		}
+		require.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+		close(release)
+		wg.Wait()
+		require.Eventually(t, func() bool {
+			return h.Metrics.fetchesInFlight() == 0
+		}, time.Second, 10*time.Millisecond)
+
+		// Once the fetch ends the limit is free again, and hits never count
+		requireStatus(t, serve(h, "http://example.com/other"), cacheMiss)
+		requireStatus(t, serve(h, "http://example.com/slow"), cacheHit)
+		require.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+
+		res := doAdminRequest(t, h, "GET", "http://example.com/_cache/metrics")
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(body), "caddy_cache_responses_total{status=\"overloaded\"} 3\n")
+	})
+
+	t.Run("it should serve a stale response over the limit", func(t *testing.T) {
+		now = originalNow
+		release = make(chan struct{})
+		config := emptyConfig()
+		config.MaxConcurrentFetches = 1
+		config.RetryAfter = defaultRetryAfter
+		config.ServeStaleOnError = true
+		h := NewHandler(upstream, config)
+
+		serveWithStatus := func(target string, status string) *http.Response {
+			res := serve(h, target)
+			requireStatus(t, res, status)
+			return res
+		}
+		serveWithStatus("http://example.com/other", cacheMiss)
+		now = func() time.Time { return originalNow().Add(time.Minute) }
+
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(h, "http://example.com/slow")
+		}()
+		require.Eventually(t, func() bool {
+			return h.Metrics.fetchesInFlight() == 1
+		}, time.Second, 10*time.Millisecond)
+
+		res := serveWithStatus("http://example.com/other", cacheStale)
+		requireCode(t, res, 200)
+		requireBody(t, res, []byte("/other"))
+		require.Equal(t, warningStale, res.Header.Get("Warning"))
+
+		close(release)
+		wg.Wait()
+	})
+
+	t.Run("it should not limit the fetches by default", func(t *testing.T) {
+		release = make(chan struct{})
+		h := NewHandler(upstream, emptyConfig())
+
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(h, "http://example.com/slow")
+		}()
+		require.Eventually(t, func() bool {
+			return h.Metrics.fetchesInFlight() == 1
+		}, time.Second, 10*time.Millisecond)
+
+		requireStatus(t, serve(h, "http://example.com/other"), cacheMiss)
+		close(release)
+		wg.Wait()
+	})
+}
@@ -0,0 +1,161 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var errInvalidRange = errors.New("invalid range")
+var errUnsatisfiableRange = errors.New("unsatisfiable range")
+
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.start+br.length-1, size)
+}
+
+// parseRange parses a Range header with a single range like "bytes=0-499", "bytes=500-" or "bytes=-500".
+// Multiple ranges are not supported and are reported as invalid so the whole body is sent
+func parseRange(header string, size int64) (byteRange, error) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return byteRange{}, errInvalidRange
+	}
+
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	if strings.Contains(spec, ",") {
+		return byteRange{}, errInvalidRange
+	}
+
+	dash := strings.Index(spec, "-")
+	if dash < 0 {
+		return byteRange{}, errInvalidRange
+	}
+	startValue, endValue := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+
+	// Suffix range, the last bytes of the body
+	if startValue == "" {
+		suffix, err := strconv.ParseInt(endValue, 10, 64)
+		if err != nil || suffix < 0 {
+			return byteRange{}, errInvalidRange
+		}
+		if suffix == 0 || size == 0 {
+			return byteRange{}, errUnsatisfiableRange
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return byteRange{start: size - suffix, length: suffix}, nil
+	}
+
+	start, err := strconv.ParseInt(startValue, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, errInvalidRange
+	}
+
+	end := size - 1
+	if endValue != "" {
+		end, err = strconv.ParseInt(endValue, 10, 64)
+		if err != nil || end < start {
+			return byteRange{}, errInvalidRange
+		}
+	}
+
+	if start >= size {
+		return byteRange{}, errUnsatisfiableRange
+	}
+	if end >= size {
+		end = size - 1
+	}
+
+	return byteRange{start: start, length: end - start + 1}, nil
+}
+
+// ifRangeMatches returns if the If-Range validator still matches the response headers.
+// As RFC 7233 section 3.2 requires entity tags use the strong comparison
+// and dates must be exactly the Last-Modified of the response
+func ifRangeMatches(ifRange string, header http.Header) bool {
+	ifRange = strings.TrimSpace(ifRange)
+
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		validator, _ := scanETag(ifRange)
+		etag, _ := scanETag(header.Get("Etag"))
+		return etagStrongMatch(validator, etag)
+	}
+
+	date, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return date.Equal(lastModified)
+}
+
+// respondRange sends the requested range of a cached entry.
+// If the Range can't be used or If-Range does not match the whole body is sent.
+// Only 200 responses have ranges, the entries with any other status are sent as they are
+func (handler *Handler) respondRange(w http.ResponseWriter, r *http.Request, entry *HTTPCacheEntry, cacheStatus string) (int, error) {
+	if entry.Response.Code != http.StatusOK {
+		return handler.respond(w, r, entry, cacheStatus)
+	}
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && !ifRangeMatches(ifRange, entry.Response.snapHeader) {
+		return handler.respond(w, r, entry, cacheStatus)
+	}
+
+	// The size must be known so the body has to be completely saved
+	entry.Response.WaitClose()
+	size := entry.Response.Size()
+
+	requestedRange, err := parseRange(r.Header.Get("Range"), size)
+	if err == errInvalidRange {
+		return handler.respond(w, r, entry, cacheStatus)
+	}
+
+	handler.addStatusHeaderIfConfigured(w, cacheStatus)
+
+	// Caddy writes the error response with the headers that were set
+	if err == errUnsatisfiableRange {
+		handler.Cache.counters.unsatisfiableRange()
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		return http.StatusRequestedRangeNotSatisfiable, nil
+	}
+
+	entry.Response.CopyHeadersTo(w.Header())
+	removeMismatchedWarnings(w.Header())
+	handler.addHitHeaders(w.Header(), cacheStatus)
+	handler.addAgeHeader(w.Header(), entry, cacheStatus)
+	handler.addDebugTTLHeader(w, r, entry)
+	delHeaderFold(w.Header(), "Content-Range")
+	delHeaderFold(w.Header(), "Content-Length")
+	w.Header().Set("Content-Range", requestedRange.contentRange(size))
+	w.Header().Set("Content-Length", strconv.FormatInt(requestedRange.length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+
+	reader, err := entry.Response.body.GetReader()
+	if err != nil {
+		return http.StatusPartialContent, err
+	}
+	defer reader.Close()
+
+	// Mapped bodies can seek, files being written must be read until the start
+	if seeker, ok := reader.(io.Seeker); ok {
+		if _, err := seeker.Seek(requestedRange.start, io.SeekStart); err != nil {
+			return http.StatusPartialContent, err
+		}
+	} else if _, err := io.CopyN(ioutil.Discard, reader, requestedRange.start); err != nil {
+		return http.StatusPartialContent, err
+	}
+	sent, err := io.CopyN(w, reader, requestedRange.length)
+	handler.Cache.counters.servedRange(sent)
+	return http.StatusPartialContent, err
+}
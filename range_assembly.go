@@ -0,0 +1,388 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nicolasazrak/caddy-cache/storage"
+)
+
+var errSegmentChanged = errors.New("upstream sent a range of a different body")
+
+// segmentedBody is a body that is assembled from the ranges fetched from upstream
+type segmentedBody struct {
+	key        string
+	storage    *storage.SegmentedStorage
+	header     http.Header // headers of the whole body, without Content-Range and Content-Length
+	expiration time.Time
+
+	// Only one request at a time fetches the missing segments
+	fetchLock *sync.Mutex
+}
+
+type segmentedBodies struct {
+	lock   *sync.Mutex
+	bodies map[string]*segmentedBody
+}
+
+func newSegmentedBodies() *segmentedBodies {
+	return &segmentedBodies{
+		lock:   new(sync.Mutex),
+		bodies: map[string]*segmentedBody{},
+	}
+}
+
+// getSegmented returns the segments saved for the key if they are still fresh
+func (cache *HTTPCache) getSegmented(key string) (*segmentedBody, bool) {
+	cache.segments.lock.Lock()
+	defer cache.segments.lock.Unlock()
+
+	body, ok := cache.segments.bodies[key]
+	if !ok || !now().Before(body.expiration) {
+		return nil, false
+	}
+	return body, true
+}
+
+// putSegmented saves the body replacing the previous one and removes it once it expires
+func (cache *HTTPCache) putSegmented(body *segmentedBody) {
+	cache.segments.lock.Lock()
+	previous, ok := cache.segments.bodies[body.key]
+	cache.segments.bodies[body.key] = body
+	cache.segments.lock.Unlock()
+
+	if ok {
+		go previous.storage.Clean()
+	}
+
+	wait := body.expiration.Sub(now())
+	go func() {
+		time.Sleep(wait)
+		cache.removeSegmented(body)
+	}()
+}
+
+// removeSegmented removes the body if it was not replaced yet
+func (cache *HTTPCache) removeSegmented(body *segmentedBody) {
+	cache.segments.lock.Lock()
+	defer cache.segments.lock.Unlock()
+
+	if cache.segments.bodies[body.key] == body {
+		delete(cache.segments.bodies, body.key)
+		go body.storage.Clean()
+	}
+}
+
+// purgeSegmented removes the segments of every key that matches and returns how many were removed
+func (cache *HTTPCache) purgeSegmented(matches func(key string) bool) int {
+	cache.segments.lock.Lock()
+	defer cache.segments.lock.Unlock()
+
+	purged := 0
+	for key, body := range cache.segments.bodies {
+		if matches(key) {
+			delete(cache.segments.bodies, key)
+			go body.storage.Clean()
+			purged++
+		}
+	}
+	return purged
+}
+
+// segmentWriter is the body of an upstream range response, it saves the bytes
+// in their place of the whole body and optionally sends them to the client
+type segmentWriter struct {
+	storage *storage.SegmentedStorage
+	offset  int64
+	client  http.ResponseWriter
+}
+
+func (s *segmentWriter) Write(p []byte) (int, error) {
+	n, err := s.storage.WriteAt(p, s.offset)
+	s.offset += int64(n)
+
+	// The segment is still saved if the client goes away
+	if s.client != nil {
+		if _, clientErr := s.client.Write(p); clientErr != nil {
+			s.client = nil
+		}
+	}
+	return n, err
+}
+
+func (s *segmentWriter) Flush() error {
+	if f, ok := s.client.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func (s *segmentWriter) Close() error {
+	return nil
+}
+
+// Clean does nothing, the segments are removed with the whole body
+func (s *segmentWriter) Clean() error {
+	return nil
+}
+
+func (s *segmentWriter) GetReader() (io.ReadCloser, error) {
+	return nil, errors.New("Segments are read from the segmented storage")
+}
+
+// parseContentRange parses a Content-Range like "bytes 0-499/1234".
+// The returned end is exclusive
+func parseContentRange(value string) (start, end, size int64, err error) {
+	if !strings.HasPrefix(value, "bytes ") {
+		return 0, 0, 0, errInvalidRange
+	}
+	spec := strings.TrimPrefix(value, "bytes ")
+
+	slash := strings.Index(spec, "/")
+	dash := strings.Index(spec, "-")
+	if slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, 0, errInvalidRange
+	}
+
+	start, err = strconv.ParseInt(spec[:dash], 10, 64)
+	if err != nil {
+		return 0, 0, 0, errInvalidRange
+	}
+	last, err := strconv.ParseInt(spec[dash+1:slash], 10, 64)
+	if err != nil {
+		return 0, 0, 0, errInvalidRange
+	}
+	size, err = strconv.ParseInt(spec[slash+1:], 10, 64)
+	if err != nil || start < 0 || last < start || last >= size {
+		return 0, 0, 0, errInvalidRange
+	}
+
+	return start, last + 1, size, nil
+}
+
+// wholeBodyHeader returns the headers of a range response without the headers of the range
+func wholeBodyHeader(header http.Header) http.Header {
+	whole := http.Header{}
+	copyHeaders(header, whole)
+	delHeaderFold(whole, "Content-Range")
+	delHeaderFold(whole, "Content-Length")
+	return whole
+}
+
+func sameValidators(a, b http.Header) bool {
+	return a.Get("Etag") == b.Get("Etag") && a.Get("Last-Modified") == b.Get("Last-Modified")
+}
+
+// newSegmentedBody creates the body the upstream range response belongs to.
+// It returns false if the response is not a single range or the whole body would not be cacheable
+func (handler *Handler) newSegmentedBody(entry *HTTPCacheEntry) (*segmentedBody, int64, bool) {
+	response := entry.Response
+	if response.Code != http.StatusPartialContent || handler.Config.NullStorage {
+		return nil, 0, false
+	}
+
+	start, _, size, err := parseContentRange(response.snapHeader.Get("Content-Range"))
+	if err != nil {
+		return nil, 0, false
+	}
+
+	// Variants are not supported, the segments of different bodies would be mixed
+	if len(varyHeaders(response.snapHeader)) > 0 {
+		return nil, 0, false
+	}
+
+	header := wholeBodyHeader(response.snapHeader)
+	isPublic, expiration, _ := getCacheability(entry.Request, &Response{Code: http.StatusOK, snapHeader: header}, handler.Config)
+
+	// The segments are not revalidated, so no-cache bodies can't be assembled
+	if !isPublic || requiresRevalidation(header) {
+		return nil, 0, false
+	}
+
+	segments, err := handler.Cache.newSegmentedStorage(entry.Request, size)
+	if err != nil {
+		return nil, 0, false
+	}
+
+	return &segmentedBody{
+		key:        entry.Key(),
+		storage:    segments,
+		header:     header,
+		expiration: expiration,
+		fetchLock:  new(sync.Mutex),
+	}, start, true
+}
+
+// serveAssembledRange answers a range request with the segments that are already saved,
+// fetching from upstream only the parts that are missing
+func (handler *Handler) serveAssembledRange(w http.ResponseWriter, r *http.Request, event *cacheEvent, directives requestDirectives) (int, error) {
+	key := getKey(handler.Config, r)
+	body, exists := handler.Cache.getSegmented(key)
+	if !exists {
+		if directives.onlyIfCached {
+			return handler.respondNotCached(w, event)
+		}
+
+		// Only one request creates the body, the ones that waited use the segments it saved.
+		// Without the lock each one would save its own body and the last would remove the others while they are written
+		lock, locked := handler.URLLocks.AdquireWithTimeout(key, handler.Config.CollapseTimeout)
+		if !locked {
+			event.bypass("collapse timeout")
+			handler.addStatusHeaderIfConfigured(w, cacheBypass)
+			return handler.Next.ServeHTTP(w, r)
+		}
+		body, exists = handler.Cache.getSegmented(key)
+		if !exists {
+			defer lock.Unlock()
+			return handler.fetchFirstSegment(w, r, event)
+		}
+		lock.Unlock()
+	}
+
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && !ifRangeMatches(ifRange, body.header) {
+		event.bypass("If-Range does not match")
+		handler.addStatusHeaderIfConfigured(w, cacheBypass)
+		return handler.Next.ServeHTTP(w, r)
+	}
+
+	size := body.storage.Size()
+	requestedRange, err := parseRange(r.Header.Get("Range"), size)
+	if err == errInvalidRange {
+		event.bypass("range request")
+		handler.addStatusHeaderIfConfigured(w, cacheBypass)
+		return handler.Next.ServeHTTP(w, r)
+	}
+	if err == errUnsatisfiableRange {
+		event.record(cacheHit, nil)
+		handler.addStatusHeaderIfConfigured(w, cacheHit)
+		handler.Cache.counters.unsatisfiableRange()
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		return http.StatusRequestedRangeNotSatisfiable, nil
+	}
+
+	body.fetchLock.Lock()
+	missing := body.storage.Missing(requestedRange.start, requestedRange.start+requestedRange.length)
+	if len(missing) > 0 && directives.onlyIfCached {
+		body.fetchLock.Unlock()
+		return handler.respondNotCached(w, event)
+	}
+
+	start := time.Now()
+	for _, segment := range missing {
+		if err := handler.fetchSegment(r, body, segment); err != nil {
+			body.fetchLock.Unlock()
+
+			// The saved segments can't be used anymore if the body changed
+			if err == errSegmentChanged {
+				handler.Cache.removeSegmented(body)
+			}
+			event.bypass("range fetch failed")
+			handler.addStatusHeaderIfConfigured(w, cacheBypass)
+			return handler.Next.ServeHTTP(w, r)
+		}
+	}
+	body.fetchLock.Unlock()
+
+	status := cacheHit
+	if len(missing) > 0 {
+		event.fetched(start)
+		status = cacheMiss
+	}
+	event.record(status, nil)
+	return handler.respondSegments(w, body, requestedRange, status)
+}
+
+// fetchFirstSegment sends the range request to upstream and saves the response
+// as the first segment of the body while it is sent to the client
+func (handler *Handler) fetchFirstSegment(w http.ResponseWriter, r *http.Request, event *cacheEvent) (int, error) {
+	start := time.Now()
+	entry, err := handler.fetchUpstream(r)
+	event.fetched(start)
+	if err != nil {
+		// Release the upstream response, its body is not going to be used
+		entry.Response.SetBody(nil)
+		return entry.Response.Code, err
+	}
+
+	body, offset, ok := handler.newSegmentedBody(entry)
+	if !ok {
+		// Nothing is saved, like when upstream ignored the Range and sent the whole body,
+		// so it is sent like the private responses while upstream writes it
+		if entry.isPublic {
+			entry.isPublic = false
+			entry.reason = "range not assembled"
+		}
+		event.record(cacheSkip, entry)
+		return handler.respond(w, r, entry, cacheSkip)
+	}
+	handler.Cache.putSegmented(body)
+	handler.Metrics.observe(entry, cacheMiss)
+
+	event.record(cacheMiss, entry)
+	handler.addStatusHeaderIfConfigured(w, cacheMiss)
+	entry.Response.CopyHeadersTo(w.Header())
+	w.WriteHeader(entry.Response.Code)
+
+	entry.Response.SetBody(&segmentWriter{storage: body.storage, offset: offset, client: w})
+	entry.Response.WaitClose()
+	return entry.Response.Code, nil
+}
+
+// fetchSegment requests a missing segment to upstream and saves it
+func (handler *Handler) fetchSegment(r *http.Request, body *segmentedBody, segment storage.Segment) error {
+	segmentRequest := r.WithContext(r.Context())
+	segmentRequest.Header = http.Header{}
+	copyHeaders(r.Header, segmentRequest.Header)
+	segmentRequest.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", segment.Start, segment.End-1))
+	segmentRequest.Header.Del("If-Range")
+
+	entry, err := handler.fetchUpstream(segmentRequest)
+	if err != nil {
+		entry.Response.SetBody(nil)
+		return err
+	}
+
+	start, _, size, err := parseContentRange(entry.Response.snapHeader.Get("Content-Range"))
+	if entry.Response.Code != http.StatusPartialContent || err != nil || start != segment.Start ||
+		size != body.storage.Size() || !sameValidators(body.header, entry.Response.snapHeader) {
+		entry.Response.SetBody(nil)
+		return errSegmentChanged
+	}
+
+	entry.Response.SetBody(&segmentWriter{storage: body.storage, offset: start})
+	entry.Response.WaitClose()
+	handler.Metrics.observe(entry, cacheMiss)
+
+	if len(body.storage.Missing(segment.Start, segment.End)) > 0 {
+		return errors.New("upstream sent an incomplete range")
+	}
+	return nil
+}
+
+// respondSegments sends the requested range from the saved segments
+func (handler *Handler) respondSegments(w http.ResponseWriter, body *segmentedBody, requestedRange byteRange, cacheStatus string) (int, error) {
+	reader, err := body.storage.GetRangeReader(requestedRange.start, requestedRange.length)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer reader.Close()
+
+	handler.addStatusHeaderIfConfigured(w, cacheStatus)
+	copyHeaders(body.header, w.Header())
+	handler.addHitHeaders(w.Header(), cacheStatus)
+	w.Header().Set("Content-Range", requestedRange.contentRange(body.storage.Size()))
+	w.Header().Set("Content-Length", strconv.FormatInt(requestedRange.length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+
+	sent, err := io.Copy(w, reader)
+	if cacheStatus == cacheHit {
+		handler.Cache.counters.servedRange(sent)
+	}
+	return http.StatusPartialContent, err
+}
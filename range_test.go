@@ -0,0 +1,37 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		size   int64
+		expect byteRange
+		err    error
+	}{
+		{"bytes=0-4", 10, byteRange{start: 0, length: 5}, nil},
+		{"bytes=5-", 10, byteRange{start: 5, length: 5}, nil},
+		{"bytes=-3", 10, byteRange{start: 7, length: 3}, nil},
+		{"bytes=-30", 10, byteRange{start: 0, length: 10}, nil},
+		{"bytes=8-20", 10, byteRange{start: 8, length: 2}, nil},
+		{"bytes= 1 - 2", 10, byteRange{start: 1, length: 2}, nil},
+		{"bytes=10-", 10, byteRange{}, errUnsatisfiableRange},
+		{"bytes=-0", 10, byteRange{}, errUnsatisfiableRange},
+		{"bytes=0-", 0, byteRange{}, errUnsatisfiableRange},
+		{"bytes=0-1,3-4", 10, byteRange{}, errInvalidRange},
+		{"bytes=4-2", 10, byteRange{}, errInvalidRange},
+		{"bytes=a-b", 10, byteRange{}, errInvalidRange},
+		{"lines=0-4", 10, byteRange{}, errInvalidRange},
+		{"bytes=4", 10, byteRange{}, errInvalidRange},
+	}
+
+	for _, test := range tests {
+		actual, err := parseRange(test.header, test.size)
+		require.Equal(t, test.err, err, "Invalid error parsing "+test.header)
+		require.Equal(t, test.expect, actual, "Invalid range parsing "+test.header)
+	}
+}
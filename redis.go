@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Biggest bulk reply accepted, purge messages are much smaller
+const maxRedisBulkSize = 1 << 20
+
+var errInvalidRedisReply = errors.New("invalid redis reply")
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn is a minimal client of the redis protocol, just enough to publish and subscribe
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialRedis connects to a host:port address or to a redis://:password@host:port url
+func dialRedis(address string, timeout time.Duration) (*redisConn, error) {
+	password := ""
+	if strings.HasPrefix(address, "redis://") {
+		u, err := url.Parse(address)
+		if err != nil {
+			return nil, err
+		}
+		address = u.Host
+		if u.User != nil {
+			password, _ = u.User.Password()
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if password != "" {
+		if _, err := rc.do("AUTH", password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+func (rc *redisConn) Close() error {
+	return rc.conn.Close()
+}
+
+// send writes the command as an array of bulk strings
+func (rc *redisConn) send(args ...string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := rc.conn.Write(buf.Bytes())
+	return err
+}
+
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	if err := rc.send(args...); err != nil {
+		return nil, err
+	}
+	return rc.receive()
+}
+
+// receive reads a reply, arrays are returned as []interface{} and bulk strings as string
+func (rc *redisConn) receive() (interface{}, error) {
+	line, err := rc.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errInvalidRedisReply
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size > maxRedisBulkSize {
+			return nil, errInvalidRedisReply
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(rc.reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size > maxRedisBulkSize {
+			return nil, errInvalidRedisReply
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, size)
+		for i := range items {
+			if items[i], err = rc.receive(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+
+	return nil, errInvalidRedisReply
+}
@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy"
+)
+
+const defaultRefreshConcurrency = 4
+
+// refreshCtxKey marks the requests that must replace the cached entry
+const refreshCtxKey caddy.CtxKey = "cache_refresh"
+
+func isRefreshRequest(r *http.Request) bool {
+	refresh, _ := r.Context().Value(refreshCtxKey).(bool)
+	return refresh
+}
+
+// RefreshSchedule is an url that is fetched again every Interval
+type RefreshSchedule struct {
+	URL      string
+	Interval time.Duration
+}
+
+// RefreshScheduler keeps the scheduled urls fresh fetching them periodically
+type RefreshScheduler struct {
+	handler   *Handler
+	schedules []RefreshSchedule
+
+	// Limits how many refreshes run at the same time
+	slots chan struct{}
+
+	stop     chan struct{}
+	stopOnce *sync.Once
+	wg       *sync.WaitGroup
+}
+
+// NewRefreshScheduler creates a scheduler that refreshes the urls through the handler
+func NewRefreshScheduler(handler *Handler, schedules []RefreshSchedule, concurrency int) *RefreshScheduler {
+	if concurrency <= 0 {
+		concurrency = defaultRefreshConcurrency
+	}
+
+	return &RefreshScheduler{
+		handler:   handler,
+		schedules: schedules,
+		slots:     make(chan struct{}, concurrency),
+		stop:      make(chan struct{}),
+		stopOnce:  new(sync.Once),
+		wg:        new(sync.WaitGroup),
+	}
+}
+
+// Start refreshes every url now and then at its interval
+func (scheduler *RefreshScheduler) Start() {
+	for _, schedule := range scheduler.schedules {
+		scheduler.wg.Add(1)
+		go scheduler.run(schedule)
+	}
+}
+
+// Stop stops the schedules and waits the running refreshes
+func (scheduler *RefreshScheduler) Stop() {
+	scheduler.stopOnce.Do(func() {
+		close(scheduler.stop)
+	})
+	scheduler.wg.Wait()
+}
+
+func (scheduler *RefreshScheduler) run(schedule RefreshSchedule) {
+	defer scheduler.wg.Done()
+
+	ticker := time.NewTicker(schedule.Interval)
+	defer ticker.Stop()
+
+	var running int32
+	refresh := func() {
+		// Skip this tick if the previous refresh did not end yet
+		if !atomic.CompareAndSwapInt32(&running, 0, 1) {
+			return
+		}
+
+		scheduler.wg.Add(1)
+		go func() {
+			defer scheduler.wg.Done()
+			defer atomic.StoreInt32(&running, 0)
+
+			select {
+			case scheduler.slots <- struct{}{}:
+			case <-scheduler.stop:
+				return
+			}
+			defer func() { <-scheduler.slots }()
+
+			if !scheduler.handler.requestInternally(schedule.URL, true) {
+				log.Printf("[WARNING] cache: Refresh of %s failed", schedule.URL)
+			}
+		}()
+	}
+
+	refresh()
+	for {
+		select {
+		case <-scheduler.stop:
+			return
+		case <-ticker.C:
+			refresh()
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefreshSchedule(t *testing.T) {
+	t.Run("it should replace the entry even if it is fresh", func(t *testing.T) {
+		var hits int32
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			atomic.AddInt32(&hits, 1)
+			w.Header().Add("Cache-control", "max-age=100")
+			w.Write([]byte("abc"))
+			return 200, nil
+		}), emptyConfig())
+
+		scheduler := NewRefreshScheduler(h, []RefreshSchedule{{URL: "http://example.com/a", Interval: 20 * time.Millisecond}}, 1)
+		scheduler.Start()
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(&hits) >= 3
+		}, time.Second, 5*time.Millisecond)
+		scheduler.Stop()
+
+		require.Len(t, h.Cache.GetVariants("GET example.com/a?"), 1)
+		stopped := atomic.LoadInt32(&hits)
+		time.Sleep(50 * time.Millisecond)
+		require.Equal(t, stopped, atomic.LoadInt32(&hits))
+	})
+
+	t.Run("it should skip the tick if the previous refresh is still running", func(t *testing.T) {
+		var hits int32
+		release := make(chan struct{})
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			atomic.AddInt32(&hits, 1)
+			<-release
+			w.Header().Add("Cache-control", "max-age=100")
+			return 200, nil
+		}), emptyConfig())
+
+		scheduler := NewRefreshScheduler(h, []RefreshSchedule{{URL: "http://example.com/a", Interval: 5 * time.Millisecond}}, 1)
+		scheduler.Start()
+		time.Sleep(50 * time.Millisecond)
+		require.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+		close(release)
+		scheduler.Stop()
+	})
+
+	t.Run("it should limit the concurrent refreshes", func(t *testing.T) {
+		lock := new(sync.Mutex)
+		running, maxRunning := 0, 0
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			lock.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			lock.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			lock.Lock()
+			running--
+			lock.Unlock()
+			return 200, nil
+		}), emptyConfig())
+
+		schedules := []RefreshSchedule{}
+		for _, path := range []string{"a", "b", "c", "d"} {
+			schedules = append(schedules, RefreshSchedule{URL: "http://example.com/" + path, Interval: 5 * time.Millisecond})
+		}
+		scheduler := NewRefreshScheduler(h, schedules, 2)
+		scheduler.Start()
+		time.Sleep(60 * time.Millisecond)
+		scheduler.Stop()
+
+		lock.Lock()
+		defer lock.Unlock()
+		require.Equal(t, 2, maxRunning)
+	})
+}
@@ -0,0 +1,167 @@
+package cache
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+// requestDirectives are the Cache-Control directives of a request that change how the cache responds
+type requestDirectives struct {
+	// onlyIfCached means the origin must not be contacted, a 504 is sent if nothing usable is cached
+	onlyIfCached bool
+
+	// maxStale is how long after expiring a response is still accepted, without a value any age is accepted
+	maxStale    time.Duration
+	maxStaleSet bool
+
+	// minFresh is how long a response must still be fresh to be accepted
+	minFresh time.Duration
+
+	// noStore means the response must not be saved
+	noStore bool
+}
+
+// cacheControlDirective is a directive of a Cache-Control header, with its name in lowercase and its value unquoted
+type cacheControlDirective struct {
+	name     string
+	value    string
+	hasValue bool
+}
+
+// parseCacheControl splits the Cache-Control values in their directives. Commas inside quoted values,
+// like the field names of no-cache="Set-Cookie, Date", don't split them and escaped characters are unescaped.
+// Empty elements are skipped and what follows a closing quote is ignored, so a malformed directive
+// never makes the others unreadable
+func parseCacheControl(values []string) []cacheControlDirective {
+	directives := []cacheControlDirective{}
+	for _, value := range values {
+		for i := 0; i < len(value); i++ {
+			start := i
+			for i < len(value) && value[i] != ',' && value[i] != '=' {
+				i++
+			}
+			directive := cacheControlDirective{name: strings.ToLower(strings.TrimSpace(value[start:i]))}
+
+			if i < len(value) && value[i] == '=' {
+				directive.hasValue = true
+				i++
+				for i < len(value) && (value[i] == ' ' || value[i] == '\t') {
+					i++
+				}
+
+				if i < len(value) && value[i] == '"' {
+					unquoted := []byte{}
+					for i++; i < len(value) && value[i] != '"'; i++ {
+						if value[i] == '\\' && i+1 < len(value) {
+							i++
+						}
+						unquoted = append(unquoted, value[i])
+					}
+					directive.value = string(unquoted)
+					for i < len(value) && value[i] != ',' {
+						i++
+					}
+				} else {
+					start = i
+					for i < len(value) && value[i] != ',' {
+						i++
+					}
+					directive.value = strings.TrimSpace(value[start:i])
+				}
+			}
+
+			if directive.name != "" {
+				directives = append(directives, directive)
+			}
+		}
+	}
+	return directives
+}
+
+// maxDeltaSeconds is the greatest delta-seconds, larger values are treated as it like RFC 7234 section 1.2.1 says
+const maxDeltaSeconds = 1 << 31
+
+// parseDeltaSeconds parses the non negative number of seconds of max-stale or min-fresh
+func parseDeltaSeconds(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	for _, c := range value {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds > maxDeltaSeconds {
+		seconds = maxDeltaSeconds
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+func getRequestDirectives(r *http.Request) requestDirectives {
+	directives := requestDirectives{}
+
+	for _, directive := range parseCacheControl(r.Header["Cache-Control"]) {
+		switch directive.name {
+		case "only-if-cached":
+			directives.onlyIfCached = true
+		case "no-store":
+			directives.noStore = true
+		case "max-stale":
+			if directive.value == "" {
+				directives.maxStale, directives.maxStaleSet = time.Duration(math.MaxInt64), true
+			} else if maxStale, ok := parseDeltaSeconds(directive.value); ok {
+				directives.maxStale, directives.maxStaleSet = maxStale, true
+			}
+		case "min-fresh":
+			if minFresh, ok := parseDeltaSeconds(directive.value); ok {
+				directives.minFresh = minFresh
+			}
+		}
+	}
+
+	return directives
+}
+
+// withParsedCacheControl returns the request with only the Cache-Control directives that cacheobject uses.
+// It fails on the forms it does not expect, like a no-cache with field names, and the response would not be cached
+func withParsedCacheControl(req *http.Request) *http.Request {
+	if _, ok := req.Header["Cache-Control"]; !ok {
+		return req
+	}
+
+	copied := req.WithContext(req.Context())
+	copied.Header = http.Header{}
+	copyHeaders(req.Header, copied.Header)
+	copied.Header.Del("Cache-Control")
+	if getRequestDirectives(req).noStore {
+		copied.Header.Set("Cache-Control", "no-store")
+	}
+	return copied
+}
+
+// freshEnough returns if the entry will still be fresh after min-fresh
+func (directives requestDirectives) freshEnough(entry *HTTPCacheEntry) bool {
+	return directives.minFresh <= 0 || entry.expiration.After(now().Add(directives.minFresh))
+}
+
+// canServeStale returns if the response allows to be served once it is stale.
+// must-revalidate and proxy-revalidate override the max-stale of the request and serve_stale_on_error,
+// proxy-revalidate applies to this cache because it is shared
+func canServeStale(entry *HTTPCacheEntry) bool {
+	// no-cache entries are never used without revalidation, stale or not
+	if entry.alwaysRevalidate {
+		return false
+	}
+
+	directives, err := cacheobject.ParseResponseCacheControl(entry.Response.snapHeader.Get("Cache-Control"))
+	if err != nil {
+		return false
+	}
+	return !directives.MustRevalidate && !directives.ProxyRevalidate
+}
@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	tests := []struct {
+		values   []string
+		expected []cacheControlDirective
+	}{
+		{nil, []cacheControlDirective{}},
+		{[]string{""}, []cacheControlDirective{}},
+		{[]string{"No-Cache"}, []cacheControlDirective{{name: "no-cache"}}},
+		{[]string{" max-age = 10 ,no-store"}, []cacheControlDirective{{"max-age", "10", true}, {name: "no-store"}}},
+		{[]string{`no-cache="Set-Cookie, Date", max-stale`}, []cacheControlDirective{{"no-cache", "Set-Cookie, Date", true}, {name: "max-stale"}}},
+		{[]string{`ext="a \"quoted\" \\ value"`}, []cacheControlDirective{{"ext", `a "quoted" \ value`, true}}},
+		{[]string{`max-age="10" garbage, min-fresh=5`}, []cacheControlDirective{{"max-age", "10", true}, {"min-fresh", "5", true}}},
+		{[]string{`no-cache="unterminated, max-age=10`}, []cacheControlDirective{{"no-cache", "unterminated, max-age=10", true}}},
+		{[]string{",,=5, max-stale=", "only-if-cached"}, []cacheControlDirective{{"max-stale", "", true}, {name: "only-if-cached"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(strings.Join(test.values, " | "), func(t *testing.T) {
+			require.Equal(t, test.expected, parseCacheControl(test.values))
+		})
+	}
+}
+
+func TestGetRequestDirectives(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		expected     requestDirectives
+	}{
+		{"", requestDirectives{}},
+		{"only-if-cached", requestDirectives{onlyIfCached: true}},
+		{"max-stale", requestDirectives{maxStale: time.Duration(math.MaxInt64), maxStaleSet: true}},
+		{"Max-Stale=30, min-fresh=5", requestDirectives{maxStale: 30 * time.Second, maxStaleSet: true, minFresh: 5 * time.Second}},
+		{`max-stale="30"`, requestDirectives{maxStale: 30 * time.Second, maxStaleSet: true}},
+		{"max-stale=soon, min-fresh=-1", requestDirectives{}},
+		{"max-stale=", requestDirectives{maxStale: time.Duration(math.MaxInt64), maxStaleSet: true}},
+		{"min-fresh=99999999999999999999", requestDirectives{minFresh: maxDeltaSeconds * time.Second}},
+		{"min-fresh=+5, max-stale=1.5", requestDirectives{}},
+		{`no-cache="Set-Cookie, max-stale=10", NO-STORE`, requestDirectives{noStore: true}},
+		{` , ,only-if-cached,, `, requestDirectives{onlyIfCached: true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.cacheControl, func(t *testing.T) {
+			r, err := http.NewRequest("GET", "/", nil)
+			require.NoError(t, err)
+			r.Header.Set("Cache-Control", test.cacheControl)
+			require.Equal(t, test.expected, getRequestDirectives(r))
+		})
+	}
+}
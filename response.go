@@ -3,16 +3,30 @@ package cache
 import (
 	"errors"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/nicolasazrak/caddy-cache/storage"
 )
 
 type Response struct {
+	size      int64        // bytes written to the body, first to be 64 bit aligned for atomic access
+	lastWrite int64        // unix nanoseconds when the headers or the last write were sent, only accessed atomically
+	closed    int32        // 1 once Close was called, only accessed atomically
+	writing   int32        // 1 while a write is in progress, a slow client must not look like a stalled upstream
+	aborted   int32        // 1 once the body was stopped before upstream finished it, only accessed atomically
+	abortErr  atomic.Value // why the body was stopped, set once by the first Abort
+
 	Code       int         // the HTTP response code from WriteHeader
 	HeaderMap  http.Header // the HTTP response headers
 	body       storage.ResponseStorage
 	snapHeader http.Header // copy of HTTP headeres at writeHeader time
+	rawHeader  http.Header // copy of the headers without canonicalizing the keys, only if preserveHeaderCase is set
+	trailer    http.Header // headers set after the body, saved on Close
+
+	preserveHeaderCase bool
 
 	wroteHeader   bool
 	firstByteSent bool
@@ -94,12 +108,54 @@ func (rw *Response) Write(buf []byte) (int, error) {
 	}
 
 	if rw.body != nil {
-		return rw.body.Write(buf)
+		atomic.StoreInt32(&rw.writing, 1)
+		n, err := rw.body.Write(buf)
+		atomic.AddInt64(&rw.size, int64(n))
+		atomic.StoreInt64(&rw.lastWrite, time.Now().UnixNano())
+		atomic.StoreInt32(&rw.writing, 0)
+		return n, err
 	}
 
 	return 0, errors.New("No storage")
 }
 
+// idleFor returns how long ago upstream sent the headers or the last write. It is zero while a write is in progress
+func (rw *Response) idleFor() time.Duration {
+	if atomic.LoadInt32(&rw.writing) == 1 {
+		return 0
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(&rw.lastWrite)))
+}
+
+// Abort marks the body as incomplete, the entry is not served once it is closed.
+// Only the reason of the first call is kept
+func (rw *Response) Abort(reason error) {
+	if atomic.CompareAndSwapInt32(&rw.aborted, 0, 1) {
+		rw.abortErr.Store(reason)
+	}
+}
+
+// Aborted returns if the body was stopped before upstream finished it
+func (rw *Response) Aborted() bool {
+	return rw.AbortError() != nil
+}
+
+// AbortError returns why the body was stopped or nil if it was not
+func (rw *Response) AbortError() error {
+	reason, _ := rw.abortErr.Load().(error)
+	return reason
+}
+
+// Size returns how many bytes of the body were written so far
+func (rw *Response) Size() int64 {
+	return atomic.LoadInt64(&rw.size)
+}
+
+// IsClosed returns if Close was called, it does not block
+func (rw *Response) IsClosed() bool {
+	return atomic.LoadInt32(&rw.closed) == 1
+}
+
 // WaitClose blocks until Close is called
 func (rw *Response) WaitClose() {
 	rw.closedLock.RLock()
@@ -124,15 +180,58 @@ func (rw *Response) WriteHeader(code int) {
 	if rw.wroteHeader {
 		return
 	}
+
+	// Informational responses like 100 Continue or 103 Early Hints are followed by the final one,
+	// that is the one that is waited and saved. 101 Switching Protocols is final
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		return
+	}
 	rw.Code = code
 	rw.wroteHeader = true
 
 	rw.snapHeader = http.Header{}
 	copyHeaders(rw.Header(), rw.snapHeader)
-	rw.snapHeader.Del("server")
+	if rw.preserveHeaderCase {
+		rw.rawHeader = http.Header{}
+		for k, values := range rw.Header() {
+			rw.rawHeader[k] = append([]string{}, values...)
+		}
+	}
+	rw.DelHeader("server")
+	atomic.StoreInt64(&rw.lastWrite, time.Now().UnixNano())
 	rw.headersLock.Unlock()
 }
 
+// DelHeader removes a header from the saved headers
+func (rw *Response) DelHeader(name string) {
+	rw.snapHeader.Del(name)
+	if rw.rawHeader != nil {
+		delHeaderFold(rw.rawHeader, name)
+	}
+}
+
+// SetHeader replaces a header in the saved headers
+func (rw *Response) SetHeader(name string, value string) {
+	rw.DelHeader(name)
+	rw.snapHeader.Set(name, value)
+	if rw.rawHeader != nil {
+		rw.rawHeader[http.CanonicalHeaderKey(name)] = []string{value}
+	}
+}
+
+// CopyHeadersTo adds the saved headers into the given ones.
+// If the case is preserved the keys are copied with the case they were set, their order is not kept
+func (rw *Response) CopyHeadersTo(to http.Header) {
+	if rw.rawHeader == nil {
+		copyHeaders(rw.snapHeader, to)
+		return
+	}
+
+	for k, values := range rw.rawHeader {
+		to[k] = append(to[k], values...)
+	}
+}
+
 func (rw *Response) Flush() {
 	if !rw.wroteHeader {
 		rw.WriteHeader(200)
@@ -152,6 +251,9 @@ func (rw *Response) Flush() {
 // Otherwise body won't be closed blocking the response
 func (rw *Response) Close() error {
 	defer rw.closedLock.Unlock()
+	defer atomic.StoreInt32(&rw.closed, 1)
+
+	rw.trailer = rw.collectTrailer()
 
 	if rw.body != nil {
 		return rw.body.Close()
@@ -159,6 +261,33 @@ func (rw *Response) Close() error {
 	return nil
 }
 
+// collectTrailer returns the trailers declared in the Trailer header
+// and the ones set with the http.TrailerPrefix, like net/http does
+func (rw *Response) collectTrailer() http.Header {
+	trailer := http.Header{}
+	for _, declared := range rw.snapHeader["Trailer"] {
+		for _, name := range strings.Split(declared, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if values, ok := rw.HeaderMap[name]; ok && name != "" {
+				trailer[name] = append([]string{}, values...)
+			}
+		}
+	}
+
+	for name, values := range rw.HeaderMap {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			trailer[http.CanonicalHeaderKey(strings.TrimPrefix(name, http.TrailerPrefix))] = append([]string{}, values...)
+		}
+	}
+	return trailer
+}
+
+// Trailer returns the headers that upstream set after the body. It waits until the response is closed
+func (rw *Response) Trailer() http.Header {
+	rw.WaitClose()
+	return rw.trailer
+}
+
 // Clean the body if it is set
 func (rw *Response) Clean() error {
 	rw.bodyLock.RLock()
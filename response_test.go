@@ -62,6 +62,21 @@ func TestResponseSendHeaders(t *testing.T) {
 	require.Equal(t, r.Header().Get("Content-Type"), "application/json")
 }
 
+func TestResponseInformationalStatus(t *testing.T) {
+	r := NewResponse()
+
+	go func() {
+		r.WriteHeader(100)
+		r.WriteHeader(103)
+		r.Header().Add("Cache-Control", "max-age=10")
+		r.WriteHeader(200)
+	}()
+
+	r.WaitHeaders()
+	require.Equal(t, 200, r.Code)
+	require.Equal(t, "max-age=10", r.snapHeader.Get("Cache-Control"))
+}
+
 func TestResponseWaitStorage(t *testing.T) {
 	r := NewResponse()
 	routineStarted := make(chan struct{}, 1)
@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const defaultFetchRetryBackoff = 100 * time.Millisecond
+
+// isIdempotentMethod returns if sending the request again has the same effect than sending it once
+func isIdempotentMethod(method string) bool {
+	return isSafeMethod(method) || method == http.MethodPut || method == http.MethodDelete
+}
+
+// isRetryableFailure returns if upstream failed in a way that can go away with another attempt
+func isRetryableFailure(code int, err error) bool {
+	return err != nil || code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// retryBackoff returns how long to wait before the attempt after the given one,
+// the base doubled on every attempt with a jitter so the retries of many requests are spread
+func retryBackoff(base time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		base = defaultFetchRetryBackoff
+	}
+	backoff := base << uint(attempt)
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+}
+
+// serveUpstream sends the request to upstream, again up to fetch_retries times while it fails before writing anything.
+// The waits are stopped when the fetch is cancelled and the retries never go past the deadline of the client request
+func (handler *Handler) serveUpstream(response *Response, req *http.Request, original *http.Request) (int, error) {
+	for attempt := 0; ; attempt++ {
+		code, err := handler.Next.ServeHTTP(response, req)
+		if attempt >= handler.Config.FetchRetries || response.wroteHeader || !isRetryableFailure(code, err) || !isIdempotentMethod(req.Method) {
+			return code, err
+		}
+
+		backoff := retryBackoff(handler.Config.FetchRetryBackoff, attempt)
+		if deadline, ok := original.Context().Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+			return code, err
+		}
+
+		log.Printf("[WARNING] cache: Upstream failed for %s with %d %v, retrying in %s", req.URL, code, err, backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return code, err
+		}
+
+		// Nothing was written, the headers of the failed attempt are not sent with the next one
+		response.HeaderMap = http.Header{}
+	}
+}
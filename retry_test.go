@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchRetries(t *testing.T) {
+	newFailingOnce := func(fail func(w http.ResponseWriter) (int, error), config *Config) (*Handler, *int) {
+		fetches := 0
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			fetches++
+			if fetches == 1 {
+				return fail(w)
+			}
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte("abc"))
+			return 200, nil
+		}), config), &fetches
+	}
+
+	serve := func(h *Handler, req *http.Request) *http.Response {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	retryConfig := func() *Config {
+		config := emptyConfig()
+		config.FetchRetries = 2
+		config.FetchRetryBackoff = time.Millisecond
+		return config
+	}
+
+	t.Run("it should cache the response of a fetch that succeeds on the second attempt", func(t *testing.T) {
+		h, fetches := newFailingOnce(func(w http.ResponseWriter) (int, error) {
+			w.Header().Set("X-Failed", "true")
+			return http.StatusBadGateway, errors.New("connection refused")
+		}, retryConfig())
+
+		res := serve(h, newRequestWithOriginalURL(t, "GET", "http://example.com/"))
+		requireStatus(t, res, cacheMiss)
+		requireCode(t, res, 200)
+		requireBody(t, res, []byte("abc"))
+		require.Empty(t, res.Header.Get("X-Failed"))
+
+		res = serve(h, newRequestWithOriginalURL(t, "GET", "http://example.com/"))
+		requireStatus(t, res, cacheHit)
+		requireBody(t, res, []byte("abc"))
+		require.Equal(t, 2, *fetches)
+	})
+
+	t.Run("it should not retry without fetch_retries", func(t *testing.T) {
+		h, fetches := newFailingOnce(func(w http.ResponseWriter) (int, error) {
+			return http.StatusServiceUnavailable, nil
+		}, emptyConfig())
+
+		requireCode(t, serve(h, newRequestWithOriginalURL(t, "GET", "http://example.com/")), 503)
+		require.Equal(t, 1, *fetches)
+	})
+
+	t.Run("it should not retry a response that was already written", func(t *testing.T) {
+		h, fetches := newFailingOnce(func(w http.ResponseWriter) (int, error) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return http.StatusServiceUnavailable, nil
+		}, retryConfig())
+
+		requireCode(t, serve(h, newRequestWithOriginalURL(t, "GET", "http://example.com/")), 503)
+		require.Equal(t, 1, *fetches)
+	})
+
+	t.Run("it should not retry past the deadline of the request", func(t *testing.T) {
+		config := retryConfig()
+		config.FetchRetryBackoff = time.Minute
+		h, fetches := newFailingOnce(func(w http.ResponseWriter) (int, error) {
+			return http.StatusBadGateway, nil
+		}, config)
+
+		req := newRequestWithOriginalURL(t, "GET", "http://example.com/")
+		ctx, cancel := context.WithTimeout(req.Context(), time.Second)
+		defer cancel()
+		started := time.Now()
+		requireCode(t, serve(h, req.WithContext(ctx)), 502)
+		require.Equal(t, 1, *fetches)
+		require.True(t, time.Since(started) < time.Second)
+	})
+}
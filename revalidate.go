@@ -0,0 +1,187 @@
+package cache
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+// conditionalHeaders are the request headers that make upstream compare its response with a stored one
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"}
+
+// bodyHeaders describe the empty body of a 304, they are not copied into the stored response
+var bodyHeaders = []string{"Content-Length", "Content-Encoding", "Transfer-Encoding", "Content-Range", "Trailer"}
+
+// requiresRevalidation returns if the response has a bare no-cache directive.
+// RFC 7234 section 5.2.2.2 allows storing it but it can't be reused without asking upstream first.
+// A no-cache with field names only forbids those headers, that is not handled here
+func requiresRevalidation(header http.Header) bool {
+	directives, err := cacheobject.ParseResponseCacheControl(header.Get("Cache-Control"))
+	return err == nil && directives.NoCachePresent && len(directives.NoCache) == 0
+}
+
+// hasValidators returns if upstream can tell if the response changed using a conditional request
+func hasValidators(header http.Header) bool {
+	return header.Get("Etag") != "" || header.Get("Last-Modified") != ""
+}
+
+// revalidationRequest returns a copy of the request that asks upstream if the entry is still valid.
+// The conditions of the client are replaced, they are checked against the entry once upstream answers
+func revalidationRequest(r *http.Request, entry *HTTPCacheEntry) *http.Request {
+	req := r.WithContext(r.Context())
+	req.Header = http.Header{}
+	copyHeaders(r.Header, req.Header)
+	for _, name := range conditionalHeaders {
+		req.Header.Del(name)
+	}
+
+	if etag := entry.Response.snapHeader.Get("Etag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := entry.Response.snapHeader.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	return req
+}
+
+// updateHeaders returns the stored headers with the ones of a 304 replacing them, as RFC 7234 section 4.3.4 says.
+// The names are compared without case so the headers saved with their original case are updated too
+func updateHeaders(stored http.Header, notModified http.Header) http.Header {
+	updated := http.Header{}
+	for name, values := range stored {
+		updated[name] = append([]string{}, values...)
+	}
+
+	for name, values := range notModified {
+		if isBodyHeader(name) {
+			continue
+		}
+		delHeaderFold(updated, name)
+		updated[name] = append([]string{}, values...)
+	}
+	return updated
+}
+
+func isBodyHeader(name string) bool {
+	for _, bodyHeader := range bodyHeaders {
+		if strings.EqualFold(name, bodyHeader) {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshedResponse returns a complete response with the body of the stored one and the headers updated by a 304
+func refreshedResponse(stored *Response, notModified *Response) *Response {
+	header := updateHeaders(stored.snapHeader, notModified.snapHeader)
+
+	var rawHeader http.Header
+	if stored.rawHeader != nil && notModified.rawHeader != nil {
+		rawHeader = updateHeaders(stored.rawHeader, notModified.rawHeader)
+	}
+
+	return &Response{
+		size:               stored.Size(),
+		closed:             1,
+		Code:               stored.Code,
+		HeaderMap:          header,
+		body:               stored.body,
+		snapHeader:         header,
+		rawHeader:          rawHeader,
+		trailer:            stored.trailer,
+		preserveHeaderCase: stored.preserveHeaderCase,
+		wroteHeader:        true,
+		firstByteSent:      true,
+		bodyLock:           new(sync.RWMutex),
+		closedLock:         new(sync.RWMutex),
+		headersLock:        new(sync.RWMutex),
+		closeNotify:        make(chan bool, 1),
+	}
+}
+
+// refreshEntry returns an entry with the body of the stored one, saved again with the headers of a 304.
+// The body is kept while the entry that owns it or the new one are cached, like with an alias
+func (handler *Handler) refreshEntry(stored *HTTPCacheEntry, notModified *HTTPCacheEntry) *HTTPCacheEntry {
+	refreshed := NewHTTPCacheEntry(stored.key, stored.Request, refreshedResponse(stored.Response, notModified.Response), handler.Config)
+	refreshed.fetchStart = notModified.fetchStart
+	refreshed.firstByteAt = notModified.firstByteAt
+
+	// The body is still the compressed one, the ETag of the 304 is for what upstream sent
+	if stored.compressed {
+		refreshed.compressed = true
+		weakenETag(refreshed.Response)
+	}
+	if !refreshed.isPublic {
+		return refreshed
+	}
+
+	owner := stored
+	for owner.aliasOf != nil {
+		owner = owner.aliasOf
+	}
+	owner.acquire()
+	refreshed.aliasOf = owner
+	return refreshed
+}
+
+// validatedSince returns if upstream sent the entry, or confirmed it with a 304, after the given time.
+// The requests that waited the lock while another one revalidated the entry use its result instead of asking again
+func validatedSince(entry *HTTPCacheEntry, since time.Time) bool {
+	return entry != nil && entry.firstByteAt.After(since)
+}
+
+// serveRevalidated answers with the stored entry once upstream said with a 304 that it did not change.
+// The entry is replaced by one with the headers of the 304, so it is fresh again for as long as they say
+func (handler *Handler) serveRevalidated(w http.ResponseWriter, r *http.Request, event *cacheEvent, lock *KeyLock, stored *HTTPCacheEntry, notModified *HTTPCacheEntry) (int, error) {
+	notModified.Response.SetBody(nil)
+	handler.Metrics.observe(notModified, cacheHit)
+
+	// A body that is still being written can't be shared yet, the stored entry is kept as it is
+	entry := stored
+	if stored.Response.IsClosed() {
+		if refreshed := handler.refreshEntry(stored, notModified); refreshed.isPublic {
+			refreshed.acquire()
+			defer refreshed.release()
+			handler.Cache.Put(refreshed.Request, refreshed)
+			entry = refreshed
+		}
+	}
+	lock.Unlock()
+
+	event.record(cacheHit, entry)
+	if isNotModified(r, entry) {
+		return handler.respondNotModified(w, r, entry, cacheHit)
+	}
+	return handler.respond(w, r, entry, cacheHit)
+}
+
+// matchesNotModified returns if a 304 refers to the stored response, as RFC 7234 section 4.3.4 selects it:
+// by its ETag, else by its Last-Modified, else only a stored response without validators
+func matchesNotModified(stored http.Header, notModified http.Header) bool {
+	if etag := notModified.Get("Etag"); etag != "" {
+		return etagWeakMatch(etag, stored.Get("Etag"))
+	}
+	if lastModified := notModified.Get("Last-Modified"); lastModified != "" {
+		return lastModified == stored.Get("Last-Modified")
+	}
+	return !hasValidators(stored)
+}
+
+// getNotModifiedEntry returns the cached entry an unrequested 304 refers to, the fresh one or an expired one.
+// The entry must be released
+func (handler *Handler) getNotModifiedEntry(r *http.Request, previous *HTTPCacheEntry, notModified *HTTPCacheEntry) (*HTTPCacheEntry, bool) {
+	if previous != nil && previous.isPublic && matchesNotModified(previous.Response.snapHeader, notModified.Response.snapHeader) {
+		previous.acquire()
+		return previous, true
+	}
+
+	stale, ok := handler.Cache.GetStale(r, handler.Config.MaxStale)
+	if ok && stale.isPublic && matchesNotModified(stale.Response.snapHeader, notModified.Response.snapHeader) {
+		return stale, true
+	}
+	stale.release()
+	return nil, false
+}
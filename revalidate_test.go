@@ -0,0 +1,398 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoCacheCacheability(t *testing.T) {
+	c := emptyConfig()
+	request := makeRequest("/", http.Header{})
+
+	t.Run("it should store a no-cache response with validators", func(t *testing.T) {
+		for _, validator := range []http.Header{
+			{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}},
+			{"Cache-Control": {"no-cache"}, "Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"}},
+		} {
+			isPublic, _ := getCacheableStatus(request, makeResponse(200, validator), c)
+			require.True(t, isPublic)
+			require.True(t, NewHTTPCacheEntry("key", request, makeResponse(200, validator), c).alwaysRevalidate)
+		}
+	})
+
+	t.Run("it should use the default max age without an explicit expiration", func(t *testing.T) {
+		_, expiration, reason := getCacheability(request, makeResponse(200, http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}}), c)
+		require.Equal(t, "no-cache with validators", reason)
+		require.True(t, expiration.After(now().Add(c.DefaultMaxAge-time.Second)))
+	})
+
+	t.Run("it should not store a no-cache response without validators", func(t *testing.T) {
+		isPublic, _, reason := getCacheability(request, makeResponse(200, http.Header{"Cache-Control": {"no-cache, max-age=60"}}), c)
+		require.False(t, isPublic)
+		require.Equal(t, "no-cache without validators", reason)
+	})
+
+	t.Run("it should keep the max-age of a no-cache response", func(t *testing.T) {
+		header := http.Header{"Cache-Control": {"no-cache, max-age=60"}, "Etag": {`"v1"`}}
+		entry := NewHTTPCacheEntry("key", request, makeResponse(200, header), c)
+		require.True(t, entry.isPublic)
+		require.True(t, entry.alwaysRevalidate)
+		require.Equal(t, "explicit expiration", entry.reason)
+	})
+
+	t.Run("it should not revalidate must-revalidate or no-cache with field names", func(t *testing.T) {
+		for _, value := range []string{"max-age=60, must-revalidate", `no-cache="Set-Cookie", max-age=60`} {
+			entry := NewHTTPCacheEntry("key", request, makeResponse(200, makeHeader("Cache-Control", value)), c)
+			require.True(t, entry.isPublic, value)
+			require.False(t, entry.alwaysRevalidate, value)
+		}
+	})
+}
+
+func TestAlwaysRevalidate(t *testing.T) {
+	var conditions []string
+	version := "v1"
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		conditions = append(conditions, r.Header.Get("If-None-Match")+"|"+r.Header.Get("If-Modified-Since"))
+		w.Header().Set("Cache-Control", "no-cache")
+		if r.URL.Path == "/modified" {
+			w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+			if r.Header.Get("If-Modified-Since") != "" {
+				return http.StatusNotModified, nil
+			}
+		} else {
+			w.Header().Set("Etag", `"`+version+`"`)
+			if r.Header.Get("If-None-Match") == `"`+version+`"` {
+				return http.StatusNotModified, nil
+			}
+		}
+		w.Write([]byte(version))
+		return 200, nil
+	})
+
+	serve := func(h *Handler, target string, header http.Header) *http.Response {
+		w := httptest.NewRecorder()
+		r := newRequestWithOriginalURL(t, "GET", target)
+		copyHeaders(header, r.Header)
+		code, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		if code >= 400 {
+			w.WriteHeader(code)
+		}
+		return w.Result()
+	}
+
+	t.Run("it should serve the stored body after a 304", func(t *testing.T) {
+		conditions = nil
+		version = "v1"
+		h := NewHandler(upstream, emptyConfig())
+
+		requireStatus(t, serve(h, "http://example.com/", nil), cacheMiss)
+		for i := 0; i < 2; i++ {
+			res := serve(h, "http://example.com/", http.Header{"If-None-Match": {`"other"`}})
+			requireStatus(t, res, cacheHit)
+			requireCode(t, res, 200)
+			requireBody(t, res, []byte("v1"))
+		}
+		require.Equal(t, []string{"|", `"v1"|`, `"v1"|`}, conditions)
+
+		// The conditions of the client are checked against the entry
+		res := serve(h, "http://example.com/", http.Header{"If-None-Match": {`"v1"`}})
+		requireStatus(t, res, cacheHit)
+		requireCode(t, res, http.StatusNotModified)
+	})
+
+	t.Run("it should replace the entry when upstream sends a new response", func(t *testing.T) {
+		conditions = nil
+		version = "v1"
+		h := NewHandler(upstream, emptyConfig())
+
+		requireStatus(t, serve(h, "http://example.com/", nil), cacheMiss)
+		version = "v2"
+		res := serve(h, "http://example.com/", nil)
+		requireStatus(t, res, cacheMiss)
+		requireBody(t, res, []byte("v2"))
+
+		res = serve(h, "http://example.com/", nil)
+		requireStatus(t, res, cacheHit)
+		requireBody(t, res, []byte("v2"))
+		require.Equal(t, []string{"|", `"v1"|`, `"v2"|`}, conditions)
+	})
+
+	t.Run("it should revalidate with Last-Modified", func(t *testing.T) {
+		conditions = nil
+		version = "v1"
+		h := NewHandler(upstream, emptyConfig())
+
+		requireStatus(t, serve(h, "http://example.com/modified", nil), cacheMiss)
+		res := serve(h, "http://example.com/modified", nil)
+		requireStatus(t, res, cacheHit)
+		requireBody(t, res, []byte("v1"))
+		require.Equal(t, []string{"|", "|Mon, 02 Jan 2006 15:04:05 GMT"}, conditions)
+	})
+
+	t.Run("it should not serve the entry without revalidation", func(t *testing.T) {
+		config := emptyConfig()
+		config.ServeStaleOnError = true
+		h := NewHandler(upstream, config)
+
+		requireStatus(t, serve(h, "http://example.com/", nil), cacheMiss)
+		requireCode(t, serve(h, "http://example.com/", http.Header{"Cache-Control": {"only-if-cached"}}), http.StatusGatewayTimeout)
+		requireStatus(t, serve(h, "http://example.com/", http.Header{"Range": {"bytes=0-0"}}), cacheBypass)
+	})
+}
+
+func TestStaleRevalidation(t *testing.T) {
+	originalNow := now
+	defer func() { now = originalNow }()
+
+	var conditions []string
+	version := "v1"
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		conditions = append(conditions, r.Header.Get("If-None-Match"))
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Etag", `"`+version+`"`)
+		w.Header().Set("X-Fetched", strconv.Itoa(len(conditions)))
+		if r.Header.Get("If-None-Match") == `"`+version+`"` {
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(http.StatusNotModified)
+			return http.StatusNotModified, nil
+		}
+		w.Write([]byte(version))
+		return 200, nil
+	})
+
+	serve := func(h *Handler, header http.Header) *http.Response {
+		w := httptest.NewRecorder()
+		r := newRequestWithOriginalURL(t, "GET", "http://example.com/")
+		copyHeaders(header, r.Header)
+		_, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	t.Run("it should refresh the expired entry with the headers of a 304", func(t *testing.T) {
+		now = originalNow
+		conditions = nil
+		version = "v1"
+		h := NewHandler(upstream, emptyConfig())
+
+		requireStatus(t, serve(h, nil), cacheMiss)
+		now = func() time.Time { return originalNow().Add(2 * time.Minute) }
+
+		res := serve(h, http.Header{"If-None-Match": {`"other"`}})
+		requireStatus(t, res, cacheHit)
+		requireCode(t, res, 200)
+		requireBody(t, res, []byte("v1"))
+		require.Equal(t, "2", res.Header.Get("X-Fetched"))
+		require.Equal(t, "2", res.Header.Get("Content-Length"))
+
+		// It is fresh again, upstream is not asked until it expires
+		res = serve(h, nil)
+		requireStatus(t, res, cacheHit)
+		requireBody(t, res, []byte("v1"))
+		require.Equal(t, []string{"", `"v1"`}, conditions)
+		require.Len(t, h.Cache.GetVariants("GET example.com/?"), 1)
+	})
+
+	t.Run("it should replace the expired entry when upstream sends a new response", func(t *testing.T) {
+		now = originalNow
+		conditions = nil
+		version = "v1"
+		h := NewHandler(upstream, emptyConfig())
+
+		requireStatus(t, serve(h, nil), cacheMiss)
+		now = func() time.Time { return originalNow().Add(2 * time.Minute) }
+		version = "v2"
+
+		res := serve(h, nil)
+		requireStatus(t, res, cacheMiss)
+		requireBody(t, res, []byte("v2"))
+
+		res = serve(h, nil)
+		requireStatus(t, res, cacheHit)
+		requireBody(t, res, []byte("v2"))
+		require.Equal(t, []string{"", `"v1"`}, conditions)
+	})
+
+	t.Run("it should check the conditions of the client against the refreshed entry", func(t *testing.T) {
+		now = originalNow
+		conditions = nil
+		version = "v1"
+		h := NewHandler(upstream, emptyConfig())
+
+		requireStatus(t, serve(h, nil), cacheMiss)
+		now = func() time.Time { return originalNow().Add(2 * time.Minute) }
+
+		res := serve(h, http.Header{"If-None-Match": {`"v1"`}})
+		requireStatus(t, res, cacheHit)
+		requireCode(t, res, http.StatusNotModified)
+	})
+}
+
+func TestUnrequestedNotModified(t *testing.T) {
+	originalNow := now
+	defer func() { now = originalNow }()
+
+	var notModified http.Header
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if notModified != nil || r.Header.Get("If-None-Match") != "" {
+			copyHeaders(notModified, w.Header())
+			w.WriteHeader(http.StatusNotModified)
+			return http.StatusNotModified, nil
+		}
+		w.Write([]byte("v1"))
+		return 200, nil
+	})
+
+	serve := func(h *Handler, header http.Header) *http.Response {
+		w := httptest.NewRecorder()
+		r := newRequestWithOriginalURL(t, "GET", "http://example.com/")
+		copyHeaders(header, r.Header)
+		_, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	t.Run("it should pass the 304 through without caching it", func(t *testing.T) {
+		notModified = nil
+		h := NewHandler(upstream, emptyConfig())
+
+		for _, header := range []http.Header{{"If-None-Match": {`"v1"`}}, {"If-None-Match": {`"v1"`}}} {
+			res := serve(h, header)
+			requireStatus(t, res, cacheMiss)
+			requireCode(t, res, http.StatusNotModified)
+		}
+		require.Empty(t, h.Cache.GetVariants("GET example.com/?"))
+
+		notModified = http.Header{}
+		res := serve(h, nil)
+		requireCode(t, res, http.StatusNotModified)
+		require.Empty(t, h.Cache.GetVariants("GET example.com/?"))
+	})
+
+	t.Run("it should refresh the cached entry the 304 refers to", func(t *testing.T) {
+		now = originalNow
+		notModified = nil
+		h := NewHandler(upstream, emptyConfig())
+
+		requireStatus(t, serve(h, nil), cacheMiss)
+		now = func() time.Time { return originalNow().Add(2 * time.Minute) }
+
+		// Neither the stored response nor the 304 have validators
+		notModified = http.Header{}
+		res := serve(h, nil)
+		requireStatus(t, res, cacheHit)
+		requireCode(t, res, 200)
+		requireBody(t, res, []byte("v1"))
+
+		// It is fresh again
+		notModified = nil
+		res = serve(h, nil)
+		requireStatus(t, res, cacheHit)
+		requireBody(t, res, []byte("v1"))
+		require.Len(t, h.Cache.GetVariants("GET example.com/?"), 1)
+	})
+
+	t.Run("it should not refresh an entry with other validators", func(t *testing.T) {
+		now = originalNow
+		notModified = nil
+		h := NewHandler(upstream, emptyConfig())
+
+		requireStatus(t, serve(h, nil), cacheMiss)
+		now = func() time.Time { return originalNow().Add(2 * time.Minute) }
+
+		notModified = http.Header{"Etag": {`"v2"`}}
+		res := serve(h, nil)
+		requireStatus(t, res, cacheMiss)
+		requireCode(t, res, http.StatusNotModified)
+
+		variants := h.Cache.GetVariants("GET example.com/?")
+		require.Len(t, variants, 1)
+		require.Equal(t, 200, variants[0].Response.Code)
+	})
+}
+
+func TestMatchesNotModified(t *testing.T) {
+	lastModified := "Mon, 02 Jan 2006 15:04:05 GMT"
+	require.True(t, matchesNotModified(http.Header{"Etag": {`W/"v1"`}}, http.Header{"Etag": {`"v1"`}}))
+	require.False(t, matchesNotModified(http.Header{"Etag": {`"v1"`}}, http.Header{"Etag": {`"v2"`}}))
+	require.True(t, matchesNotModified(http.Header{"Last-Modified": {lastModified}}, http.Header{"Last-Modified": {lastModified}}))
+	require.False(t, matchesNotModified(http.Header{}, http.Header{"Last-Modified": {lastModified}}))
+	require.True(t, matchesNotModified(http.Header{}, http.Header{}))
+	require.False(t, matchesNotModified(http.Header{"Etag": {`"v1"`}}, http.Header{}))
+}
+
+func TestUpdateHeaders(t *testing.T) {
+	stored := http.Header{"Etag": {`"v1"`}, "Content-Length": {"2"}, "Content-Type": {"text/plain"}, "x-Custom": {"old"}}
+	updated := updateHeaders(stored, http.Header{"Content-Length": {"0"}, "X-Custom": {"new"}, "Date": {"Mon, 02 Jan 2006 15:04:05 GMT"}})
+
+	require.Equal(t, http.Header{
+		"Etag":           {`"v1"`},
+		"Content-Length": {"2"},
+		"Content-Type":   {"text/plain"},
+		"X-Custom":       {"new"},
+		"Date":           {"Mon, 02 Jan 2006 15:04:05 GMT"},
+	}, updated)
+	require.Equal(t, []string{"old"}, stored["x-Custom"])
+}
+
+func TestRevalidationCoalescing(t *testing.T) {
+	originalNow := now
+	defer func() { now = originalNow }()
+
+	for _, cacheControl := range []string{"max-age=60", "no-cache"} {
+		t.Run("it should revalidate once an entry with "+cacheControl+" requested by many clients at once", func(t *testing.T) {
+			now = originalNow
+			conditional := int32(0)
+			release := make(chan struct{})
+			h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				w.Header().Set("Cache-Control", cacheControl)
+				w.Header().Set("Etag", `"v1"`)
+				if r.Header.Get("If-None-Match") == `"v1"` {
+					atomic.AddInt32(&conditional, 1)
+					<-release
+					return http.StatusNotModified, nil
+				}
+				w.Write([]byte("v1"))
+				return 200, nil
+			}), emptyConfig())
+
+			serve := func() *http.Response {
+				w := httptest.NewRecorder()
+				_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", "http://example.com/"))
+				require.NoError(t, err)
+				return w.Result()
+			}
+
+			requireStatus(t, serve(), cacheMiss)
+			now = func() time.Time { return originalNow().Add(2 * time.Minute) }
+
+			clients := 5
+			responses := make(chan *http.Response, clients)
+			for i := 0; i < clients; i++ {
+				go func() { responses <- serve() }()
+			}
+			require.Eventually(t, func() bool {
+				return atomic.LoadInt32(&conditional) == 1 && h.URLLocks.Waiting() == int64(clients-1)
+			}, time.Second, 10*time.Millisecond)
+			close(release)
+
+			for i := 0; i < clients; i++ {
+				res := <-responses
+				requireStatus(t, res, cacheHit)
+				requireCode(t, res, 200)
+				requireBody(t, res, []byte("v1"))
+			}
+			require.Equal(t, int32(1), atomic.LoadInt32(&conditional))
+		})
+	}
+}
@@ -1,7 +1,10 @@
 package cache
 
 import (
+	"errors"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -24,6 +27,10 @@ type HeaderCacheRule struct {
 	Value  []string
 }
 
+// CacheabilityFunc returns if the response to the request can be cached and until when.
+// A zero expiration uses the default max age, an error uses the built-in rules instead
+type CacheabilityFunc func(req *http.Request, statusCode int, respHeaders http.Header) (bool, time.Time, error)
+
 // Made for testing
 var now = time.Now
 
@@ -44,32 +51,125 @@ func (rule *HeaderCacheRule) matches(req *http.Request, statusCode int, respHead
 }
 
 func getCacheableStatus(req *http.Request, response *Response, config *Config) (bool, time.Time) {
+	isPublic, expiration, _ := getCacheability(req, response, config)
+	return isPublic, expiration
+}
+
+// getCacheability is like getCacheableStatus but it also returns why the response is
+// or isn't cacheable, which is only used for logging
+func getCacheability(req *http.Request, response *Response, config *Config) (bool, time.Time, string) {
+	// The denied statuses win over every other rule and the ttl header
+	for _, code := range config.NeverCacheStatus {
+		if response.Code == code {
+			return false, now().Add(config.LockTimeout), "status " + strconv.Itoa(code) + " in never_cache_status"
+		}
+	}
+
 	// Partial responses are not supported yet
 	if response.Code == http.StatusPartialContent || response.snapHeader.Get("Content-Range") != "" {
-		return false, now().Add(config.LockTimeout)
+		return false, now().Add(config.LockTimeout), "partial response"
 	}
 
 	if response.Code == http.StatusNotModified {
-		return false, now()
+		return false, now(), "not modified response"
+	}
+
+	// Small bodies and authorized requests are not cached even if the ttl header says so.
+	// Bodies of unknown size are checked when they are buffered
+	if config.MinBodySize > 0 {
+		if length, err := strconv.ParseInt(response.snapHeader.Get("Content-Length"), 10, 64); err == nil && length < config.MinBodySize {
+			return false, now().Add(config.LockTimeout), "body smaller than min_body_size"
+		}
+	}
+
+	if reason := authorizationReason(req, response.snapHeader, config); reason != "" {
+		return false, now().Add(config.LockTimeout), reason
+	}
+
+	// The origin can decide how long to cache the response overriding Cache-Control
+	if ttl, ok := getTTLOverride(response, config); ok {
+		if ttl <= 0 {
+			return false, now().Add(config.LockTimeout), config.TTLHeader + " disables caching"
+		}
+		if reason := varyReason(response.snapHeader, config); reason != "" {
+			return false, now().Add(config.LockTimeout), reason
+		}
+		if reason := varyByReason(response.snapHeader, config); reason != "" {
+			return false, now().Add(config.LockTimeout), reason
+		}
+		if matchConditions(config.SkipIfHeader, response.snapHeader, config.HeaderConditionsAll) {
+			return false, now().Add(config.LockTimeout), "skip_if_header"
+		}
+		return true, now().Add(ttl), config.TTLHeader
 	}
 
-	reasonsNotToCache, expiration, err := cacheobject.UsingRequestResponse(req, response.Code, response.snapHeader, false)
+	// A no-cache response is revalidated before each use, without validators upstream would always send it again
+	noCache := requiresRevalidation(response.snapHeader)
+	if noCache && !hasValidators(response.snapHeader) {
+		return false, now().Add(config.LockTimeout), "no-cache without validators"
+	}
+
+	reasonsNotToCache, expiration, err := evaluateResponse(withParsedCacheControl(withoutAuthorization(req)), response.Code, response.snapHeader)
 
 	// err means there was an error parsing headers
 	// Just ignore them and make response not cacheable
 	if err != nil {
-		return false, time.Time{}
+		return false, time.Time{}, "invalid headers: " + err.Error()
 	}
 
 	isPublic := len(reasonsNotToCache) == 0
 
 	if !isPublic {
-		return false, now().Add(config.LockTimeout)
+		reasons := make([]string, len(reasonsNotToCache))
+		for i, reason := range reasonsNotToCache {
+			reasons[i] = reason.String()
+		}
+		return false, now().Add(config.LockTimeout), strings.Join(reasons, ",")
 	}
 
-	varyHeader := response.HeaderMap.Get("Vary")
-	if varyHeader == "*" {
-		return false, now().Add(config.LockTimeout)
+	if reason := varyReason(response.snapHeader, config); reason != "" {
+		return false, now().Add(config.LockTimeout), reason
+	}
+	if reason := varyByReason(response.snapHeader, config); reason != "" {
+		return false, now().Add(config.LockTimeout), reason
+	}
+
+	// The header conditions only choose among the responses that can be shared, they never override no-store or private
+	if matchConditions(config.SkipIfHeader, response.snapHeader, config.HeaderConditionsAll) {
+		return false, now().Add(config.LockTimeout), "skip_if_header"
+	}
+
+	// The checks above keep responses that must not be shared out of the cache, the rest can be customized
+	if config.CacheabilityFunc != nil {
+		if cacheable, expiration, ok := customCacheability(req, response, config); ok {
+			return cacheable, expiration, "cacheability func"
+		}
+	}
+
+	// Otherwise a rule would cache it with the default max age
+	if expiredByExpires(response.snapHeader) {
+		return false, now().Add(config.LockTimeout), "already expired"
+	}
+
+	// The response may have been cached upstream for a while, that time is not fresh anymore
+	if expiration.After(now()) {
+		expiration = expiration.Add(-initialAge(response.snapHeader))
+		if !expiration.After(now()) {
+			return false, now().Add(config.LockTimeout), "aged out upstream"
+		}
+	}
+
+	// Otherwise a rule, the Last-Modified heuristic or no-cache would give it a default freshness
+	if config.StrictFreshness && !hasExplicitFreshness(response.snapHeader) {
+		return false, now().Add(config.LockTimeout), "no explicit freshness"
+	}
+
+	// cache_if_header works like a rule
+	if matchConditions(config.CacheIfHeader, response.snapHeader, config.HeaderConditionsAll) {
+		if expiration.Before(now()) {
+			return true, now().Add(config.DefaultMaxAge), "cache_if_header with default max age"
+		}
+		return true, expiration, "cache_if_header"
 	}
 
 	// Check if any rule matches
@@ -79,26 +179,343 @@ func getCacheableStatus(req *http.Request, response *Response, config *Config) (
 			// If any rule matches but the response has no explicit expiration
 			if expiration.Before(now()) {
 				// Use the default max age
-				expiration = now().Add(config.DefaultMaxAge)
+				return true, now().Add(config.DefaultMaxAge), "rule with default max age"
 			}
-			return true, expiration
+			return true, expiration, "rule"
 		}
 	}
 
 	// isPublic only if has an explicit expiration
 	if expiration.Before(now()) {
-		return false, now().Add(config.LockTimeout)
+		// It is revalidated anyway, the default max age only says how long it is kept
+		if noCache {
+			return true, now().Add(config.DefaultMaxAge), "no-cache with validators"
+		}
+		return false, now().Add(config.LockTimeout), "no explicit expiration"
 	}
 
-	return true, expiration
+	return true, expiration, "explicit expiration"
 }
 
-func matchesVary(currentRequest *http.Request, entry *HTTPCacheEntry) bool {
-	vary := entry.Response.HeaderMap.Get("Vary")
+// customCacheability asks the CacheabilityFunc, it returns false if it failed
+func customCacheability(req *http.Request, response *Response, config *Config) (bool, time.Time, bool) {
+	cacheable, expiration, err := config.CacheabilityFunc(req, response.Code, response.snapHeader)
+	if err != nil {
+		log.Printf("[WARNING] cache: Cacheability func failed, using the built-in rules: %v", err)
+		return false, time.Time{}, false
+	}
+
+	if !cacheable {
+		return false, now().Add(config.LockTimeout), true
+	}
+	if expiration.IsZero() {
+		return true, now().Add(config.DefaultMaxAge), true
+	}
+	// An expiration in the past can't be served at all, it is like not caching it
+	if !expiration.After(now()) {
+		return false, now().Add(config.LockTimeout), true
+	}
+	return true, expiration, true
+}
+
+// authorizationReason returns why the response to a request with Authorization can't be stored.
+// RFC 7234 section 3.2 allows it only if the response has public, s-maxage or must-revalidate,
+// unless cache_authorized is used. The ttl header allows it too, like s-maxage
+func authorizationReason(req *http.Request, header http.Header, config *Config) string {
+	if req.Header.Get("Authorization") == "" || config.CacheAuthorized {
+		return ""
+	}
+
+	directives, err := cacheobject.ParseResponseCacheControl(header.Get("Cache-Control"))
+	if err == nil && (directives.Public || directives.SMaxAge != -1 || directives.MustRevalidate) {
+		return ""
+	}
+	return "request with Authorization"
+}
+
+// withoutAuthorization returns a copy of the request without the Authorization header,
+// it was already checked so cacheobject must not refuse it again
+func withoutAuthorization(req *http.Request) *http.Request {
+	if req.Header.Get("Authorization") == "" {
+		return req
+	}
+
+	copied := req.WithContext(req.Context())
+	copied.Header = http.Header{}
+	copyHeaders(req.Header, copied.Header)
+	copied.Header.Del("Authorization")
+	return copied
+}
+
+// expiredByExpires returns if the Expires header says the response is already expired.
+// Values that are not dates like 0 or -1 mean it is expired as RFC 7234 section 5.3 says.
+// It is ignored if there is a max-age or s-maxage
+func expiredByExpires(header http.Header) bool {
+	value := header.Get("Expires")
+	if value == "" {
+		return false
+	}
+
+	directives, err := cacheobject.ParseResponseCacheControl(header.Get("Cache-Control"))
+	if err == nil && (directives.MaxAge != -1 || directives.SMaxAge != -1) {
+		return false
+	}
+
+	expires, err := http.ParseTime(value)
+	if err != nil {
+		return true
+	}
+
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		date = now()
+	}
+	return !expires.After(date)
+}
+
+// hasExplicitFreshness returns if the origin said how long the response is fresh,
+// with max-age, s-maxage or an Expires date
+func hasExplicitFreshness(header http.Header) bool {
+	directives, err := cacheobject.ParseResponseCacheControl(header.Get("Cache-Control"))
+	if err == nil && (directives.MaxAge != -1 || directives.SMaxAge != -1) {
+		return true
+	}
+
+	_, err = http.ParseTime(header.Get("Expires"))
+	return err == nil
+}
+
+// evaluateResponse is like cacheobject.UsingRequestResponse but the freshness lifetime is counted from now, when the
+// response is received, and the Last-Modified heuristic is a fraction of the time between it and Date, both set by
+// the clock of the origin. The age since Date is subtracted later. A Date that can't be parsed is ignored like a missing one
+func evaluateResponse(req *http.Request, statusCode int, header http.Header) ([]cacheobject.Reason, time.Time, error) {
+	if value := header.Get("Date"); value != "" {
+		if _, err := http.ParseTime(value); err != nil {
+			withoutDate := http.Header{}
+			copyHeaders(header, withoutDate)
+			withoutDate.Del("Date")
+			header = withoutDate
+		}
+	}
+
+	reasons, _, _, object, err := cacheobject.UsingRequestResponseWithObject(req, statusCode, header, false)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	object.NowUTC = now().UTC()
+	if !object.RespDateHeader.IsZero() && !object.RespLastModifiedHeader.IsZero() {
+		object.RespLastModifiedHeader = object.RespLastModifiedHeader.Add(object.NowUTC.Sub(object.RespDateHeader))
+	}
+
+	results := cacheobject.ObjectResults{}
+	cacheobject.ExpirationObject(object, &results)
+	return reasons, results.OutExpirationTime, results.OutErr
+}
+
+// initialAge is how old the response is when it arrives, the greatest of its Age
+// and the time since its Date as RFC 7234 section 4.2.3 computes it
+func initialAge(header http.Header) time.Duration {
+	return correctedInitialAge(header, now(), now())
+}
+
+// correctedInitialAge is initialAge for a response requested at requestTime that arrived at responseTime.
+// The Age is corrected with the time upstream took to answer, so the response is never younger than it really is
+func correctedInitialAge(header http.Header, requestTime time.Time, responseTime time.Time) time.Duration {
+	age := responseTime.Sub(requestTime)
+	if seconds, err := strconv.ParseInt(strings.TrimSpace(header.Get("Age")), 10, 64); err == nil && seconds > 0 {
+		if seconds > maxDeltaSeconds {
+			seconds = maxDeltaSeconds
+		}
+		age += time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(header.Get("Date")); err == nil {
+		if apparentAge := responseTime.Sub(date); apparentAge > age {
+			age = apparentAge
+		}
+	}
+
+	return age
+}
+
+func getTTLOverride(response *Response, config *Config) (time.Duration, bool) {
+	if config.TTLHeader == "" {
+		return 0, false
+	}
+
+	value := response.snapHeader.Get(config.TTLHeader)
+	if value == "" {
+		return 0, false
+	}
+
+	ttl, err := parseTTL(value)
+	if err != nil {
+		log.Printf("[WARNING] cache: Ignoring invalid %s header %q: %v", config.TTLHeader, value, err)
+		return 0, false
+	}
+
+	return ttl, true
+}
+
+// parseTTL accepts a number of seconds or a duration like 2m
+func parseTTL(value string) (time.Duration, error) {
+	var ttl time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		ttl = time.Duration(seconds) * time.Second
+	} else if ttl, err = time.ParseDuration(value); err != nil {
+		return 0, err
+	}
+
+	if ttl < 0 {
+		return 0, errors.New("negative ttl")
+	}
+
+	return ttl, nil
+}
+
+// VaryCookieMode is how responses with Vary: Cookie are cached
+type VaryCookieMode int
+
+const (
+	// VaryCookieRefuse does not cache the responses
+	VaryCookieRefuse VaryCookieMode = iota
+	// VaryCookieHonor saves a variant for each different Cookie header
+	VaryCookieHonor
+	// VaryCookieSubset saves a variant for each different value of the cookies in VaryCookieNames
+	VaryCookieSubset
+)
+
+// varyReason returns why the Vary header prevents caching the response or an empty string if it doesn't
+func varyReason(header http.Header, config *Config) string {
+	if variesOn(header, "*") {
+		return "Vary *"
+	}
+	// An empty Vary means no variance, some origins send it anyway
+	if config.RefuseEmptyVary && len(header["Vary"]) > 0 && len(varyHeaders(header)) == 0 {
+		return "empty Vary"
+	}
+	if config.VaryCookie == VaryCookieRefuse && variesOn(header, "Cookie") {
+		return "Vary Cookie"
+	}
+	for _, name := range config.VaryDeny {
+		// With vary_device or vary_user_agent the variants are compared by device class or bucket, so there are only a few of them
+		if name == "User-Agent" && (config.VaryDevice != nil || config.VaryUserAgent != nil) {
+			continue
+		}
+		if variesOn(header, name) {
+			return "Vary " + name
+		}
+	}
+	return ""
+}
+
+// varyByReason returns why the response can't be cached because upstream says in the vary_by_header that it depends
+// on a request header the key doesn't have. A header listed in Vary is safe too, each of its values gets a variant
+func varyByReason(header http.Header, config *Config) string {
+	if config.VaryByHeader == "" {
+		return ""
+	}
+	for _, value := range header[http.CanonicalHeaderKey(config.VaryByHeader)] {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" && !isKeyHeader(name, config) && !variesOn(header, name) {
+				return config.VaryByHeader + " " + name + " not in the key"
+			}
+		}
+	}
+	return ""
+}
+
+// isKeyHeader returns if the values of the request header are part of the key,
+// with key_headers or with its {>Name} placeholder in cache_key
+func isKeyHeader(name string, config *Config) bool {
+	for _, keyed := range config.KeyHeaders {
+		if keyed == name {
+			return true
+		}
+	}
+	return strings.Contains(strings.ToLower(config.CacheKeyTemplate), "{>"+strings.ToLower(name)+"}")
+}
+
+// variesOn returns if the Vary header lists the given request header
+func variesOn(header http.Header, name string) bool {
+	for _, varied := range varyHeaders(header) {
+		if varied == http.CanonicalHeaderKey(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// varyHeaders returns the request headers listed in every Vary header.
+// Empty names and repeated ones are skipped so malformed values like "Accept-Encoding,,accept-encoding" still work
+func varyHeaders(header http.Header) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, value := range header["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// sameVary returns if both headers list the same request headers in their Vary, in any order
+func sameVary(a http.Header, b http.Header) bool {
+	namesA, namesB := varyHeaders(a), varyHeaders(b)
+	if len(namesA) != len(namesB) {
+		return false
+	}
+	listed := map[string]bool{}
+	for _, name := range namesA {
+		listed[name] = true
+	}
+	for _, name := range namesB {
+		if !listed[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// varyValue returns the value of the request header that tells apart the variants.
+// With vary_cookie only the named cookies are compared, with vary_device only the device class of the User-Agent
+// and with vary_user_agent only its bucket.
+// With gzip_dedup Accept-Encoding is not compared
+func varyValue(r *http.Request, name string, config *Config) string {
+	if config.VaryCookie == VaryCookieSubset && strings.EqualFold(name, "Cookie") {
+		values := []string{}
+		for _, cookieName := range config.VaryCookieNames {
+			if cookie, err := r.Cookie(cookieName); err == nil {
+				values = append(values, cookieName+"="+cookie.Value)
+			}
+		}
+		return strings.Join(values, "; ")
+	}
+	// Upstream always gets the same Accept-Encoding, so there is a single variant for every client
+	if config.GzipDedup && strings.EqualFold(name, "Accept-Encoding") {
+		return "gzip"
+	}
+	if config.VaryDevice != nil && strings.EqualFold(name, "User-Agent") {
+		return config.VaryDevice.classify(r.Header.Get("User-Agent"))
+	}
+	if config.VaryUserAgent != nil && strings.EqualFold(name, "User-Agent") {
+		return config.VaryUserAgent.bucket(r.Header.Get("User-Agent"))
+	}
+	if config.VaryLanguage != nil && strings.EqualFold(name, "Accept-Language") {
+		return config.VaryLanguage.normalize(r.Header)
+	}
+	return r.Header.Get(name)
+}
 
-	for _, searchedHeader := range strings.Split(vary, ",") {
-		searchedHeader = strings.TrimSpace(searchedHeader)
-		if currentRequest.Header.Get(searchedHeader) != entry.Request.Header.Get(searchedHeader) {
+func matchesVary(currentRequest *http.Request, entry *HTTPCacheEntry, config *Config) bool {
+	for _, searchedHeader := range varyHeaders(entry.Response.HeaderMap) {
+		if varyValue(currentRequest, searchedHeader, config) != varyValue(entry.Request, searchedHeader, config) {
 			return false
 		}
 	}
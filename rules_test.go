@@ -2,9 +2,11 @@ package cache
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
 	"github.com/stretchr/testify/require"
 )
 
@@ -97,6 +99,39 @@ func TestCacheableStatus(t *testing.T) {
 		require.False(t, isPublic)
 	})
 
+	t.Run("should return public = false for partial responses even if they match a rule", func(t *testing.T) {
+		request := makeRequest("/public", http.Header{})
+		partial := makeResponse(206, makeHeader("Cache-control", "max-age=5"))
+		isPublic, expiration := getCacheableStatus(request, partial, c)
+		require.False(t, isPublic)
+		require.Equal(t, testTime.Add(c.LockTimeout), expiration)
+
+		withRange := makeResponse(200, makeHeader("Content-Range", "bytes 0-4/10"))
+		isPublic, _ = getCacheableStatus(request, withRange, c)
+		require.False(t, isPublic)
+	})
+
+	t.Run("should return public = false if Expires is not a date or is in the past", func(t *testing.T) {
+		for _, path := range []string{"/", "/public"} {
+			for _, expires := range []string{"0", "-1", "tomorrow", testTime.Add(-time.Minute).UTC().Format(http.TimeFormat)} {
+				headers := makeHeader("Expires", expires)
+				headers.Set("Last-Modified", testTime.Add(-24*time.Hour).UTC().Format(http.TimeFormat))
+				isPublic, expiration := getCacheableStatus(makeRequest(path, http.Header{}), makeResponse(200, headers), c)
+
+				require.False(t, isPublic, expires)
+				require.Equal(t, testTime.Add(c.LockTimeout), expiration)
+			}
+		}
+	})
+
+	t.Run("should prefer max-age over an invalid Expires", func(t *testing.T) {
+		headers := makeHeader("Expires", "0")
+		headers.Set("Cache-Control", "max-age=5")
+		isPublic, _ := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(200, headers), c)
+
+		require.True(t, isPublic)
+	})
+
 	t.Run("should return public = true if it has explicit expiration", func(t *testing.T) {
 		request := makeRequest("/", http.Header{})
 		response := makeResponse(200, makeHeader("Cache-control", "max-age=5"))
@@ -129,6 +164,606 @@ func TestCacheableStatus(t *testing.T) {
 	})
 }
 
+func TestRequestCacheControl(t *testing.T) {
+	c := emptyConfig()
+
+	tests := []struct {
+		cacheControl string
+		isPublic     bool
+	}{
+		{`no-cache="Set-Cookie"`, true},
+		{"max-age=soon, max-stale=-1", true},
+		{`ext="unterminated`, true},
+		{"no-store", false},
+		{`No-Store, no-cache="a, b"`, false},
+	}
+
+	for _, test := range tests {
+		t.Run("it should tolerate "+test.cacheControl, func(t *testing.T) {
+			request := makeRequest("/", makeHeader("Cache-Control", test.cacheControl))
+			response := makeResponse(200, makeHeader("Cache-Control", "max-age=10"))
+			isPublic, _ := getCacheableStatus(request, response, c)
+			require.Equal(t, test.isPublic, isPublic)
+		})
+	}
+}
+
+func TestAuthorizedRequests(t *testing.T) {
+	c := emptyConfig()
+	authorized := makeHeader("Authorization", "Bearer token")
+
+	tests := []struct {
+		cacheControl string
+		isPublic     bool
+	}{
+		{"max-age=10", false},
+		{"max-age=10, public", true},
+		{"s-maxage=10", true},
+		{"max-age=10, must-revalidate", true},
+		{"max-age=10, proxy-revalidate", false},
+		{"public, no-store", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.cacheControl, func(t *testing.T) {
+			response := makeResponse(200, makeHeader("Cache-Control", test.cacheControl))
+			isPublic, _, reason := getCacheability(makeRequest("/", authorized), response, c)
+			require.Equal(t, test.isPublic, isPublic, reason)
+
+			// Without Authorization all of them but no-store can be stored
+			isPublic, _, _ = getCacheability(makeRequest("/", http.Header{}), response, c)
+			require.Equal(t, test.cacheControl != "public, no-store", isPublic)
+		})
+	}
+
+	t.Run("it should say why it is not stored", func(t *testing.T) {
+		response := makeResponse(200, makeHeader("Cache-Control", "max-age=10"))
+		_, _, reason := getCacheability(makeRequest("/", authorized), response, c)
+		require.Equal(t, "request with Authorization", reason)
+	})
+
+	t.Run("it should store them when cache_authorized is used", func(t *testing.T) {
+		config := emptyConfig()
+		config.CacheAuthorized = true
+
+		isPublic, _, _ := getCacheability(makeRequest("/", authorized), makeResponse(200, makeHeader("Cache-Control", "max-age=10")), config)
+		require.True(t, isPublic)
+
+		isPublic, _, _ = getCacheability(makeRequest("/", authorized), makeResponse(200, makeHeader("Cache-Control", "max-age=10, private")), config)
+		require.False(t, isPublic)
+	})
+
+	t.Run("it should not change the request", func(t *testing.T) {
+		request := makeRequest("/", authorized)
+		getCacheability(request, makeResponse(200, makeHeader("Cache-Control", "public, max-age=10")), c)
+		require.Equal(t, "Bearer token", request.Header.Get("Authorization"))
+	})
+}
+
+func TestInitialAge(t *testing.T) {
+	c := emptyConfig()
+	c.CacheRules = []CacheRule{&PathCacheRule{Path: "/public"}}
+	testTime := time.Now()
+	now = func() time.Time {
+		return testTime
+	}
+	defer func() { now = time.Now }()
+
+	roundedExpiration := func(expiration time.Time) time.Time {
+		return expiration.UTC().Round(time.Second)
+	}
+
+	t.Run("it should subtract the Age from the max-age", func(t *testing.T) {
+		headers := makeHeader("Cache-control", "max-age=60")
+		headers.Set("Age", "20")
+		isPublic, expiration := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(200, headers), c)
+
+		require.True(t, isPublic)
+		require.Equal(t, roundedExpiration(testTime.Add(40*time.Second)), roundedExpiration(expiration))
+	})
+
+	t.Run("it should use the time since Date if it is greater than Age", func(t *testing.T) {
+		headers := makeHeader("Cache-control", "max-age=60")
+		headers.Set("Age", "5")
+		headers.Set("Date", testTime.Add(-30*time.Second).UTC().Format(http.TimeFormat))
+		isPublic, expiration := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(200, headers), c)
+
+		require.True(t, isPublic)
+		require.InDelta(t, float64(testTime.Add(30*time.Second).Unix()), float64(expiration.Unix()), 1)
+	})
+
+	t.Run("it should ignore a Date in the future", func(t *testing.T) {
+		headers := makeHeader("Cache-control", "max-age=60")
+		headers.Set("Date", testTime.Add(time.Hour).UTC().Format(http.TimeFormat))
+		_, expiration := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(200, headers), c)
+
+		require.Equal(t, roundedExpiration(testTime.Add(60*time.Second)), roundedExpiration(expiration))
+	})
+
+	t.Run("it should count the lifetime of Expires from a Date in the past", func(t *testing.T) {
+		date := testTime.Add(-time.Hour)
+		headers := makeHeader("Date", date.UTC().Format(http.TimeFormat))
+		headers.Set("Expires", date.Add(2*time.Hour).UTC().Format(http.TimeFormat))
+		isPublic, expiration := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(200, headers), c)
+
+		require.True(t, isPublic)
+		require.InDelta(t, float64(testTime.Add(time.Hour).Unix()), float64(expiration.Unix()), 1)
+	})
+
+	t.Run("it should measure the Last-Modified heuristic until Date", func(t *testing.T) {
+		date := testTime.Add(-30 * time.Minute)
+		headers := makeHeader("Date", date.UTC().Format(http.TimeFormat))
+		headers.Set("Last-Modified", date.Add(-10*time.Hour).UTC().Format(http.TimeFormat))
+		isPublic, expiration := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(200, headers), c)
+
+		// A tenth of the 10 hours since it was modified, minus the 30 minutes since Date
+		require.True(t, isPublic)
+		require.InDelta(t, float64(testTime.Add(30*time.Minute).Unix()), float64(expiration.Unix()), 1)
+	})
+
+	t.Run("it should ignore a Date that can't be parsed", func(t *testing.T) {
+		headers := makeHeader("Cache-control", "max-age=60")
+		headers.Set("Date", "yesterday")
+		isPublic, expiration := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(200, headers), c)
+
+		require.True(t, isPublic)
+		require.Equal(t, roundedExpiration(testTime.Add(60*time.Second)), roundedExpiration(expiration))
+	})
+
+	t.Run("it should not cache a response older than its freshness lifetime", func(t *testing.T) {
+		for _, path := range []string{"/", "/public"} {
+			headers := makeHeader("Cache-control", "max-age=60")
+			headers.Set("Age", "120")
+			isPublic, _ := getCacheableStatus(makeRequest(path, http.Header{}), makeResponse(200, headers), c)
+
+			require.False(t, isPublic)
+		}
+	})
+
+	t.Run("it should ignore invalid values", func(t *testing.T) {
+		for _, age := range []string{"soon", "-10", "99999999999999999999"} {
+			headers := makeHeader("Cache-control", "max-age=60")
+			headers.Set("Age", age)
+			isPublic, _ := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(200, headers), c)
+
+			require.True(t, isPublic)
+		}
+	})
+
+	t.Run("it should not change the ttl header", func(t *testing.T) {
+		config := emptyConfig()
+		config.TTLHeader = "X-Cache-TTL"
+		headers := makeHeader("X-Cache-TTL", "60")
+		headers.Set("Age", "20")
+		_, expiration := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(200, headers), config)
+
+		require.Equal(t, testTime.Add(60*time.Second), expiration)
+	})
+}
+
+func TestTTLHeader(t *testing.T) {
+	c := emptyConfig()
+	c.TTLHeader = "X-Cache-TTL"
+	testTime := time.Now()
+	now = func() time.Time {
+		return testTime
+	}
+
+	t.Run("it should use the ttl header as seconds", func(t *testing.T) {
+		request := makeRequest("/", http.Header{})
+		response := makeResponse(200, makeHeader("X-Cache-TTL", "120"))
+		isPublic, expiration := getCacheableStatus(request, response, c)
+
+		require.True(t, isPublic)
+		require.Equal(t, testTime.Add(time.Duration(120)*time.Second), expiration)
+	})
+
+	t.Run("it should use the ttl header as a duration", func(t *testing.T) {
+		request := makeRequest("/", http.Header{})
+		response := makeResponse(200, makeHeader("X-Cache-TTL", "2m"))
+		isPublic, expiration := getCacheableStatus(request, response, c)
+
+		require.True(t, isPublic)
+		require.Equal(t, testTime.Add(time.Duration(2)*time.Minute), expiration)
+	})
+
+	t.Run("it should override cache-control", func(t *testing.T) {
+		request := makeRequest("/", http.Header{})
+		headers := makeHeader("X-Cache-TTL", "60")
+		headers.Add("Cache-Control", "no-cache, max-age=0")
+		response := makeResponse(200, headers)
+		isPublic, expiration := getCacheableStatus(request, response, c)
+
+		require.True(t, isPublic)
+		require.Equal(t, testTime.Add(time.Duration(60)*time.Second), expiration)
+	})
+
+	t.Run("it should not cache if the ttl is zero", func(t *testing.T) {
+		request := makeRequest("/", http.Header{})
+		headers := makeHeader("X-Cache-TTL", "0")
+		headers.Add("Cache-Control", "max-age=60")
+		response := makeResponse(200, headers)
+		isPublic, _ := getCacheableStatus(request, response, c)
+
+		require.False(t, isPublic)
+	})
+
+	t.Run("it should not cache partial responses", func(t *testing.T) {
+		request := makeRequest("/", http.Header{})
+		response := makeResponse(206, makeHeader("X-Cache-TTL", "60"))
+		isPublic, _ := getCacheableStatus(request, response, c)
+
+		require.False(t, isPublic)
+	})
+
+	t.Run("it should ignore invalid values", func(t *testing.T) {
+		for _, value := range []string{"soon", "-10", "1.5"} {
+			request := makeRequest("/", http.Header{})
+			headers := makeHeader("X-Cache-TTL", value)
+			headers.Add("Cache-Control", "max-age=5")
+			response := makeResponse(200, headers)
+			isPublic, expiration := getCacheableStatus(request, response, c)
+
+			require.True(t, isPublic)
+			require.Equal(t, testTime.Add(time.Duration(5)*time.Second).UTC().Round(time.Second), expiration.UTC().Round(time.Second))
+		}
+	})
+
+	t.Run("it should ignore the header if it is not configured", func(t *testing.T) {
+		request := makeRequest("/", http.Header{})
+		response := makeResponse(200, makeHeader("X-Cache-TTL", "120"))
+		isPublic, _ := getCacheableStatus(request, response, emptyConfig())
+
+		require.False(t, isPublic)
+	})
+
+	t.Run("it should not cache bodies smaller than min_body_size", func(t *testing.T) {
+		withMinSize := *c
+		withMinSize.MinBodySize = 1024
+		headers := makeHeader("X-Cache-TTL", "120")
+		headers.Set("Content-Length", "10")
+		isPublic, _, reason := getCacheability(makeRequest("/", http.Header{}), makeResponse(200, headers), &withMinSize)
+
+		require.False(t, isPublic)
+		require.Equal(t, "body smaller than min_body_size", reason)
+	})
+
+	t.Run("it should not cache the responses to authorized requests", func(t *testing.T) {
+		request := makeRequest("/", makeHeader("Authorization", "Bearer token"))
+		isPublic, _, reason := getCacheability(request, makeResponse(200, makeHeader("X-Cache-TTL", "120")), c)
+
+		require.False(t, isPublic)
+		require.Equal(t, "request with Authorization", reason)
+	})
+}
+
+func TestVaryHeaders(t *testing.T) {
+	t.Run("it should skip empty names and duplicates", func(t *testing.T) {
+		header := http.Header{"Vary": []string{"accept-encoding,, Cookie ,Accept-Encoding", "cookie, Origin"}}
+		require.Equal(t, []string{"Accept-Encoding", "Cookie", "Origin"}, varyHeaders(header))
+	})
+
+	t.Run("it should ignore a value with only whitespace and commas", func(t *testing.T) {
+		require.Equal(t, []string{}, varyHeaders(http.Header{"Vary": []string{"  "}}))
+		require.Equal(t, []string{}, varyHeaders(http.Header{"Vary": []string{" , ,"}}))
+		require.Equal(t, []string{}, varyHeaders(http.Header{}))
+	})
+
+	t.Run("it should match requests of malformed Vary headers", func(t *testing.T) {
+		config := emptyConfig()
+		config.VaryCookie = VaryCookieHonor
+		entryRequest := makeRequest("/", makeHeader("Accept-Encoding", "gzip"))
+		entryRequest.Header.Set("Cookie", "a=1")
+		entry := &HTTPCacheEntry{
+			Request:  entryRequest,
+			Response: &Response{HeaderMap: http.Header{"Vary": []string{"Accept-Encoding,,cookie, accept-encoding"}}},
+		}
+
+		same := makeRequest("/", makeHeader("Accept-Encoding", "gzip"))
+		same.Header.Set("Cookie", "a=1")
+		require.True(t, matchesVary(same, entry, config))
+
+		require.False(t, matchesVary(makeRequest("/", makeHeader("Accept-Encoding", "gzip")), entry, config))
+
+		entry.Response.HeaderMap = http.Header{"Vary": []string{"   "}}
+		require.True(t, matchesVary(makeRequest("/", http.Header{}), entry, config))
+	})
+
+	t.Run("it should find * in a list", func(t *testing.T) {
+		require.Equal(t, "Vary *", varyReason(http.Header{"Vary": []string{"Accept-Encoding, *"}}, emptyConfig()))
+		require.Equal(t, "", varyReason(http.Header{"Vary": []string{" ,Accept-Encoding"}}, emptyConfig()))
+	})
+}
+
+func TestEmptyVary(t *testing.T) {
+	t.Run("it should cache and always match a response with an empty Vary", func(t *testing.T) {
+		for _, vary := range []string{"", " ", ","} {
+			header := http.Header{"Cache-Control": {"max-age=10"}, "Vary": {vary}}
+			isPublic, _, reason := getCacheability(makeRequest("/", http.Header{}), makeResponse(200, header), emptyConfig())
+			require.True(t, isPublic, vary)
+			require.Equal(t, "explicit expiration", reason)
+
+			entry := &HTTPCacheEntry{
+				Request:  makeRequest("/", makeHeader("Accept-Encoding", "gzip")),
+				Response: &Response{HeaderMap: header},
+			}
+			require.True(t, matchesVary(makeRequest("/", http.Header{}), entry, emptyConfig()), vary)
+			require.True(t, matchesVary(makeRequest("/", makeHeader("Accept-Encoding", "br")), entry, emptyConfig()), vary)
+		}
+	})
+
+	t.Run("it should not cache a response with an empty Vary with vary_empty refuse", func(t *testing.T) {
+		config := emptyConfig()
+		config.RefuseEmptyVary = true
+
+		isPublic, _, reason := getCacheability(makeRequest("/", http.Header{}), makeResponse(200, http.Header{
+			"Cache-Control": {"max-age=10"},
+			"Vary":          {""},
+		}), config)
+		require.False(t, isPublic)
+		require.Equal(t, "empty Vary", reason)
+
+		isPublic, _, _ = getCacheability(makeRequest("/", http.Header{}), makeResponse(200, makeHeader("Cache-Control", "max-age=10")), config)
+		require.True(t, isPublic)
+	})
+}
+
+func TestVaryDeny(t *testing.T) {
+	header := http.Header{"Cache-Control": []string{"max-age=10"}, "Vary": []string{"Accept-Encoding, user-agent"}}
+
+	t.Run("it should not cache responses that vary on User-Agent by default", func(t *testing.T) {
+		isPublic, _, reason := getCacheability(makeRequest("/", http.Header{}), makeResponse(200, header), emptyConfig())
+		require.False(t, isPublic)
+		require.Equal(t, "Vary User-Agent", reason)
+	})
+
+	t.Run("it should not cache responses that vary on the configured headers", func(t *testing.T) {
+		config := emptyConfig()
+		config.VaryDeny = []string{"X-Request-Id"}
+
+		isPublic, _, _ := getCacheability(makeRequest("/", http.Header{}), makeResponse(200, header), config)
+		require.True(t, isPublic)
+
+		isPublic, _, reason := getCacheability(makeRequest("/", http.Header{}), makeResponse(200, http.Header{
+			"Cache-Control": []string{"max-age=10"},
+			"Vary":          []string{"X-Request-Id"},
+		}), config)
+		require.False(t, isPublic)
+		require.Equal(t, "Vary X-Request-Id", reason)
+	})
+
+	t.Run("it should cache every response if it is off", func(t *testing.T) {
+		config := emptyConfig()
+		config.VaryDeny = []string{}
+
+		isPublic, _, _ := getCacheability(makeRequest("/", http.Header{}), makeResponse(200, header), config)
+		require.True(t, isPublic)
+	})
+
+	t.Run("it should compare the device class of the User-Agent with vary_device", func(t *testing.T) {
+		config := emptyConfig()
+		config.VaryDevice = NewDeviceClassifier()
+
+		isPublic, _, _ := getCacheability(makeRequest("/", http.Header{}), makeResponse(200, header), config)
+		require.True(t, isPublic)
+
+		iphone := "Mozilla/5.0 (iPhone; CPU iPhone OS 12_0 like Mac OS X) Mobile/15E148"
+		entry := &HTTPCacheEntry{
+			Request:  makeRequest("/", makeHeader("User-Agent", iphone)),
+			Response: &Response{HeaderMap: http.Header{"Vary": []string{"User-Agent"}}},
+		}
+		require.True(t, matchesVary(makeRequest("/", makeHeader("User-Agent", "Mozilla/5.0 (Linux; Android 9; Pixel 3) Mobile Safari/537.36")), entry, config))
+		require.False(t, matchesVary(makeRequest("/", makeHeader("User-Agent", "Mozilla/5.0 (iPad; CPU OS 12_0 like Mac OS X)")), entry, config))
+	})
+}
+
+func TestVaryByHeader(t *testing.T) {
+	response := func(header ...string) *Response {
+		return makeResponse(200, http.Header{"Cache-Control": {"max-age=10"}, "X-Cache-Vary-By": {"x-tenant, Accept-Language"}, "Vary": header})
+	}
+	config := emptyConfig()
+	config.VaryByHeader = "X-Cache-Vary-By"
+
+	t.Run("it should not cache responses that vary by a header that is not in the key", func(t *testing.T) {
+		isPublic, _, reason := getCacheability(makeRequest("/", http.Header{}), response(), config)
+		require.False(t, isPublic)
+		require.Equal(t, "X-Cache-Vary-By X-Tenant not in the key", reason)
+	})
+
+	t.Run("it should cache them when every header is in the key or in Vary", func(t *testing.T) {
+		keyed := *config
+		keyed.KeyHeaders = []string{"X-Tenant"}
+		isPublic, _, _ := getCacheability(makeRequest("/", http.Header{}), response("Accept-Language"), &keyed)
+		require.True(t, isPublic)
+
+		templated := *config
+		templated.CacheKeyTemplate = defaultCacheKeyTemplate + " {>X-Tenant} {>accept-language}"
+		isPublic, _, _ = getCacheability(makeRequest("/", http.Header{}), response(), &templated)
+		require.True(t, isPublic)
+	})
+
+	t.Run("it should apply to the responses with a ttl header", func(t *testing.T) {
+		withTTL := *config
+		withTTL.TTLHeader = "X-Cache-TTL"
+		header := response().snapHeader
+		header.Set("X-Cache-TTL", "60")
+		isPublic, _, _ := getCacheability(makeRequest("/", http.Header{}), makeResponse(200, header), &withTTL)
+		require.False(t, isPublic)
+	})
+
+	t.Run("it should ignore the header without vary_by_header", func(t *testing.T) {
+		isPublic, _, _ := getCacheability(makeRequest("/", http.Header{}), response(), emptyConfig())
+		require.True(t, isPublic)
+	})
+}
+
+func TestStrictFreshness(t *testing.T) {
+	strict := emptyConfig()
+	strict.StrictFreshness = true
+	strict.CacheRules = []CacheRule{&PathCacheRule{Path: "/public"}}
+	lenient := emptyConfig()
+	lenient.CacheRules = strict.CacheRules
+
+	lastModified := makeHeader("Last-Modified", now().Add(-24*time.Hour).UTC().Format(http.TimeFormat))
+
+	t.Run("should not give a default freshness", func(t *testing.T) {
+		for _, path := range []string{"/", "/public"} {
+			isPublic, _ := getCacheableStatus(makeRequest(path, http.Header{}), makeResponse(200, lastModified), lenient)
+			require.True(t, isPublic, path)
+
+			isPublic, _, reason := getCacheability(makeRequest(path, http.Header{}), makeResponse(200, lastModified), strict)
+			require.False(t, isPublic, path)
+			require.Equal(t, "no explicit freshness", reason)
+		}
+
+		isPublic, _ := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(200, http.Header{
+			"Cache-Control": {"no-cache"},
+			"Etag":          {`"v1"`},
+		}), strict)
+		require.False(t, isPublic)
+	})
+
+	t.Run("should cache the responses with explicit freshness", func(t *testing.T) {
+		for _, header := range []http.Header{
+			makeHeader("Cache-Control", "max-age=10"),
+			makeHeader("Cache-Control", "s-maxage=10"),
+			makeHeader("Expires", now().Add(time.Minute).UTC().Format(http.TimeFormat)),
+		} {
+			isPublic, _ := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(200, header), strict)
+			require.True(t, isPublic, header)
+		}
+	})
+
+	t.Run("should fetch the responses without freshness every time", func(t *testing.T) {
+		fetches := 0
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			fetches++
+			w.Header().Set("Last-Modified", lastModified.Get("Last-Modified"))
+			w.Write([]byte("content"))
+			return 200, nil
+		}), strict)
+
+		for i := 0; i < 3; i++ {
+			w := httptest.NewRecorder()
+			_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", "http://example.com/public"))
+			require.NoError(t, err)
+			require.NotEqual(t, cacheHit, w.Result().Header.Get(defaultStatusHeader))
+			require.Equal(t, "content", w.Body.String())
+		}
+		require.Equal(t, 3, fetches)
+	})
+}
+
+func TestNeverCacheStatus(t *testing.T) {
+	c := emptyConfig()
+	c.NeverCacheStatus = []int{400, 401, 403}
+	c.TTLHeader = "X-Cache-TTL"
+	c.CacheRules = []CacheRule{&PathCacheRule{Path: "/"}}
+
+	t.Run("it should not cache a denied status with a positive max-age", func(t *testing.T) {
+		isPublic, _, reason := getCacheability(makeRequest("/", http.Header{}), makeResponse(401, makeHeader("Cache-Control", "max-age=60")), c)
+		require.False(t, isPublic)
+		require.Equal(t, "status 401 in never_cache_status", reason)
+	})
+
+	t.Run("it should win over the ttl header", func(t *testing.T) {
+		isPublic, _ := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(403, makeHeader("X-Cache-TTL", "60")), c)
+		require.False(t, isPublic)
+	})
+
+	t.Run("it should cache the other statuses", func(t *testing.T) {
+		isPublic, _ := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(404, makeHeader("Cache-Control", "max-age=60")), c)
+		require.True(t, isPublic)
+	})
+
+	t.Run("it should fetch a denied status every time", func(t *testing.T) {
+		fetches := 0
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			fetches++
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"unauthorized"}`))
+			return http.StatusUnauthorized, nil
+		}), c)
+
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", "http://example.com/api"))
+			require.NoError(t, err)
+			require.NotEqual(t, cacheHit, w.Result().Header.Get(defaultStatusHeader))
+			require.Equal(t, `{"error":"unauthorized"}`, w.Body.String())
+		}
+		require.Equal(t, 2, fetches)
+	})
+}
+
+func TestCacheabilityFunc(t *testing.T) {
+	config := emptyConfig()
+	config.CacheabilityFunc = func(req *http.Request, statusCode int, respHeaders http.Header) (bool, time.Time, error) {
+		value := respHeaders.Get("X-Cache-For")
+		if value == "" {
+			return false, time.Time{}, nil
+		}
+		if value == "default" {
+			return true, time.Time{}, nil
+		}
+		ttl, err := time.ParseDuration(value)
+		return true, now().Add(ttl), err
+	}
+
+	t.Run("should cache the responses the func allows", func(t *testing.T) {
+		isPublic, expiration, reason := getCacheability(makeRequest("/", http.Header{}), makeResponse(200, makeHeader("X-Cache-For", "30s")), config)
+		require.True(t, isPublic)
+		require.Equal(t, "cacheability func", reason)
+		require.True(t, expiration.After(now().Add(29*time.Second)) && expiration.Before(now().Add(31*time.Second)))
+
+		_, expiration = getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(200, makeHeader("X-Cache-For", "default")), config)
+		require.True(t, expiration.After(now().Add(config.DefaultMaxAge-time.Second)))
+	})
+
+	t.Run("should override the headers of the response", func(t *testing.T) {
+		isPublic, _ := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(200, makeHeader("Cache-Control", "max-age=60")), config)
+		require.False(t, isPublic)
+	})
+
+	t.Run("should not cache what the built-in checks refuse", func(t *testing.T) {
+		for _, value := range []string{"no-store", "private"} {
+			header := http.Header{"Cache-Control": {value}, "X-Cache-For": {"30s"}}
+			isPublic, _ := getCacheableStatus(makeRequest("/", http.Header{}), makeResponse(200, header), config)
+			require.False(t, isPublic, value)
+		}
+
+		isPublic, _ := getCacheableStatus(makeRequest("/", makeHeader("Authorization", "Basic a")), makeResponse(200, makeHeader("X-Cache-For", "30s")), config)
+		require.False(t, isPublic)
+	})
+
+	t.Run("should use the built-in rules if the func fails", func(t *testing.T) {
+		header := http.Header{"Cache-Control": {"max-age=60"}, "X-Cache-For": {"soon"}}
+		isPublic, _, reason := getCacheability(makeRequest("/", http.Header{}), makeResponse(200, header), config)
+		require.True(t, isPublic)
+		require.Equal(t, "explicit expiration", reason)
+	})
+
+	t.Run("should serve from cache what the func allows", func(t *testing.T) {
+		fetches := 0
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			fetches++
+			w.Header().Set("X-Cache-For", "1m")
+			w.Write([]byte("content"))
+			return 200, nil
+		}), config)
+
+		for i := 0; i < 3; i++ {
+			w := httptest.NewRecorder()
+			_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", "http://example.com/"))
+			require.NoError(t, err)
+			require.Equal(t, "content", w.Body.String())
+		}
+		require.Equal(t, 1, fetches)
+	})
+}
+
 func TestHeaderCacheRule(t *testing.T) {
 	r := &HeaderCacheRule{
 		Header: "Content-Type",
@@ -1,9 +1,17 @@
 package cache
 
 import (
-	"time"
-
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy"
 	"github.com/caddyserver/caddy/caddyhttp/httpserver"
@@ -13,7 +21,13 @@ var (
 	defaultStatusHeader = "X-Cache-Status"
 	defaultLockTimeout  = time.Duration(5) * time.Minute
 	defaultMaxAge       = time.Duration(5) * time.Minute
+	defaultMaxStale     = time.Duration(1) * time.Hour
 	defaultPath         = ""
+	defaultVaryDeny     = []string{"User-Agent"}
+	defaultRetryAfter   = time.Duration(5) * time.Second
+
+	defaultAdminTokenHeader = "X-Purge-Token"
+	defaultPurgeChannel     = "caddy-cache-purge"
 )
 
 type Config struct {
@@ -23,6 +37,236 @@ type Config struct {
 	CacheRules       []CacheRule
 	Path             string
 	CacheKeyTemplate string
+
+	// ServeStaleOnError makes the cache answer with an expired entry,
+	// at most MaxStale old, when upstream fails or responds with a 5xx
+	ServeStaleOnError bool
+	MaxStale          time.Duration
+
+	// Grace is how long after expiring an entry is still served, with a Warning, while it is revalidated in background
+	Grace time.Duration
+
+	// MaxStaleAge caps how long after expiring an entry is used, by grace, max_stale and the max-stale of the requests
+	MaxStaleAge time.Duration
+
+	// AgeCap is the greatest Age sent with the responses served from cache
+	AgeCap time.Duration
+
+	// Admission is how many times a key must be requested recently before its response is saved, 0 saves it at once
+	Admission int
+
+	// FetchRetries is how many times a failed fetch is sent again, waiting FetchRetryBackoff doubled on every attempt
+	FetchRetries      int
+	FetchRetryBackoff time.Duration
+
+	// Maintenance starts the cache in maintenance mode, it never requests upstream until it is disabled
+	Maintenance bool
+
+	// NeverCacheStatus are the status codes whose responses are never cached, whatever their headers and the rules say
+	NeverCacheStatus []int
+
+	// CacheIfHeader caches the responses that can be shared and have the headers, like a rule, and SkipIfHeader
+	// never caches them. With HeaderConditionsAll every condition of a list must match instead of any of them
+	CacheIfHeader       []HeaderCondition
+	SkipIfHeader        []HeaderCondition
+	HeaderConditionsAll bool
+
+	// ClearSiteData is the scope purged when a response has Clear-Site-Data with the cache type:
+	// url, directory or host. It is empty if the header is ignored
+	ClearSiteData string
+
+	// EventSink receives the stores, hits, stale responses, evictions and purges. event_webhook sets a WebhookSink
+	EventSink EventSink
+
+	// PurgeTombstone is how long a purge keeps the responses whose fetch started before it from being saved.
+	// The default is used if it is 0
+	PurgeTombstone time.Duration
+
+	// TTLHeader is a response header that upstream can use to set how long to cache the response
+	TTLHeader string
+
+	// DebugTTLHeader is a header set to the responses with the freshness lifetime of the entry and how much of it is left
+	DebugTTLHeader string
+
+	// PreserveHeaderCase sends the cached headers keys with the case upstream used instead of canonicalizing them.
+	// Only the case is kept, the headers are still written sorted
+	PreserveHeaderCase bool
+
+	// AdminPath is where the endpoints to inspect the cache are served
+	AdminPath string
+
+	// Admin requests, including PURGE, must have the token in the AdminTokenHeader
+	// and come from the AdminAllow networks. They are disabled if none is configured
+	AdminToken       string
+	AdminTokenHeader string
+	AdminAllow       []*net.IPNet
+
+	// PurgeRedis is the address of a redis used to send purges to the other instances
+	// that use the same PurgeChannel
+	PurgeRedis   string
+	PurgeChannel string
+
+	// EventLog is how much is logged about each request, as text or as JSON if EventLogJSON is set
+	EventLog     EventLogLevel
+	EventLogJSON bool
+
+	// PerHostMaxEntries and PerHostMaxSize limit the public entries each host can have,
+	// when a host goes over them its least recently used entries are removed
+	PerHostMaxEntries int
+	PerHostMaxSize    int64
+
+	// MaxVariants limits the variants saved with the same key,
+	// when a new one is saved the one the eviction policy picks is removed
+	MaxVariants int
+
+	// Eviction is the policy that picks the entries removed by the quotas and max_variants: lru, lfu or fifo.
+	// Empty is lru
+	Eviction string
+
+	// MemoryTierSize is how many bytes of the most used bodies are kept in memory instead of disk
+	MemoryTierSize int64
+
+	// MemorySpillSize is the size up to which bodies are kept only in memory,
+	// bigger ones are moved to disk once they reach it. 0 saves every body to disk
+	MemorySpillSize int64
+
+	// MmapMinSize is the size from which complete bodies on disk are read with mmap, 0 disables it
+	MmapMinSize int64
+
+	// MaxOpenFiles is how many bodies can be read from disk at the same time, the other requests wait.
+	// If it is 0 it is half of the open files the process can have
+	MaxOpenFiles int
+
+	// MinBodySize is the size from which responses are cached, smaller ones cost more than they save
+	MinBodySize int64
+
+	// WarmURLs and the urls in WarmFiles are requested on startup so they are already cached,
+	// making at most WarmConcurrency requests at the same time
+	WarmURLs        []string
+	WarmFiles       []string
+	WarmConcurrency int
+
+	// RefreshSchedules are urls that are fetched again periodically so they are always cached,
+	// making at most RefreshConcurrency requests at the same time
+	RefreshSchedules   []RefreshSchedule
+	RefreshConcurrency int
+
+	// VaryCookie is what is done with responses that vary on Cookie.
+	// With VaryCookieSubset only the cookies in VaryCookieNames are compared
+	VaryCookie      VaryCookieMode
+	VaryCookieNames []string
+
+	// VaryDeny are the request headers that make a response not cacheable if it varies on them,
+	// because each client would get its own variant. User-Agent is allowed with VaryDevice
+	VaryDeny []string
+
+	// RefuseEmptyVary does not cache responses whose Vary headers list no request header, like "Vary:".
+	// Otherwise they are cached like responses without Vary
+	RefuseEmptyVary bool
+
+	// StorageBackends are named places where bodies can be saved instead of Path,
+	// StorageRules route the requests whose path starts with theirs to one of them
+	StorageBackends map[string]StorageBackend
+	StorageRules    []StorageRule
+
+	// KeyHeaders are request headers whose values are added to the key, canonicalized and sorted
+	KeyHeaders []string
+
+	// KeyAccept adds the preferred media type of the Accept header to the key
+	KeyAccept bool
+
+	// VaryByHeader is a response header where upstream lists the request headers the response depends on.
+	// Responses that depend on one that is not in the key nor in Vary are not cached
+	VaryByHeader string
+
+	// HitHeaders are set to the responses sent from the cache, replacing the cached ones with the same name
+	HitHeaders http.Header
+
+	// StripHeaders are removed from the responses that are cached, they are not saved nor sent from the cache
+	StripHeaders []string
+
+	// KeyMergeHead gives HEAD requests the key of the GET of the same url
+	KeyMergeHead bool
+
+	// KeyVersion is added to every key, changing it at runtime makes every url miss
+	KeyVersion *KeyVersion
+
+	// CacheMethods are the request methods that can use the cache, GET and HEAD if it is empty.
+	// Requests with other methods are sent to upstream
+	CacheMethods []string
+
+	// GzipDedup asks upstream for gzip bodies and saves only them, they are decompressed for
+	// the clients that don't accept gzip. It saves disk at the cost of CPU
+	GzipDedup bool
+
+	// CompressStore saves the compressible bodies with gzip, they are decompressed for the clients that don't accept it.
+	// CompressAllow and CompressDeny are media types added to the default ones, a type ending with a slash matches its subtypes
+	CompressStore bool
+	CompressAllow []string
+	CompressDeny  []string
+
+	// VaryDevice adds the device class of the request to the key, nil if disabled
+	VaryDevice *DeviceClassifier
+
+	// VaryUserAgent compares the variants that vary on User-Agent by the bucket of device class and browser, nil if disabled
+	VaryUserAgent *UserAgentBucketer
+
+	// VaryLanguage compares the variants that vary on Accept-Language by the supported language the request prefers,
+	// nil if disabled
+	VaryLanguage *LanguageNormalizer
+
+	// RangeAssembly saves the responses to range requests as segments of the whole body,
+	// so later ranges are assembled from them fetching only what is missing
+	RangeAssembly bool
+
+	// BypassQuery is a query parameter that makes the request skip the cache and replace the cached
+	// response with a new one. It needs the BypassQueryValue or to come from an AdminAllow ip
+	BypassQuery      string
+	BypassQueryValue string
+
+	// NullStorage saves nothing, every request gets a response from upstream.
+	// It is used to measure the overhead of the handler or to disable the cache
+	NullStorage bool
+
+	// WriteTimeout abandons saving a body when a write to the storage takes longer, the clients still get the body
+	WriteTimeout time.Duration
+
+	// BodyTimeout aborts a fetch when upstream sends no part of the body for that long, 0 waits forever
+	BodyTimeout time.Duration
+
+	// AbortOnDisconnect cancels a fetch when the client that started it leaves before the body is complete
+	AbortOnDisconnect bool
+
+	// CollapseTimeout is how long a request waits another one of the same key that is fetching upstream.
+	// After that it is served stale or it goes upstream too. 0 waits until the other one ends
+	CollapseTimeout time.Duration
+
+	// MaxConcurrentFetches limits the fetches to upstream of the requests, 0 is no limit.
+	// Over it requests get a stale response or a 503 with RetryAfter
+	MaxConcurrentFetches int
+	RetryAfter           time.Duration
+
+	// CacheAuthorized stores the responses to requests with Authorization even without
+	// public, s-maxage or must-revalidate. Every client gets them no matter its credentials
+	CacheAuthorized bool
+
+	// StrictFreshness only caches the responses with max-age, s-maxage, Expires or the ttl header.
+	// Without it rules use DefaultMaxAge and responses with Last-Modified get a heuristic freshness
+	StrictFreshness bool
+
+	// CacheabilityFunc decides if a response is cached and until when instead of the rules and the
+	// expiration of its headers. It is only called for the responses that pass the checks that can't
+	// be overridden, like no-store, private or Authorization. It can only be set from Go
+	CacheabilityFunc CacheabilityFunc
+
+	// HonorContentLocation also saves the responses under the url of their Content-Location if it has the same host
+	HonorContentLocation bool
+
+	// Fallback is sent when upstream fails and nothing cached can be used, nil if disabled
+	Fallback *FallbackResponse
+
+	// MetricsByHost labels the upstream latency metrics with the host of the request
+	MetricsByHost bool
 }
 
 func init() {
@@ -41,20 +285,132 @@ func Setup(c *caddy.Controller) error {
 		return err
 	}
 
-	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
-		return NewHandler(next, config)
+	path, err := preparePath(config.Path)
+	if err != nil {
+		return c.Err(err.Error())
+	}
+	if config.Path == "" {
+		c.OnShutdown(func() error {
+			return os.RemoveAll(path)
+		})
+	}
+	config.Path = path
+	diskPaths := []string{path}
+
+	for _, backend := range config.StorageBackends {
+		if !backend.Memory {
+			if _, err := preparePath(backend.Path); err != nil {
+				return c.Err(err.Error())
+			}
+			diskPaths = append(diskPaths, backend.Path)
+		}
+	}
+
+	// Only on the first startup, on a reload the files are still used by the previous instance
+	signature := keySignature(config)
+	c.OnFirstStartup(func() error {
+		for _, diskPath := range diskPaths {
+			if err := migrateKeys(diskPath, signature); err != nil {
+				return fmt.Errorf("Can not check the keys of the cache path %s: %v", diskPath, err)
+			}
+		}
+		return nil
 	})
 
-	c.OnStartup(func() error {
-		if config.Path == "" {
+	var purger *DistributedPurger
+	if config.PurgeRedis != "" {
+		purger = NewDistributedPurger(config.PurgeRedis, config.PurgeChannel)
+		c.OnStartup(func() error {
+			purger.Start()
+			return nil
+		})
+		c.OnShutdown(func() error {
+			purger.Stop()
 			return nil
+		})
+	}
+
+	var handler *Handler
+	c.OnShutdown(func() error {
+		if handler != nil {
+			handler.Cache.events.Stop()
+		}
+		return nil
+	})
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		handler = NewHandler(next, config)
+		if purger != nil {
+			purger.AddCache(handler.Cache)
+			handler.Purger = purger
 		}
-		return os.MkdirAll(config.Path, 0600)
+		return handler
 	})
 
+	// The middlewares are created before the startup callbacks run. Warming requests go
+	// directly to the handler in background so they don't delay the server start
+	if len(config.WarmURLs) > 0 || len(config.WarmFiles) > 0 {
+		c.OnStartup(func() error {
+			if handler != nil {
+				go handler.warmOnStartup()
+			}
+			return nil
+		})
+	}
+
+	if len(config.RefreshSchedules) > 0 {
+		var scheduler *RefreshScheduler
+		c.OnStartup(func() error {
+			if handler != nil {
+				scheduler = NewRefreshScheduler(handler, config.RefreshSchedules, config.RefreshConcurrency)
+				scheduler.Start()
+			}
+			return nil
+		})
+		c.OnShutdown(func() error {
+			if scheduler != nil {
+				scheduler.Stop()
+			}
+			return nil
+		})
+	}
+
 	return nil
 }
 
+// preparePath creates the directory where the bodies are saved and checks that it is writable,
+// so problems are found when the config is loaded instead of on the first request.
+// Without a path a new directory is created in the temp folder, it is returned so it can be removed
+func preparePath(path string) (string, error) {
+	if path == "" {
+		return ioutil.TempDir("", "caddy-cache-")
+	}
+
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return "", fmt.Errorf("Can not create the cache path %s: %v", path, err)
+	}
+
+	check, err := ioutil.TempFile(path, "caddy-cache-check-")
+	if err != nil {
+		return "", fmt.Errorf("The cache path %s is not writable: %v", path, err)
+	}
+	check.Close()
+	return path, os.Remove(check.Name())
+}
+
+// isHeaderName returns if the name is a valid header field name, a token as RFC 7230 section 3.2.6 defines
+func isHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, char := range name {
+		isAlphanumeric := char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z' || char >= '0' && char <= '9'
+		if !isAlphanumeric && !strings.ContainsRune("!#$%&'*+-.^_`|~", char) {
+			return false
+		}
+	}
+	return true
+}
+
 // defaultCacheKeyTemplate is the placeholder template that will be used to
 // generate the cache key.
 const defaultCacheKeyTemplate = "{method} {host}{path}?{query}"
@@ -67,6 +423,8 @@ func emptyConfig() *Config {
 		CacheRules:       []CacheRule{},
 		Path:             defaultPath,
 		CacheKeyTemplate: defaultCacheKeyTemplate,
+		MaxStale:         defaultMaxStale,
+		VaryDeny:         defaultVaryDeny,
 	}
 }
 
@@ -118,6 +476,42 @@ func cacheParse(c *caddy.Controller) (*Config, error) {
 			}
 			cacheRule := &HeaderCacheRule{Header: args[0], Value: args[1:]}
 			config.CacheRules = append(config.CacheRules, cacheRule)
+		case "cache_if_header", "skip_if_header":
+			if len(args) < 1 {
+				return nil, c.Err("Invalid usage of " + parameter + " in cache config.")
+			}
+			condition := HeaderCondition{Header: args[0], Values: args[1:]}
+			if parameter == "cache_if_header" {
+				config.CacheIfHeader = append(config.CacheIfHeader, condition)
+			} else {
+				config.SkipIfHeader = append(config.SkipIfHeader, condition)
+			}
+		case "header_conditions":
+			if len(args) != 1 || (args[0] != "any" && args[0] != "all") {
+				return nil, c.Err("Invalid usage of header_conditions in cache config.")
+			}
+			config.HeaderConditionsAll = args[0] == "all"
+		case "honor_clear_site_data":
+			if len(args) > 1 {
+				return nil, c.Err("Invalid usage of honor_clear_site_data in cache config.")
+			}
+			config.ClearSiteData = clearSiteDataDirectory
+			if len(args) == 1 {
+				switch args[0] {
+				case clearSiteDataURL, clearSiteDataDirectory, clearSiteDataHost:
+					config.ClearSiteData = args[0]
+				default:
+					return nil, c.Err("honor_clear_site_data: Invalid scope " + args[0])
+				}
+			}
+		case "event_webhook":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of event_webhook in cache config.")
+			}
+			if u, err := url.Parse(args[0]); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, c.Err("event_webhook: Invalid url " + args[0])
+			}
+			config.EventSink = NewWebhookSink(args[0])
 		case "match_path":
 			if len(args) != 1 {
 				return nil, c.Err("Invalid usage of match_path in cache config.")
@@ -129,10 +523,665 @@ func cacheParse(c *caddy.Controller) (*Config, error) {
 				return nil, c.Err("Invalid usage of cache_key in cache config.")
 			}
 			config.CacheKeyTemplate = args[0]
+		case "serve_stale_on_error":
+			if len(args) != 0 {
+				return nil, c.Err("Invalid usage of serve_stale_on_error in cache config.")
+			}
+			config.ServeStaleOnError = true
+		case "max_stale":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of max_stale in cache config.")
+			}
+			duration, err := time.ParseDuration(args[0])
+			if err != nil {
+				return nil, c.Err("max_stale: Invalid duration " + args[0])
+			}
+			config.MaxStale = duration
+		case "max_stale_age":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of max_stale_age in cache config.")
+			}
+			duration, err := time.ParseDuration(args[0])
+			if err != nil || duration <= 0 {
+				return nil, c.Err("max_stale_age: Invalid duration " + args[0])
+			}
+			config.MaxStaleAge = duration
+		case "admission":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of admission in cache config.")
+			}
+			requests, err := strconv.Atoi(args[0])
+			if err != nil || requests < 1 || requests > 255 {
+				return nil, c.Err("admission: Invalid number " + args[0])
+			}
+			config.Admission = requests
+		case "age_cap":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of age_cap in cache config.")
+			}
+			duration, err := time.ParseDuration(args[0])
+			if err != nil || duration < time.Second {
+				return nil, c.Err("age_cap: Invalid duration " + args[0])
+			}
+			config.AgeCap = duration
+		case "fetch_retries":
+			if len(args) < 1 || len(args) > 2 {
+				return nil, c.Err("Invalid usage of fetch_retries in cache config.")
+			}
+			retries, err := strconv.Atoi(args[0])
+			if err != nil || retries <= 0 {
+				return nil, c.Err("fetch_retries: Invalid number " + args[0])
+			}
+			config.FetchRetries = retries
+			if len(args) == 2 {
+				duration, err := time.ParseDuration(args[1])
+				if err != nil || duration <= 0 {
+					return nil, c.Err("fetch_retries: Invalid duration " + args[1])
+				}
+				config.FetchRetryBackoff = duration
+			}
+		case "maintenance":
+			if len(args) != 0 {
+				return nil, c.Err("Invalid usage of maintenance in cache config.")
+			}
+			config.Maintenance = true
+		case "never_cache_status":
+			if len(args) == 0 {
+				return nil, c.Err("Invalid usage of never_cache_status in cache config.")
+			}
+			for _, arg := range args {
+				code, err := strconv.Atoi(arg)
+				if err != nil || code < 100 || code > 599 {
+					return nil, c.Err("never_cache_status: Invalid status " + arg)
+				}
+				config.NeverCacheStatus = append(config.NeverCacheStatus, code)
+			}
+		case "purge_tombstone":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of purge_tombstone in cache config.")
+			}
+			duration, err := time.ParseDuration(args[0])
+			if err != nil || duration <= 0 {
+				return nil, c.Err("purge_tombstone: Invalid duration " + args[0])
+			}
+			config.PurgeTombstone = duration
+		case "grace":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of grace in cache config.")
+			}
+			duration, err := time.ParseDuration(args[0])
+			if err != nil || duration < 0 {
+				return nil, c.Err("grace: Invalid duration " + args[0])
+			}
+			config.Grace = duration
+		case "ttl_header":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of ttl_header in cache config.")
+			}
+			config.TTLHeader = args[0]
+		case "debug_ttl_header":
+			if len(args) > 1 {
+				return nil, c.Err("Invalid usage of debug_ttl_header in cache config.")
+			}
+			config.DebugTTLHeader = defaultDebugTTLHeader
+			if len(args) == 1 {
+				if !isHeaderName(args[0]) {
+					return nil, c.Err("debug_ttl_header: Invalid header name " + args[0])
+				}
+				config.DebugTTLHeader = args[0]
+			}
+		case "preserve_header_case":
+			if len(args) != 0 {
+				return nil, c.Err("Invalid usage of preserve_header_case in cache config.")
+			}
+			config.PreserveHeaderCase = true
+		case "admin_path":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of admin_path in cache config.")
+			}
+			config.AdminPath = strings.TrimSuffix(args[0], "/")
+			if config.AdminPath == "" {
+				return nil, c.Err("admin_path: Can not be the root path")
+			}
+		case "admin_token":
+			if len(args) != 1 && len(args) != 2 {
+				return nil, c.Err("Invalid usage of admin_token in cache config.")
+			}
+			config.AdminToken = args[0]
+			config.AdminTokenHeader = defaultAdminTokenHeader
+			if len(args) == 2 {
+				config.AdminTokenHeader = args[1]
+			}
+		case "admin_allow":
+			if len(args) == 0 {
+				return nil, c.Err("Invalid usage of admin_allow in cache config.")
+			}
+			for _, arg := range args {
+				network, err := parseNetwork(arg)
+				if err != nil {
+					return nil, c.Err("admin_allow: Invalid ip or network " + arg)
+				}
+				config.AdminAllow = append(config.AdminAllow, network)
+			}
+		case "purge_redis":
+			if len(args) != 1 && len(args) != 2 {
+				return nil, c.Err("Invalid usage of purge_redis in cache config.")
+			}
+			config.PurgeRedis = args[0]
+			config.PurgeChannel = defaultPurgeChannel
+			if len(args) == 2 {
+				config.PurgeChannel = args[1]
+			}
+		case "log_events":
+			if len(args) != 1 && len(args) != 2 {
+				return nil, c.Err("Invalid usage of log_events in cache config.")
+			}
+			level, ok := eventLogLevels[args[0]]
+			if !ok {
+				return nil, c.Err("log_events: Invalid level " + args[0])
+			}
+			config.EventLog = level
+			if len(args) == 2 {
+				switch args[1] {
+				case "json":
+					config.EventLogJSON = true
+				case "text":
+					config.EventLogJSON = false
+				default:
+					return nil, c.Err("log_events: Invalid format " + args[1])
+				}
+			}
+		case "per_host_max_entries":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of per_host_max_entries in cache config.")
+			}
+			entries, err := strconv.Atoi(args[0])
+			if err != nil || entries <= 0 {
+				return nil, c.Err("per_host_max_entries: Invalid number " + args[0])
+			}
+			config.PerHostMaxEntries = entries
+		case "max_variants":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of max_variants in cache config.")
+			}
+			variants, err := strconv.Atoi(args[0])
+			if err != nil || variants <= 0 {
+				return nil, c.Err("max_variants: Invalid number " + args[0])
+			}
+			config.MaxVariants = variants
+		case "eviction":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of eviction in cache config.")
+			}
+			switch args[0] {
+			case evictionLRU, evictionLFU, evictionFIFO:
+				config.Eviction = args[0]
+			default:
+				return nil, c.Err("eviction: Invalid policy " + args[0])
+			}
+		case "per_host_max_size":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of per_host_max_size in cache config.")
+			}
+			size, err := parseSize(args[0])
+			if err != nil || size <= 0 {
+				return nil, c.Err("per_host_max_size: Invalid size " + args[0])
+			}
+			config.PerHostMaxSize = size
+		case "memory_tier_size":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of memory_tier_size in cache config.")
+			}
+			size, err := parseSize(args[0])
+			if err != nil || size <= 0 {
+				return nil, c.Err("memory_tier_size: Invalid size " + args[0])
+			}
+			config.MemoryTierSize = size
+		case "memory_spill_size":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of memory_spill_size in cache config.")
+			}
+			size, err := parseSize(args[0])
+			if err != nil || size <= 0 {
+				return nil, c.Err("memory_spill_size: Invalid size " + args[0])
+			}
+			config.MemorySpillSize = size
+		case "max_open_files":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of max_open_files in cache config.")
+			}
+			max, err := strconv.Atoi(args[0])
+			if err != nil || max <= 0 {
+				return nil, c.Err("max_open_files: Invalid number " + args[0])
+			}
+			config.MaxOpenFiles = max
+		case "mmap_min_size":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of mmap_min_size in cache config.")
+			}
+			size, err := parseSize(args[0])
+			if err != nil || size <= 0 {
+				return nil, c.Err("mmap_min_size: Invalid size " + args[0])
+			}
+			config.MmapMinSize = size
+		case "min_body_size":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of min_body_size in cache config.")
+			}
+			size, err := parseSize(args[0])
+			if err != nil || size <= 0 {
+				return nil, c.Err("min_body_size: Invalid size " + args[0])
+			}
+			config.MinBodySize = size
+		case "warm":
+			if len(args) == 0 {
+				return nil, c.Err("Invalid usage of warm in cache config.")
+			}
+			config.WarmURLs = append(config.WarmURLs, args...)
+		case "warm_file":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of warm_file in cache config.")
+			}
+			config.WarmFiles = append(config.WarmFiles, args[0])
+		case "warm_concurrency":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of warm_concurrency in cache config.")
+			}
+			concurrency, err := strconv.Atoi(args[0])
+			if err != nil || concurrency <= 0 {
+				return nil, c.Err("warm_concurrency: Invalid number " + args[0])
+			}
+			config.WarmConcurrency = concurrency
+		case "refresh_schedule":
+			if len(args) != 2 {
+				return nil, c.Err("Invalid usage of refresh_schedule in cache config.")
+			}
+			interval, err := time.ParseDuration(args[1])
+			if err != nil || interval <= 0 {
+				return nil, c.Err("refresh_schedule: Invalid interval " + args[1])
+			}
+			config.RefreshSchedules = append(config.RefreshSchedules, RefreshSchedule{URL: args[0], Interval: interval})
+		case "refresh_concurrency":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of refresh_concurrency in cache config.")
+			}
+			concurrency, err := strconv.Atoi(args[0])
+			if err != nil || concurrency <= 0 {
+				return nil, c.Err("refresh_concurrency: Invalid number " + args[0])
+			}
+			config.RefreshConcurrency = concurrency
+		case "vary_cookie":
+			if len(args) == 0 {
+				return nil, c.Err("Invalid usage of vary_cookie in cache config.")
+			}
+			switch args[0] {
+			case "refuse", "honor":
+				if len(args) != 1 {
+					return nil, c.Err("Invalid usage of vary_cookie in cache config.")
+				}
+				config.VaryCookie = VaryCookieRefuse
+				if args[0] == "honor" {
+					config.VaryCookie = VaryCookieHonor
+				}
+			case "only":
+				if len(args) < 2 {
+					return nil, c.Err("vary_cookie: only needs at least a cookie name")
+				}
+				config.VaryCookie = VaryCookieSubset
+				config.VaryCookieNames = args[1:]
+			default:
+				return nil, c.Err("vary_cookie: Invalid mode " + args[0])
+			}
+		case "vary_deny":
+			if len(args) == 0 {
+				return nil, c.Err("Invalid usage of vary_deny in cache config.")
+			}
+			config.VaryDeny = []string{}
+			if len(args) == 1 && args[0] == "off" {
+				break
+			}
+			for _, name := range args {
+				config.VaryDeny = append(config.VaryDeny, http.CanonicalHeaderKey(name))
+			}
+		case "vary_empty":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of vary_empty in cache config.")
+			}
+			switch args[0] {
+			case "ignore":
+				config.RefuseEmptyVary = false
+			case "refuse":
+				config.RefuseEmptyVary = true
+			default:
+				return nil, c.Err("vary_empty: Invalid mode " + args[0])
+			}
+		case "storage_backend":
+			if len(args) < 2 {
+				return nil, c.Err("Invalid usage of storage_backend in cache config.")
+			}
+			backend := StorageBackend{}
+			switch args[1] {
+			case "memory":
+				if len(args) != 2 {
+					return nil, c.Err("Invalid usage of storage_backend in cache config.")
+				}
+				backend.Memory = true
+			case "disk":
+				if len(args) != 3 {
+					return nil, c.Err("Invalid usage of storage_backend in cache config.")
+				}
+				backend.Path = args[2]
+			default:
+				return nil, c.Err("storage_backend: Invalid type " + args[1])
+			}
+			if config.StorageBackends == nil {
+				config.StorageBackends = map[string]StorageBackend{}
+			}
+			config.StorageBackends[args[0]] = backend
+		case "storage_path":
+			if len(args) != 2 {
+				return nil, c.Err("Invalid usage of storage_path in cache config.")
+			}
+			config.StorageRules = append(config.StorageRules, StorageRule{Path: args[0], Backend: args[1]})
+		case "key_headers":
+			if len(args) == 0 {
+				return nil, c.Err("Invalid usage of key_headers in cache config.")
+			}
+			names := append(config.KeyHeaders, args...)
+			for i := range names {
+				names[i] = http.CanonicalHeaderKey(names[i])
+			}
+			sort.Strings(names)
+
+			// Repeated names would be added twice to the key
+			config.KeyHeaders = []string{}
+			for i, name := range names {
+				if i == 0 || names[i-1] != name {
+					config.KeyHeaders = append(config.KeyHeaders, name)
+				}
+			}
+		case "vary_by_header":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of vary_by_header in cache config.")
+			}
+			if !isHeaderName(args[0]) {
+				return nil, c.Err("vary_by_header: Invalid header name " + args[0])
+			}
+			config.VaryByHeader = http.CanonicalHeaderKey(args[0])
+		case "add_headers_on_hit":
+			if len(args) != 2 {
+				return nil, c.Err("Invalid usage of add_headers_on_hit in cache config.")
+			}
+			if !isHeaderName(args[0]) {
+				return nil, c.Err("add_headers_on_hit: Invalid header name " + args[0])
+			}
+			if config.HitHeaders == nil {
+				config.HitHeaders = http.Header{}
+			}
+			config.HitHeaders.Add(args[0], args[1])
+		case "strip_headers":
+			if len(args) == 0 {
+				return nil, c.Err("Invalid usage of strip_headers in cache config.")
+			}
+			for _, name := range args {
+				if !isHeaderName(name) {
+					return nil, c.Err("strip_headers: Invalid header name " + name)
+				}
+				config.StripHeaders = append(config.StripHeaders, http.CanonicalHeaderKey(name))
+			}
+		case "key_merge_head":
+			if len(args) != 0 {
+				return nil, c.Err("Invalid usage of key_merge_head in cache config.")
+			}
+			config.KeyMergeHead = true
+		case "key_version":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of key_version in cache config.")
+			}
+			config.KeyVersion = NewKeyVersion(args[0])
+		case "cache_methods":
+			if len(args) == 0 {
+				return nil, c.Err("Invalid usage of cache_methods in cache config.")
+			}
+			config.CacheMethods = nil
+			for _, method := range args {
+				method = strings.ToUpper(method)
+				if method != http.MethodGet && method != http.MethodHead {
+					return nil, c.Err("cache_methods: Invalid method " + method)
+				}
+				config.CacheMethods = append(config.CacheMethods, method)
+			}
+		case "key_accept":
+			if len(args) != 0 {
+				return nil, c.Err("Invalid usage of key_accept in cache config.")
+			}
+			config.KeyAccept = true
+		case "vary_device":
+			if len(args)%2 != 0 {
+				return nil, c.Err("Invalid usage of vary_device in cache config.")
+			}
+			config.VaryDevice = NewDeviceClassifier()
+			for i := 0; i < len(args); i += 2 {
+				if err := config.VaryDevice.Override(args[i], args[i+1]); err != nil {
+					return nil, c.Err("vary_device: " + err.Error())
+				}
+			}
+		case "vary_user_agent":
+			if len(args)%2 != 0 {
+				return nil, c.Err("Invalid usage of vary_user_agent in cache config.")
+			}
+			config.VaryUserAgent = NewUserAgentBucketer()
+			for i := 0; i < len(args); i += 2 {
+				if err := config.VaryUserAgent.Add(args[i], args[i+1]); err != nil {
+					return nil, c.Err("vary_user_agent: " + err.Error())
+				}
+			}
+		case "vary_language":
+			if len(args) == 0 {
+				return nil, c.Err("Invalid usage of vary_language in cache config.")
+			}
+			for _, language := range args {
+				if !isLanguageTag(language) {
+					return nil, c.Err("vary_language: Invalid language " + language)
+				}
+			}
+			config.VaryLanguage = NewLanguageNormalizer(args)
+		case "gzip_dedup":
+			if len(args) != 0 {
+				return nil, c.Err("Invalid usage of gzip_dedup in cache config.")
+			}
+			config.GzipDedup = true
+		case "compress_store":
+			if len(args) != 0 {
+				return nil, c.Err("Invalid usage of compress_store in cache config.")
+			}
+			config.CompressStore = true
+		case "compress_allow", "compress_deny":
+			if len(args) == 0 {
+				return nil, c.Err("Invalid usage of " + parameter + " in cache config.")
+			}
+			types := []string{}
+			for _, mediaType := range args {
+				types = append(types, strings.ToLower(mediaType))
+			}
+			if parameter == "compress_allow" {
+				config.CompressAllow = append(config.CompressAllow, types...)
+			} else {
+				config.CompressDeny = append(config.CompressDeny, types...)
+			}
+		case "range_assembly":
+			if len(args) != 0 {
+				return nil, c.Err("Invalid usage of range_assembly in cache config.")
+			}
+			config.RangeAssembly = true
+		case "bypass_query":
+			if len(args) != 1 && len(args) != 2 {
+				return nil, c.Err("Invalid usage of bypass_query in cache config.")
+			}
+			config.BypassQuery = args[0]
+			if len(args) == 2 {
+				config.BypassQueryValue = args[1]
+			}
+		case "storage":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of storage in cache config.")
+			}
+			switch args[0] {
+			case "disk":
+				config.NullStorage = false
+			case "null":
+				config.NullStorage = true
+			default:
+				return nil, c.Err("storage: Invalid storage " + args[0])
+			}
+		case "cache_authorized":
+			if len(args) != 0 {
+				return nil, c.Err("Invalid usage of cache_authorized in cache config.")
+			}
+			config.CacheAuthorized = true
+		case "strict_freshness":
+			if len(args) != 0 {
+				return nil, c.Err("Invalid usage of strict_freshness in cache config.")
+			}
+			config.StrictFreshness = true
+		case "honor_content_location":
+			if len(args) != 0 {
+				return nil, c.Err("Invalid usage of honor_content_location in cache config.")
+			}
+			config.HonorContentLocation = true
+		case "fallback_response":
+			if len(args) != 1 && len(args) != 2 {
+				return nil, c.Err("Invalid usage of fallback_response in cache config.")
+			}
+			code := http.StatusServiceUnavailable
+			if len(args) == 2 {
+				parsed, err := strconv.Atoi(args[1])
+				if err != nil || parsed < 200 || parsed > 599 {
+					return nil, c.Err("fallback_response: Invalid status code " + args[1])
+				}
+				code = parsed
+			}
+			fallback, err := NewFallbackResponse(args[0], code)
+			if err != nil {
+				return nil, c.Err("fallback_response: " + err.Error())
+			}
+			config.Fallback = fallback
+		case "collapse_timeout":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of collapse_timeout in cache config.")
+			}
+			timeout, err := time.ParseDuration(args[0])
+			if err != nil || timeout < 0 {
+				return nil, c.Err("collapse_timeout: Invalid duration " + args[0])
+			}
+			config.CollapseTimeout = timeout
+		case "body_timeout":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of body_timeout in cache config.")
+			}
+			timeout, err := time.ParseDuration(args[0])
+			if err != nil || timeout <= 0 {
+				return nil, c.Err("body_timeout: Invalid duration " + args[0])
+			}
+			config.BodyTimeout = timeout
+		case "write_timeout":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of write_timeout in cache config.")
+			}
+			timeout, err := time.ParseDuration(args[0])
+			if err != nil || timeout <= 0 {
+				return nil, c.Err("write_timeout: Invalid duration " + args[0])
+			}
+			config.WriteTimeout = timeout
+		case "continue_on_disconnect":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of continue_on_disconnect in cache config.")
+			}
+			switch args[0] {
+			case "on":
+				config.AbortOnDisconnect = false
+			case "off":
+				config.AbortOnDisconnect = true
+			default:
+				return nil, c.Err("continue_on_disconnect: Invalid value " + args[0])
+			}
+		case "max_concurrent_fetches":
+			if len(args) != 1 && len(args) != 2 {
+				return nil, c.Err("Invalid usage of max_concurrent_fetches in cache config.")
+			}
+			fetches, err := strconv.Atoi(args[0])
+			if err != nil || fetches <= 0 {
+				return nil, c.Err("max_concurrent_fetches: Invalid number " + args[0])
+			}
+			config.MaxConcurrentFetches = fetches
+			config.RetryAfter = defaultRetryAfter
+			if len(args) == 2 {
+				retryAfter, err := time.ParseDuration(args[1])
+				if err != nil || retryAfter < time.Second {
+					return nil, c.Err("max_concurrent_fetches: Invalid retry after " + args[1])
+				}
+				config.RetryAfter = retryAfter
+			}
+		case "metrics_by_host":
+			if len(args) != 0 {
+				return nil, c.Err("Invalid usage of metrics_by_host in cache config.")
+			}
+			config.MetricsByHost = true
 		default:
 			return nil, c.Err("Unknown cache parameter: " + parameter)
 		}
 	}
 
+	// Backends can be declared after the rules that use them
+	for _, rule := range config.StorageRules {
+		if _, ok := config.StorageBackends[rule.Backend]; !ok {
+			return nil, c.Err("storage_path: Unknown storage backend " + rule.Backend)
+		}
+	}
+
+	// Anyone could skip the cache and load the upstream otherwise
+	if config.BypassQuery != "" && config.BypassQueryValue == "" && len(config.AdminAllow) == 0 {
+		return nil, c.Err("bypass_query needs a secret value or admin_allow")
+	}
+
 	return config, nil
 }
+
+var sizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"KB", 1 << 10},
+	{"MB", 1 << 20},
+	{"GB", 1 << 30},
+	{"B", 1},
+}
+
+// parseSize accepts a number of bytes or a size like 512KB, 100MB or 1GB
+func parseSize(value string) (int64, error) {
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(strings.ToUpper(value), unit.suffix) {
+			number, err := strconv.ParseInt(value[:len(value)-len(unit.suffix)], 10, 64)
+			return number * unit.multiplier, err
+		}
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// parseNetwork accepts a CIDR like 10.0.0.0/8 or a single ip
+func parseNetwork(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		return network, err
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, errors.New("invalid ip " + value)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(8*net.IPv4len, 8*net.IPv4len)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(8*net.IPv6len, 8*net.IPv6len)}, nil
+}
@@ -1,7 +1,13 @@
 package cache
 
 import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -21,6 +27,8 @@ func TestParsingConfig(t *testing.T) {
 			DefaultMaxAge:    defaultMaxAge,
 			CacheRules:       []CacheRule{},
 			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
 		}},
 		{"cache {\n match_path /assets \n} }", false, Config{
 			StatusHeader:     defaultStatusHeader,
@@ -28,6 +36,8 @@ func TestParsingConfig(t *testing.T) {
 			DefaultMaxAge:    defaultMaxAge,
 			CacheRules:       []CacheRule{&PathCacheRule{Path: "/assets"}},
 			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
 		}},
 		{"cache {\n match_path /assets \n match_path /api \n} \n}", false, Config{
 			StatusHeader:  defaultStatusHeader,
@@ -38,6 +48,8 @@ func TestParsingConfig(t *testing.T) {
 				&PathCacheRule{Path: "/api"},
 			},
 			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
 		}},
 		{"cache {\n match_header Content-Type image/png image/gif \n match_path /assets \n}", false, Config{
 			StatusHeader:  defaultStatusHeader,
@@ -48,6 +60,8 @@ func TestParsingConfig(t *testing.T) {
 				&PathCacheRule{Path: "/assets"},
 			},
 			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
 		}},
 		{"cache {\n status_header X-Custom-Header \n}", false, Config{
 			StatusHeader:     "X-Custom-Header",
@@ -55,6 +69,8 @@ func TestParsingConfig(t *testing.T) {
 			DefaultMaxAge:    defaultMaxAge,
 			CacheRules:       []CacheRule{},
 			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
 		}},
 		{"cache {\n path /tmp/caddy \n}", false, Config{
 			StatusHeader:     defaultStatusHeader,
@@ -63,6 +79,8 @@ func TestParsingConfig(t *testing.T) {
 			CacheRules:       []CacheRule{},
 			Path:             "/tmp/caddy",
 			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
 		}},
 		{"cache {\n lock_timeout 1s \n}", false, Config{
 			StatusHeader:     defaultStatusHeader,
@@ -70,6 +88,8 @@ func TestParsingConfig(t *testing.T) {
 			DefaultMaxAge:    defaultMaxAge,
 			CacheRules:       []CacheRule{},
 			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
 		}},
 		{"cache {\n default_max_age 1h \n}", false, Config{
 			StatusHeader:     defaultStatusHeader,
@@ -77,6 +97,8 @@ func TestParsingConfig(t *testing.T) {
 			DefaultMaxAge:    time.Duration(1) * time.Hour,
 			CacheRules:       []CacheRule{},
 			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
 		}},
 		{"cache {\n cache_key \"{scheme} {host}{uri}\" \n}", false, Config{
 			StatusHeader:     defaultStatusHeader,
@@ -84,6 +106,746 @@ func TestParsingConfig(t *testing.T) {
 			DefaultMaxAge:    defaultMaxAge,
 			CacheRules:       []CacheRule{},
 			CacheKeyTemplate: "{scheme} {host}{uri}",
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+		}},
+		{"cache {\n serve_stale_on_error \n max_stale 10m \n}", false, Config{
+			StatusHeader:      defaultStatusHeader,
+			LockTimeout:       defaultLockTimeout,
+			DefaultMaxAge:     defaultMaxAge,
+			CacheRules:        []CacheRule{},
+			CacheKeyTemplate:  defaultCacheKeyTemplate,
+			ServeStaleOnError: true,
+			MaxStale:          time.Duration(10) * time.Minute,
+			VaryDeny:          defaultVaryDeny,
+		}},
+		{"cache {\n grace 30s \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			Grace:            30 * time.Second,
+		}},
+		{"cache {\n vary_by_header x-cache-vary-by \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			VaryByHeader:     "X-Cache-Vary-By",
+		}},
+		{"cache {\n cache_methods get \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			CacheMethods:     []string{"GET"},
+		}},
+		{"cache {\n eviction lfu \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			Eviction:         "lfu",
+		}},
+		{"cache {\n maintenance \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			Maintenance:      true,
+		}},
+		{"cache {\n max_open_files 512 \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			MaxOpenFiles:     512,
+		}},
+		{"cache {\n never_cache_status 400 401 \n never_cache_status 403 \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			NeverCacheStatus: []int{400, 401, 403},
+		}},
+		{"cache {\n purge_tombstone 30s \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			PurgeTombstone:   30 * time.Second,
+		}},
+		{"cache {\n max_stale_age 10m \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			MaxStaleAge:      10 * time.Minute,
+		}},
+		{"cache {\n fetch_retries 2 \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			FetchRetries:     2,
+		}},
+		{"cache {\n fetch_retries 3 50ms \n}", false, Config{
+			StatusHeader:      defaultStatusHeader,
+			LockTimeout:       defaultLockTimeout,
+			DefaultMaxAge:     defaultMaxAge,
+			CacheRules:        []CacheRule{},
+			CacheKeyTemplate:  defaultCacheKeyTemplate,
+			MaxStale:          defaultMaxStale,
+			VaryDeny:          defaultVaryDeny,
+			FetchRetries:      3,
+			FetchRetryBackoff: 50 * time.Millisecond,
+		}},
+		{"cache {\n debug_ttl_header \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			DebugTTLHeader:   defaultDebugTTLHeader,
+		}},
+		{"cache {\n debug_ttl_header X-Debug-TTL \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			DebugTTLHeader:   "X-Debug-TTL",
+		}},
+		{"cache {\n key_version 42 \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			KeyVersion:       NewKeyVersion("42"),
+		}},
+		{"cache {\n write_timeout 2s \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			WriteTimeout:     2 * time.Second,
+		}},
+		{"cache {\n cache_if_header X-Cacheable 1 yes \n skip_if_header Set-Cookie \n header_conditions all \n}", false, Config{
+			StatusHeader:        defaultStatusHeader,
+			LockTimeout:         defaultLockTimeout,
+			DefaultMaxAge:       defaultMaxAge,
+			CacheRules:          []CacheRule{},
+			CacheKeyTemplate:    defaultCacheKeyTemplate,
+			MaxStale:            defaultMaxStale,
+			VaryDeny:            defaultVaryDeny,
+			CacheIfHeader:       []HeaderCondition{{Header: "X-Cacheable", Values: []string{"1", "yes"}}},
+			SkipIfHeader:        []HeaderCondition{{Header: "Set-Cookie", Values: []string{}}},
+			HeaderConditionsAll: true,
+		}},
+		{"cache {\n honor_clear_site_data \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			ClearSiteData:    clearSiteDataDirectory,
+		}},
+		{"cache {\n honor_clear_site_data host \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			ClearSiteData:    clearSiteDataHost,
+		}},
+		{"cache {\n event_webhook https://events.example.com/cache \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			EventSink:        NewWebhookSink("https://events.example.com/cache"),
+		}},
+		{"cache {\n age_cap 24h \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			AgeCap:           24 * time.Hour,
+		}},
+		{"cache {\n admission 2 \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			Admission:        2,
+		}},
+		{"cache {\n admin_path /_cache/ \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			AdminPath:        "/_cache",
+		}},
+		{"cache {\n ttl_header X-Cache-TTL \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			TTLHeader:        "X-Cache-TTL",
+		}},
+		{"cache {\n preserve_header_case \n}", false, Config{
+			StatusHeader:       defaultStatusHeader,
+			LockTimeout:        defaultLockTimeout,
+			DefaultMaxAge:      defaultMaxAge,
+			CacheRules:         []CacheRule{},
+			CacheKeyTemplate:   defaultCacheKeyTemplate,
+			MaxStale:           defaultMaxStale,
+			VaryDeny:           defaultVaryDeny,
+			PreserveHeaderCase: true,
+		}},
+		{"cache {\n metrics_by_host \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			MetricsByHost:    true,
+		}},
+		{"cache {\n collapse_timeout 500ms \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			CollapseTimeout:  500 * time.Millisecond,
+		}},
+		{"cache {\n body_timeout 30s \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			BodyTimeout:      30 * time.Second,
+		}},
+		{"cache {\n continue_on_disconnect off \n}", false, Config{
+			StatusHeader:      defaultStatusHeader,
+			LockTimeout:       defaultLockTimeout,
+			DefaultMaxAge:     defaultMaxAge,
+			CacheRules:        []CacheRule{},
+			CacheKeyTemplate:  defaultCacheKeyTemplate,
+			MaxStale:          defaultMaxStale,
+			VaryDeny:          defaultVaryDeny,
+			AbortOnDisconnect: true,
+		}},
+		{"cache {\n storage null \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			NullStorage:      true,
+		}},
+		{"cache {\n bypass_query nocache secret \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			BypassQuery:      "nocache",
+			BypassQueryValue: "secret",
+		}},
+		{"cache {\n key_headers x-tenant Accept-Language \n key_headers X-Tenant \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			KeyHeaders:       []string{"Accept-Language", "X-Tenant"},
+		}},
+		{"cache {\n storage_path /api/ fast \n storage_path /images/ images \n storage_backend fast memory \n storage_backend images disk /tmp/images \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			StorageBackends: map[string]StorageBackend{
+				"fast":   {Memory: true},
+				"images": {Path: "/tmp/images"},
+			},
+			StorageRules: []StorageRule{{Path: "/api/", Backend: "fast"}, {Path: "/images/", Backend: "images"}},
+		}},
+		{"cache {\n key_accept \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			KeyAccept:        true,
+		}},
+		{"cache {\n key_merge_head \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			KeyMergeHead:     true,
+		}},
+		{"cache {\n strip_headers set-cookie X-Backend-Server \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			StripHeaders:     []string{"Set-Cookie", "X-Backend-Server"},
+		}},
+		{"cache {\n add_headers_on_hit x-served-by cache-1 \n add_headers_on_hit X-Served-By \"edge a\" \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			HitHeaders:       http.Header{"X-Served-By": {"cache-1", "edge a"}},
+		}},
+		{"cache {\n fallback_response README.md 500 \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			Fallback: func() *FallbackResponse {
+				fallback, _ := NewFallbackResponse("README.md", 500)
+				return fallback
+			}(),
+		}},
+		{"cache {\n cache_authorized \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			CacheAuthorized:  true,
+		}},
+		{"cache {\n vary_empty refuse \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			RefuseEmptyVary:  true,
+		}},
+		{"cache {\n gzip_dedup \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			GzipDedup:        true,
+		}},
+		{"cache {\n compress_store \n compress_allow video/mp2t \n compress_deny Text/Event-Stream application/x-protobuf \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			CompressStore:    true,
+			CompressAllow:    []string{"video/mp2t"},
+			CompressDeny:     []string{"text/event-stream", "application/x-protobuf"},
+		}},
+		{"cache {\n strict_freshness \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			StrictFreshness:  true,
+		}},
+		{"cache {\n honor_content_location \n}", false, Config{
+			StatusHeader:         defaultStatusHeader,
+			LockTimeout:          defaultLockTimeout,
+			DefaultMaxAge:        defaultMaxAge,
+			CacheRules:           []CacheRule{},
+			CacheKeyTemplate:     defaultCacheKeyTemplate,
+			MaxStale:             defaultMaxStale,
+			VaryDeny:             defaultVaryDeny,
+			HonorContentLocation: true,
+		}},
+		{"cache {\n vary_deny user-agent Cookie \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         []string{"User-Agent", "Cookie"},
+		}},
+		{"cache {\n vary_deny off \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         []string{},
+		}},
+		{"cache {\n vary_language en fr pt-BR \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			VaryLanguage:     &LanguageNormalizer{Supported: []string{"en", "fr", "pt-br"}},
+		}},
+		{"cache {\n vary_device \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			VaryDevice:       NewDeviceClassifier(),
+		}},
+		{"cache {\n vary_device mobile (?i)phone \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			VaryDevice: func() *DeviceClassifier {
+				classifier := NewDeviceClassifier()
+				classifier.Override("mobile", "(?i)phone")
+				return classifier
+			}(),
+		}},
+		{"cache {\n vary_user_agent \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			VaryUserAgent:    NewUserAgentBucketer(),
+		}},
+		{"cache {\n vary_user_agent myapp-$1 MyApp/(\\d+) \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			VaryUserAgent: func() *UserAgentBucketer {
+				bucketer := NewUserAgentBucketer()
+				bucketer.Add("myapp-$1", `MyApp/(\d+)`)
+				return bucketer
+			}(),
+		}},
+		{"cache {\n range_assembly \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			RangeAssembly:    true,
+		}},
+		{"cache {\n vary_cookie honor \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			VaryCookie:       VaryCookieHonor,
+		}},
+		{"cache {\n vary_cookie only session lang \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			VaryCookie:       VaryCookieSubset,
+			VaryCookieNames:  []string{"session", "lang"},
+		}},
+		{"cache {\n admin_token secret \n admin_allow 10.0.0.0/8 127.0.0.1 \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			AdminToken:       "secret",
+			AdminTokenHeader: defaultAdminTokenHeader,
+			AdminAllow: []*net.IPNet{
+				{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)},
+				{IP: net.IP{127, 0, 0, 1}, Mask: net.CIDRMask(32, 32)},
+			},
+		}},
+		{"cache {\n admin_token secret X-Admin-Token \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			AdminToken:       "secret",
+			AdminTokenHeader: "X-Admin-Token",
+		}},
+		{"cache {\n purge_redis localhost:6379 \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			PurgeRedis:       "localhost:6379",
+			PurgeChannel:     defaultPurgeChannel,
+		}},
+		{"cache {\n purge_redis redis://:pass@localhost:6379 purges \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			PurgeRedis:       "redis://:pass@localhost:6379",
+			PurgeChannel:     "purges",
+		}},
+		{"cache {\n log_events summary \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			EventLog:         EventLogSummary,
+		}},
+		{"cache {\n log_events verbose json \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			EventLog:         EventLogVerbose,
+			EventLogJSON:     true,
+		}},
+		{"cache {\n per_host_max_entries 100 \n per_host_max_size 10MB \n}", false, Config{
+			StatusHeader:      defaultStatusHeader,
+			LockTimeout:       defaultLockTimeout,
+			DefaultMaxAge:     defaultMaxAge,
+			CacheRules:        []CacheRule{},
+			CacheKeyTemplate:  defaultCacheKeyTemplate,
+			MaxStale:          defaultMaxStale,
+			VaryDeny:          defaultVaryDeny,
+			PerHostMaxEntries: 100,
+			PerHostMaxSize:    10 << 20,
+		}},
+		{"cache {\n max_concurrent_fetches 100 \n}", false, Config{
+			StatusHeader:         defaultStatusHeader,
+			LockTimeout:          defaultLockTimeout,
+			DefaultMaxAge:        defaultMaxAge,
+			CacheRules:           []CacheRule{},
+			CacheKeyTemplate:     defaultCacheKeyTemplate,
+			MaxStale:             defaultMaxStale,
+			VaryDeny:             defaultVaryDeny,
+			MaxConcurrentFetches: 100,
+			RetryAfter:           defaultRetryAfter,
+		}},
+		{"cache {\n max_concurrent_fetches 100 30s \n}", false, Config{
+			StatusHeader:         defaultStatusHeader,
+			LockTimeout:          defaultLockTimeout,
+			DefaultMaxAge:        defaultMaxAge,
+			CacheRules:           []CacheRule{},
+			CacheKeyTemplate:     defaultCacheKeyTemplate,
+			MaxStale:             defaultMaxStale,
+			VaryDeny:             defaultVaryDeny,
+			MaxConcurrentFetches: 100,
+			RetryAfter:           30 * time.Second,
+		}},
+		{"cache {\n max_variants 8 \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			MaxVariants:      8,
+		}},
+		{"cache {\n memory_tier_size 64MB \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			MemoryTierSize:   64 << 20,
+		}},
+		{"cache {\n memory_spill_size 256KB \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			MemorySpillSize:  256 << 10,
+		}},
+		{"cache {\n mmap_min_size 1MB \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			MmapMinSize:      1 << 20,
+		}},
+		{"cache {\n min_body_size 512 \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			MinBodySize:      512,
+		}},
+		{"cache {\n warm http://example.com/a http://example.com/b \n warm_file /etc/urls \n warm_concurrency 2 \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			WarmURLs:         []string{"http://example.com/a", "http://example.com/b"},
+			WarmFiles:        []string{"/etc/urls"},
+			WarmConcurrency:  2,
+		}},
+		{"cache {\n refresh_schedule http://example.com/ 30s \n refresh_schedule http://example.com/news 1m \n refresh_concurrency 2 \n}", false, Config{
+			StatusHeader:     defaultStatusHeader,
+			LockTimeout:      defaultLockTimeout,
+			DefaultMaxAge:    defaultMaxAge,
+			CacheRules:       []CacheRule{},
+			CacheKeyTemplate: defaultCacheKeyTemplate,
+			MaxStale:         defaultMaxStale,
+			VaryDeny:         defaultVaryDeny,
+			RefreshSchedules: []RefreshSchedule{
+				{URL: "http://example.com/", Interval: 30 * time.Second},
+				{URL: "http://example.com/news", Interval: time.Minute},
+			},
+			RefreshConcurrency: 2,
 		}},
 		{"cache {\n match_header aheader \n}", true, Config{}},          // match_header without value
 		{"cache {\n lock_timeout aheader \n}", true, Config{}},          // lock_timeout with invalid duration
@@ -95,6 +857,90 @@ func TestParsingConfig(t *testing.T) {
 		{"cache {\n invalid / ea \n}", true, Config{}},                  // Invalid directive
 		{"cache {\n path \n}", true, Config{}},                          // Path without arguments
 		{"cache {\n cache_key \n}", true, Config{}},                     // cache_key without arguments
+		{"cache {\n serve_stale_on_error yes \n}", true, Config{}},      // serve_stale_on_error does not take arguments
+		{"cache {\n max_stale forever \n}", true, Config{}},             // max_stale with invalid duration
+		{"cache {\n grace soon \n}", true, Config{}},                    // grace with invalid duration
+		{"cache {\n grace -1m \n}", true, Config{}},                     // grace with negative duration
+		{"cache {\n max_stale_age 0s \n}", true, Config{}},              // max_stale_age must be positive
+		{"cache {\n purge_tombstone soon \n}", true, Config{}},          // purge_tombstone with an invalid duration
+		{"cache {\n fetch_retries 0 \n}", true, Config{}},               // fetch_retries must be positive
+		{"cache {\n fetch_retries 2 soon \n}", true, Config{}},          // fetch_retries with an invalid backoff
+		{"cache {\n debug_ttl_header X-A X-B \n}", true, Config{}},      // debug_ttl_header takes one name
+		{"cache {\n debug_ttl_header X:TTL \n}", true, Config{}},        // debug_ttl_header with an invalid name
+		{"cache {\n key_version \n}", true, Config{}},                   // key_version needs a version
+		{"cache {\n write_timeout 0s \n}", true, Config{}},              // write_timeout must be positive
+		{"cache {\n skip_if_header \n}", true, Config{}},
+		{"cache {\n header_conditions some \n}", true, Config{}},
+		{"cache {\n honor_clear_site_data site \n}", true, Config{}},
+		{"cache {\n event_webhook events.example.com \n}", true, Config{}},
+		{"cache {\n age_cap 500ms \n}", true, Config{}},
+		{"cache {\n admission 0 \n}", true, Config{}},
+		{"cache {\n maintenance on \n}", true, Config{}},           // maintenance has no arguments
+		{"cache {\n max_open_files 0 \n}", true, Config{}},         // max_open_files must be positive
+		{"cache {\n never_cache_status \n}", true, Config{}},       // never_cache_status without statuses
+		{"cache {\n never_cache_status 4xx \n}", true, Config{}},   // never_cache_status with an invalid status
+		{"cache {\n never_cache_status 700 \n}", true, Config{}},   // never_cache_status with an unknown status
+		{"cache {\n admin_path / \n}", true, Config{}},             // admin_path can not be the root
+		{"cache {\n ttl_header \n}", true, Config{}},               // ttl_header without arguments
+		{"cache {\n preserve_header_case yes \n}", true, Config{}}, // preserve_header_case does not take arguments
+		{"cache {\n admin_token \n}", true, Config{}},              // admin_token without arguments
+		{"cache {\n admin_allow 10.0.0.300 \n}", true, Config{}},   // admin_allow with an invalid ip
+		{"cache {\n purge_redis \n}", true, Config{}},              // purge_redis without arguments
+		{"cache {\n log_events everything \n}", true, Config{}},    // log_events with an invalid level
+		{"cache {\n log_events verbose xml \n}", true, Config{}},   // log_events with an invalid format
+		{"cache {\n per_host_max_entries 0 \n}", true, Config{}},   // per_host_max_entries must be positive
+		{"cache {\n max_variants none \n}", true, Config{}},        // max_variants must be a number
+		{"cache {\n eviction random \n}", true, Config{}},
+		{"cache {\n cache_methods \n}", true, Config{}},                          // cache_methods without methods
+		{"cache {\n cache_methods GET POST \n}", true, Config{}},                 // cache_methods with a method that is not cacheable                         // eviction with an unknown policy
+		{"cache {\n max_concurrent_fetches 0 \n}", true, Config{}},               // max_concurrent_fetches must be positive
+		{"cache {\n max_concurrent_fetches 10 500ms \n}", true, Config{}},        // Retry-After is sent in seconds
+		{"cache {\n per_host_max_size 10XB \n}", true, Config{}},                 // per_host_max_size with an invalid size
+		{"cache {\n memory_tier_size \n}", true, Config{}},                       // memory_tier_size without arguments
+		{"cache {\n strict_freshness on \n}", true, Config{}},                    // strict_freshness has no arguments
+		{"cache {\n gzip_dedup yes \n}", true, Config{}},                         // gzip_dedup has no arguments
+		{"cache {\n compress_store yes \n}", true, Config{}},                     // compress_store has no arguments
+		{"cache {\n compress_deny \n}", true, Config{}},                          // compress_deny without types
+		{"cache {\n vary_empty skip \n}", true, Config{}},                        // vary_empty with an invalid mode
+		{"cache {\n memory_spill_size 0 \n}", true, Config{}},                    // memory_spill_size must be positive
+		{"cache {\n mmap_min_size big \n}", true, Config{}},                      // mmap_min_size with an invalid size
+		{"cache {\n min_body_size -1 \n}", true, Config{}},                       // min_body_size must be positive
+		{"cache {\n warm \n}", true, Config{}},                                   // warm without urls
+		{"cache {\n warm_concurrency 0 \n}", true, Config{}},                     // warm_concurrency must be positive
+		{"cache {\n bypass_query nocache \n}", true, Config{}},                   // bypass_query without a guard
+		{"cache {\n storage memory \n}", true, Config{}},                         // storage with an unknown storage
+		{"cache {\n collapse_timeout soon \n}", true, Config{}},                  // collapse_timeout with an invalid duration
+		{"cache {\n body_timeout 0s \n}", true, Config{}},                        // body_timeout must be positive
+		{"cache {\n continue_on_disconnect maybe \n}", true, Config{}},           // continue_on_disconnect is on or off
+		{"cache {\n fallback_response /does/not/exist.html \n}", true, Config{}}, // fallback_response with a missing file
+		{"cache {\n fallback_response README.md 99 \n}", true, Config{}},         // fallback_response with an invalid code
+		{"cache {\n cache_authorized yes \n}", true, Config{}},                   // cache_authorized does not take arguments
+		{"cache {\n honor_content_location yes \n}", true, Config{}},             // honor_content_location does not take arguments
+		{"cache {\n key_headers \n}", true, Config{}},                            // key_headers without names
+		{"cache {\n vary_by_header x:y \n}", true, Config{}},                     // vary_by_header with an invalid header name
+		{"cache {\n key_accept json \n}", true, Config{}},                        // key_accept does not take arguments
+		{"cache {\n key_merge_head yes \n}", true, Config{}},                     // key_merge_head does not take arguments
+		{"cache {\n strip_headers \n}", true, Config{}},                          // strip_headers without names
+		{"cache {\n strip_headers X-Backend: \n}", true, Config{}},               // strip_headers with an invalid name
+		{"cache {\n add_headers_on_hit X-Served-By \n}", true, Config{}},         // add_headers_on_hit without a value
+		{"cache {\n add_headers_on_hit X@Y cache \n}", true, Config{}},           // add_headers_on_hit with an invalid name
+		{"cache {\n storage_path /api/ fast \n}", true, Config{}},                // storage_path with an unknown backend
+		{"cache {\n storage_backend fast redis \n}", true, Config{}},             // storage_backend with an unknown type
+		{"cache {\n storage_backend images disk \n}", true, Config{}},            // storage_backend disk without directory
+		{"cache {\n storage_path /api/ \n}", true, Config{}},                     // storage_path without backend
+		{"cache {\n vary_language \n}", true, Config{}},                          // vary_language without languages
+		{"cache {\n vary_language en fr_FR \n}", true, Config{}},                 // vary_language with an invalid tag
+		{"cache {\n vary_device mobile \n}", true, Config{}},                     // vary_device without pattern
+		{"cache {\n vary_device watch (?i)watch \n}", true, Config{}},            // vary_device with unknown class
+		{"cache {\n vary_device tablet ( \n}", true, Config{}},
+		{"cache {\n vary_user_agent myapp \n}", true, Config{}},                   // vary_user_agent without pattern
+		{"cache {\n vary_user_agent myapp ( \n}", true, Config{}},                 // vary_user_agent with invalid regex                    // vary_device with invalid regex
+		{"cache {\n vary_cookie \n}", true, Config{}},                             // vary_cookie without mode
+		{"cache {\n vary_cookie sometimes \n}", true, Config{}},                   // vary_cookie invalid mode
+		{"cache {\n vary_cookie only \n}", true, Config{}},                        // vary_cookie only without names
+		{"cache {\n vary_deny \n}", true, Config{}},                               // vary_deny without names
+		{"cache {\n refresh_schedule http://example.com/ \n}", true, Config{}},    // refresh_schedule without interval
+		{"cache {\n refresh_schedule http://example.com/ 0s \n}", true, Config{}}, // refresh_schedule interval must be positive
 	}
 
 	for i, test := range tests {
@@ -112,3 +958,53 @@ func TestParsingConfig(t *testing.T) {
 	}
 
 }
+
+func TestPreparePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy-cache-path")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	t.Run("it should create the missing directories", func(t *testing.T) {
+		path := filepath.Join(dir, "a", "b")
+		prepared, err := preparePath(path)
+		require.NoError(t, err)
+		require.Equal(t, path, prepared)
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.True(t, info.IsDir())
+
+		// The file used to check it is writable is removed
+		files, err := ioutil.ReadDir(path)
+		require.NoError(t, err)
+		require.Empty(t, files)
+	})
+
+	t.Run("it should fail if the path can not be written", func(t *testing.T) {
+		file := filepath.Join(dir, "file")
+		require.NoError(t, ioutil.WriteFile(file, []byte("abc"), 0600))
+
+		_, err := preparePath(filepath.Join(file, "cache"))
+		require.Error(t, err)
+
+		// Root can write in any directory, so only a file can't be written as a directory
+		if os.Geteuid() != 0 {
+			readOnly := filepath.Join(dir, "read-only")
+			require.NoError(t, os.Mkdir(readOnly, 0500))
+			_, err := preparePath(readOnly)
+			require.Error(t, err)
+		}
+	})
+
+	t.Run("it should use a new temp directory if there is no path", func(t *testing.T) {
+		prepared, err := preparePath("")
+		require.NoError(t, err)
+		defer os.RemoveAll(prepared)
+
+		require.True(t, strings.HasPrefix(prepared, filepath.Join(os.TempDir(), "caddy-cache-")))
+		other, err := preparePath("")
+		require.NoError(t, err)
+		defer os.RemoveAll(other)
+		require.NotEqual(t, prepared, other)
+	})
+}
@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var countedStatuses = []string{cacheHit, cacheMiss, cacheSkip, cacheStale, cacheBypass, cacheOverloaded, cacheMaintenance}
+
+// cacheCounters count what the cache did since it was created.
+// They are only accessed atomically, so reading them never waits for the requests
+type cacheCounters struct {
+	evicted  int64 // entries removed by the host quotas and max_variants
+	purged   int64 // entries removed by purges and flushes
+	eviction string
+
+	rangeHits           int64 // 206 responses sent from saved bodies or segments without going to upstream
+	rangeBytes          int64 // bytes sent in those responses, overlapping ranges count each time they are sent
+	unsatisfiableRanges int64 // 416 responses to ranges outside a saved body
+	abandonedWrites     int64 // bodies that were not saved because write_timeout abandoned their storage
+
+	// responses by cache status, the map is not modified after it is created
+	responses map[string]*int64
+	started   time.Time
+}
+
+func newCacheCounters(eviction string) *cacheCounters {
+	responses := map[string]*int64{}
+	for _, status := range countedStatuses {
+		responses[status] = new(int64)
+	}
+	return &cacheCounters{responses: responses, started: time.Now(), eviction: eviction}
+}
+
+func (counters *cacheCounters) responded(status string) {
+	if counter, ok := counters.responses[status]; ok {
+		atomic.AddInt64(counter, 1)
+	}
+}
+
+func (counters *cacheCounters) responsesWith(status string) int64 {
+	return atomic.LoadInt64(counters.responses[status])
+}
+
+func (counters *cacheCounters) addEvicted(entries int) {
+	atomic.AddInt64(&counters.evicted, int64(entries))
+}
+
+func (counters *cacheCounters) addPurged(entries int) {
+	atomic.AddInt64(&counters.purged, int64(entries))
+}
+
+// servedRange counts a partial hit that sent length bytes of a saved body
+func (counters *cacheCounters) servedRange(length int64) {
+	atomic.AddInt64(&counters.rangeHits, 1)
+	atomic.AddInt64(&counters.rangeBytes, length)
+}
+
+func (counters *cacheCounters) unsatisfiableRange() {
+	atomic.AddInt64(&counters.unsatisfiableRanges, 1)
+}
+
+func (counters *cacheCounters) abandonedWrite() {
+	atomic.AddInt64(&counters.abandonedWrites, 1)
+}
+
+// write writes the counters in the prometheus text format
+func (counters *cacheCounters) write(w io.Writer) {
+	name := "caddy_cache_responses_total"
+	fmt.Fprintf(w, "# HELP %s Responses sent by the cache.\n# TYPE %s counter\n", name, name)
+	for _, status := range countedStatuses {
+		fmt.Fprintf(w, "%s{status=\"%s\"} %d\n", name, status, counters.responsesWith(status))
+	}
+	name = "caddy_cache_evicted_entries_total"
+	fmt.Fprintf(w, "# HELP %s Entries removed by the host quotas and max_variants.\n# TYPE %s counter\n", name, name)
+	fmt.Fprintf(w, "%s{policy=\"%s\"} %d\n", name, counters.eviction, atomic.LoadInt64(&counters.evicted))
+	writeCounter(w, "caddy_cache_purged_entries_total", "Entries removed by purges and flushes.", atomic.LoadInt64(&counters.purged))
+	writeCounter(w, "caddy_cache_range_hits_total", "Partial responses sent from the cache.", atomic.LoadInt64(&counters.rangeHits))
+	writeCounter(w, "caddy_cache_range_served_bytes_total", "Bytes sent in partial responses from the cache.", atomic.LoadInt64(&counters.rangeBytes))
+	writeCounter(w, "caddy_cache_unsatisfiable_ranges_total", "Range requests answered with 416.", atomic.LoadInt64(&counters.unsatisfiableRanges))
+	writeCounter(w, "caddy_cache_abandoned_writes_total", "Bodies not saved because writing them took more than write_timeout.", atomic.LoadInt64(&counters.abandonedWrites))
+}
+
+func writeCounter(w io.Writer, name string, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+}
+
+// CacheStats is what the cache did since it started and how much it has saved, it is sent by /_cache/stats
+type CacheStats struct {
+	Entries             int     `json:"entries"`
+	Size                int64   `json:"size"`
+	Hits                int64   `json:"hits"`
+	Misses              int64   `json:"misses"`
+	Skips               int64   `json:"skips"`
+	Stale               int64   `json:"stale"`
+	Bypasses            int64   `json:"bypasses"`
+	Overloaded          int64   `json:"overloaded"`
+	Maintenance         int64   `json:"maintenance"`
+	Evicted             int64   `json:"evicted"`
+	EvictionPolicy      string  `json:"evictionPolicy"`
+	Purged              int64   `json:"purged"`
+	RangeHits           int64   `json:"rangeHits"`
+	RangeBytes          int64   `json:"rangeBytes"`
+	UnsatisfiableRanges int64   `json:"unsatisfiableRanges"`
+	AbandonedWrites     int64   `json:"abandonedWrites"`
+	UptimeSeconds       float64 `json:"uptimeSeconds"`
+	AverageFetchSeconds float64 `json:"averageFetchSeconds"`
+}
+
+// stats returns a snapshot of the counters and the usage of the hosts
+func (handler *Handler) stats() CacheStats {
+	counters := handler.Cache.counters
+	result := CacheStats{
+		Hits:                counters.responsesWith(cacheHit),
+		Misses:              counters.responsesWith(cacheMiss),
+		Skips:               counters.responsesWith(cacheSkip),
+		Stale:               counters.responsesWith(cacheStale),
+		Bypasses:            counters.responsesWith(cacheBypass),
+		Overloaded:          counters.responsesWith(cacheOverloaded),
+		Maintenance:         counters.responsesWith(cacheMaintenance),
+		Evicted:             atomic.LoadInt64(&counters.evicted),
+		EvictionPolicy:      counters.eviction,
+		Purged:              atomic.LoadInt64(&counters.purged),
+		RangeHits:           atomic.LoadInt64(&counters.rangeHits),
+		RangeBytes:          atomic.LoadInt64(&counters.rangeBytes),
+		UnsatisfiableRanges: atomic.LoadInt64(&counters.unsatisfiableRanges),
+		AbandonedWrites:     atomic.LoadInt64(&counters.abandonedWrites),
+		UptimeSeconds:       time.Since(counters.started).Seconds(),
+		AverageFetchSeconds: handler.Metrics.averageFetch(),
+	}
+
+	for _, usage := range handler.Cache.HostsUsage() {
+		result.Entries += usage.Entries
+		result.Size += usage.Size
+	}
+	return result
+}
+
+func (handler *Handler) serveStats(w http.ResponseWriter) (int, error) {
+	return writeJSON(w, handler.stats())
+}
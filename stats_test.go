@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	getStats := func(h *Handler) CacheStats {
+		res := doAdminRequest(t, h, "GET", "http://example.com/_cache/stats")
+		requireCode(t, res, 200)
+		result := CacheStats{}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+		return result
+	}
+
+	newHandler := func(config *Config) *Handler {
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			if r.URL.Path == "/private" {
+				w.Header().Add("Cache-control", "private")
+			} else {
+				w.Header().Add("Cache-control", "max-age=10")
+			}
+			w.Write([]byte("abc"))
+			return 200, nil
+		}), config)
+	}
+
+	serve := func(h *Handler, method string, target string) {
+		_, err := h.ServeHTTP(httptest.NewRecorder(), newRequestWithOriginalURL(t, method, target))
+		require.NoError(t, err)
+	}
+
+	t.Run("it should count the responses and the removed entries", func(t *testing.T) {
+		h := newHandler(newAdminConfig())
+
+		serve(h, "GET", "http://example.com/a")
+		serve(h, "GET", "http://example.com/a")
+		serve(h, "GET", "http://example.com/a")
+		serve(h, "GET", "http://example.com/b")
+		serve(h, "GET", "http://example.com/private")
+		serve(h, "GET", "http://example.com/private")
+		serve(h, "POST", "http://example.com/c")
+
+		// The size and the latency are known once the bodies are received
+		require.Eventually(t, func() bool {
+			stats := getStats(h)
+			return stats.Size == 6 && stats.AverageFetchSeconds > 0
+		}, time.Second, 10*time.Millisecond)
+
+		stats := getStats(h)
+		require.Equal(t, 2, stats.Entries)
+		require.Equal(t, int64(2), stats.Hits)
+		require.Equal(t, int64(3), stats.Misses)
+		require.Equal(t, int64(1), stats.Skips)
+		require.Equal(t, int64(1), stats.Bypasses)
+		require.Equal(t, int64(0), stats.Purged)
+		require.True(t, stats.UptimeSeconds > 0)
+
+		requireCode(t, doAdminRequest(t, h, "PURGE", "http://example.com/a"), 200)
+		stats = getStats(h)
+		require.Equal(t, 1, stats.Entries)
+		require.Equal(t, int64(1), stats.Purged)
+
+		res := doAdminRequest(t, h, "GET", "http://example.com/_cache/metrics")
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(body), "caddy_cache_responses_total{status=\"hit\"} 2\n")
+		require.Contains(t, string(body), "caddy_cache_responses_total{status=\"miss\"} 3\n")
+		require.Contains(t, string(body), "caddy_cache_purged_entries_total 1\n")
+	})
+
+	t.Run("it should count every range served from a saved body", func(t *testing.T) {
+		h := newHandler(newAdminConfig())
+		serve(h, "GET", "http://example.com/a")
+
+		for _, value := range []string{"bytes=0-1", "bytes=1-2", "bytes=0-", "bytes=5-"} {
+			r := newRequestWithOriginalURL(t, "GET", "http://example.com/a")
+			r.Header.Set("Range", value)
+			_, err := h.ServeHTTP(httptest.NewRecorder(), r)
+			require.NoError(t, err)
+		}
+
+		// The overlapping ranges are sent again each time, the body is saved once
+		require.Eventually(t, func() bool {
+			return getStats(h).Size == 3
+		}, time.Second, 10*time.Millisecond)
+		stats := getStats(h)
+		require.Equal(t, int64(3), stats.RangeHits)
+		require.Equal(t, int64(7), stats.RangeBytes)
+		require.Equal(t, int64(1), stats.UnsatisfiableRanges)
+
+		res := doAdminRequest(t, h, "GET", "http://example.com/_cache/metrics")
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(body), "caddy_cache_range_hits_total 3\n")
+		require.Contains(t, string(body), "caddy_cache_range_served_bytes_total 7\n")
+		require.Contains(t, string(body), "caddy_cache_unsatisfiable_ranges_total 1\n")
+	})
+
+	t.Run("it should count the entries evicted by the quotas", func(t *testing.T) {
+		config := newAdminConfig()
+		config.PerHostMaxEntries = 1
+		h := newHandler(config)
+
+		serve(h, "GET", "http://example.com/a")
+		serve(h, "GET", "http://example.com/b")
+
+		stats := getStats(h)
+		require.Equal(t, 1, stats.Entries)
+		require.Equal(t, int64(1), stats.Evicted)
+	})
+
+	t.Run("it should require authorization", func(t *testing.T) {
+		h := newHandler(newAdminConfig())
+		res := doAdminRequestWithHeaders(t, h, "GET", "http://example.com/_cache/stats", http.Header{})
+		requireCode(t, res, 403)
+	})
+}
@@ -4,16 +4,40 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"sync"
 )
 
 // FileStorage saves the content into a file
 type FileStorage struct {
 	file         *os.File
 	subscription *Subscription
+
+	// Complete files of at least mmapMinSize bytes are read with mmap, 0 disables it
+	mmapMinSize int64
+
+	// limit bounds the readers open at the same time, it is nil without limit
+	limit *OpenFileLimit
+
+	lock    *sync.Mutex
+	size    int64
+	closed  bool
+	cleaned bool
+	mapped  *mappedFile
 }
 
 // NewFileStorage creates a new temp file that will be used as a the storage of the cache entry
 func NewFileStorage(path string) (ResponseStorage, error) {
+	return NewMappedFileStorage(path, 0)
+}
+
+// NewMappedFileStorage is like NewFileStorage but once the file is complete
+// it is read with mmap if it has at least mmapMinSize bytes
+func NewMappedFileStorage(path string, mmapMinSize int64) (ResponseStorage, error) {
+	return NewLimitedFileStorage(path, mmapMinSize, nil)
+}
+
+// NewLimitedFileStorage is like NewMappedFileStorage but its readers wait for a slot of the limit to open the file
+func NewLimitedFileStorage(path string, mmapMinSize int64, limit *OpenFileLimit) (ResponseStorage, error) {
 	file, err := ioutil.TempFile(path, "caddy-cache-")
 	if err != nil {
 		return nil, err
@@ -21,12 +45,20 @@ func NewFileStorage(path string) (ResponseStorage, error) {
 	return &FileStorage{
 		file:         file,
 		subscription: NewSubscription(),
+		mmapMinSize:  mmapMinSize,
+		limit:        limit,
+		lock:         new(sync.Mutex),
 	}, nil
 }
 
 func (f *FileStorage) Write(p []byte) (n int, err error) {
 	defer f.subscription.NotifyAll(len(p))
-	return f.file.Write(p)
+	n, err = f.file.Write(p)
+
+	f.lock.Lock()
+	f.size += int64(n)
+	f.lock.Unlock()
+	return n, err
 }
 
 // Flush syncs the underlying file
@@ -37,6 +69,15 @@ func (f *FileStorage) Flush() error {
 
 // Clean removes the file
 func (f *FileStorage) Clean() error {
+	f.lock.Lock()
+	f.cleaned = true
+	if f.mapped != nil {
+		// Mapped readers keep working until they are closed
+		f.mapped.release()
+		f.mapped = nil
+	}
+	f.lock.Unlock()
+
 	f.subscription.WaitAll() // Wait until every subscriber ends waiting every result
 	return os.Remove(f.file.Name())
 }
@@ -44,12 +85,21 @@ func (f *FileStorage) Clean() error {
 // Close the underlying file
 func (f *FileStorage) Close() error {
 	f.subscription.Close()
+
+	f.lock.Lock()
+	f.closed = true
+	f.lock.Unlock()
 	return f.file.Close()
 }
 
 // GetReader returns a new file descriptor to the same file
+// or a reader of the mapped file if it is complete and big enough
 func (f *FileStorage) GetReader() (io.ReadCloser, error) {
-	newFile, err := os.Open(f.file.Name())
+	if reader := f.getMappedReader(); reader != nil {
+		return reader, nil
+	}
+
+	newFile, err := f.limit.Open(f.file.Name())
 	if err != nil {
 		return nil, err
 	}
@@ -60,6 +110,28 @@ func (f *FileStorage) GetReader() (io.ReadCloser, error) {
 	}, nil
 }
 
+// getMappedReader returns nil if the file can't be mapped so it is read as usual
+func (f *FileStorage) getMappedReader() *MappedReader {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.mmapMinSize <= 0 || !f.closed || f.cleaned || f.size < f.mmapMinSize {
+		return nil
+	}
+
+	if f.mapped == nil {
+		mapped, err := newMappedFile(f.file.Name(), f.size)
+		if err != nil {
+			// Never try again, it will fail the same way
+			f.mmapMinSize = 0
+			return nil
+		}
+		f.mapped = mapped
+	}
+
+	return f.mapped.acquire()
+}
+
 /////////////////////////////////////////
 
 // FileReader is the common code to read the storages until the subscription channel is closed
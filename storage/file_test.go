@@ -84,3 +84,74 @@ func TestFileReader(t *testing.T) {
 		require.Equal(t, true, closed)
 	})
 }
+
+func TestMappedFileStorage(t *testing.T) {
+	newClosedStorage := func(t *testing.T, mmapMinSize int64, content []byte) *FileStorage {
+		s, err := NewMappedFileStorage("", mmapMinSize)
+		require.NoError(t, err)
+		s.Write(content)
+		s.Close()
+		return s.(*FileStorage)
+	}
+
+	t.Run("should map complete files of the minimum size", func(t *testing.T) {
+		s := newClosedStorage(t, 3, []byte("abcdef"))
+		defer s.Clean()
+
+		reader, err := s.GetReader()
+		require.NoError(t, err)
+		defer reader.Close()
+
+		_, isMapped := reader.(*MappedReader)
+		require.True(t, isMapped)
+		content, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, []byte("abcdef"), content)
+	})
+
+	t.Run("should read small files as usual", func(t *testing.T) {
+		s := newClosedStorage(t, 10, []byte("abcdef"))
+		defer s.Clean()
+
+		reader, err := s.GetReader()
+		require.NoError(t, err)
+		defer reader.Close()
+
+		_, isMapped := reader.(*MappedReader)
+		require.False(t, isMapped)
+	})
+
+	t.Run("should not map files that are being written", func(t *testing.T) {
+		s, err := NewMappedFileStorage("", 1)
+		require.NoError(t, err)
+		defer s.Clean()
+		s.Write([]byte("abc"))
+
+		reader, err := s.GetReader()
+		require.NoError(t, err)
+		_, isMapped := reader.(*MappedReader)
+		require.False(t, isMapped)
+		s.Close()
+		reader.Close()
+	})
+
+	t.Run("should keep reading after the file is cleaned", func(t *testing.T) {
+		s := newClosedStorage(t, 1, []byte("abcdef"))
+
+		reader, err := s.GetReader()
+		require.NoError(t, err)
+		mapped := s.mapped
+
+		require.NoError(t, s.Clean())
+		_, err = os.Stat(s.file.Name())
+		require.True(t, os.IsNotExist(err))
+
+		content, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, []byte("abcdef"), content)
+
+		require.NotNil(t, mapped.data)
+		reader.Close()
+		require.Nil(t, mapped.data)
+	})
+}
@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"compress/gzip"
+)
+
+// GzipStorage compresses the content before it is written to the wrapped storage.
+// Readers get the compressed content, it is decompressed by whoever needs it
+type GzipStorage struct {
+	ResponseStorage
+	writer *gzip.Writer
+}
+
+// NewGzipStorage creates a storage that saves the content compressed in the given one
+func NewGzipStorage(storage ResponseStorage) *GzipStorage {
+	return &GzipStorage{ResponseStorage: storage, writer: gzip.NewWriter(storage)}
+}
+
+func (s *GzipStorage) Write(p []byte) (int, error) {
+	return s.writer.Write(p)
+}
+
+// Flush writes the content compressed so far, so readers don't wait for the whole body
+func (s *GzipStorage) Flush() error {
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	return s.ResponseStorage.Flush()
+}
+
+// Close ends the compressed content and closes the wrapped storage
+func (s *GzipStorage) Close() error {
+	if err := s.writer.Close(); err != nil {
+		s.ResponseStorage.Close()
+		return err
+	}
+	return s.ResponseStorage.Close()
+}
+
+// Storage returns the storage where the compressed content is saved
+func (s *GzipStorage) Storage() ResponseStorage {
+	return s.ResponseStorage
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGzipStorage(t *testing.T) {
+	t.Run("should save the content compressed", func(t *testing.T) {
+		content := bytes.Repeat([]byte("compressible "), 1000)
+		s := NewGzipStorage(NewMemoryStorage())
+		s.Write(content[:500])
+		s.Write(content[500:])
+		require.NoError(t, s.Close())
+
+		compressed := readAll(t, s)
+		require.True(t, len(compressed) < len(content))
+
+		reader, err := gzip.NewReader(bytes.NewReader(compressed))
+		require.NoError(t, err)
+		decompressed, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, content, decompressed)
+	})
+
+	t.Run("should send what was written when it is flushed", func(t *testing.T) {
+		s := NewGzipStorage(NewMemoryStorage())
+		defer s.Clean()
+		s.Write([]byte("abc"))
+		require.NoError(t, s.Flush())
+
+		require.NotEmpty(t, s.Storage().(*SpillStorage).content)
+	})
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"sync"
+)
+
+// mappedFile is a file mapped in memory that is shared by every reader.
+// It is unmapped when the storage and every reader released it, so it can still
+// be read after the file is removed
+type mappedFile struct {
+	lock *sync.Mutex
+	data []byte
+	refs int
+}
+
+func newMappedFile(name string, size int64) (*mappedFile, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	// The mapping does not need the file to stay open
+	defer file.Close()
+
+	data, err := mmapFile(file, int(size))
+	if err != nil {
+		return nil, err
+	}
+
+	// The storage keeps a reference until it is cleaned
+	return &mappedFile{lock: new(sync.Mutex), data: data, refs: 1}, nil
+}
+
+func (m *mappedFile) acquire() *MappedReader {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.refs++
+	return &MappedReader{Reader: bytes.NewReader(m.data), mapped: m}
+}
+
+func (m *mappedFile) release() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.refs--
+	if m.refs > 0 {
+		return nil
+	}
+	data := m.data
+	m.data = nil
+	return munmap(data)
+}
+
+// MappedReader reads a mapped file. It implements io.WriterTo so io.Copy
+// writes the whole content at once without copying it to a buffer
+type MappedReader struct {
+	*bytes.Reader
+	mapped   *mappedFile
+	closeOne sync.Once
+}
+
+// Close releases the mapping, the reader can't be used after it
+func (r *MappedReader) Close() error {
+	var err error
+	r.closeOne.Do(func() {
+		err = r.mapped.release()
+	})
+	return err
+}
@@ -0,0 +1,17 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package storage
+
+import (
+	"errors"
+	"os"
+)
+
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return nil, errors.New("mmap is not supported")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
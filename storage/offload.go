@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"io"
+	"sync"
+)
+
+// Offloader saves bodies in an external store, like S3, where the clients can download them from directly
+type Offloader interface {
+	// Create starts the upload of the body saved with the key
+	Create(key string) (OffloadedBody, error)
+}
+
+// OffloadedBody is a body uploaded to an external store
+type OffloadedBody interface {
+	// The body is written while it arrives and closed once it is complete
+	io.WriteCloser
+
+	// URL returns where the clients download the body, usually pre-signed for a while. It is asked for every redirect
+	URL() (string, error)
+
+	// Remove deletes the body from the store
+	Remove() error
+}
+
+// OffloadStorage saves the content in a local storage and uploads it to an external store.
+// Once the upload is complete the clients can be redirected to the store, the local copy is
+// still read while the upload is in progress and for what can't be redirected, like ranges.
+// A failed upload only stops the redirects, the content is still saved locally
+type OffloadStorage struct {
+	local  ResponseStorage
+	remote OffloadedBody
+
+	lock     *sync.RWMutex
+	uploaded bool
+	failed   bool
+}
+
+// NewOffloadStorage creates a storage that saves the content in local and uploads it to remote
+func NewOffloadStorage(local ResponseStorage, remote OffloadedBody) *OffloadStorage {
+	return &OffloadStorage{local: local, remote: remote, lock: new(sync.RWMutex)}
+}
+
+func (s *OffloadStorage) Write(p []byte) (int, error) {
+	n, err := s.local.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	if !s.uploadFailed() {
+		if _, err := s.remote.Write(p); err != nil {
+			s.fail()
+		}
+	}
+	return n, nil
+}
+
+func (s *OffloadStorage) uploadFailed() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.failed
+}
+
+func (s *OffloadStorage) fail() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failed = true
+}
+
+// Flush flushes the local storage
+func (s *OffloadStorage) Flush() error {
+	return s.local.Flush()
+}
+
+// Close completes the local content and the upload, the redirects start once both succeeded
+func (s *OffloadStorage) Close() error {
+	err := s.local.Close()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.failed {
+		return err
+	}
+	if s.remote.Close() != nil || err != nil {
+		s.failed = true
+		return err
+	}
+	s.uploaded = true
+	return nil
+}
+
+// Clean removes the local content and the uploaded one
+func (s *OffloadStorage) Clean() error {
+	s.remote.Remove()
+	return s.local.Clean()
+}
+
+// GetReader reads the local content
+func (s *OffloadStorage) GetReader() (io.ReadCloser, error) {
+	return s.local.GetReader()
+}
+
+// RedirectURL returns where the clients can download the content, false until the upload is complete
+func (s *OffloadStorage) RedirectURL() (string, bool) {
+	s.lock.RLock()
+	uploaded := s.uploaded
+	s.lock.RUnlock()
+	if !uploaded {
+		return "", false
+	}
+
+	url, err := s.remote.URL()
+	if err != nil {
+		return "", false
+	}
+	return url, true
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memoryUpload is an upload kept in a buffer, it fails the writes if failing is set
+type memoryUpload struct {
+	bytes.Buffer
+	failing bool
+	closed  bool
+	removed bool
+}
+
+func (u *memoryUpload) Write(p []byte) (int, error) {
+	if u.failing {
+		return 0, errors.New("upload failed")
+	}
+	return u.Buffer.Write(p)
+}
+
+func (u *memoryUpload) Close() error {
+	u.closed = true
+	return nil
+}
+
+func (u *memoryUpload) URL() (string, error) {
+	return "https://bucket.example.com/body?signature=abc", nil
+}
+
+func (u *memoryUpload) Remove() error {
+	u.removed = true
+	return nil
+}
+
+func TestOffloadStorage(t *testing.T) {
+	t.Run("should upload the content and redirect once it is complete", func(t *testing.T) {
+		upload := &memoryUpload{}
+		s := NewOffloadStorage(NewMemoryStorage(), upload)
+
+		s.Write([]byte("abc"))
+		_, ok := s.RedirectURL()
+		require.False(t, ok)
+
+		require.NoError(t, s.Close())
+		url, ok := s.RedirectURL()
+		require.True(t, ok)
+		require.Equal(t, "https://bucket.example.com/body?signature=abc", url)
+		require.Equal(t, "abc", upload.String())
+		require.True(t, upload.closed)
+
+		reader, err := s.GetReader()
+		require.NoError(t, err)
+		content, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, []byte("abc"), content)
+	})
+
+	t.Run("should keep the local content if the upload fails", func(t *testing.T) {
+		s := NewOffloadStorage(NewMemoryStorage(), &memoryUpload{failing: true})
+
+		n, err := s.Write([]byte("abc"))
+		require.NoError(t, err)
+		require.Equal(t, 3, n)
+		require.NoError(t, s.Close())
+		_, ok := s.RedirectURL()
+		require.False(t, ok)
+
+		reader, err := s.GetReader()
+		require.NoError(t, err)
+		content, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, []byte("abc"), content)
+	})
+
+	t.Run("should remove the upload when it is cleaned", func(t *testing.T) {
+		upload := &memoryUpload{}
+		s := NewOffloadStorage(NewMemoryStorage(), upload)
+		s.Write([]byte("abc"))
+		s.Close()
+
+		require.NoError(t, s.Clean())
+		require.True(t, upload.removed)
+	})
+}
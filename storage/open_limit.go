@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// OpenFileLimit bounds how many files the readers of the storages keep open at the same time,
+// so a spike of requests for big files can't exhaust the file descriptors of the process.
+// Readers beyond the limit wait until another one is closed
+type OpenFileLimit struct {
+	slots chan struct{}
+}
+
+// NewOpenFileLimit creates a limit of max open files
+func NewOpenFileLimit(max int) *OpenFileLimit {
+	return &OpenFileLimit{slots: make(chan struct{}, max)}
+}
+
+// DefaultOpenFileLimit returns half of the max open files of the process, the rest is left for
+// the connections and the files being written. It returns 0 if the limit of the process is unknown
+func DefaultOpenFileLimit() int {
+	max, ok := maxOpenFiles()
+	if !ok {
+		return 0
+	}
+	return max / 2
+}
+
+// Open opens the file for reading once there is a free slot, the slot is freed when the file is closed.
+// A nil limit opens it at once
+func (l *OpenFileLimit) Open(name string) (io.ReadCloser, error) {
+	if l == nil {
+		return os.Open(name)
+	}
+
+	l.slots <- struct{}{}
+	file, err := os.Open(name)
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitedFile{File: file, limit: l, once: new(sync.Once)}, nil
+}
+
+// InUse returns how many files are open
+func (l *OpenFileLimit) InUse() int {
+	return len(l.slots)
+}
+
+// limitedFile frees its slot the first time it is closed
+type limitedFile struct {
+	*os.File
+	limit *OpenFileLimit
+	once  *sync.Once
+}
+
+func (f *limitedFile) Close() error {
+	err := f.File.Close()
+	f.once.Do(func() { <-f.limit.slots })
+	return err
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenFileLimit(t *testing.T) {
+	t.Run("should wait for a free slot", func(t *testing.T) {
+		s, err := NewLimitedFileStorage("", 0, NewOpenFileLimit(1))
+		require.NoError(t, err)
+		defer s.Clean()
+		s.Write([]byte("abc"))
+		s.Close()
+
+		first, err := s.GetReader()
+		require.NoError(t, err)
+
+		opened := make(chan struct{})
+		go func() {
+			second, err := s.GetReader()
+			require.NoError(t, err)
+			close(opened)
+			second.Close()
+		}()
+
+		select {
+		case <-opened:
+			t.Fatal("the second reader was opened before the first was closed")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		first.Close()
+		first.Close() // Closing twice frees a single slot
+		<-opened
+	})
+
+	t.Run("should queue more readers than the limit and read them all", func(t *testing.T) {
+		limit := NewOpenFileLimit(3)
+		content := bytes.Repeat([]byte("abcdef"), 10*1024)
+		storages := []ResponseStorage{}
+		for _, newStorage := range []func() (ResponseStorage, error){
+			func() (ResponseStorage, error) { return NewLimitedFileStorage("", 0, limit) },
+			func() (ResponseStorage, error) { return NewLimitedTieredStorage("", NewMemoryTier(1), limit) },
+		} {
+			s, err := newStorage()
+			require.NoError(t, err)
+			defer s.Clean()
+			s.Write(content)
+			s.Close()
+			storages = append(storages, s)
+		}
+
+		lock := new(sync.Mutex)
+		maxInUse := 0
+		wg := &sync.WaitGroup{}
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(s ResponseStorage) {
+				defer wg.Done()
+				reader, err := s.GetReader()
+				require.NoError(t, err)
+				defer reader.Close()
+
+				lock.Lock()
+				if limit.InUse() > maxInUse {
+					maxInUse = limit.InUse()
+				}
+				lock.Unlock()
+
+				read, err := ioutil.ReadAll(reader)
+				require.NoError(t, err)
+				require.Equal(t, content, read)
+			}(storages[i%len(storages)])
+		}
+		wg.Wait()
+
+		require.True(t, maxInUse <= 3, maxInUse)
+		require.Equal(t, 0, limit.InUse())
+	})
+
+	t.Run("should open at once without limit", func(t *testing.T) {
+		var limit *OpenFileLimit
+		file, err := ioutil.TempFile("", "caddy-cache-")
+		require.NoError(t, err)
+		file.Close()
+		defer os.Remove(file.Name())
+
+		reader, err := limit.Open(file.Name())
+		require.NoError(t, err)
+		reader.Close()
+	})
+
+	t.Run("should free the slot if the file can't be opened", func(t *testing.T) {
+		limit := NewOpenFileLimit(1)
+		_, err := limit.Open("/does/not/exist")
+		require.Error(t, err)
+		require.Equal(t, 0, limit.InUse())
+	})
+}
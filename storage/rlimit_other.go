@@ -0,0 +1,8 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package storage
+
+func maxOpenFiles() (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,20 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package storage
+
+import (
+	"math"
+	"syscall"
+)
+
+func maxOpenFiles() (int, bool) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil || limit.Cur == 0 {
+		return 0, false
+	}
+	if limit.Cur > math.MaxInt32 {
+		return math.MaxInt32, true
+	}
+	return int(limit.Cur), true
+}
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+var errSegmentMissing = errors.New("Range is not completely saved")
+
+// Segment is a range of bytes that starts at Start and ends before End
+type Segment struct {
+	Start int64
+	End   int64
+}
+
+// SegmentedStorage saves parts of a body of a known size in a sparse file,
+// so a body requested by ranges can be assembled while it is fetched
+type SegmentedStorage struct {
+	file *os.File
+	size int64
+
+	lock     *sync.RWMutex
+	segments []Segment // sorted and merged
+	readers  int
+	cleaned  bool
+}
+
+// NewSegmentedStorage creates a temp file for a body of size bytes
+func NewSegmentedStorage(path string, size int64) (*SegmentedStorage, error) {
+	file, err := ioutil.TempFile(path, "caddy-cache-")
+	if err != nil {
+		return nil, err
+	}
+	return &SegmentedStorage{
+		file: file,
+		size: size,
+		lock: new(sync.RWMutex),
+	}, nil
+}
+
+// Size returns the size of the whole body
+func (s *SegmentedStorage) Size() int64 {
+	return s.size
+}
+
+// WriteAt saves p at the offset and marks it as available
+func (s *SegmentedStorage) WriteAt(p []byte, offset int64) (int, error) {
+	if offset < 0 || offset+int64(len(p)) > s.size {
+		return 0, errors.New("Write outside of the body")
+	}
+
+	n, err := s.file.WriteAt(p, offset)
+	if n > 0 {
+		s.lock.Lock()
+		s.addLocked(Segment{Start: offset, End: offset + int64(n)})
+		s.lock.Unlock()
+	}
+	return n, err
+}
+
+func (s *SegmentedStorage) addLocked(added Segment) {
+	merged := []Segment{}
+	for _, segment := range s.segments {
+		if segment.End < added.Start || segment.Start > added.End {
+			merged = append(merged, segment)
+			continue
+		}
+		if segment.Start < added.Start {
+			added.Start = segment.Start
+		}
+		if segment.End > added.End {
+			added.End = segment.End
+		}
+	}
+	merged = append(merged, added)
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Start < merged[j].Start })
+	s.segments = merged
+}
+
+// Missing returns the parts between start and end that are not saved yet
+func (s *SegmentedStorage) Missing(start, end int64) []Segment {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	missing := []Segment{}
+	for _, segment := range s.segments {
+		if segment.End <= start {
+			continue
+		}
+		if segment.Start >= end {
+			break
+		}
+		if segment.Start > start {
+			missing = append(missing, Segment{Start: start, End: segment.Start})
+		}
+		start = segment.End
+	}
+	if start < end {
+		missing = append(missing, Segment{Start: start, End: end})
+	}
+	return missing
+}
+
+// Complete returns if the whole body is saved
+func (s *SegmentedStorage) Complete() bool {
+	return len(s.Missing(0, s.size)) == 0
+}
+
+// GetRangeReader reads length bytes from start, they must be already saved
+func (s *SegmentedStorage) GetRangeReader(start, length int64) (io.ReadCloser, error) {
+	if len(s.Missing(start, start+length)) > 0 {
+		return nil, errSegmentMissing
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.cleaned {
+		return nil, errors.New("Storage was cleaned")
+	}
+	s.readers++
+
+	return &segmentReader{
+		SectionReader: io.NewSectionReader(s.file, start, length),
+		storage:       s,
+	}, nil
+}
+
+// Clean removes the file, readers that are still open can keep reading it
+func (s *SegmentedStorage) Clean() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.cleaned {
+		return nil
+	}
+	s.cleaned = true
+	s.segments = nil
+
+	err := os.Remove(s.file.Name())
+	if s.readers == 0 {
+		s.file.Close()
+	}
+	return err
+}
+
+func (s *SegmentedStorage) releaseReader() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.readers--
+	if s.readers == 0 && s.cleaned {
+		s.file.Close()
+	}
+}
+
+type segmentReader struct {
+	*io.SectionReader
+	storage *SegmentedStorage
+	once    sync.Once
+}
+
+func (r *segmentReader) Close() error {
+	r.once.Do(r.storage.releaseReader)
+	return nil
+}
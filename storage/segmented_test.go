@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentedStorage(t *testing.T) {
+	t.Run("should report the missing segments", func(t *testing.T) {
+		s, err := NewSegmentedStorage("", 10)
+		require.NoError(t, err)
+		defer s.Clean()
+
+		require.Equal(t, []Segment{{Start: 0, End: 10}}, s.Missing(0, 10))
+
+		s.WriteAt([]byte("23"), 2)
+		s.WriteAt([]byte("67"), 6)
+		require.Equal(t, []Segment{{Start: 0, End: 2}, {Start: 4, End: 6}, {Start: 8, End: 10}}, s.Missing(0, 10))
+		require.Equal(t, []Segment{{Start: 4, End: 6}}, s.Missing(3, 7))
+		require.Equal(t, []Segment{}, s.Missing(6, 8))
+		require.False(t, s.Complete())
+	})
+
+	t.Run("should merge the segments", func(t *testing.T) {
+		s, err := NewSegmentedStorage("", 10)
+		require.NoError(t, err)
+		defer s.Clean()
+
+		s.WriteAt([]byte("0123"), 0)
+		s.WriteAt([]byte("89"), 8)
+		s.WriteAt([]byte("34567"), 3)
+		require.True(t, s.Complete())
+		require.Equal(t, []Segment{{Start: 0, End: 10}}, s.segments)
+	})
+
+	t.Run("should read only saved ranges", func(t *testing.T) {
+		s, err := NewSegmentedStorage("", 10)
+		require.NoError(t, err)
+		defer s.Clean()
+
+		s.WriteAt([]byte("2345"), 2)
+		reader, err := s.GetRangeReader(3, 2)
+		require.NoError(t, err)
+		content, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		require.Equal(t, []byte("34"), content)
+
+		_, err = s.GetRangeReader(5, 2)
+		require.Error(t, err)
+	})
+
+	t.Run("should not write outside the body", func(t *testing.T) {
+		s, err := NewSegmentedStorage("", 4)
+		require.NoError(t, err)
+		defer s.Clean()
+
+		_, err = s.WriteAt([]byte("abc"), 2)
+		require.Error(t, err)
+	})
+
+	t.Run("should keep open readers working after it is cleaned", func(t *testing.T) {
+		s, err := NewSegmentedStorage("", 3)
+		require.NoError(t, err)
+		s.WriteAt([]byte("abc"), 0)
+		fileName := s.file.Name()
+
+		reader, err := s.GetRangeReader(0, 3)
+		require.NoError(t, err)
+		require.NoError(t, s.Clean())
+		_, err = os.Stat(fileName)
+		require.True(t, os.IsNotExist(err))
+
+		content, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, []byte("abc"), content)
+		reader.Close()
+
+		_, err = s.GetRangeReader(0, 3)
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math"
+	"sync"
+)
+
+// SpillStorage keeps the content in memory while it is smaller than spillSize.
+// Once it grows over it the content is moved to the storage created with newFile and the rest is written there,
+// so small bodies never touch the disk and big ones don't use memory
+type SpillStorage struct {
+	spillSize int64
+	newFile   func() (ResponseStorage, error)
+
+	lock         *sync.RWMutex
+	content      []byte
+	file         ResponseStorage
+	closed       bool
+	subscription *Subscription
+}
+
+// NewSpillStorage creates a storage that is in memory until it has more than spillSize bytes
+func NewSpillStorage(spillSize int64, newFile func() (ResponseStorage, error)) *SpillStorage {
+	return &SpillStorage{
+		spillSize:    spillSize,
+		newFile:      newFile,
+		lock:         new(sync.RWMutex),
+		subscription: NewSubscription(),
+	}
+}
+
+// NewMemoryStorage creates a storage that keeps the whole content in memory, it never spills
+func NewMemoryStorage() *SpillStorage {
+	return NewSpillStorage(math.MaxInt64, nil)
+}
+
+func (s *SpillStorage) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	if s.file != nil {
+		s.lock.Unlock()
+		return s.file.Write(p)
+	}
+
+	if int64(len(s.content)+len(p)) <= s.spillSize {
+		// Readers only read up to the length they saw, appending never changes that part
+		s.content = append(s.content, p...)
+		s.lock.Unlock()
+		s.subscription.NotifyAll(len(p))
+		return len(p), nil
+	}
+
+	defer s.subscription.NotifyAll(0)
+	defer s.lock.Unlock()
+
+	file, err := s.newFile()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := file.Write(s.content); err != nil {
+		file.Clean()
+		return 0, err
+	}
+	s.content = nil
+	s.file = file
+	return file.Write(p)
+}
+
+// Flush flushes the file once it spilled, otherwise there is nothing to flush
+func (s *SpillStorage) Flush() error {
+	s.lock.RLock()
+	file := s.file
+	s.lock.RUnlock()
+
+	defer s.subscription.NotifyAll(0)
+	if file != nil {
+		return file.Flush()
+	}
+	return nil
+}
+
+// Close marks the content as complete
+func (s *SpillStorage) Close() error {
+	s.lock.Lock()
+	s.closed = true
+	file := s.file
+	s.lock.Unlock()
+
+	s.subscription.Close()
+	if file != nil {
+		return file.Close()
+	}
+	return nil
+}
+
+// Clean removes the file if the content spilled, the memory is freed with the storage
+func (s *SpillStorage) Clean() error {
+	s.lock.RLock()
+	file := s.file
+	s.lock.RUnlock()
+
+	if file != nil {
+		return file.Clean()
+	}
+	return nil
+}
+
+// Storage returns the file the content was moved to or nil if it is still in memory
+func (s *SpillStorage) Storage() ResponseStorage {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.file
+}
+
+// GetReader reads from memory or from the file if the content spilled.
+// Readers that started in memory continue from the file if it spills while they read
+func (s *SpillStorage) GetReader() (io.ReadCloser, error) {
+	s.lock.RLock()
+	file, closed, content := s.file, s.closed, s.content
+	s.lock.RUnlock()
+
+	if file != nil {
+		return file.GetReader()
+	}
+	if closed {
+		return ioutil.NopCloser(bytes.NewReader(content)), nil
+	}
+	return &spillReader{storage: s, subscription: s.subscription.NewSubscriber()}, nil
+}
+
+// spillReader reads the content while it is being written
+type spillReader struct {
+	storage      *SpillStorage
+	subscription <-chan int
+	offset       int
+	file         io.ReadCloser
+}
+
+func (r *spillReader) Read(p []byte) (int, error) {
+	for r.file == nil {
+		r.storage.lock.RLock()
+		file, closed, content := r.storage.file, r.storage.closed, r.storage.content
+		r.storage.lock.RUnlock()
+
+		if file != nil {
+			if err := r.continueFrom(file); err != nil {
+				return 0, err
+			}
+			break
+		}
+
+		if r.offset < len(content) {
+			n := copy(p, content[r.offset:])
+			r.offset += n
+			return n, nil
+		}
+
+		if closed {
+			return 0, io.EOF
+		}
+
+		// A closed subscription only means the content is complete, it is checked again
+		<-r.subscription
+	}
+
+	return r.file.Read(p)
+}
+
+// continueFrom opens the file and skips what was already read from memory
+func (r *spillReader) continueFrom(file ResponseStorage) error {
+	reader, err := file.GetReader()
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(ioutil.Discard, reader, int64(r.offset)); err != nil {
+		reader.Close()
+		return err
+	}
+	r.file = reader
+	return nil
+}
+
+func (r *spillReader) Close() error {
+	r.storage.subscription.RemoveSubscriber(r.subscription)
+	if r.file != nil {
+		return r.file.Close()
+	}
+	return nil
+}
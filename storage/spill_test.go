@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSpillStorage returns the storage and the files it created
+func newTestSpillStorage(spillSize int64) (*SpillStorage, *[]string) {
+	files := &[]string{}
+	return NewSpillStorage(spillSize, func() (ResponseStorage, error) {
+		file, err := NewFileStorage("")
+		if err == nil {
+			*files = append(*files, file.(*FileStorage).file.Name())
+		}
+		return file, err
+	}), files
+}
+
+func TestSpillStorage(t *testing.T) {
+	t.Run("should keep small contents in memory", func(t *testing.T) {
+		s, files := newTestSpillStorage(5)
+		s.Write([]byte("abc"))
+		s.Write([]byte("de"))
+		s.Close()
+
+		require.Nil(t, s.Storage())
+		require.Empty(t, *files)
+		require.Equal(t, []byte("abcde"), readAll(t, s))
+		require.NoError(t, s.Clean())
+	})
+
+	t.Run("should move the content to disk when it grows over the spill size", func(t *testing.T) {
+		s, files := newTestSpillStorage(5)
+		s.Write([]byte("abc"))
+		s.Write([]byte("def"))
+		s.Write([]byte("g"))
+		s.Close()
+
+		require.NotNil(t, s.Storage())
+		require.Len(t, *files, 1)
+		require.Equal(t, []byte("abcdefg"), readAll(t, s))
+
+		require.NoError(t, s.Clean())
+		_, err := os.Stat((*files)[0])
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("should continue from disk a reader that started in memory", func(t *testing.T) {
+		s, _ := newTestSpillStorage(5)
+		defer s.Clean()
+		s.Write([]byte("abc"))
+
+		reader, err := s.GetReader()
+		require.NoError(t, err)
+		defer reader.Close()
+
+		buffer := make([]byte, 2)
+		n, err := reader.Read(buffer)
+		require.NoError(t, err)
+		require.Equal(t, []byte("ab"), buffer[:n])
+
+		// The body straddles the spill size while it is read
+		s.Write([]byte("defgh"))
+		s.Close()
+
+		rest, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, []byte("cdefgh"), rest)
+	})
+
+	t.Run("should wait for the content while it is written", func(t *testing.T) {
+		s, _ := newTestSpillStorage(1024)
+		defer s.Clean()
+
+		reader, err := s.GetReader()
+		require.NoError(t, err)
+		defer reader.Close()
+
+		go func() {
+			for i := 0; i < 300; i++ {
+				s.Write([]byte("abcd"))
+			}
+			s.Close()
+		}()
+
+		content, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, bytes.Repeat([]byte("abcd"), 300), content)
+	})
+
+	t.Run("should never spill a memory storage", func(t *testing.T) {
+		s := NewMemoryStorage()
+		s.Write(bytes.Repeat([]byte("a"), 1<<20))
+		s.Close()
+
+		require.Nil(t, s.Storage())
+		require.Len(t, readAll(t, s), 1<<20)
+	})
+
+	t.Run("should fail the write if the file can not be created", func(t *testing.T) {
+		s := NewSpillStorage(2, func() (ResponseStorage, error) {
+			return nil, errors.New("disk full")
+		})
+
+		_, err := s.Write([]byte("abc"))
+		require.Error(t, err)
+	})
+}
+
+// benchmarkSpillWriteRead saves and reads a body of the given size, with memory below the spill size
+// and with disk above it. Comparing both for each size shows where the disk costs more than the memory it saves
+func benchmarkSpillWriteRead(b *testing.B, size int, inMemory bool) {
+	content := bytes.Repeat([]byte("a"), size)
+	spillSize := int64(size)
+	if !inMemory {
+		spillSize = 1
+	}
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s, _ := newTestSpillStorage(spillSize)
+		s.Write(content)
+		s.Close()
+		reader, _ := s.GetReader()
+		io.Copy(ioutil.Discard, reader)
+		reader.Close()
+		s.Clean()
+	}
+}
+
+func BenchmarkSpillStorage(b *testing.B) {
+	for _, size := range []int{4 << 10, 64 << 10, 1 << 20, 16 << 20} {
+		b.Run(fmt.Sprintf("memory-%dKB", size>>10), func(b *testing.B) {
+			benchmarkSpillWriteRead(b, size, true)
+		})
+		b.Run(fmt.Sprintf("disk-%dKB", size>>10), func(b *testing.B) {
+			benchmarkSpillWriteRead(b, size, false)
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// ThresholdStorage keeps the content in memory until it has threshold bytes or it is closed,
+// so it can be decided if it is worth to save it before creating the real storage
+type ThresholdStorage struct {
+	threshold int64
+
+	lock    *sync.Mutex
+	buffer  bytes.Buffer
+	storage ResponseStorage
+	closed  bool
+	decided chan struct{}
+	decide  *sync.Once
+}
+
+// NewThresholdStorage creates a storage that buffers up to threshold bytes
+func NewThresholdStorage(threshold int64) *ThresholdStorage {
+	return &ThresholdStorage{
+		threshold: threshold,
+		lock:      new(sync.Mutex),
+		decided:   make(chan struct{}),
+		decide:    new(sync.Once),
+	}
+}
+
+func (s *ThresholdStorage) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	if s.storage != nil {
+		s.lock.Unlock()
+		return s.storage.Write(p)
+	}
+	defer s.lock.Unlock()
+
+	n, err := s.buffer.Write(p)
+	if int64(s.buffer.Len()) >= s.threshold {
+		s.decide.Do(func() { close(s.decided) })
+	}
+	return n, err
+}
+
+// Flush flushes the storage, buffered content is flushed when it is committed
+func (s *ThresholdStorage) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.storage != nil {
+		return s.storage.Flush()
+	}
+	return nil
+}
+
+// Close closes the storage or marks the buffered content as complete
+func (s *ThresholdStorage) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	s.decide.Do(func() { close(s.decided) })
+	if s.storage != nil {
+		return s.storage.Close()
+	}
+	return nil
+}
+
+// Reached blocks until the content has threshold bytes, then it returns true,
+// or until it is closed with less bytes, then it returns false
+func (s *ThresholdStorage) Reached() bool {
+	<-s.decided
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return int64(s.buffer.Len()) >= s.threshold || s.storage != nil
+}
+
+// Commit moves the buffered content to the storage where the rest is going to be written
+func (s *ThresholdStorage) Commit(storage ResponseStorage) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.storage != nil {
+		return errors.New("Storage already committed")
+	}
+
+	if _, err := storage.Write(s.buffer.Bytes()); err != nil {
+		return err
+	}
+	s.buffer = bytes.Buffer{}
+	s.storage = storage
+
+	if s.closed {
+		return storage.Close()
+	}
+	return nil
+}
+
+// Storage returns the committed storage or nil if it is still buffering
+func (s *ThresholdStorage) Storage() ResponseStorage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.storage
+}
+
+// Clean cleans the committed storage
+func (s *ThresholdStorage) Clean() error {
+	s.lock.Lock()
+	storage := s.storage
+	s.lock.Unlock()
+
+	if storage != nil {
+		return storage.Clean()
+	}
+	return nil
+}
+
+// GetReader reads from the committed storage or the buffered content if it was closed before reaching the threshold
+func (s *ThresholdStorage) GetReader() (io.ReadCloser, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.storage != nil {
+		return s.storage.GetReader()
+	}
+	if !s.closed {
+		return nil, errors.New("Content is still being buffered")
+	}
+	return ioutil.NopCloser(bytes.NewReader(s.buffer.Bytes())), nil
+}
@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestThresholdStorage(t *testing.T) {
+	t.Run("should report when the threshold is not reached", func(t *testing.T) {
+		s := NewThresholdStorage(5)
+		s.Write([]byte("abc"))
+		s.Close()
+
+		require.False(t, s.Reached())
+		require.Nil(t, s.Storage())
+
+		reader, err := s.GetReader()
+		require.NoError(t, err)
+		content, _ := ioutil.ReadAll(reader)
+		require.Equal(t, []byte("abc"), content)
+	})
+
+	t.Run("should move the buffer to the committed storage", func(t *testing.T) {
+		s := NewThresholdStorage(2)
+		s.Write([]byte("abc"))
+		require.True(t, s.Reached())
+
+		file, err := NewFileStorage("")
+		require.NoError(t, err)
+		require.NoError(t, s.Commit(file))
+		defer s.Clean()
+
+		s.Write([]byte("def"))
+		s.Close()
+
+		reader, err := s.GetReader()
+		require.NoError(t, err)
+		defer reader.Close()
+		content, _ := ioutil.ReadAll(reader)
+		require.Equal(t, []byte("abcdef"), content)
+	})
+}
@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// MemoryTier keeps the content of the most recently used TieredStorages in memory up to maxSize bytes.
+// When there is no room the least recently used ones are moved back to disk
+type MemoryTier struct {
+	lock     *sync.Mutex
+	maxSize  int64
+	size     int64
+	lru      *list.List
+	elements map[*TieredStorage]*list.Element
+}
+
+// NewMemoryTier creates a memory tier that can hold up to maxSize bytes
+func NewMemoryTier(maxSize int64) *MemoryTier {
+	return &MemoryTier{
+		lock:     new(sync.Mutex),
+		maxSize:  maxSize,
+		lru:      list.New(),
+		elements: map[*TieredStorage]*list.Element{},
+	}
+}
+
+// Size returns how many bytes are in memory
+func (t *MemoryTier) Size() int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.size
+}
+
+// Accessed promotes the storage to memory if it is complete and fits, moving others to disk if needed
+func (t *MemoryTier) Accessed(s *TieredStorage) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if element, ok := t.elements[s]; ok {
+		t.lru.MoveToFront(element)
+		return
+	}
+
+	size, ok := s.diskSize()
+	if !ok || size > t.maxSize {
+		return
+	}
+
+	for t.size+size > t.maxSize {
+		last := t.lru.Back().Value.(*TieredStorage)
+		if err := last.demote(); err != nil {
+			// It can't leave memory so there is no room for another one
+			return
+		}
+		t.removeLocked(last)
+	}
+
+	if size, ok = s.promote(); ok {
+		t.elements[s] = t.lru.PushFront(s)
+		t.size += size
+	}
+}
+
+func (t *MemoryTier) remove(s *TieredStorage) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.removeLocked(s)
+}
+
+func (t *MemoryTier) removeLocked(s *TieredStorage) {
+	element, ok := t.elements[s]
+	if !ok {
+		return
+	}
+	t.lru.Remove(element)
+	delete(t.elements, s)
+	t.size -= s.memorySize
+}
+
+// TieredStorage saves the content into a file like FileStorage. Once it is complete
+// the MemoryTier can move the content to memory and remove the file, so it is never stored twice
+type TieredStorage struct {
+	path  string
+	file  *FileStorage
+	tier  *MemoryTier
+	limit *OpenFileLimit
+
+	lock     *sync.RWMutex
+	closed   bool
+	cleaned  bool
+	content  []byte
+	fileName string
+
+	// Only changed with the tier lock held
+	memorySize int64
+}
+
+// NewTieredStorage creates a storage that starts in a temp file and can be promoted to the memory tier
+func NewTieredStorage(path string, tier *MemoryTier) (ResponseStorage, error) {
+	return NewLimitedTieredStorage(path, tier, nil)
+}
+
+// NewLimitedTieredStorage is like NewTieredStorage but its readers from disk wait for a slot of the limit to open the file
+func NewLimitedTieredStorage(path string, tier *MemoryTier, limit *OpenFileLimit) (ResponseStorage, error) {
+	file, err := NewLimitedFileStorage(path, 0, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	fileStorage := file.(*FileStorage)
+	return &TieredStorage{
+		path:     path,
+		file:     fileStorage,
+		tier:     tier,
+		limit:    limit,
+		lock:     new(sync.RWMutex),
+		fileName: fileStorage.file.Name(),
+	}, nil
+}
+
+func (s *TieredStorage) Write(p []byte) (n int, err error) {
+	return s.file.Write(p)
+}
+
+// Flush syncs the underlying file
+func (s *TieredStorage) Flush() error {
+	return s.file.Flush()
+}
+
+// Close the underlying file, after this the content can be promoted
+func (s *TieredStorage) Close() error {
+	err := s.file.Close()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	return err
+}
+
+// Clean removes the content from memory and disk
+func (s *TieredStorage) Clean() error {
+	s.lock.Lock()
+	s.cleaned = true
+	s.content = nil
+	fileName := s.fileName
+	s.fileName = ""
+	s.lock.Unlock()
+
+	s.tier.remove(s)
+
+	switch fileName {
+	case "":
+		return nil
+	case s.file.file.Name():
+		return s.file.Clean()
+	default:
+		return os.Remove(fileName)
+	}
+}
+
+// GetReader reads from memory if the content was promoted and from disk otherwise
+func (s *TieredStorage) GetReader() (io.ReadCloser, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	// The content is never modified so readers can keep using it after it is demoted or cleaned
+	if s.content != nil {
+		return ioutil.NopCloser(bytes.NewReader(s.content)), nil
+	}
+
+	// While it is being written the readers have to wait for the new content
+	if !s.closed {
+		return s.file.GetReader()
+	}
+
+	return s.limit.Open(s.fileName)
+}
+
+// InMemory returns if the content is in the memory tier
+func (s *TieredStorage) InMemory() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.content != nil
+}
+
+func (s *TieredStorage) diskSize() (int64, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if !s.closed || s.cleaned || s.content != nil {
+		return 0, false
+	}
+
+	info, err := os.Stat(s.fileName)
+	if err != nil {
+		return 0, false
+	}
+	return info.Size(), true
+}
+
+// promote loads the content in memory and removes the file.
+// Readers that already opened the file can keep reading it
+func (s *TieredStorage) promote() (int64, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.closed || s.cleaned || s.content != nil {
+		return 0, false
+	}
+
+	content, err := ioutil.ReadFile(s.fileName)
+	if err != nil {
+		return 0, false
+	}
+
+	os.Remove(s.fileName)
+	s.content = content
+	s.fileName = ""
+	s.memorySize = int64(len(content))
+	return s.memorySize, true
+}
+
+// demote writes the content to a new file and removes it from memory
+func (s *TieredStorage) demote() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.content == nil {
+		return nil
+	}
+
+	file, err := ioutil.TempFile(s.path, "caddy-cache-")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(s.content); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	s.fileName = file.Name()
+	s.content = nil
+	return nil
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTieredStorage(t require.TestingT, tier *MemoryTier, content []byte) *TieredStorage {
+	s, err := NewTieredStorage("", tier)
+	require.NoError(t, err)
+	s.Write(content)
+	s.Close()
+	return s.(*TieredStorage)
+}
+
+func readAll(t require.TestingT, s ResponseStorage) []byte {
+	reader, err := s.GetReader()
+	require.NoError(t, err)
+	defer reader.Close()
+
+	content, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	return content
+}
+
+func TestTieredStorage(t *testing.T) {
+	t.Run("should move the content to memory and remove the file", func(t *testing.T) {
+		tier := NewMemoryTier(10)
+		s := newTestTieredStorage(t, tier, []byte("abc"))
+		defer s.Clean()
+		fileName := s.file.file.Name()
+
+		tier.Accessed(s)
+
+		require.True(t, s.InMemory())
+		require.Equal(t, int64(3), tier.Size())
+		_, err := os.Stat(fileName)
+		require.True(t, os.IsNotExist(err))
+		require.Equal(t, []byte("abc"), readAll(t, s))
+	})
+
+	t.Run("should not promote until it is complete", func(t *testing.T) {
+		tier := NewMemoryTier(10)
+		s, err := NewTieredStorage("", tier)
+		require.NoError(t, err)
+		defer s.Clean()
+
+		s.Write([]byte("abc"))
+		tier.Accessed(s.(*TieredStorage))
+		require.False(t, s.(*TieredStorage).InMemory())
+		s.Close()
+	})
+
+	t.Run("should not promote contents bigger than the tier", func(t *testing.T) {
+		tier := NewMemoryTier(2)
+		s := newTestTieredStorage(t, tier, []byte("abc"))
+		defer s.Clean()
+
+		tier.Accessed(s)
+		require.False(t, s.InMemory())
+		require.Equal(t, []byte("abc"), readAll(t, s))
+	})
+
+	t.Run("should move the least recently used content to disk", func(t *testing.T) {
+		tier := NewMemoryTier(6)
+		a := newTestTieredStorage(t, tier, []byte("aaa"))
+		defer a.Clean()
+		b := newTestTieredStorage(t, tier, []byte("bbb"))
+		defer b.Clean()
+		c := newTestTieredStorage(t, tier, []byte("ccc"))
+		defer c.Clean()
+
+		tier.Accessed(a)
+		tier.Accessed(b)
+		tier.Accessed(a)
+		tier.Accessed(c)
+
+		require.True(t, a.InMemory())
+		require.False(t, b.InMemory())
+		require.True(t, c.InMemory())
+		require.Equal(t, int64(6), tier.Size())
+		require.Equal(t, []byte("bbb"), readAll(t, b))
+	})
+
+	t.Run("should keep reading after the content is moved", func(t *testing.T) {
+		tier := NewMemoryTier(3)
+		a := newTestTieredStorage(t, tier, []byte("aaa"))
+		defer a.Clean()
+		b := newTestTieredStorage(t, tier, []byte("bbb"))
+		defer b.Clean()
+
+		diskReader, err := a.GetReader()
+		require.NoError(t, err)
+		defer diskReader.Close()
+		tier.Accessed(a)
+
+		memoryReader, err := a.GetReader()
+		require.NoError(t, err)
+		defer memoryReader.Close()
+		tier.Accessed(b)
+
+		for _, reader := range []io.Reader{diskReader, memoryReader} {
+			content, err := ioutil.ReadAll(reader)
+			require.NoError(t, err)
+			require.Equal(t, []byte("aaa"), content)
+		}
+	})
+
+	t.Run("should free the memory when it is cleaned", func(t *testing.T) {
+		tier := NewMemoryTier(10)
+		s := newTestTieredStorage(t, tier, []byte("abc"))
+		tier.Accessed(s)
+
+		require.NoError(t, s.Clean())
+		require.Equal(t, int64(0), tier.Size())
+		tier.Accessed(s)
+		require.False(t, s.InMemory())
+	})
+}
+
+func benchmarkTieredRead(b *testing.B, promote bool) {
+	content := bytes.Repeat([]byte("a"), 64*1024)
+	tier := NewMemoryTier(int64(len(content)))
+	s := newTestTieredStorage(b, tier, content)
+	defer s.Clean()
+
+	if promote {
+		tier.Accessed(s)
+	}
+
+	b.SetBytes(int64(len(content)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reader, _ := s.GetReader()
+		io.Copy(ioutil.Discard, reader)
+		reader.Close()
+	}
+}
+
+func BenchmarkTieredStorageMemoryRead(b *testing.B) {
+	benchmarkTieredRead(b, true)
+}
+
+func BenchmarkTieredStorageDiskRead(b *testing.B) {
+	benchmarkTieredRead(b, false)
+}
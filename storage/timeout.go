@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// TimeoutStorage saves the content in the storage, but a slow storage never delays the readers: while the content
+// is written it is also kept in memory and the readers read it from there. If a write takes longer than the timeout
+// the storage is abandoned, it is cleaned once the write returns and the rest of the content is only kept in memory.
+// Once the content is complete in the storage the memory is released and the new readers use the storage
+type TimeoutStorage struct {
+	storage   ResponseStorage
+	timeout   time.Duration
+	abandoned func()
+
+	lock        *sync.RWMutex
+	memory      *SpillStorage
+	isAbandoned bool
+	complete    bool
+}
+
+// NewTimeoutStorage creates a storage that stops using the storage when a write takes longer than timeout.
+// abandoned is called when that happens
+func NewTimeoutStorage(storage ResponseStorage, timeout time.Duration, abandoned func()) *TimeoutStorage {
+	return &TimeoutStorage{
+		storage:   storage,
+		timeout:   timeout,
+		abandoned: abandoned,
+		lock:      new(sync.RWMutex),
+		memory:    NewMemoryStorage(),
+	}
+}
+
+func (s *TimeoutStorage) Write(p []byte) (int, error) {
+	s.memory.Write(p)
+	if s.Abandoned() {
+		return len(p), nil
+	}
+
+	// The write can continue after this one returns, when the caller may already be reusing p
+	content := append([]byte{}, p...)
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.storage.Write(content)
+		done <- err
+	}()
+
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	case <-timer.C:
+	}
+
+	s.lock.Lock()
+	s.isAbandoned = true
+	s.lock.Unlock()
+
+	go func() {
+		<-done
+		s.storage.Close()
+		s.storage.Clean()
+	}()
+	if s.abandoned != nil {
+		s.abandoned()
+	}
+	return len(p), nil
+}
+
+// Abandoned returns if a write took too long and the storage is no longer used
+func (s *TimeoutStorage) Abandoned() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.isAbandoned
+}
+
+// Flush flushes the storage unless it was abandoned
+func (s *TimeoutStorage) Flush() error {
+	s.memory.Flush()
+	if s.Abandoned() {
+		return nil
+	}
+	return s.storage.Flush()
+}
+
+// Close marks the content as complete. If the storage was not abandoned the readers use it from now on
+func (s *TimeoutStorage) Close() error {
+	s.memory.Close()
+	if s.Abandoned() {
+		return nil
+	}
+
+	err := s.storage.Close()
+	s.lock.Lock()
+	s.complete = err == nil
+	if s.complete {
+		s.memory = nil
+	}
+	s.lock.Unlock()
+	return err
+}
+
+// Clean removes the content from the storage, it was already cleaned if it was abandoned
+func (s *TimeoutStorage) Clean() error {
+	if s.Abandoned() {
+		return nil
+	}
+	return s.storage.Clean()
+}
+
+// GetReader reads from memory until the storage has the whole content
+func (s *TimeoutStorage) GetReader() (io.ReadCloser, error) {
+	s.lock.RLock()
+	complete, memory := s.complete, s.memory
+	s.lock.RUnlock()
+
+	if complete {
+		return s.storage.GetReader()
+	}
+	return memory.GetReader()
+}
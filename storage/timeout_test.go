@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// blockingStorage is a storage whose writes wait until release is closed once block is set
+type blockingStorage struct {
+	*SpillStorage
+	block   int32
+	release chan struct{}
+	cleaned chan struct{}
+}
+
+func newBlockingStorage() *blockingStorage {
+	return &blockingStorage{SpillStorage: NewMemoryStorage(), release: make(chan struct{}), cleaned: make(chan struct{})}
+}
+
+func (s *blockingStorage) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&s.block) == 1 {
+		<-s.release
+	}
+	return s.SpillStorage.Write(p)
+}
+
+func (s *blockingStorage) Clean() error {
+	close(s.cleaned)
+	return s.SpillStorage.Clean()
+}
+
+func TestTimeoutStorage(t *testing.T) {
+	t.Run("should save the content and read it from the storage once it is complete", func(t *testing.T) {
+		slow := newBlockingStorage()
+		abandoned := false
+		s := NewTimeoutStorage(slow, time.Second, func() { abandoned = true })
+
+		reader, err := s.GetReader()
+		require.NoError(t, err)
+		s.Write([]byte("abc"))
+		s.Write([]byte("de"))
+		require.NoError(t, s.Close())
+
+		// The reader that started before it was complete reads from memory
+		content, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, []byte("abcde"), content)
+		reader.Close()
+
+		require.False(t, abandoned)
+		require.Nil(t, s.memory)
+		require.Equal(t, []byte("abcde"), readAll(t, slow))
+		require.Equal(t, []byte("abcde"), readAll(t, s))
+	})
+
+	t.Run("should abandon the storage when a write takes longer than the timeout", func(t *testing.T) {
+		slow := newBlockingStorage()
+		abandoned := int32(0)
+		s := NewTimeoutStorage(slow, 10*time.Millisecond, func() { atomic.AddInt32(&abandoned, 1) })
+
+		s.Write([]byte("abc"))
+		atomic.StoreInt32(&slow.block, 1)
+
+		started := time.Now()
+		n, err := s.Write([]byte("de"))
+		require.NoError(t, err)
+		require.Equal(t, 2, n)
+		s.Write([]byte("fg"))
+		require.NoError(t, s.Close())
+		require.True(t, time.Since(started) < time.Second)
+
+		require.True(t, s.Abandoned())
+		require.Equal(t, int32(1), atomic.LoadInt32(&abandoned))
+		require.Equal(t, []byte("abcdefg"), readAll(t, s))
+
+		// The storage is cleaned once the blocked write returns
+		close(slow.release)
+		select {
+		case <-slow.cleaned:
+		case <-time.After(time.Second):
+			t.Fatal("the abandoned storage was not cleaned")
+		}
+		require.NoError(t, s.Clean())
+	})
+}
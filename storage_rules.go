@@ -0,0 +1,35 @@
+package cache
+
+import (
+	"strings"
+
+	"github.com/nicolasazrak/caddy-cache/storage"
+)
+
+// StorageBackend is a place where bodies are saved instead of the default path
+type StorageBackend struct {
+	// Memory keeps the bodies only in memory, otherwise they are saved in files in Path
+	Memory bool
+	Path   string
+
+	// Offloader also uploads the bodies of at least OffloadMinSize bytes to an external store,
+	// the hits are redirected there once the upload is complete. It is only set from Go
+	Offloader      storage.Offloader
+	OffloadMinSize int64
+}
+
+// StorageRule saves the bodies of the requests whose path starts with Path in the named backend
+type StorageRule struct {
+	Path    string
+	Backend string
+}
+
+// storageBackendFor returns the backend of the first rule that matches the path, false if the default storage is used
+func storageBackendFor(config *Config, path string) (StorageBackend, bool) {
+	for _, rule := range config.StorageRules {
+		if strings.HasPrefix(path, rule.Path) {
+			return config.StorageBackends[rule.Backend], true
+		}
+	}
+	return StorageBackend{}, false
+}
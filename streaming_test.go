@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamingToClient(t *testing.T) {
+	release := make(chan struct{})
+	content := bytes.Repeat([]byte("abcdefgh"), 512*1024)
+	h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Add("Cache-control", "max-age=10")
+		if r.URL.Path == "/big" {
+			w.Write(content)
+			return 200, nil
+		}
+		if r.URL.Path == "/huge" {
+			chunk := bytes.Repeat([]byte("a"), 64*1024)
+			for i := 0; i < 512; i++ {
+				w.Write(chunk)
+			}
+			return 200, nil
+		}
+
+		// The first part is smaller than the buffer of the connection
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("second"))
+		return 200, nil
+	}), emptyConfig())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), httpserver.OriginalURLCtxKey, *r.URL)))
+	}))
+	defer server.Close()
+
+	t.Run("it should send each part to the first client as upstream sends it", func(t *testing.T) {
+		res, err := http.Get(server.URL + "/slow")
+		require.NoError(t, err)
+		defer res.Body.Close()
+		requireStatus(t, res, cacheMiss)
+
+		first := make(chan []byte, 1)
+		go func() {
+			buffer := make([]byte, 5)
+			io.ReadFull(res.Body, buffer)
+			first <- buffer
+		}()
+
+		select {
+		case buffer := <-first:
+			require.Equal(t, []byte("first"), buffer)
+			close(release)
+		case <-time.After(5 * time.Second):
+			close(release)
+			t.Fatal("the first part was not sent before upstream ended")
+		}
+		requireBody(t, res, []byte("second"))
+	})
+
+	t.Run("it should save the body while the client doesn't read it", func(t *testing.T) {
+		res, err := http.Get(server.URL + "/big")
+		require.NoError(t, err)
+		defer res.Body.Close()
+		requireStatus(t, res, cacheMiss)
+
+		r := newRequestWithOriginalURL(t, "GET", server.URL+"/big")
+		require.Eventually(t, func() bool {
+			entry, ok := h.Cache.Get(r)
+			defer entry.release()
+			return ok && entry.Response.IsClosed()
+		}, 5*time.Second, 10*time.Millisecond)
+
+		w := httptest.NewRecorder()
+		_, err = h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		requireStatus(t, w.Result(), cacheHit)
+		requireBody(t, w.Result(), content)
+	})
+
+	t.Run("it should not keep in memory what a slow client did not read yet", func(t *testing.T) {
+		stats := runtime.MemStats{}
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		baseline := stats.HeapAlloc
+
+		res, err := http.Get(server.URL + "/huge")
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		// Upstream sends the 32MB at once while the client reads them slowly
+		peak := uint64(0)
+		buffer := make([]byte, 256*1024)
+		read := 0
+		for {
+			n, err := res.Body.Read(buffer)
+			read += n
+			if err != nil {
+				break
+			}
+			time.Sleep(time.Millisecond)
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > peak {
+				peak = stats.HeapAlloc
+			}
+		}
+		require.Equal(t, 32*1024*1024, read)
+		require.True(t, peak < baseline+16*1024*1024, "the heap grew %d bytes", peak-baseline)
+	})
+}
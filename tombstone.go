@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultPurgeTombstone = 10 * time.Second
+
+// tombstoneWindow returns how long the purges are remembered, 10 seconds if purge_tombstone is not set
+func tombstoneWindow(config *Config) time.Duration {
+	if config.PurgeTombstone == 0 {
+		return defaultPurgeTombstone
+	}
+	return config.PurgeTombstone
+}
+
+// tombstones remember the recent purges so the responses whose fetch started before them are not saved,
+// they could have the content that was just purged. They are forgotten after the window
+type tombstones struct {
+	lock   *sync.Mutex
+	window time.Duration
+	keys   map[string]time.Time
+
+	// matchers are the purges of many keys, like the prefixes, the patterns and the flushes
+	matchers []tombstone
+}
+
+type tombstone struct {
+	matches  func(key string) bool
+	purgedAt time.Time
+}
+
+func newTombstones(window time.Duration) *tombstones {
+	return &tombstones{lock: new(sync.Mutex), window: window, keys: map[string]time.Time{}}
+}
+
+func (t *tombstones) addKey(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.expireLocked()
+	t.keys[key] = time.Now()
+}
+
+func (t *tombstones) addMatching(matches func(key string) bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.expireLocked()
+	t.matchers = append(t.matchers, tombstone{matches, time.Now()})
+}
+
+// buried returns if the key was purged after the fetch started. Entries that were not fetched are never buried
+func (t *tombstones) buried(key string, fetchStart time.Time) bool {
+	if fetchStart.IsZero() {
+		return false
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.expireLocked()
+
+	if purgedAt, ok := t.keys[key]; ok && purgedAt.After(fetchStart) {
+		return true
+	}
+	for _, matcher := range t.matchers {
+		if matcher.purgedAt.After(fetchStart) && matcher.matches(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// expireLocked forgets the purges older than the window, the lock must be held
+func (t *tombstones) expireLocked() {
+	limit := time.Now().Add(-t.window)
+	for key, purgedAt := range t.keys {
+		if purgedAt.Before(limit) {
+			delete(t.keys, key)
+		}
+	}
+
+	kept := t.matchers[:0]
+	for _, matcher := range t.matchers {
+		if !matcher.purgedAt.Before(limit) {
+			kept = append(kept, matcher)
+		}
+	}
+	t.matchers = kept
+}
@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTombstones(t *testing.T) {
+	t.Run("it should bury the keys purged after the fetch started", func(t *testing.T) {
+		tombstones := newTombstones(time.Minute)
+		before := time.Now()
+		tombstones.addKey("GET example.com/a?")
+
+		require.True(t, tombstones.buried("GET example.com/a?", before))
+		require.False(t, tombstones.buried("GET example.com/a?", time.Now()))
+		require.False(t, tombstones.buried("GET example.com/b?", before))
+		require.False(t, tombstones.buried("GET example.com/a?", time.Time{}))
+	})
+
+	t.Run("it should bury the keys of a matching purge", func(t *testing.T) {
+		tombstones := newTombstones(time.Minute)
+		before := time.Now()
+		tombstones.addMatching(func(key string) bool { return strings.HasPrefix(key, "GET example.com/images/") })
+
+		require.True(t, tombstones.buried("GET example.com/images/a.png?", before))
+		require.False(t, tombstones.buried("GET example.com/a?", before))
+	})
+
+	t.Run("it should forget the purges after the window", func(t *testing.T) {
+		tombstones := newTombstones(10 * time.Millisecond)
+		before := time.Now()
+		tombstones.addKey("GET example.com/a?")
+		tombstones.addMatching(func(key string) bool { return true })
+
+		time.Sleep(20 * time.Millisecond)
+		require.False(t, tombstones.buried("GET example.com/a?", before))
+		require.Empty(t, tombstones.keys)
+		require.Empty(t, tombstones.matchers)
+	})
+}
+
+func TestPurgeDuringFetch(t *testing.T) {
+	for _, purge := range []struct {
+		name  string
+		purge func(h *Handler)
+	}{
+		{"purge", func(h *Handler) { h.Cache.Purge("GET example.com/?") }},
+		{"flush", func(h *Handler) { h.Cache.Flush() }},
+	} {
+		t.Run("it should not save a response fetched before a "+purge.name, func(t *testing.T) {
+			started := make(chan struct{}, 1)
+			proceed := make(chan struct{})
+			fetches := 0
+			h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				fetches++
+				if fetches == 1 {
+					started <- struct{}{}
+					<-proceed
+				}
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.Write([]byte("abc"))
+				return 200, nil
+			}), emptyConfig())
+
+			serve := func() *http.Response {
+				w := httptest.NewRecorder()
+				_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", "http://example.com/"))
+				require.NoError(t, err)
+				return w.Result()
+			}
+
+			slow := make(chan *http.Response)
+			go func() { slow <- serve() }()
+			<-started
+			purge.purge(h)
+			close(proceed)
+
+			// The request that was waiting still gets the response
+			res := <-slow
+			requireStatus(t, res, cacheMiss)
+			requireBody(t, res, []byte("abc"))
+			require.Empty(t, h.Cache.GetVariants("GET example.com/?"))
+
+			requireStatus(t, serve(), cacheMiss)
+			requireStatus(t, serve(), cacheHit)
+			require.Equal(t, 2, fetches)
+		})
+	}
+}
@@ -4,22 +4,69 @@ import (
 	"hash/crc32"
 	"math"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const urlLockBucketsSize = 256
 
+// KeyLock is a mutex that can be adquired with a timeout
+type KeyLock struct {
+	locked  chan struct{}
+	waiters int32 // requests waiting the lock, only changed atomically
+}
+
+func newKeyLock() *KeyLock {
+	return &KeyLock{locked: make(chan struct{}, 1)}
+}
+
+// Lock blocks until the lock is adquired
+func (lock *KeyLock) Lock() {
+	lock.locked <- struct{}{}
+}
+
+// tryLock adquires the lock only if it is free
+func (lock *KeyLock) tryLock() bool {
+	select {
+	case lock.locked <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// lockWithTimeout returns false if the lock couldn't be adquired before the timeout
+func (lock *KeyLock) lockWithTimeout(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case lock.locked <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Unlock releases the lock
+func (lock *KeyLock) Unlock() {
+	<-lock.locked
+}
+
 type URLLock struct {
+	waiting int64 // requests waiting any key, first to be 64 bit aligned for atomic access
+
 	globalLocks [urlLockBucketsSize]*sync.Mutex
-	keys        [urlLockBucketsSize]map[string]*sync.Mutex
+	keys        [urlLockBucketsSize]map[string]*KeyLock
 }
 
 func NewURLLock() *URLLock {
 	globalLocks := [urlLockBucketsSize]*sync.Mutex{}
-	keys := [urlLockBucketsSize]map[string]*sync.Mutex{}
+	keys := [urlLockBucketsSize]map[string]*KeyLock{}
 
 	for i := 0; i < int(urlLockBucketsSize); i++ {
 		globalLocks[i] = new(sync.Mutex)
-		keys[i] = make(map[string]*sync.Mutex)
+		keys[i] = make(map[string]*KeyLock)
 	}
 
 	return &URLLock{
@@ -29,17 +76,67 @@ func NewURLLock() *URLLock {
 }
 
 // Adquire a lock for given key
-func (allLocks *URLLock) Adquire(key string) *sync.Mutex {
+func (allLocks *URLLock) Adquire(key string) *KeyLock {
+	lock, _ := allLocks.AdquireWithTimeout(key, 0)
+	return lock
+}
+
+// AdquireWithTimeout is like Adquire but it gives up after the timeout and returns false.
+// A timeout of 0 waits forever
+func (allLocks *URLLock) AdquireWithTimeout(key string, timeout time.Duration) (*KeyLock, bool) {
+	lock := allLocks.getLock(key)
+	if lock.tryLock() {
+		return lock, true
+	}
+
+	// Another request of the key has the lock, it is counted as waiting until it stops waiting
+	atomic.AddInt64(&allLocks.waiting, 1)
+	atomic.AddInt32(&lock.waiters, 1)
+	defer atomic.AddInt64(&allLocks.waiting, -1)
+	defer atomic.AddInt32(&lock.waiters, -1)
+
+	if timeout <= 0 {
+		lock.Lock()
+		return lock, true
+	}
+	if !lock.lockWithTimeout(timeout) {
+		return nil, false
+	}
+	return lock, true
+}
+
+// Waiting returns how many requests are waiting another one of the same key
+func (allLocks *URLLock) Waiting() int64 {
+	return atomic.LoadInt64(&allLocks.waiting)
+}
+
+// WaitingByKey returns how many requests are waiting in each key that has any
+func (allLocks *URLLock) WaitingByKey() map[string]int {
+	waiting := map[string]int{}
+	for bucketIndex := range allLocks.keys {
+		allLocks.globalLocks[bucketIndex].Lock()
+		for key, lock := range allLocks.keys[bucketIndex] {
+			if waiters := atomic.LoadInt32(&lock.waiters); waiters > 0 {
+				waiting[key] = int(waiters)
+			}
+		}
+		allLocks.globalLocks[bucketIndex].Unlock()
+	}
+	return waiting
+}
+
+// getLock returns the lock of the key. The bucket is not locked while
+// waiting the key lock so other keys of the bucket are not blocked
+func (allLocks *URLLock) getLock(key string) *KeyLock {
 	bucketIndex := allLocks.getBucketIndexForKey(key)
 	allLocks.globalLocks[bucketIndex].Lock()
 	defer allLocks.globalLocks[bucketIndex].Unlock()
 
 	lock, exists := allLocks.keys[bucketIndex][key]
 	if !exists {
-		lock = new(sync.Mutex)
+		lock = newKeyLock()
 		allLocks.keys[bucketIndex][key] = lock
 	}
-	lock.Lock()
 	return lock
 }
 
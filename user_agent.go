@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"regexp"
+)
+
+// defaultUserAgentBucket is the bucket of the User-Agents that match no rule
+const defaultUserAgentBucket = "other"
+
+type userAgentRule struct {
+	bucket  string
+	pattern *regexp.Regexp
+}
+
+// UserAgentBucketer puts the User-Agents in coarse buckets of device class and browser major version,
+// like "mobile chrome-120", so the responses with Vary: User-Agent get a few variants instead of one for each client.
+// Rules are checked in order, their bucket can use the groups of the pattern like $1
+type UserAgentBucketer struct {
+	devices *DeviceClassifier
+	rules   []userAgentRule
+
+	// added is how many rules were added, they are before the built-in ones
+	added int
+}
+
+// NewUserAgentBucketer creates the bucketer with the built-in rules. Edge, Opera and Samsung Internet send "Chrome"
+// and Chrome sends "Safari", so they are checked before them
+func NewUserAgentBucketer() *UserAgentBucketer {
+	return &UserAgentBucketer{devices: NewDeviceClassifier(), rules: []userAgentRule{
+		{"bot", regexp.MustCompile(`(?i)bot\b|crawler|spider|slurp`)},
+		{"edge-$1", regexp.MustCompile(`Edg(?:e|A|iOS)?/(\d+)`)},
+		{"opera-$1", regexp.MustCompile(`(?:OPR|Opera)/(\d+)`)},
+		{"samsung-$1", regexp.MustCompile(`SamsungBrowser/(\d+)`)},
+		{"firefox-$1", regexp.MustCompile(`(?:Firefox|FxiOS)/(\d+)`)},
+		{"chrome-$1", regexp.MustCompile(`(?:Chrome|CriOS)/(\d+)`)},
+		{"safari-$1", regexp.MustCompile(`Version/(\d+).*Safari/`)},
+		{"ie-$1", regexp.MustCompile(`MSIE (\d+)`)},
+		{"ie-11", regexp.MustCompile(`Trident/7\.`)},
+	}}
+}
+
+// Add adds a rule that is checked before the built-in ones and after the ones added before it
+func (bucketer *UserAgentBucketer) Add(bucket string, pattern string) error {
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+
+	rules := append([]userAgentRule{}, bucketer.rules[:bucketer.added]...)
+	rules = append(rules, userAgentRule{bucket, compiled})
+	bucketer.rules = append(rules, bucketer.rules[bucketer.added:]...)
+	bucketer.added++
+	return nil
+}
+
+// bucket returns the device class and the bucket of the first rule that matches, other if none does
+func (bucketer *UserAgentBucketer) bucket(userAgent string) string {
+	for _, rule := range bucketer.rules {
+		if match := rule.pattern.FindStringSubmatchIndex(userAgent); match != nil {
+			browser := rule.pattern.ExpandString(nil, rule.bucket, userAgent, match)
+			return bucketer.devices.classify(userAgent) + " " + string(browser)
+		}
+	}
+	return defaultUserAgentBucket
+}
@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	firefoxUserAgent   = "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:115.0) Gecko/20100101 Firefox/115.0"
+	edgeUserAgent      = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.2210.91"
+	googlebotUserAgent = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	ie11UserAgent      = "Mozilla/5.0 (Windows NT 10.0; WOW64; Trident/7.0; rv:11.0) like Gecko"
+)
+
+func TestUserAgentBucketer(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		bucket    string
+	}{
+		{desktopUserAgent, "desktop chrome-78"},
+		{androidPhoneUserAgent, "mobile chrome-78"},
+		{androidTabletUserAgent, "tablet chrome-78"},
+		{iPhoneUserAgent, "mobile safari-13"},
+		{iPadUserAgent, "tablet safari-12"},
+		{windowsPhoneUserAgent, "mobile edge-15"},
+		{operaMiniUserAgent, "mobile opera-9"},
+		{firefoxUserAgent, "desktop firefox-115"},
+		{edgeUserAgent, "desktop edge-120"},
+		{ie11UserAgent, "desktop ie-11"},
+		{googlebotUserAgent, "desktop bot"},
+		{curlUserAgent, defaultUserAgentBucket},
+		{"", defaultUserAgentBucket},
+	}
+
+	bucketer := NewUserAgentBucketer()
+	for _, test := range tests {
+		require.Equal(t, test.bucket, bucketer.bucket(test.userAgent), test.userAgent)
+	}
+
+	t.Run("it should check the added rules first in the order they were added", func(t *testing.T) {
+		bucketer := NewUserAgentBucketer()
+		require.NoError(t, bucketer.Add("myapp-$1", `MyApp/(\d+)`))
+		require.NoError(t, bucketer.Add("any-chrome", `Chrome/`))
+
+		require.Equal(t, "mobile myapp-3", bucketer.bucket("MyApp/3.1 (iPhone) Chrome/78.0"))
+		require.Equal(t, "desktop any-chrome", bucketer.bucket(desktopUserAgent))
+		require.Equal(t, "desktop firefox-115", bucketer.bucket(firefoxUserAgent))
+	})
+
+	t.Run("it should not accept invalid patterns", func(t *testing.T) {
+		require.Error(t, NewUserAgentBucketer().Add("broken", "("))
+	})
+}
+
+func TestVaryUserAgent(t *testing.T) {
+	serve := func(h *Handler, userAgent string) *http.Response {
+		w := httptest.NewRecorder()
+		r := newRequestWithOriginalURL(t, "GET", "http://example.com/")
+		r.Header.Set("User-Agent", userAgent)
+		_, err := h.ServeHTTP(w, r)
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	t.Run("it should share the variants of the User-Agents in the same bucket", func(t *testing.T) {
+		config := emptyConfig()
+		config.VaryUserAgent = NewUserAgentBucketer()
+		received := []string{}
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			received = append(received, r.Header.Get("User-Agent"))
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "User-Agent")
+			w.Write([]byte(r.Header.Get("User-Agent")))
+			return 200, nil
+		}), config)
+
+		requireStatus(t, serve(h, desktopUserAgent), cacheMiss)
+		res := serve(h, "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/78.0.3904.97 Safari/537.36")
+		requireStatus(t, res, cacheHit)
+		requireBody(t, res, []byte(desktopUserAgent))
+
+		requireStatus(t, serve(h, firefoxUserAgent), cacheMiss)
+		requireStatus(t, serve(h, curlUserAgent), cacheMiss)
+		requireStatus(t, serve(h, "Wget/1.20.3"), cacheHit)
+
+		require.Equal(t, []string{desktopUserAgent, firefoxUserAgent, curlUserAgent}, received)
+	})
+
+	t.Run("it should not cache the responses that vary on User-Agent without it", func(t *testing.T) {
+		h := NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "User-Agent")
+			return 200, nil
+		}), emptyConfig())
+
+		serve(h, desktopUserAgent)
+		require.NotEqual(t, cacheHit, serve(h, desktopUserAgent).Header.Get(defaultStatusHeader))
+	})
+}
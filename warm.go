@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultWarmConcurrency = 4
+
+// discardResponseWriter is where the responses of warming requests are written, only the code is kept
+type discardResponseWriter struct {
+	header http.Header
+	code   int
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return len(p), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+// readWarmFile returns the urls of the file, one per line. Empty lines and lines starting with # are ignored
+func readWarmFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	urls := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			urls = append(urls, line)
+		}
+	}
+	return urls, scanner.Err()
+}
+
+// warmURLs returns the urls of the warm directive and the ones in the warm files
+func (handler *Handler) warmURLs() []string {
+	urls := append([]string{}, handler.Config.WarmURLs...)
+	for _, path := range handler.Config.WarmFiles {
+		fileURLs, err := readWarmFile(path)
+		if err != nil {
+			log.Printf("[WARNING] cache: Can not read warm file %s: %v", path, err)
+			continue
+		}
+		urls = append(urls, fileURLs...)
+	}
+	return urls
+}
+
+// Warm requests the urls through the handler so they are cached as if a client requested them.
+// At most concurrency requests are made at the same time. It returns how many succeeded
+func (handler *Handler) Warm(urls []string, concurrency int) int {
+	if concurrency <= 0 {
+		concurrency = defaultWarmConcurrency
+	}
+
+	log.Printf("[INFO] cache: Warming %d urls", len(urls))
+
+	pending := make(chan string)
+	warmed := 0
+	warmedLock := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rawURL := range pending {
+				if handler.warmURL(rawURL) {
+					warmedLock.Lock()
+					warmed++
+					warmedLock.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, rawURL := range urls {
+		pending <- rawURL
+	}
+	close(pending)
+	wg.Wait()
+
+	log.Printf("[INFO] cache: Warmed %d of %d urls", warmed, len(urls))
+	return warmed
+}
+
+func (handler *Handler) warmsOnStartup() bool {
+	return len(handler.Config.WarmURLs) > 0 || len(handler.Config.WarmFiles) > 0
+}
+
+// warmOnStartup warms the configured urls and then marks the handler as ready
+func (handler *Handler) warmOnStartup() {
+	handler.Warm(handler.warmURLs(), handler.Config.WarmConcurrency)
+	handler.markReady()
+}
+
+func (handler *Handler) markReady() {
+	atomic.StoreInt32(&handler.ready, 1)
+}
+
+func (handler *Handler) isReady() bool {
+	return atomic.LoadInt32(&handler.ready) == 1
+}
+
+type readyResult struct {
+	Ready bool `json:"ready"`
+}
+
+// serveReady responds with 503 until the startup warming finished, so health checks
+// don't send traffic to an empty cache that would send every request to upstream
+func (handler *Handler) serveReady(w http.ResponseWriter) (int, error) {
+	if !handler.isReady() {
+		return writeJSONWithCode(w, http.StatusServiceUnavailable, readyResult{Ready: false})
+	}
+	return writeJSON(w, readyResult{Ready: true})
+}
+
+func (handler *Handler) warmURL(rawURL string) bool {
+	return handler.requestInternally(rawURL, false)
+}
+
+// requestInternally makes a GET request to the url through the handler. When refresh is set
+// upstream is requested even if there is a fresh entry, replacing it
+func (handler *Handler) requestInternally(rawURL string, refresh bool) bool {
+	r, err := newRequestForURL(http.MethodGet, rawURL)
+	if err != nil {
+		log.Printf("[WARNING] cache: Can not request invalid url %s: %v", rawURL, err)
+		return false
+	}
+	r = r.WithContext(context.WithValue(r.Context(), admitCtxKey, true))
+	if refresh {
+		r = r.WithContext(context.WithValue(r.Context(), refreshCtxKey, true))
+	}
+
+	w := &discardResponseWriter{header: http.Header{}}
+	code, err := handler.ServeHTTP(w, r)
+	if w.code != 0 {
+		code = w.code
+	}
+
+	if err != nil || code >= 400 {
+		log.Printf("[WARNING] cache: Request to %s failed with code %d: %v", rawURL, code, err)
+		return false
+	}
+	return true
+}
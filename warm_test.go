@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWarm(t *testing.T) {
+	newHandler := func() (*Handler, map[string]int) {
+		hitsLock := new(sync.Mutex)
+		hits := map[string]int{}
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			hitsLock.Lock()
+			hits[r.URL.Path]++
+			hitsLock.Unlock()
+
+			switch r.URL.Path {
+			case "/missing":
+				return http.StatusNotFound, nil
+			case "/private":
+				w.Header().Add("Cache-control", "no-store")
+			default:
+				w.Header().Add("Cache-control", "max-age=10")
+			}
+			w.Write([]byte("abc"))
+			return 200, nil
+		}), emptyConfig()), hits
+	}
+
+	t.Run("it should cache the urls", func(t *testing.T) {
+		h, hits := newHandler()
+
+		warmed := h.Warm([]string{"http://example.com/a", "http://example.com/b", "http://example.com/missing", "invalid"}, 2)
+		require.Equal(t, 2, warmed)
+		require.Len(t, h.Cache.GetVariants("GET example.com/a?"), 1)
+		require.Len(t, h.Cache.GetVariants("GET example.com/b?"), 1)
+
+		_, err := h.ServeHTTP(&discardResponseWriter{header: http.Header{}}, newRequestWithOriginalURL(t, "GET", "http://example.com/a"))
+		require.NoError(t, err)
+		require.Equal(t, 1, hits["/a"])
+	})
+
+	t.Run("it should follow the same rules as other requests", func(t *testing.T) {
+		h, _ := newHandler()
+
+		require.Equal(t, 1, h.Warm([]string{"http://example.com/private"}, 1))
+		entries := h.Cache.GetVariants("GET example.com/private?")
+		require.Len(t, entries, 1)
+		require.False(t, entries[0].isPublic)
+	})
+
+	t.Run("it should read the urls from files", func(t *testing.T) {
+		file, err := ioutil.TempFile("", "caddy-cache-warm-")
+		require.NoError(t, err)
+		defer os.Remove(file.Name())
+		file.WriteString("# assets\nhttp://example.com/a\n\nhttp://example.com/b\n")
+		file.Close()
+
+		h, _ := newHandler()
+		h.Config.WarmURLs = []string{"http://example.com/c"}
+		h.Config.WarmFiles = []string{file.Name(), "/does/not/exist"}
+
+		require.Equal(t, []string{"http://example.com/c", "http://example.com/a", "http://example.com/b"}, h.warmURLs())
+	})
+}
+
+func TestReady(t *testing.T) {
+	upstream := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Add("Cache-control", "max-age=10")
+		w.Write([]byte("abc"))
+		return 200, nil
+	})
+
+	t.Run("it should be ready once the startup urls are warmed", func(t *testing.T) {
+		config := newAdminConfig()
+		config.WarmURLs = []string{"http://example.com/a"}
+		h := NewHandler(upstream, config)
+
+		require.False(t, h.Ready())
+		res := doAdminRequest(t, h, "GET", "http://example.com/_cache/ready")
+		require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+
+		h.warmOnStartup()
+
+		require.True(t, h.Ready())
+		require.Len(t, h.Cache.GetVariants("GET example.com/a?"), 1)
+		res = doAdminRequest(t, h, "GET", "http://example.com/_cache/ready")
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		body, _ := ioutil.ReadAll(res.Body)
+		require.JSONEq(t, `{"ready": true}`, string(body))
+	})
+
+	t.Run("it should be ready without warm urls", func(t *testing.T) {
+		require.True(t, NewHandler(upstream, emptyConfig()).Ready())
+	})
+}
@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	warningStale              = `110 - "Response is Stale"`
+	warningRevalidationFailed = `111 - "Revalidation Failed"`
+)
+
+// respondStale sends an expired entry with the Warning that RFC 7234 section 5.5 requires
+func (handler *Handler) respondStale(w http.ResponseWriter, r *http.Request, entry *HTTPCacheEntry, warning string) (int, error) {
+	w.Header().Add("Warning", warning)
+	return handler.respond(w, r, entry, cacheStale)
+}
+
+// removeMismatchedWarnings removes the warnings that have a warn-date different from the Date header.
+// RFC 7234 section 5.5 requires it because they were added to a previous version of the response
+func removeMismatchedWarnings(header http.Header) {
+	date, dateErr := http.ParseTime(header.Get("Date"))
+
+	for name, values := range header {
+		if !strings.EqualFold(name, "Warning") {
+			continue
+		}
+
+		kept := []string{}
+		for _, value := range values {
+			for _, warning := range splitWarnings(value) {
+				warnDate, hasDate := parseWarnDate(warning)
+				if !hasDate || (dateErr == nil && warnDate.Equal(date)) {
+					kept = append(kept, warning)
+				}
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(header, name)
+		} else {
+			header[name] = kept
+		}
+	}
+}
+
+// splitWarnings splits a Warning header in its values. Commas inside quoted strings don't split
+func splitWarnings(value string) []string {
+	warnings := []string{}
+	start := 0
+	quoted := false
+
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				warnings = appendWarning(warnings, value[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return appendWarning(warnings, value[start:])
+}
+
+func appendWarning(warnings []string, warning string) []string {
+	if warning = strings.TrimSpace(warning); warning != "" {
+		warnings = append(warnings, warning)
+	}
+	return warnings
+}
+
+// parseWarnDate returns the warn-date that can follow the warn-text, like in
+// 110 - "Response is Stale" "Sat, 25 Aug 2012 23:34:45 GMT"
+func parseWarnDate(warning string) (time.Time, bool) {
+	textStart := strings.Index(warning, `"`)
+	if textStart < 0 {
+		return time.Time{}, false
+	}
+
+	textEnd := -1
+	for i := textStart + 1; i < len(warning); i++ {
+		if warning[i] == '\\' {
+			i++
+			continue
+		}
+		if warning[i] == '"' {
+			textEnd = i
+			break
+		}
+	}
+	if textEnd < 0 {
+		return time.Time{}, false
+	}
+
+	rest := strings.TrimSpace(warning[textEnd+1:])
+	if len(rest) < 2 || rest[0] != '"' || rest[len(rest)-1] != '"' {
+		return time.Time{}, false
+	}
+
+	// An invalid date never matches the Date header
+	warnDate, err := http.ParseTime(rest[1 : len(rest)-1])
+	if err != nil {
+		return time.Time{}, true
+	}
+	return warnDate, true
+}
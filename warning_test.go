@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitWarnings(t *testing.T) {
+	tests := []struct {
+		value    string
+		warnings []string
+	}{
+		{`110 - "Response is Stale"`, []string{`110 - "Response is Stale"`}},
+		{`110 - "Response is Stale", 111 - "Revalidation Failed"`, []string{`110 - "Response is Stale"`, `111 - "Revalidation Failed"`}},
+		{`199 - "a, b", 214 - "c \", d"`, []string{`199 - "a, b"`, `214 - "c \", d"`}},
+		{` , 110 - "Response is Stale",`, []string{`110 - "Response is Stale"`}},
+		{``, []string{}},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.warnings, splitWarnings(test.value), test.value)
+	}
+}
+
+func TestRemoveMismatchedWarnings(t *testing.T) {
+	date := "Sat, 25 Aug 2012 23:34:45 GMT"
+
+	t.Run("it should keep warnings without date or with the same date", func(t *testing.T) {
+		header := http.Header{
+			"Date":    []string{date},
+			"Warning": []string{`110 - "Response is Stale"`, `112 - "cache down" "` + date + `"`},
+		}
+		removeMismatchedWarnings(header)
+		require.Equal(t, []string{`110 - "Response is Stale"`, `112 - "cache down" "` + date + `"`}, header["Warning"])
+	})
+
+	t.Run("it should remove warnings with another date", func(t *testing.T) {
+		header := http.Header{
+			"Date":    []string{date},
+			"Warning": []string{`110 - "Response is Stale" "Fri, 24 Aug 2012 23:34:45 GMT", 199 - "kept"`},
+		}
+		removeMismatchedWarnings(header)
+		require.Equal(t, []string{`199 - "kept"`}, header["Warning"])
+	})
+
+	t.Run("it should remove warnings with invalid dates or without a Date header", func(t *testing.T) {
+		header := http.Header{"warning": []string{`110 - "Response is Stale" "yesterday"`}}
+		removeMismatchedWarnings(header)
+		require.Empty(t, header)
+
+		header = http.Header{"Warning": []string{`110 - "Response is Stale" "` + date + `"`}}
+		removeMismatchedWarnings(header)
+		require.Empty(t, header)
+	})
+}
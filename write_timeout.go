@@ -0,0 +1,26 @@
+package cache
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/nicolasazrak/caddy-cache/storage"
+)
+
+// withWriteTimeout makes the clients read the body from memory while it is saved. When a write to the storage takes
+// longer than write_timeout the storage is abandoned and the entry is discarded once the body is complete
+func (cache *HTTPCache) withWriteTimeout(e *HTTPCacheEntry, body storage.ResponseStorage) storage.ResponseStorage {
+	if cache.config.WriteTimeout <= 0 || body == nil {
+		return body
+	}
+	return storage.NewTimeoutStorage(body, cache.config.WriteTimeout, func() {
+		atomic.StoreInt32(&e.writeAbandoned, 1)
+		cache.counters.abandonedWrite()
+		log.Printf("[WARNING] cache: Writing the body of %s took more than %s, it is sent without saving it", e.Key(), cache.config.WriteTimeout)
+	})
+}
+
+// isWriteAbandoned returns if the storage of the body was abandoned because it was too slow
+func (e *HTTPCacheEntry) isWriteAbandoned() bool {
+	return atomic.LoadInt32(&e.writeAbandoned) == 1
+}
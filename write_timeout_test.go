@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/nicolasazrak/caddy-cache/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// slowStorage takes delay for every write after the first one, like a disk that is saturated
+type slowStorage struct {
+	storage.ResponseStorage
+	delay  time.Duration
+	writes int
+}
+
+func (s *slowStorage) Write(p []byte) (int, error) {
+	s.writes++
+	if s.writes > 1 {
+		time.Sleep(s.delay)
+	}
+	return s.ResponseStorage.Write(p)
+}
+
+func TestWriteTimeout(t *testing.T) {
+	originalNewFileStorage := newFileStorage
+	defer func() { newFileStorage = originalNewFileStorage }()
+
+	newHandler := func(delay time.Duration) (*Handler, *int) {
+		newFileStorage = func(path string, mmapMinSize int64, limit *storage.OpenFileLimit) (storage.ResponseStorage, error) {
+			file, err := originalNewFileStorage(path, mmapMinSize, limit)
+			return &slowStorage{ResponseStorage: file, delay: delay}, err
+		}
+
+		config := emptyConfig()
+		config.WriteTimeout = 20 * time.Millisecond
+		fetches := 0
+		return NewHandler(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			fetches++
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte("abc"))
+			w.Write([]byte("def"))
+			w.Write([]byte("ghi"))
+			return 200, nil
+		}), config), &fetches
+	}
+
+	serve := func(h *Handler) *http.Response {
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, newRequestWithOriginalURL(t, "GET", "http://example.com/"))
+		require.NoError(t, err)
+		return w.Result()
+	}
+
+	t.Run("it should send the whole body promptly when the disk is slow and not cache it", func(t *testing.T) {
+		h, fetches := newHandler(2 * time.Second)
+
+		started := time.Now()
+		res := serve(h)
+		requireStatus(t, res, cacheMiss)
+		requireBody(t, res, []byte("abcdefghi"))
+		require.True(t, time.Since(started) < time.Second)
+		require.Equal(t, int64(1), h.Stats().AbandonedWrites)
+
+		require.Eventually(t, func() bool {
+			return len(h.Cache.GetVariants("GET example.com/?")) == 0
+		}, time.Second, 10*time.Millisecond)
+		requireStatus(t, serve(h), cacheMiss)
+		require.Equal(t, 2, *fetches)
+	})
+
+	t.Run("it should save the body when the disk is fast enough", func(t *testing.T) {
+		h, fetches := newHandler(time.Millisecond)
+
+		requireStatus(t, serve(h), cacheMiss)
+		res := serve(h)
+		requireStatus(t, res, cacheHit)
+		requireBody(t, res, []byte("abcdefghi"))
+		require.Equal(t, 1, *fetches)
+		require.Equal(t, int64(0), h.Stats().AbandonedWrites)
+	})
+}